@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Prefix that identifies an encrypted ACL file i.e. a file encrypted with a random AES-256-GCM key that is itself
+// encrypted with RSA-OAEP (SHA-256) for the recipient public key. The prefix is followed by the 2 byte (big-endian)
+// length of the encrypted key, the encrypted key, the 12 byte GCM nonce and the encrypted file.
+const ENCRYPTED_MARKER = "uhppoted:rsa-oaep+aes-256-gcm:"
+
+// ErrNotEncrypted is returned when attempting to decrypt a file that is not encrypted.
+var ErrNotEncrypted = errors.New("file is not encrypted")
+
+// Returns true if the file is encrypted i.e. starts with ENCRYPTED_MARKER.
+func IsEncrypted(b []byte) bool {
+	return bytes.HasPrefix(b, []byte(ENCRYPTED_MARKER))
+}
+
+// Encrypts the file for the RSA public key in the PEM public key file (ed25519 keys cannot be used for encryption).
+func Encrypt(b []byte, pubkeyfile string) ([]byte, error) {
+	key, err := loadPublicKey(pubkeyfile)
+	if err != nil {
+		return nil, err
+	}
+
+	pubkey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an RSA public key (only RSA keys can be used for encryption)", pubkeyfile)
+	}
+
+	secret := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return nil, err
+	}
+
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pubkey, secret, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: error encrypting key (%w)", pubkeyfile, err)
+	}
+
+	gcm, err := newGCM(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	var encrypted bytes.Buffer
+
+	encrypted.WriteString(ENCRYPTED_MARKER)
+	binary.Write(&encrypted, binary.BigEndian, uint16(len(wrapped)))
+	encrypted.Write(wrapped)
+	encrypted.Write(nonce)
+	encrypted.Write(gcm.Seal(nil, nonce, b, []byte(ENCRYPTED_MARKER)))
+
+	return encrypted.Bytes(), nil
+}
+
+// Decrypts an encrypted file with the RSA private key in the PKCS8 PEM key file. Encrypted key files are decrypted
+// with the passphrase.
+func Decrypt(b []byte, keyfile string, passphrase []byte) ([]byte, error) {
+	if !IsEncrypted(b) {
+		return nil, ErrNotEncrypted
+	}
+
+	key, err := loadPrivateKey(keyfile, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	privkey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an RSA private key (only RSA keys can be used for decryption)", keyfile)
+	}
+
+	r := bytes.NewReader(b[len(ENCRYPTED_MARKER):])
+
+	var N uint16
+	if err := binary.Read(r, binary.BigEndian, &N); err != nil {
+		return nil, fmt.Errorf("Invalid encrypted file (%w)", err)
+	}
+
+	wrapped := make([]byte, N)
+	if _, err := io.ReadFull(r, wrapped); err != nil {
+		return nil, fmt.Errorf("Invalid encrypted file (%w)", err)
+	}
+
+	secret, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, privkey, wrapped, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: error decrypting key - the file may have been encrypted for a different key (%w)", keyfile, err)
+	}
+
+	gcm, err := newGCM(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(r, nonce); err != nil {
+		return nil, fmt.Errorf("Invalid encrypted file (%w)", err)
+	}
+
+	ciphertext, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, []byte(ENCRYPTED_MARKER))
+	if err != nil {
+		return nil, fmt.Errorf("encrypted file is corrupt or has been modified (%w)", err)
+	}
+
+	return plaintext, nil
+}
+
+func newGCM(secret []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
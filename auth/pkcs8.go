@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// PKCS#8 encrypted private keys (RFC 5958) with PBES2 (RFC 8018) i.e. as generated by openssl genpkey -aes256
+// or openssl pkcs8 -topk8 -v2 aes256. The standard library only supports unencrypted PKCS#8 keys.
+
+var (
+	oidPBES2        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidScrypt       = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11591, 4, 11}
+	oidHMACSHA1     = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACSHA256   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACSHA384   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACSHA512   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC    = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC    = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC    = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC   = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+	errPassphrase   = errors.New("incorrect passphrase")
+	errNotSupported = errors.New("unsupported encryption")
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Data      []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int                      `asn1:"optional"`
+	PRF        pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+type scryptParams struct {
+	Salt            []byte
+	CostParameter   int
+	BlockSize       int
+	Parallelization int
+	KeyLength       int `asn1:"optional"`
+}
+
+// Decrypts a PKCS#8 encrypted private key, returning the DER encoded (unencrypted) PKCS#8 private key.
+func decryptPKCS8(der []byte, passphrase []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, err
+	}
+
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("%w %v", errNotSupported, info.Algorithm.Algorithm)
+	}
+
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+
+	var block func([]byte) (cipher.Block, error)
+	var size int
+
+	switch scheme := params.EncryptionScheme.Algorithm; {
+	case scheme.Equal(oidAES128CBC):
+		block, size = aes.NewCipher, 16
+	case scheme.Equal(oidAES192CBC):
+		block, size = aes.NewCipher, 24
+	case scheme.Equal(oidAES256CBC):
+		block, size = aes.NewCipher, 32
+	case scheme.Equal(oidDESEDE3CBC):
+		block, size = des.NewTripleDESCipher, 24
+	default:
+		return nil, fmt.Errorf("%w %v", errNotSupported, scheme)
+	}
+
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+
+	key, err := deriveKey(params.KeyDerivationFunc, passphrase, size)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := block(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(iv) != c.BlockSize() || len(info.Data) == 0 || len(info.Data)%c.BlockSize() != 0 {
+		return nil, fmt.Errorf("invalid encrypted key")
+	}
+
+	plaintext := make([]byte, len(info.Data))
+	cipher.NewCBCDecrypter(c, iv).CryptBlocks(plaintext, info.Data)
+
+	// ... PKCS#7 padding - invalid padding is almost always an incorrect passphrase
+	N := int(plaintext[len(plaintext)-1])
+	if N == 0 || N > c.BlockSize() {
+		return nil, errPassphrase
+	}
+
+	for _, b := range plaintext[len(plaintext)-N:] {
+		if int(b) != N {
+			return nil, errPassphrase
+		}
+	}
+
+	return plaintext[:len(plaintext)-N], nil
+}
+
+func deriveKey(kdf pkix.AlgorithmIdentifier, passphrase []byte, size int) ([]byte, error) {
+	switch {
+	case kdf.Algorithm.Equal(oidPBKDF2):
+		var params pbkdf2Params
+		if _, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &params); err != nil {
+			return nil, err
+		}
+
+		var h func() hash.Hash
+		switch prf := params.PRF.Algorithm; {
+		case len(prf) == 0, prf.Equal(oidHMACSHA1):
+			h = sha1.New
+		case prf.Equal(oidHMACSHA256):
+			h = sha256.New
+		case prf.Equal(oidHMACSHA384):
+			h = sha512.New384
+		case prf.Equal(oidHMACSHA512):
+			h = sha512.New
+		default:
+			return nil, fmt.Errorf("%w %v", errNotSupported, prf)
+		}
+
+		return pbkdf2.Key(passphrase, params.Salt, params.Iterations, size, h), nil
+
+	case kdf.Algorithm.Equal(oidScrypt):
+		var params scryptParams
+		if _, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &params); err != nil {
+			return nil, err
+		}
+
+		return scrypt.Key(passphrase, params.Salt, params.CostParameter, params.BlockSize, params.Parallelization, size)
+
+	default:
+		return nil, fmt.Errorf("%w %v", errNotSupported, kdf.Algorithm)
+	}
+}
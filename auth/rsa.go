@@ -2,73 +2,151 @@ package auth
 
 import (
 	"crypto"
-	"crypto/rand"
+	"crypto/ed25519"
 	"crypto/rsa"
-	"crypto/sha256"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"strings"
 )
 
-func Sign(acl []byte, keyfile string) ([]byte, error) {
-	key, err := loadPrivateKey(keyfile)
+// ErrPassphraseRequired is returned when the signing key is encrypted and a passphrase was not supplied.
+var ErrPassphraseRequired = errors.New("encrypted private key requires a passphrase")
+
+// Signs the ACL with the RSA or ed25519 private key in the PKCS8 (or for RSA, PKCS1) PEM key file. Encrypted key
+// files (legacy encrypted PEM or PKCS8 encrypted PEM) are decrypted with the passphrase.
+func Sign(acl []byte, keyfile string, passphrase []byte) ([]byte, error) {
+	key, err := loadPrivateKey(keyfile, passphrase)
 	if err != nil {
 		return nil, err
 	} else if key == nil {
-		return nil, fmt.Errorf("Invalid RSA signing key")
+		return nil, fmt.Errorf("Invalid signing key")
 	}
 
-	rng := rand.Reader
-	hashed := sha256.Sum256(acl)
-
-	return rsa.SignPKCS1v15(rng, key, crypto.SHA256, hashed[:])
+	return sign(key, acl)
 }
 
-func Verify(signedBy string, acl []byte, signature []byte, dir string) error {
-	pubkey, err := loadPublicKey(dir, signedBy)
+// Verifies the ACL against the RSA or ed25519 public keys for the signer i.e. <dir>/<signedBy>.pub and any
+// additional (e.g. rotated) keys in the <dir>/<signedBy>/ subdirectory (<dir>/<signedBy>/*.pub). A subdirectory
+// rather than a file name suffix ensures that the keys for one signer can never match another signer whose name
+// happens to share the prefix (e.g. 'foo' and 'foo.bar'). The ACL is verified if any of the signatures validates
+// against any of the keys and the name of the key file (relative to dir) that matched is returned.
+func Verify(signedBy string, acl []byte, signatures [][]byte, dir string) (string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, signedBy, "*.pub"))
 	if err != nil {
-		return err
-	} else if pubkey == nil {
-		return fmt.Errorf("%s: no RSA public key", signedBy)
+		return "", err
 	}
 
-	hash := sha256.Sum256(acl)
-	err = rsa.VerifyPKCS1v15(pubkey, crypto.SHA256, hash[:], signature)
-	if err != nil {
-		return fmt.Errorf("%s: invalid RSA signature (%w)", signedBy, err)
+	files = append([]string{filepath.Join(dir, signedBy+".pub")}, files...)
+
+	var keys []string
+	var errs error
+	for _, file := range files {
+		pubkey, err := loadPublicKey(file)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return "", err
+		} else if pubkey == nil {
+			return "", fmt.Errorf("%s: no public key", signedBy)
+		}
+
+		name, err := filepath.Rel(dir, file)
+		if err != nil {
+			name = filepath.Base(file)
+		}
+
+		keys = append(keys, name)
+
+		for _, signature := range signatures {
+			if err := verify(signedBy, pubkey, acl, signature); err != nil {
+				errs = err
+			} else {
+				return name, nil
+			}
+		}
+	}
+
+	if len(keys) == 0 {
+		return "", fmt.Errorf("%s: no public key in %v", signedBy, dir)
+	}
+
+	if len(signatures) == 0 {
+		return "", fmt.Errorf("%s: no signature", signedBy)
+	}
+
+	if len(keys) > 1 || len(signatures) > 1 {
+		return "", fmt.Errorf("%s: no signature verified with %v (%w)", signedBy, strings.Join(keys, ", "), errs)
 	}
 
-	return nil
+	return "", errs
 }
 
-func loadPrivateKey(filepath string) (*rsa.PrivateKey, error) {
+func loadPrivateKey(filepath string, passphrase []byte) (crypto.PrivateKey, error) {
 	bytes, err := ioutil.ReadFile(filepath)
 	if err != nil {
 		return nil, err
 	}
 
 	block, _ := pem.Decode(bytes)
-	if block == nil || block.Type != "PRIVATE KEY" {
-		return nil, fmt.Errorf("%s is not a valid RSA private key", filepath)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a valid RSA or ed25519 private key", filepath)
 	}
 
-	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
-	if err != nil {
-		return nil, fmt.Errorf("%s is not a valid RSA private key", filepath)
+	der := block.Bytes
+
+	switch {
+	case block.Type == "ENCRYPTED PRIVATE KEY":
+		if len(passphrase) == 0 {
+			return nil, fmt.Errorf("%s: %w", filepath, ErrPassphraseRequired)
+		}
+
+		if der, err = decryptPKCS8(block.Bytes, passphrase); err != nil {
+			return nil, fmt.Errorf("%s: error decrypting private key (%w)", filepath, err)
+		}
+
+	case x509.IsEncryptedPEMBlock(block):
+		if len(passphrase) == 0 {
+			return nil, fmt.Errorf("%s: %w", filepath, ErrPassphraseRequired)
+		}
+
+		if der, err = x509.DecryptPEMBlock(block, passphrase); err != nil {
+			return nil, fmt.Errorf("%s: error decrypting private key (%w)", filepath, err)
+		}
+
+	case block.Type != "PRIVATE KEY" && block.Type != "RSA PRIVATE KEY":
+		return nil, fmt.Errorf("%s is not a valid RSA or ed25519 private key", filepath)
 	}
 
-	pk, ok := key.(*rsa.PrivateKey)
-	if !ok {
-		return nil, fmt.Errorf("%s is not a valid RSA private key", filepath)
+	// ... PKCS1 (RSA PRIVATE KEY) keys are accepted both unencrypted and legacy encrypted
+	if block.Type == "RSA PRIVATE KEY" {
+		if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+			return key, nil
+		}
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a valid RSA or ed25519 private key", filepath)
 	}
 
-	return pk, nil
+	switch pk := key.(type) {
+	case *rsa.PrivateKey:
+		return pk, nil
+
+	case ed25519.PrivateKey:
+		return pk, nil
+
+	default:
+		return nil, fmt.Errorf("%s is not a valid RSA or ed25519 private key", filepath)
+	}
 }
 
-func loadPublicKey(dir, id string) (*rsa.PublicKey, error) {
-	file := filepath.Join(dir, id+".pub")
+func loadPublicKey(file string) (crypto.PublicKey, error) {
 	bytes, err := ioutil.ReadFile(file)
 	if err != nil {
 		return nil, err
@@ -76,18 +154,22 @@ func loadPublicKey(dir, id string) (*rsa.PublicKey, error) {
 
 	block, _ := pem.Decode(bytes)
 	if block == nil || block.Type != "PUBLIC KEY" {
-		return nil, fmt.Errorf("%s is not a valid RSA public key", file)
+		return nil, fmt.Errorf("%s is not a valid RSA or ed25519 public key", file)
 	}
 
 	key, err := x509.ParsePKIXPublicKey(block.Bytes)
 	if err != nil {
-		return nil, fmt.Errorf("%s is not a valid RSA public key (%w)", file, err)
+		return nil, fmt.Errorf("%s is not a valid RSA or ed25519 public key (%w)", file, err)
 	}
 
-	pubkey, ok := key.(*rsa.PublicKey)
-	if !ok {
-		return nil, fmt.Errorf("%s is not a valid RSA public key", file)
-	}
+	switch pubkey := key.(type) {
+	case *rsa.PublicKey:
+		return pubkey, nil
+
+	case ed25519.PublicKey:
+		return pubkey, nil
 
-	return pubkey, nil
+	default:
+		return nil, fmt.Errorf("%s is not a valid RSA or ed25519 public key", file)
+	}
 }
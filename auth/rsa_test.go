@@ -0,0 +1,225 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var acl = []byte("Card Number\tFrom\tTo\tGreat Hall\n8165538\t2021-01-01\t2021-12-31\tY\n")
+
+func TestSignVerifyRSA(t *testing.T) {
+	dir := t.TempDir()
+	keyfile := makeRSAKey(t, dir, "uhppoted")
+
+	signature, err := Sign(acl, keyfile, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error signing ACL (%v)", err)
+	}
+
+	key, err := Verify("uhppoted", acl, [][]byte{signature}, dir)
+	if err != nil {
+		t.Errorf("Unexpected error verifying RSA signature (%v)", err)
+	} else if key != "uhppoted.pub" {
+		t.Errorf("Incorrect verification key - expected:%v, got:%v", "uhppoted.pub", key)
+	}
+}
+
+func TestSignVerifyEd25519(t *testing.T) {
+	dir := t.TempDir()
+	keyfile := makeEd25519Key(t, dir, "uhppoted")
+
+	signature, err := Sign(acl, keyfile, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error signing ACL (%v)", err)
+	}
+
+	if string(signature[:len(ED25519_MARKER)]) != ED25519_MARKER {
+		t.Errorf("ed25519 signature missing '%v' marker", ED25519_MARKER)
+	}
+
+	key, err := Verify("uhppoted", acl, [][]byte{signature}, dir)
+	if err != nil {
+		t.Errorf("Unexpected error verifying ed25519 signature (%v)", err)
+	} else if key != "uhppoted.pub" {
+		t.Errorf("Incorrect verification key - expected:%v, got:%v", "uhppoted.pub", key)
+	}
+}
+
+func TestVerifyTamperedACL(t *testing.T) {
+	tests := map[string]func(*testing.T, string, string) string{
+		"RSA":     makeRSAKey,
+		"ed25519": makeEd25519Key,
+	}
+
+	for name, keygen := range tests {
+		dir := t.TempDir()
+		keyfile := keygen(t, dir, "uhppoted")
+
+		signature, err := Sign(acl, keyfile, nil)
+		if err != nil {
+			t.Fatalf("%v: unexpected error signing ACL (%v)", name, err)
+		}
+
+		tampered := append([]byte{}, acl...)
+		tampered[len(tampered)-2] = 'N'
+
+		if _, err := Verify("uhppoted", tampered, [][]byte{signature}, dir); err == nil {
+			t.Errorf("%v: tampered ACL verified", name)
+		}
+	}
+}
+
+func TestVerifyMixedSignatures(t *testing.T) {
+	keys := t.TempDir()
+	dir := t.TempDir()
+
+	ed25519Key := makeEd25519Key(t, keys, "ed25519")
+	rsaKey := makeRSAKey(t, dir, "uhppoted")
+
+	signature, err := Sign(acl, ed25519Key, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error signing ACL (%v)", err)
+	}
+
+	signature2, err := Sign(acl, rsaKey, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error signing ACL (%v)", err)
+	}
+
+	// ... 'signature' does not verify with the RSA key but 'signature.2' does
+	key, err := Verify("uhppoted", acl, [][]byte{signature, signature2}, dir)
+	if err != nil {
+		t.Errorf("Unexpected error verifying signature/signature.2 (%v)", err)
+	} else if key != "uhppoted.pub" {
+		t.Errorf("Incorrect verification key - expected:%v, got:%v", "uhppoted.pub", key)
+	}
+
+	if _, err := Verify("uhppoted", acl, [][]byte{signature}, dir); err == nil {
+		t.Errorf("ed25519 signature verified with RSA public key")
+	}
+}
+
+func TestVerifyRotatedKey(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "uhppoted"), 0755); err != nil {
+		t.Fatalf("Error creating rotated keys directory (%v)", err)
+	}
+
+	makeRSAKey(t, dir, "uhppoted")
+	rotated := makeEd25519Key(t, filepath.Join(dir, "uhppoted"), "2026-10")
+	other := makeRSAKey(t, dir, "uhppoted.ops")
+
+	signature, err := Sign(acl, rotated, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error signing ACL (%v)", err)
+	}
+
+	expected := filepath.Join("uhppoted", "2026-10.pub")
+	if key, err := Verify("uhppoted", acl, [][]byte{signature}, dir); err != nil {
+		t.Errorf("Unexpected error verifying signature with rotated key (%v)", err)
+	} else if key != expected {
+		t.Errorf("Incorrect verification key - expected:%v, got:%v", expected, key)
+	}
+
+	// ... the key for 'uhppoted.ops' is not a rotated key for 'uhppoted'
+	signature, err = Sign(acl, other, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error signing ACL (%v)", err)
+	}
+
+	if key, err := Verify("uhppoted", acl, [][]byte{signature}, dir); err == nil {
+		t.Errorf("'uhppoted.ops' signature verified for 'uhppoted' with key %v", key)
+	}
+}
+
+func TestSignPKCS1Key(t *testing.T) {
+	dir := t.TempDir()
+	keyfile := makeRSAKey(t, dir, "uhppoted")
+
+	key, err := loadPrivateKey(keyfile, nil)
+	if err != nil {
+		t.Fatalf("Error loading private key (%v)", err)
+	}
+
+	der := x509.MarshalPKCS1PrivateKey(key.(*rsa.PrivateKey))
+	encrypted, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", der, []byte("secret"), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatalf("Error encrypting PKCS1 private key (%v)", err)
+	}
+
+	tests := map[string]struct {
+		block      *pem.Block
+		passphrase []byte
+	}{
+		"unencrypted": {&pem.Block{Type: "RSA PRIVATE KEY", Bytes: der}, nil},
+		"encrypted":   {encrypted, []byte("secret")},
+	}
+
+	for name, test := range tests {
+		pkcs1 := filepath.Join(dir, "pkcs1.key")
+		if err := ioutil.WriteFile(pkcs1, pem.EncodeToMemory(test.block), 0600); err != nil {
+			t.Fatalf("%v: error writing PKCS1 private key (%v)", name, err)
+		}
+
+		signature, err := Sign(acl, pkcs1, test.passphrase)
+		if err != nil {
+			t.Fatalf("%v: unexpected error signing ACL with PKCS1 key (%v)", name, err)
+		}
+
+		if _, err := Verify("uhppoted", acl, [][]byte{signature}, dir); err != nil {
+			t.Errorf("%v: unexpected error verifying PKCS1 signature (%v)", name, err)
+		}
+	}
+}
+
+// Creates an RSA key pair in the directory, returning the private key file. The public key is <dir>/<uname>.pub.
+func makeRSAKey(t *testing.T, dir, uname string) string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error generating RSA key (%v)", err)
+	}
+
+	return writeKeys(t, dir, uname, key, &key.PublicKey)
+}
+
+// Creates an ed25519 key pair in the directory, returning the private key file. The public key is <dir>/<uname>.pub.
+func makeEd25519Key(t *testing.T, dir, uname string) string {
+	pubkey, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating ed25519 key (%v)", err)
+	}
+
+	return writeKeys(t, dir, uname, key, pubkey)
+}
+
+func writeKeys(t *testing.T, dir, uname string, key crypto.PrivateKey, pubkey crypto.PublicKey) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("Error marshalling private key (%v)", err)
+	}
+
+	pub, err := x509.MarshalPKIXPublicKey(pubkey)
+	if err != nil {
+		t.Fatalf("Error marshalling public key (%v)", err)
+	}
+
+	keyfile := filepath.Join(dir, uname+".key")
+	if err := ioutil.WriteFile(keyfile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatalf("Error writing private key (%v)", err)
+	}
+
+	pubfile := filepath.Join(dir, uname+".pub")
+	if err := ioutil.WriteFile(pubfile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}), 0644); err != nil {
+		t.Fatalf("Error writing public key (%v)", err)
+	}
+
+	return keyfile
+}
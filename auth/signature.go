@@ -0,0 +1,64 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+)
+
+// Prefix that identifies an ed25519 signature. RSA signatures are not prefixed so that files signed
+// before ed25519 support was added (or signed directly with openssl) still verify.
+const ED25519_MARKER = "ed25519:"
+
+func sign(key crypto.PrivateKey, acl []byte) ([]byte, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		hashed := sha256.Sum256(acl)
+
+		return rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, hashed[:])
+
+	case ed25519.PrivateKey:
+		signature := ed25519.Sign(k, acl)
+
+		return append([]byte(ED25519_MARKER), signature...), nil
+
+	default:
+		return nil, fmt.Errorf("Unsupported signing key type %T", key)
+	}
+}
+
+func verify(id string, key crypto.PublicKey, acl []byte, signature []byte) error {
+	ed25519Signature := bytes.HasPrefix(signature, []byte(ED25519_MARKER))
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if ed25519Signature {
+			return fmt.Errorf("%s: ed25519 signature cannot be verified with an RSA public key", id)
+		}
+
+		hash := sha256.Sum256(acl)
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], signature); err != nil {
+			return fmt.Errorf("%s: invalid RSA signature (%w)", id, err)
+		}
+
+		return nil
+
+	case ed25519.PublicKey:
+		if !ed25519Signature {
+			return fmt.Errorf("%s: RSA signature cannot be verified with an ed25519 public key", id)
+		}
+
+		if !ed25519.Verify(k, acl, signature[len(ED25519_MARKER):]) {
+			return fmt.Errorf("%s: invalid ed25519 signature", id)
+		}
+
+		return nil
+
+	default:
+		return fmt.Errorf("%s: unsupported public key type %T", id, key)
+	}
+}
@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+)
+
+func LoadCertificateChain(file string) ([]byte, error) {
+	bytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := parseCertificates(bytes); err != nil {
+		return nil, fmt.Errorf("%s is not a valid certificate chain (%w)", file, err)
+	}
+
+	return bytes, nil
+}
+
+func VerifyCertificate(acl []byte, signature []byte, chain []byte, ca string) (string, error) {
+	certificates, err := parseCertificates(chain)
+	if err != nil {
+		return "", fmt.Errorf("invalid certificate chain (%w)", err)
+	}
+
+	roots, err := loadRoots(ca)
+	if err != nil {
+		return "", err
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range certificates[1:] {
+		intermediates.AddCert(c)
+	}
+
+	leaf := certificates[0]
+	options := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+
+	if _, err := leaf.Verify(options); err != nil {
+		return leaf.Subject.CommonName, fmt.Errorf("%s: untrusted certificate (%w)", leaf.Subject.CommonName, err)
+	}
+
+	switch leaf.PublicKey.(type) {
+	case *rsa.PublicKey, ed25519.PublicKey:
+	default:
+		return leaf.Subject.CommonName, fmt.Errorf("%s: certificate does not contain an RSA or ed25519 public key", leaf.Subject.CommonName)
+	}
+
+	if err := verify(leaf.Subject.CommonName, leaf.PublicKey, acl, signature); err != nil {
+		return leaf.Subject.CommonName, err
+	}
+
+	return leaf.Subject.CommonName, nil
+}
+
+func parseCertificates(bytes []byte) ([]*x509.Certificate, error) {
+	certificates := []*x509.Certificate{}
+
+	for {
+		block, rest := pem.Decode(bytes)
+		if block == nil {
+			break
+		}
+
+		if block.Type == "CERTIFICATE" {
+			c, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+
+			certificates = append(certificates, c)
+		}
+
+		bytes = rest
+	}
+
+	if len(certificates) == 0 {
+		return nil, fmt.Errorf("no PEM encoded certificates")
+	}
+
+	return certificates, nil
+}
+
+func loadRoots(file string) (*x509.CertPool, error) {
+	bytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(bytes) {
+		return nil, fmt.Errorf("%s does not contain any valid CA certificates", file)
+	}
+
+	return roots, nil
+}
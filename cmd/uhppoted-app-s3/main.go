@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/uhppoted/uhppote-core/uhppote"
 	"github.com/uhppoted/uhppoted-app-s3/commands"
@@ -15,6 +19,15 @@ var cli = []uhppoted.Command{
 	&commands.LoadACLCmd,
 	&commands.StoreACLCmd,
 	&commands.CompareACLCmd,
+	&commands.CompareSitesCmd,
+	&commands.DiffACLCmd,
+	&commands.InspectCmd,
+	&commands.VerifyReportCmd,
+	&commands.ListCmd,
+	&commands.PruneCmd,
+	&commands.PresignCmd,
+	&commands.RollbackCmd,
+	&commands.CheckCmd,
 	&uhppoted.Version{
 		Application: commands.APP,
 		Version:     uhppote.VERSION,
@@ -28,9 +41,12 @@ var options = commands.Options{
 	Debug:  false,
 }
 
+var exitCodes = commands.NewExitCodes()
+
 func main() {
 	flag.StringVar(&options.Config, "config", options.Config, "configuration file to use for controller identification and configuration")
 	flag.BoolVar(&options.Debug, "debug", options.Debug, "Enable debugging information")
+	flag.Var(&exitCodes, "exit-codes", "Maps command outcomes (clean, drift, unreachable, fetch, verify, parse, error) to exit codes e.g. clean:0,drift:2,unreachable:3,fetch:1,verify:1,parse:1,error:1")
 	flag.Parse()
 
 	cmd, err := uhppoted.Parse(cli, nil, help)
@@ -44,8 +60,27 @@ func main() {
 		os.Exit(1)
 	}
 
+	// ... cancel the command on Ctrl-C (a second Ctrl-C terminates immediately)
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupt := make(chan os.Signal, 1)
+
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupt
+		signal.Stop(interrupt)
+		cancel()
+	}()
+
+	options.Context = ctx
+
 	if err = cmd.Execute(&options); err != nil {
-		fmt.Printf("\n   ERROR: %v\n\n", err)
-		os.Exit(1)
+		if errors.Is(err, commands.ErrDrift) {
+			fmt.Printf("\n   WARN:  %v\n\n", err)
+		} else {
+			fmt.Printf("\n   ERROR: %v\n\n", err)
+		}
 	}
+
+	cancel()
+	os.Exit(exitCodes.Code(err))
 }
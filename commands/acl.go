@@ -3,11 +3,16 @@ package commands
 import (
 	"archive/tar"
 	"archive/zip"
+	"bufio"
 	"bytes"
+	"compress/flate"
 	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
@@ -16,18 +21,62 @@ import (
 	"github.com/uhppoted/uhppoted-app-s3/auth"
 	"github.com/uhppoted/uhppoted-lib/acl"
 	"github.com/uhppoted/uhppoted-lib/config"
+	htmltemplate "html/template"
 	"io"
 	"io/ioutil"
+	"log"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"text/template"
 	"time"
+	"unicode/utf8"
 )
 
+const KEY_PASSPHRASE = "UHPPOTED_KEY_PASSPHRASE"
+const DECRYPT_KEY_PASSPHRASE = "UHPPOTED_DECRYPT_KEY_PASSPHRASE"
+const RAW_ACL_FILE = "authoritative.tsv"
+const DEFAULT_HTTP_TIMEOUT = 30 * time.Second
+const DEFAULT_DIAL_TIMEOUT = 10 * time.Second
+const DEFAULT_TLS_TIMEOUT = 10 * time.Second
+
+// Pseudo compression level for --compression none i.e. an uncompressed tar (or stored zip) archive
+const UNCOMPRESSED = -100
+
 type Report struct {
-	DateTime *types.DateTime
-	Diffs    map[uint32]acl.Diff
+	DateTime   *types.DateTime
+	Diffs      map[uint32]acl.Diff
+	Changes    map[uint32]acl.Diff
+	Overflow   map[uint32]*Overflow
+	Names      map[uint32]string
+	Review     map[uint32]bool
+	Trend      map[uint32]map[uint32]string
+	Skipped    map[uint32]bool
+	Errors     map[uint32]string
+	Duplicates []Duplicate
+	Devices    map[uint32]ReportDevice
+}
+
+// Returns the name of the device for the JSON reports i.e. the configured controller (or friendly device) name.
+func (rpt Report) name(device uint32) string {
+	if d, ok := rpt.Devices[device]; ok && d.Name != "" {
+		return d.Name
+	}
+
+	return rpt.Names[device]
+}
+
+type Overflow struct {
+	Cards    int
+	Capacity int
 }
 
 func getDevices(conf *config.Config, debug bool) (uhppote.IUHPPOTE, []uhppote.Device) {
@@ -64,120 +113,796 @@ func getDevices(conf *config.Config, debug bool) (uhppote.IUHPPOTE, []uhppote.De
 	return u, devices
 }
 
-func fetchHTTP(url string) ([]byte, error) {
-	response, err := http.Get(url)
-	if err != nil {
-		return nil, err
+// Retrieves the ACL for each device individually so that the per-device query latency can be recorded. The
+// controllers are queried by (at most) 'concurrency' workers i.e. 1 retrieves the ACLs one controller at a time.
+func getACL(ctx context.Context, u uhppote.IUHPPOTE, devices []uhppote.Device, concurrency int) (acl.ACL, []error, map[uint32]time.Duration, error) {
+	list := acl.ACL{}
+	errors := []error{}
+	latency := map[uint32]time.Duration{}
+
+	_, err := streamACL(ctx, u, devices, concurrency, 0, nil, func(device uint32, cards map[uint32]types.Card, errs []error, dt time.Duration) {
+		list[device] = cards
+		errors = append(errors, errs...)
+		latency[device] = dt
+	})
+
+	return list, errors, latency, err
+}
+
+// Retrieves the ACL from each controller concurrently, invoking the (serialized) callback for each controller
+// as soon as the controller ACL has been retrieved rather than waiting for all the controllers. The controllers
+// are queried in order by a pool of (at most) 'concurrency' workers - 0 queries all the controllers at once. If
+// the (optional) budget is exhausted before all the controllers have responded, the remaining controllers are
+// skipped and returned as 'not checked'. Cancelling the context abandons the controllers that have not yet
+// responded and returns the context error. The (optional) progress is updated as each controller is queried.
+func streamACL(ctx context.Context, u uhppote.IUHPPOTE, devices []uhppote.Device, concurrency int, budget time.Duration, p *progress, f func(uint32, map[uint32]types.Card, []error, time.Duration)) ([]uint32, error) {
+	guard := sync.Mutex{}
+	pending := map[uint32]bool{}
+	expired := false
+
+	for _, d := range devices {
+		pending[d.DeviceID] = true
+	}
+
+	workers := len(devices)
+	if concurrency > 0 && concurrency < workers {
+		workers = concurrency
+	}
+
+	queue := make(chan uhppote.Device)
+	abandoned := make(chan struct{})
+
+	go func() {
+		defer close(queue)
+		for _, d := range devices {
+			select {
+			case queue <- d:
+			case <-abandoned:
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for device := range queue {
+				p.starting(device.DeviceID)
+
+				start := time.Now()
+				cards, errs := acl.GetACL(u, []uhppote.Device{device})
+				dt := time.Since(start)
+
+				guard.Lock()
+				if !expired {
+					delete(pending, device.DeviceID)
+					p.completed(device.DeviceID, len(cards[device.DeviceID]), errs, dt)
+					f(device.DeviceID, cards[device.DeviceID], errs, dt)
+				}
+				guard.Unlock()
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	var timeout <-chan time.Time
+	if budget > 0 {
+		timeout = time.After(budget)
+	}
+
+	select {
+	case <-done:
+	case <-timeout:
+	case <-ctx.Done():
+	}
+
+	close(abandoned)
+
+	guard.Lock()
+	defer guard.Unlock()
+
+	expired = true
+	unchecked := []uint32{}
+	for k := range pending {
+		unchecked = append(unchecked, k)
+	}
+
+	sort.Slice(unchecked, func(i, j int) bool { return unchecked[i] < unchecked[j] })
+
+	if len(unchecked) > 0 && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	return unchecked, nil
+}
+
+// Returns an HTTP client with the timeout applied to the whole request (including reading the response body), so
+// that a server that stalls mid-transfer fails the request rather than blocking indefinitely. The (optional) client
+// certificate is only presented to https:// servers that request it.
+func httpClient(timeout time.Duration) *http.Client {
+	dialer := net.Dialer{
+		Timeout:   DEFAULT_DIAL_TIMEOUT,
+		KeepAlive: 30 * time.Second,
+	}
+
+	if timeout > 0 && timeout < dialer.Timeout {
+		dialer.Timeout = timeout
 	}
 
-	defer response.Body.Close()
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:                 proxyFunc(),
+			TLSClientConfig:       getClientTLS(),
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   DEFAULT_TLS_TIMEOUT,
+			ResponseHeaderTimeout: timeout,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+	}
+}
 
+func fetchHTTP(ctx context.Context, url string, timeout time.Duration, auth httpAuth, retry retryPolicy) ([]byte, error) {
+	client := httpClient(timeout)
 	var b bytes.Buffer
-	if _, err = io.Copy(&b, response.Body); err != nil {
+
+	err := retry.do(ctx, fmt.Sprintf("GET %v", url), func() error {
+		b.Reset()
+
+		rq, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return err
+		}
+
+		auth.apply(rq)
+
+		response, err := client.Do(rq)
+		if err != nil {
+			return err
+		}
+
+		defer response.Body.Close()
+
+		if response.StatusCode >= 400 {
+			return httpStatusError{URL: url, StatusCode: response.StatusCode, Status: response.Status}
+		}
+
+		_, err = io.Copy(&b, response.Body)
+
+		return err
+	})
+
+	if err != nil {
 		return nil, err
 	}
 
 	return b.Bytes(), nil
 }
 
-func fetchS3(url, config, profile, region string) ([]byte, error) {
+// Sends a HEAD request for the URL e.g. to check that the URL is reachable without fetching the file. Returns the
+// HTTP status.
+func headHTTP(ctx context.Context, url string, timeout time.Duration, auth httpAuth, retry retryPolicy) (string, error) {
+	client := httpClient(timeout)
+	status := ""
+
+	err := retry.do(ctx, fmt.Sprintf("HEAD %v", url), func() error {
+		rq, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+		if err != nil {
+			return err
+		}
+
+		auth.apply(rq)
+
+		response, err := client.Do(rq)
+		if err != nil {
+			return err
+		}
+
+		defer response.Body.Close()
+
+		if response.StatusCode >= 400 {
+			return httpStatusError{URL: url, StatusCode: response.StatusCode, Status: response.Status}
+		}
+
+		status = response.Status
+
+		return nil
+	})
+
+	return status, err
+}
+
+func fetchS3(ctx context.Context, url, config, profile, region, fallback string, endpoint s3Endpoint, role awsRole, retry retryPolicy) ([]byte, error) {
 	match := regexp.MustCompile("^s3://(.*?)/(.*)").FindStringSubmatch(url)
 	if len(match) != 3 {
 		return nil, fmt.Errorf("Invalid S3 URI (%s)", url)
 	}
 
 	bucket := match[1]
-	key := match[2]
+	key, version := s3Version(match[2])
 	object := s3.GetObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
+		Bucket:    aws.String(bucket),
+		Key:       aws.String(key),
+		VersionId: version,
+	}
+
+	if version != nil && retry.log != nil {
+		retry.log.Printf("Fetching version %v of s3://%v/%v", *version, bucket, key)
 	}
 
-	cfg := aws.NewConfig().
-		WithCredentials(credentials.NewSharedCredentials(config, profile)).
-		WithRegion(region)
+	var b *aws.WriteAtBuffer
+
+	err := withS3Region(ctx, bucket, config, profile, region, fallback, endpoint, role, retry, func(ss *session.Session) error {
+		return retry.do(ctx, fmt.Sprintf("GET %v", url), func() error {
+			b = aws.NewWriteAtBuffer(make([]byte, 0, 1024))
+			_, err := s3manager.NewDownloader(ss).DownloadWithContext(ctx, b, &object)
 
-	ss := session.Must(session.NewSession(cfg))
+			return err
+		})
+	})
 
-	buffer := make([]byte, 1024)
-	b := aws.NewWriteAtBuffer(buffer)
-	if _, err := s3manager.NewDownloader(ss).Download(b, &object); err != nil {
+	if err != nil {
 		return nil, err
 	}
 
 	return b.Bytes(), nil
 }
 
+// Splits the (optional) versionId query parameter from an S3 object key e.g. for
+// s3://uhppoted/hogwarts.tar.gz?versionId=3HL4kqtJlcpXroDTDmjVBH40Nrjfkd. Returns a nil version if the key
+// does not include a versionId.
+func s3Version(key string) (string, *string) {
+	if ix := strings.LastIndex(key, "?"); ix >= 0 {
+		if q, err := url.ParseQuery(key[ix+1:]); err == nil && q.Get("versionId") != "" {
+			return key[:ix], aws.String(q.Get("versionId"))
+		}
+	}
+
+	return key, nil
+}
+
+type s3Object struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last-modified"`
+}
+
+// Lists the objects under an s3://bucket/prefix URL, following the ListObjectsV2 continuation tokens.
+func listS3(ctx context.Context, url, config, profile, region, fallback string, endpoint s3Endpoint, role awsRole, retry retryPolicy) ([]s3Object, error) {
+	match := regexp.MustCompile("^s3://(.*?)(?:/(.*))?$").FindStringSubmatch(url)
+	if len(match) != 3 || match[1] == "" {
+		return nil, fmt.Errorf("Invalid S3 URI (%s)", url)
+	}
+
+	objects := []s3Object{}
+
+	err := withS3Region(ctx, match[1], config, profile, region, fallback, endpoint, role, retry, func(ss *session.Session) error {
+		objects = []s3Object{}
+		request := s3.ListObjectsV2Input{
+			Bucket: aws.String(match[1]),
+			Prefix: aws.String(match[2]),
+		}
+
+		for {
+			var page *s3.ListObjectsV2Output
+
+			err := retry.do(ctx, fmt.Sprintf("LIST %v", url), func() error {
+				p, err := s3.New(ss).ListObjectsV2WithContext(ctx, &request)
+				page = p
+
+				return err
+			})
+
+			if err != nil {
+				return err
+			}
+
+			for _, o := range page.Contents {
+				objects = append(objects, s3Object{
+					Key:          aws.StringValue(o.Key),
+					Size:         aws.Int64Value(o.Size),
+					LastModified: aws.TimeValue(o.LastModified),
+				})
+			}
+
+			if !aws.BoolValue(page.IsTruncated) || page.NextContinuationToken == nil {
+				return nil
+			}
+
+			request.ContinuationToken = page.NextContinuationToken
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return objects, nil
+}
+
+// Checks that the S3 bucket (and object, if the URL includes a key) exists and is accessible with the credentials
+// i.e. a HeadBucket request followed by a HeadObject request for s3://bucket/key URLs.
+func headS3(ctx context.Context, url, config, profile, region string, endpoint s3Endpoint, role awsRole, retry retryPolicy) error {
+	match := regexp.MustCompile("^s3://(.*?)(?:/(.*))?$").FindStringSubmatch(url)
+	if len(match) != 3 || match[1] == "" {
+		return fmt.Errorf("Invalid S3 URI (%s)", url)
+	}
+
+	ss, err := awsSession(config, profile, region, endpoint, role)
+	if err != nil {
+		return err
+	}
+
+	bucket := match[1]
+	err = retry.do(ctx, fmt.Sprintf("HEAD s3://%v", bucket), func() error {
+		_, err := s3.New(ss).HeadBucketWithContext(ctx, &s3.HeadBucketInput{
+			Bucket: aws.String(bucket),
+		})
+
+		return err
+	})
+
+	if err != nil || match[2] == "" {
+		return err
+	}
+
+	key, version := s3Version(match[2])
+
+	return retry.do(ctx, fmt.Sprintf("HEAD %v", url), func() error {
+		_, err := s3.New(ss).HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket:    aws.String(bucket),
+			Key:       aws.String(key),
+			VersionId: version,
+		})
+
+		return err
+	})
+}
+
+// Generates a presigned GET or PUT URL for an S3 object. The URL is signed locally with the session credentials
+// and is valid for the 'expires' duration (or until the session credentials expire, if sooner). Because a presigned
+// URL is only valid for the bucket region, the URL is signed for the bucket region (from the x-amz-bucket-region
+// header of a HeadBucket request) if the bucket is not in the configured region. Not applicable to custom S3
+// endpoints.
+func presignS3(ctx context.Context, url, method string, expires time.Duration, config, profile, region string, endpoint s3Endpoint, role awsRole) (string, error) {
+	match := regexp.MustCompile("^s3://(.*?)/(.+)").FindStringSubmatch(url)
+	if len(match) != 3 || match[1] == "" {
+		return "", fmt.Errorf("Invalid S3 URI (%s)", url)
+	}
+
+	ss, err := awsSession(config, profile, region, endpoint, role)
+	if err != nil {
+		return "", err
+	}
+
+	if endpoint.url == "" {
+		hint, err := s3manager.GetBucketRegion(ctx, ss, match[1], aws.StringValue(ss.Config.Region))
+		if err == nil && hint != "" && hint != aws.StringValue(ss.Config.Region) {
+			if ss, err = awsSession(config, profile, hint, endpoint, role); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	switch method {
+	case "GET":
+		key, version := s3Version(match[2])
+		rq, _ := s3.New(ss).GetObjectRequest(&s3.GetObjectInput{
+			Bucket:    aws.String(match[1]),
+			Key:       aws.String(key),
+			VersionId: version,
+		})
+
+		return rq.Presign(expires)
+
+	case "PUT":
+		rq, _ := s3.New(ss).PutObjectRequest(&s3.PutObjectInput{
+			Bucket: aws.String(match[1]),
+			Key:    aws.String(match[2]),
+		})
+
+		return rq.Presign(expires)
+
+	default:
+		return "", fmt.Errorf("Invalid presign method '%v'", method)
+	}
+}
+
+// Downloads the S3 object to a temporary file in the directory rather than to memory, so that memory usage is
+// bounded by the download part size rather than the object size. The caller closes and deletes the returned
+// file, which is deleted here if the download fails.
+func fetchS3ToFile(ctx context.Context, url, config, profile, region, fallback string, endpoint s3Endpoint, role awsRole, retry retryPolicy, dir string) (*os.File, int64, error) {
+	match := regexp.MustCompile("^s3://(.*?)/(.*)").FindStringSubmatch(url)
+	if len(match) != 3 {
+		return nil, 0, fmt.Errorf("Invalid S3 URI (%s)", url)
+	}
+
+	key, version := s3Version(match[2])
+	object := s3.GetObjectInput{
+		Bucket:    aws.String(match[1]),
+		Key:       aws.String(key),
+		VersionId: version,
+	}
+
+	if version != nil && retry.log != nil {
+		retry.log.Printf("Fetching version %v of s3://%v/%v", *version, match[1], key)
+	}
+
+	f, err := ioutil.TempFile(dir, "acl-*.tmp")
+	if err != nil {
+		return nil, 0, fmt.Errorf("Error creating temporary file in %v (%w)", dir, err)
+	}
+
+	var N int64
+
+	err = withS3Region(ctx, match[1], config, profile, region, fallback, endpoint, role, retry, func(ss *session.Session) error {
+		return retry.do(ctx, fmt.Sprintf("GET %v", url), func() error {
+			if err := f.Truncate(0); err != nil {
+				return err
+			}
+
+			n, err := s3manager.NewDownloader(ss).DownloadWithContext(ctx, f, &object)
+			N = n
+
+			return err
+		})
+	})
+
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, 0, err
+	}
+
+	return f, N, nil
+}
+
 func fetchFile(url string) ([]byte, error) {
-	match := regexp.MustCompile("^file://(.*)").FindStringSubmatch(url)
-	if len(match) != 2 {
-		return nil, fmt.Errorf("Invalid file URI (%s)", url)
+	path, err := filePath(url)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, fmt.Errorf("File %v does not exist", path)
+	}
+
+	return ioutil.ReadFile(path)
+}
+
+// Reads the file piped to stdin for the '-' URL. Fails rather than waiting for input if stdin is a terminal.
+func fetchStdin(uri string) ([]byte, error) {
+	if isTerminal(os.Stdin) {
+		return nil, fmt.Errorf("No file piped to stdin")
+	}
+
+	return ioutil.ReadAll(os.Stdin)
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func storeHTTP(ctx context.Context, uri string, r io.Reader, timeout time.Duration, auth httpAuth, retry retryPolicy) error {
+	client := httpClient(timeout)
+
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	return retry.do(ctx, fmt.Sprintf("PUT %v", uri), func() error {
+		rq, err := http.NewRequestWithContext(ctx, "PUT", uri, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+
+		rq.Header.Set("Content-Type", "binary/octet-stream")
+		auth.apply(rq)
+
+		response, err := client.Do(rq)
+		if err != nil {
+			return err
+		}
+
+		defer response.Body.Close()
+
+		if response.StatusCode >= 400 {
+			return httpStatusError{URL: uri, StatusCode: response.StatusCode, Status: response.Status}
+		}
+
+		return nil
+	})
+}
+
+func storeS3(ctx context.Context, uri, config, profile, region, fallback string, endpoint s3Endpoint, role awsRole, encryption s3Encryption, multipart s3Multipart, tags s3Tags, cacheControl string, r io.Reader, retry retryPolicy) error {
+	match := regexp.MustCompile("^s3://(.*?)/(.*)").FindStringSubmatch(uri)
+	if len(match) != 3 {
+		return fmt.Errorf("Invalid S3 URI (%s)", uri)
+	}
+
+	bucket := match[1]
+	key := match[2]
+
+	if _, version := s3Version(key); version != nil {
+		return fmt.Errorf("Invalid S3 URI (%s) - a versionId can only be used to fetch an object", uri)
+	}
+
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	partSize := int64(multipart.partSize) * 1024 * 1024
+	if partSize < s3manager.MinUploadPartSize {
+		partSize = s3manager.MinUploadPartSize
+	}
+
+	// ... small objects are uploaded with a single PutObject
+	if int64(len(body)) < partSize {
+		object := s3.PutObjectInput{
+			Bucket:      aws.String(bucket),
+			Key:         aws.String(key),
+			ContentType: contentType(key, body),
+			Tagging:     tags.tagging(),
+		}
+
+		if cacheControl != "" {
+			object.CacheControl = aws.String(cacheControl)
+		}
+
+		if encryption.sse != "" {
+			object.ServerSideEncryption = aws.String(encryption.sse)
+		}
+
+		if encryption.kmsKeyID != "" {
+			object.SSEKMSKeyId = aws.String(encryption.kmsKeyID)
+		}
+
+		return withS3Region(ctx, bucket, config, profile, region, fallback, endpoint, role, retry, func(ss *session.Session) error {
+			return retry.do(ctx, fmt.Sprintf("PUT %v", uri), func() error {
+				object.Body = bytes.NewReader(body)
+				_, err := s3.New(ss).PutObjectWithContext(ctx, &object)
+
+				return err
+			})
+		})
+	}
+
+	object := s3manager.UploadInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		ContentType: contentType(key, body),
+		Tagging:     tags.tagging(),
+	}
+
+	if cacheControl != "" {
+		object.CacheControl = aws.String(cacheControl)
+	}
+
+	if encryption.sse != "" {
+		object.ServerSideEncryption = aws.String(encryption.sse)
+	}
+
+	if encryption.kmsKeyID != "" {
+		object.SSEKMSKeyId = aws.String(encryption.kmsKeyID)
+	}
+
+	return withS3Region(ctx, bucket, config, profile, region, fallback, endpoint, role, retry, func(ss *session.Session) error {
+		uploader := s3manager.NewUploader(ss, func(u *s3manager.Uploader) {
+			u.PartSize = partSize
+
+			if multipart.concurrency > 0 {
+				u.Concurrency = multipart.concurrency
+			}
+		})
+
+		return retry.do(ctx, fmt.Sprintf("PUT %v (multipart)", uri), func() error {
+			object.Body = bytes.NewReader(body)
+			_, err := uploader.UploadWithContext(ctx, &object)
+
+			return err
+		})
+	})
+}
+
+func storeFile(url string, r io.Reader) error {
+	path, err := filePath(url)
+	if err != nil {
+		return err
+	}
+
+	if dir := filepath.Dir(path); dir != "" {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			return fmt.Errorf("Directory %v does not exist", dir)
+		}
+	}
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	return writeAtomic(path, b, 0660)
+}
+
+// Returns the local file path for a file:// URL e.g. file:///var/lib/acl/current.tar.gz or
+// file:///C:/uhppoted/acl/current.tar.gz. A URL with a 'host' (e.g. file://acl/current.tar.gz) is
+// treated as a path relative to the current directory.
+func filePath(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return "", fmt.Errorf("Invalid file URI (%s)", uri)
+	}
+
+	path := u.Path
+	if u.Host != "" && u.Host != "localhost" {
+		path = u.Host + path
+	} else if regexp.MustCompile(`^/[a-zA-Z]:`).MatchString(path) {
+		path = path[1:]
+	}
+
+	if path == "" {
+		return "", fmt.Errorf("Invalid file URI (%s)", uri)
 	}
 
-	return ioutil.ReadFile(match[1])
+	return filepath.FromSlash(path), nil
 }
 
-func storeHTTP(uri string, r io.Reader) error {
-	rq, err := http.NewRequest("PUT", uri, r)
+func verifyUpload(uri string, sent []byte, fetch func(string) ([]byte, error)) error {
+	b, err := fetch(uri)
+	if err != nil {
+		return fmt.Errorf("Error reading back %v (%w)", uri, err)
+	}
+
+	expected := sha256.Sum256(sent)
+	actual := sha256.Sum256(b)
+	if expected != actual {
+		return fmt.Errorf("Uploaded file %v does not match (expected SHA-256 %x, got %x)", uri, expected, actual)
+	}
+
+	return nil
+}
+
+// Verifies the SHA-256 digest of a downloaded file against the expected checksum, which is either the hex digest
+// or the URL of a checksum file (e.g. a .sha256 sidecar file in 'sha256sum' format).
+func verifyChecksum(uri string, r io.Reader, checksum string, fetch func(string) ([]byte, error)) error {
+	expected := strings.ToLower(strings.TrimSpace(checksum))
+
+	if !regexp.MustCompile("^[0-9a-f]{64}$").MatchString(expected) {
+		sidecar, err := fetch(fileURI(checksum))
+		if err != nil {
+			return fmt.Errorf("Error fetching checksum %v (%w)", checksum, err)
+		}
+
+		fields := strings.Fields(string(sidecar))
+		if len(fields) == 0 || !regexp.MustCompile("^[0-9a-fA-F]{64}$").MatchString(fields[0]) {
+			return fmt.Errorf("Invalid SHA-256 checksum file %v", checksum)
+		}
+
+		expected = strings.ToLower(fields[0])
+	}
+
+	hash := sha256.New()
+	N, err := io.Copy(hash, r)
 	if err != nil {
 		return err
 	}
 
-	rq.Header.Set("Content-Type", "binary/octet-stream")
+	actual := fmt.Sprintf("%x", hash.Sum(nil))
+	if actual != expected {
+		return fmt.Errorf("Checksum mismatch for %v (%v bytes) - expected SHA-256 %v, got %v", uri, N, expected, actual)
+	}
+
+	return nil
+}
+
+// Returns the tar.gz or zip archive function for the --archive format. An empty format creates a zip archive if
+// the URL ends with .zip and a tar.gz archive otherwise.
+// Returns the archive function for the --archive format and --compression level.
+func archiver(format, uri, compression string) (func(map[string][]byte, io.Writer) error, error) {
+	level, err := compressionLevel(compression)
+	if err != nil {
+		return nil, err
+	}
+
+	tgz := func(files map[string][]byte, w io.Writer) error {
+		return targz(files, w, level)
+	}
+
+	zipped := func(files map[string][]byte, w io.Writer) error {
+		return zipf(files, w, level)
+	}
+
+	switch format {
+	case "":
+		if strings.HasSuffix(uri, ".zip") {
+			return zipped, nil
+		}
+
+		return tgz, nil
+
+	case "tar.gz":
+		return tgz, nil
+
+	case "zip":
+		return zipped, nil
+
+	default:
+		return nil, fmt.Errorf("Invalid --archive '%v' (expected 'tar.gz' or 'zip')", format)
+	}
+}
+
+// Returns the gzip compression level for --compression i.e. 0-9, 'none' (UNCOMPRESSED) or the gzip default
+// compression level if not specified.
+func compressionLevel(s string) (int, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "default":
+		return gzip.DefaultCompression, nil
 
-	response, err := http.DefaultClient.Do(rq)
-	if err != nil {
-		return err
+	case "none":
+		return UNCOMPRESSED, nil
 	}
 
-	defer response.Body.Close()
+	level, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || level < gzip.NoCompression || level > gzip.BestCompression {
+		return 0, fmt.Errorf("Invalid --compression '%v' (expected 0-9 or 'none')", s)
+	}
 
-	return nil
+	return level, nil
 }
 
-func storeS3(uri, config, profile, region string, r io.Reader) error {
-	match := regexp.MustCompile("^s3://(.*?)/(.*)").FindStringSubmatch(uri)
-	if len(match) != 3 {
-		return fmt.Errorf("Invalid S3 URI (%s)", uri)
-	}
+// Returns the Content-Type for an uploaded file i.e. the archive format detected from the content or, for other files
+// (e.g. report summaries), the type for the file extension. Returns nil (the S3 default) if the type is not known.
+func contentType(key string, b []byte) *string {
+	switch {
+	case isGzip(b):
+		return aws.String("application/gzip")
 
-	bucket := match[1]
-	key := match[2]
+	case isZip(b):
+		return aws.String("application/zip")
 
-	object := s3manager.UploadInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-		Body:   r,
+	case isTar(b):
+		return aws.String("application/x-tar")
 	}
 
-	cfg := aws.NewConfig().
-		WithCredentials(credentials.NewSharedCredentials(config, profile)).
-		WithRegion(region)
-
-	ss := session.Must(session.NewSession(cfg))
-	_, err := s3manager.NewUploader(ss).Upload(&object)
-	if err != nil {
-		return err
+	if t := mime.TypeByExtension(filepath.Ext(key)); t != "" {
+		return aws.String(t)
 	}
 
 	return nil
 }
 
-func storeFile(url string, r io.Reader) error {
-	match := regexp.MustCompile("^file://(.*)").FindStringSubmatch(url)
-	if len(match) != 2 {
-		return fmt.Errorf("Invalid file URI (%s)", url)
-	}
+func isZip(b []byte) bool {
+	return bytes.HasPrefix(b, []byte("PK\x03\x04"))
+}
 
-	b, err := ioutil.ReadAll(r)
-	if err != nil {
-		return err
-	}
+func isGzip(b []byte) bool {
+	return bytes.HasPrefix(b, []byte{0x1f, 0x8b})
+}
 
-	return ioutil.WriteFile(match[1], b, 0660)
+// ... tar archives have the 'ustar' magic at offset 257
+func isTar(b []byte) bool {
+	return len(b) > 262 && string(b[257:262]) == "ustar"
 }
 
-func targz(files map[string][]byte, w io.Writer) error {
+// Writes the files as a tar.gz archive with the gzip compression level, or as a plain tar for UNCOMPRESSED.
+func targz(files map[string][]byte, w io.Writer, level int) error {
 	var b bytes.Buffer
 
 	tw := tar.NewWriter(&b)
@@ -203,31 +928,127 @@ func targz(files map[string][]byte, w io.Writer) error {
 		return err
 	}
 
-	gz := gzip.NewWriter(w)
+	if level == UNCOMPRESSED {
+		_, err := w.Write(b.Bytes())
+		return err
+	}
+
+	gz, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return err
+	}
 
 	gz.Name = fmt.Sprintf("uhppoted-%s.tar.gz", time.Now().Format("2006-01-02T150405"))
 	gz.ModTime = time.Now()
 	gz.Comment = ""
 
-	_, err := gz.Write(b.Bytes())
-	if err != nil {
+	if _, err := gz.Write(b.Bytes()); err != nil {
 		return err
 	}
 
 	return gz.Close()
 }
 
+// Unpacks a downloaded ACL file, identifying the format from the content: a signed tar.gz, tar or zip archive, a
+// gzipped TSV file (.tsv.gz) or a plain TSV file (.tsv). Returns false for the 'archive' flag if the file is not a signed
+// archive i.e. the ACL file has no signature.
+func unpack(uri string, b []byte) (map[string][]byte, string, bool, error) {
+	switch {
+	case auth.IsEncrypted(b):
+		return nil, "", false, fmt.Errorf("%v is encrypted (use --decrypt-key to decrypt it)", uri)
+
+	case isZip(b):
+		files, uname, err := unzip(bytes.NewReader(b))
+		return files, uname, true, err
+
+	case isTar(b):
+		files, uname, err := untar(bytes.NewReader(b))
+		return files, uname, true, err
+
+	case isGzip(b):
+		gz, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, "", false, err
+		}
+
+		content, err := ioutil.ReadAll(gz)
+		if err != nil {
+			return nil, "", false, err
+		}
+
+		if isTar(content) {
+			files, uname, err := untar(bytes.NewReader(b))
+			return files, uname, true, err
+		}
+
+		if !utf8.Valid(content) {
+			return nil, "", false, fmt.Errorf("%v is not a tar.gz archive or gzipped TSV file", uri)
+		}
+
+		return map[string][]byte{"ACL": content}, "", false, nil
+
+	case utf8.Valid(b):
+		return map[string][]byte{"ACL": b}, "", false, nil
+
+	default:
+		return nil, "", false, fmt.Errorf("%v is not a recognised ACL file format (expected tar.gz, zip, TSV or gzipped TSV)", uri)
+	}
+}
+
+// As for unpack, but reads the tar.gz, tar or zip archive directly from the (downloaded) file rather than from memory.
+func unpackFile(uri string, f *os.File, size int64) (map[string][]byte, string, bool, error) {
+	magic := make([]byte, 262)
+	n, _ := io.ReadFull(f, magic)
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, "", false, err
+	}
+
+	switch {
+	case isZip(magic[:n]):
+		files, uname, err := unzipAt(f, size)
+		return files, uname, true, err
+
+	case isTar(magic[:n]):
+		files, uname, err := untar(f)
+		return files, uname, true, err
+
+	case isGzip(magic[:n]):
+		if gz, err := gzip.NewReader(f); err == nil {
+			header := make([]byte, 262)
+			if n, _ := io.ReadFull(gz, header); isTar(header[:n]) {
+				if _, err := f.Seek(0, io.SeekStart); err != nil {
+					return nil, "", false, err
+				}
+
+				files, uname, err := untar(f)
+				return files, uname, true, err
+			}
+		}
+
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, "", false, err
+		}
+	}
+
+	// ... plain and gzipped TSV files are unpacked in memory
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	return unpack(uri, b)
+}
+
 func untar(r io.Reader) (map[string][]byte, string, error) {
 	files := map[string][]byte{}
 	uname := ""
 
-	gz, err := gzip.NewReader(r)
+	tr, err := tarReader(r)
 	if err != nil {
 		return nil, "", err
 	}
 
-	tr := tar.NewReader(gz)
-
 	for {
 		header, err := tr.Next()
 		if err == io.EOF {
@@ -238,7 +1059,7 @@ func untar(r io.Reader) (map[string][]byte, string, error) {
 
 		switch header.Typeflag {
 		case tar.TypeReg:
-			if filepath.Ext(header.Name) == ".acl" {
+			if isACLFile(header.Name) {
 				if _, ok := files["ACL"]; ok {
 					return nil, "", fmt.Errorf("Multiple ACL files in tar.gz")
 				}
@@ -250,6 +1071,10 @@ func untar(r io.Reader) (map[string][]byte, string, error) {
 
 				files["ACL"] = buffer.Bytes()
 				uname = header.Uname
+
+				if ext := filepath.Ext(header.Name); ext == ".json" || ext == ".csv" {
+					files["format"] = []byte(strings.TrimPrefix(ext, "."))
+				}
 			}
 
 			if header.Name == "signature" {
@@ -264,6 +1089,45 @@ func untar(r io.Reader) (map[string][]byte, string, error) {
 
 				files["signature"] = buffer.Bytes()
 			}
+
+			if isSignature(header.Name) && header.Name != "signature" {
+				var buffer bytes.Buffer
+				if _, err := io.Copy(&buffer, tr); err != nil {
+					return nil, "", err
+				}
+
+				files[header.Name] = buffer.Bytes()
+			}
+
+			if header.Name == "version" || header.Name == TIMESTAMP_FILE {
+				if _, ok := files[header.Name]; ok {
+					return nil, "", fmt.Errorf("Multiple %v files in tar.gz", header.Name)
+				}
+
+				var buffer bytes.Buffer
+				if _, err := io.Copy(&buffer, tr); err != nil {
+					return nil, "", err
+				}
+
+				if err := checkBundleEntry(header.Name, buffer.Bytes()); err != nil {
+					return nil, "", err
+				}
+
+				files[header.Name] = buffer.Bytes()
+			}
+
+			if header.Name == "certificate" {
+				if _, ok := files["certificate"]; ok {
+					return nil, "", fmt.Errorf("Multiple certificate files in tar.gz")
+				}
+
+				var buffer bytes.Buffer
+				if _, err := io.Copy(&buffer, tr); err != nil {
+					return nil, "", err
+				}
+
+				files["certificate"] = buffer.Bytes()
+			}
 		}
 	}
 
@@ -278,10 +1142,42 @@ func untar(r io.Reader) (map[string][]byte, string, error) {
 	return files, uname, nil
 }
 
-func zipf(files map[string][]byte, w io.Writer) error {
+// Returns a tar reader for either a tar.gz or plain (uncompressed) tar stream.
+func tarReader(r io.Reader) (*tar.Reader, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); !isGzip(magic) {
+		return tar.NewReader(br), nil
+	}
+
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	return tar.NewReader(gz), nil
+}
+
+// Writes the files as a zip archive, deflated with the compression level or stored for UNCOMPRESSED.
+func zipf(files map[string][]byte, w io.Writer, level int) error {
+	method := zip.Deflate
+	if level == UNCOMPRESSED {
+		method = zip.Store
+	}
+
 	zw := zip.NewWriter(w)
+	zw.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(out, level)
+	})
+
 	for filename, body := range files {
-		if f, err := zw.Create(filename); err != nil {
+		// ... the entry comment is the signer user ID (equivalent to the tar.gz 'uname')
+		header := &zip.FileHeader{
+			Name:    filename,
+			Method:  method,
+			Comment: "uhppoted",
+		}
+
+		if f, err := zw.CreateHeader(header); err != nil {
 			return err
 		} else if _, err = f.Write([]byte(body)); err != nil {
 			return err
@@ -292,21 +1188,25 @@ func zipf(files map[string][]byte, w io.Writer) error {
 }
 
 func unzip(r io.Reader) (map[string][]byte, string, error) {
-	files := map[string][]byte{}
-	uname := ""
-
 	b, err := ioutil.ReadAll(r)
 	if err != nil {
 		return nil, "", err
 	}
 
-	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	return unzipAt(bytes.NewReader(b), int64(len(b)))
+}
+
+func unzipAt(r io.ReaderAt, size int64) (map[string][]byte, string, error) {
+	files := map[string][]byte{}
+	uname := ""
+
+	zr, err := zip.NewReader(r, size)
 	if err != nil {
 		return nil, "", err
 	}
 
 	for _, f := range zr.File {
-		if filepath.Ext(f.Name) == ".acl" {
+		if isACLFile(f.Name) {
 			if _, ok := files["ACL"]; ok {
 				return nil, "", fmt.Errorf("Multiple ACL files in tar.gz")
 			}
@@ -324,6 +1224,10 @@ func unzip(r io.Reader) (map[string][]byte, string, error) {
 			files["ACL"] = buffer.Bytes()
 			uname = f.Comment
 			rc.Close()
+
+			if ext := filepath.Ext(f.Name); ext == ".json" || ext == ".csv" {
+				files["format"] = []byte(strings.TrimPrefix(ext, "."))
+			}
 		}
 
 		if f.Name == "signature" {
@@ -344,6 +1248,64 @@ func unzip(r io.Reader) (map[string][]byte, string, error) {
 			files["signature"] = buffer.Bytes()
 			rc.Close()
 		}
+
+		if isSignature(f.Name) && f.Name != "signature" {
+			rc, err := f.Open()
+			if err != nil {
+				return nil, "", err
+			}
+
+			var buffer bytes.Buffer
+			if _, err := io.Copy(&buffer, rc); err != nil {
+				return nil, "", err
+			}
+
+			files[f.Name] = buffer.Bytes()
+			rc.Close()
+		}
+
+		if f.Name == "version" || f.Name == TIMESTAMP_FILE {
+			if _, ok := files[f.Name]; ok {
+				return nil, "", fmt.Errorf("Multiple %v files in zip", f.Name)
+			}
+
+			rc, err := f.Open()
+			if err != nil {
+				return nil, "", err
+			}
+
+			var buffer bytes.Buffer
+			if _, err := io.Copy(&buffer, rc); err != nil {
+				return nil, "", err
+			}
+
+			rc.Close()
+
+			if err := checkBundleEntry(f.Name, buffer.Bytes()); err != nil {
+				return nil, "", err
+			}
+
+			files[f.Name] = buffer.Bytes()
+		}
+
+		if f.Name == "certificate" {
+			if _, ok := files["certificate"]; ok {
+				return nil, "", fmt.Errorf("Multiple certificate files in zip")
+			}
+
+			rc, err := f.Open()
+			if err != nil {
+				return nil, "", err
+			}
+
+			var buffer bytes.Buffer
+			if _, err := io.Copy(&buffer, rc); err != nil {
+				return nil, "", err
+			}
+
+			files["certificate"] = buffer.Bytes()
+			rc.Close()
+		}
 	}
 
 	if _, ok := files["ACL"]; !ok {
@@ -357,26 +1319,312 @@ func unzip(r io.Reader) (map[string][]byte, string, error) {
 	return files, uname, nil
 }
 
-func sign(acl []byte, keyfile string) ([]byte, error) {
-	return auth.Sign(acl, keyfile)
+// Signs the ACL with each of the (comma separated) key files. The first signature is stored as 'signature' (so
+// that the file still verifies with older releases) and any additional signatures as 'signature.2', 'signature.3', etc.
+// Encrypted key files are decrypted with the passphrase (or the UHPPOTED_KEY_PASSPHRASE environment variable).
+func sign(acl []byte, keyfiles string, passphrase string) (map[string][]byte, error) {
+	signatures := map[string][]byte{}
+
+	if passphrase == "" {
+		passphrase = os.Getenv(KEY_PASSPHRASE)
+	}
+
+	for _, keyfile := range strings.Split(keyfiles, ",") {
+		if keyfile = strings.TrimSpace(keyfile); keyfile == "" {
+			continue
+		}
+
+		signature, err := auth.Sign(acl, keyfile, []byte(passphrase))
+		if errors.Is(err, auth.ErrPassphraseRequired) {
+			return nil, fmt.Errorf("%w (use --key-passphrase or the %v environment variable)", err, KEY_PASSPHRASE)
+		} else if err != nil {
+			return nil, err
+		}
+
+		if len(signatures) == 0 {
+			signatures["signature"] = signature
+		} else {
+			signatures[fmt.Sprintf("signature.%v", len(signatures)+1)] = signature
+		}
+	}
+
+	if len(signatures) == 0 {
+		return nil, fmt.Errorf("No signing key")
+	}
+
+	return signatures, nil
+}
+
+// Decrypts an ACL file encrypted with --encrypt-to using the --decrypt-key RSA private key (the passphrase for an
+// encrypted key is taken from the UHPPOTED_DECRYPT_KEY_PASSPHRASE environment variable). Unencrypted ACL files are
+// returned unchanged and the signature is verified after decryption, as for an unencrypted file.
+func decrypt(uri string, b []byte, keyfile string, log *log.Logger) ([]byte, error) {
+	if keyfile == "" || !auth.IsEncrypted(b) {
+		return b, nil
+	}
+
+	plaintext, err := auth.Decrypt(b, keyfile, []byte(os.Getenv(DECRYPT_KEY_PASSPHRASE)))
+	if errors.Is(err, auth.ErrPassphraseRequired) {
+		return nil, &VerifyError{fmt.Errorf("%w (set the %v environment variable)", err, DECRYPT_KEY_PASSPHRASE)}
+	} else if err != nil {
+		return nil, &VerifyError{fmt.Errorf("Error decrypting %v (%w)", uri, err)}
+	}
+
+	log.Printf("Decrypted ACL file %v (%v bytes)", uri, len(plaintext))
+
+	return plaintext, nil
+}
+
+// Returns the 'signature' and any additional 'signature.N' entries, in order.
+func signatures(files map[string][]byte) [][]byte {
+	list := [][]byte{}
+
+	if signature, ok := files["signature"]; ok {
+		list = append(list, signature)
+	}
+
+	for i := 2; ; i++ {
+		signature, ok := files[fmt.Sprintf("signature.%v", i)]
+		if !ok {
+			break
+		}
+
+		list = append(list, signature)
+	}
+
+	return list
+}
+
+func isSignature(name string) bool {
+	return regexp.MustCompile(`^signature(?:\.[0-9]+)?$`).MatchString(name)
 }
 
-func verify(uname string, acl, signature []byte, dir string) error {
-	return auth.Verify(uname, acl, signature, dir)
+func loadCertificateChain(file string) ([]byte, error) {
+	return auth.LoadCertificateChain(file)
 }
 
-func report(diff map[uint32]acl.Diff, format string, w io.Writer) error {
+func verify(uname string, acl []byte, signatures [][]byte, dir string) (string, error) {
+	return auth.Verify(uname, acl, signatures, dir)
+}
+
+func verifyCertificate(acl, signature, chain []byte, ca string) (string, error) {
+	return auth.VerifyCertificate(acl, signature, chain, ca)
+}
+
+func report(rpt Report, format string, w io.Writer) error {
 	t, err := template.New("report").Parse(format)
 	if err != nil {
 		return err
 	}
 
-	timestamp := types.DateTime(time.Now())
-
-	rpt := Report{
-		DateTime: &timestamp,
-		Diffs:    diff,
+	if rpt.DateTime == nil {
+		timestamp := types.DateTime(time.Now())
+		rpt.DateTime = &timestamp
 	}
 
 	return t.Execute(w, rpt)
 }
+
+// Loads a custom report template, returning a parse error (with the template line number) if the template is
+// invalid.
+func loadTemplate(file string, format string) (string, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("Error reading report template %v (%w)", file, err)
+	}
+
+	if format == "html" {
+		if _, err := htmltemplate.New(filepath.Base(file)).Funcs(htmlFunctions).Parse(string(b)); err != nil {
+			return "", fmt.Errorf("Invalid report template (%w)", err)
+		}
+	} else if _, err := template.New(filepath.Base(file)).Parse(string(b)); err != nil {
+		return "", fmt.Errorf("Invalid report template (%w)", err)
+	}
+
+	return string(b), nil
+}
+
+// Writes the report as JSON, with the per-device diffs sorted by device ID.
+func reportJSON(rpt Report, w io.Writer) error {
+	type overflow struct {
+		Cards    int `json:"cards"`
+		Capacity int `json:"capacity"`
+	}
+
+	type device struct {
+		Device     uint32            `json:"device"`
+		Name       string            `json:"name,omitempty"`
+		Added      []types.Card      `json:"added"`
+		Updated    []types.Card      `json:"updated"`
+		Deleted    []types.Card      `json:"deleted"`
+		Unchanged  []types.Card      `json:"unchanged"`
+		Overflow   *overflow         `json:"overflow,omitempty"`
+		Review     bool              `json:"review,omitempty"`
+		NotChecked bool              `json:"not-checked,omitempty"`
+		Trend      map[uint32]string `json:"trend,omitempty"`
+		Error      string            `json:"error,omitempty"`
+	}
+
+	type changes struct {
+		Device      uint32       `json:"device"`
+		Name        string       `json:"name,omitempty"`
+		Changed     []types.Card `json:"changed"`
+		Appeared    []types.Card `json:"appeared"`
+		Disappeared []types.Card `json:"disappeared"`
+	}
+
+	timestamp := time.Now()
+	if rpt.DateTime != nil {
+		timestamp = time.Time(*rpt.DateTime)
+	}
+
+	devices := []device{}
+	for k, v := range rpt.Diffs {
+		d := device{
+			Device:     k,
+			Name:       rpt.name(k),
+			Added:      v.Added,
+			Updated:    v.Updated,
+			Deleted:    v.Deleted,
+			Unchanged:  v.Unchanged,
+			Review:     rpt.Review[k],
+			NotChecked: rpt.Skipped[k],
+			Trend:      rpt.Trend[k],
+			Error:      rpt.Errors[k],
+		}
+
+		if o := rpt.Overflow[k]; o != nil {
+			d.Overflow = &overflow{Cards: o.Cards, Capacity: o.Capacity}
+		}
+
+		for _, list := range []*[]types.Card{&d.Added, &d.Updated, &d.Deleted, &d.Unchanged} {
+			if *list == nil {
+				*list = []types.Card{}
+			}
+		}
+
+		devices = append(devices, d)
+	}
+
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Device < devices[j].Device })
+
+	controllers := []changes{}
+	for k, v := range rpt.Changes {
+		c := changes{
+			Device:      k,
+			Name:        rpt.name(k),
+			Changed:     v.Updated,
+			Appeared:    v.Added,
+			Disappeared: v.Deleted,
+		}
+
+		for _, list := range []*[]types.Card{&c.Changed, &c.Appeared, &c.Disappeared} {
+			if *list == nil {
+				*list = []types.Card{}
+			}
+		}
+
+		controllers = append(controllers, c)
+	}
+
+	sort.Slice(controllers, func(i, j int) bool { return controllers[i].Device < controllers[j].Device })
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	type duplicate struct {
+		CardNumber uint32 `json:"card-number"`
+		Lines      []int  `json:"lines"`
+		Conflict   bool   `json:"conflict"`
+		Merged     bool   `json:"merged"`
+	}
+
+	duplicates := []duplicate{}
+	for _, d := range rpt.Duplicates {
+		duplicates = append(duplicates, duplicate(d))
+	}
+
+	return encoder.Encode(struct {
+		Timestamp  string      `json:"timestamp"`
+		Devices    []device    `json:"devices"`
+		Changes    []changes   `json:"changes,omitempty"`
+		Duplicates []duplicate `json:"duplicates,omitempty"`
+	}{
+		Timestamp:  timestamp.Format(time.RFC3339),
+		Devices:    devices,
+		Changes:    controllers,
+		Duplicates: duplicates,
+	})
+}
+
+// Writes the per-device and total counts of the report diffs as JSON, for ingestion by metrics systems. The counts
+// are the lengths of the same diff lists that are listed in the text and JSON reports.
+func reportSummary(rpt Report, source string, w io.Writer) error {
+	type counts struct {
+		Added     int `json:"added"`
+		Updated   int `json:"updated"`
+		Deleted   int `json:"deleted"`
+		Unchanged int `json:"unchanged"`
+	}
+
+	type device struct {
+		Device uint32 `json:"device"`
+		Name   string `json:"name,omitempty"`
+		counts
+	}
+
+	timestamp := time.Now()
+	if rpt.DateTime != nil {
+		timestamp = time.Time(*rpt.DateTime)
+	}
+
+	devices := []device{}
+	total := counts{}
+	for k, v := range rpt.Diffs {
+		d := device{
+			Device: k,
+			Name:   rpt.name(k),
+			counts: counts{
+				Added:     len(v.Added),
+				Updated:   len(v.Updated),
+				Deleted:   len(v.Deleted),
+				Unchanged: len(v.Unchanged),
+			},
+		}
+
+		total.Added += d.Added
+		total.Updated += d.Updated
+		total.Deleted += d.Deleted
+		total.Unchanged += d.Unchanged
+
+		devices = append(devices, d)
+	}
+
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Device < devices[j].Device })
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(struct {
+		Timestamp string   `json:"timestamp"`
+		ACL       string   `json:"acl"`
+		Devices   []device `json:"devices"`
+		Total     counts   `json:"total"`
+	}{
+		Timestamp: timestamp.Format(time.RFC3339),
+		ACL:       source,
+		Devices:   devices,
+		Total:     total,
+	})
+}
+
+// Converts a local file path to a file:// URL. URLs are returned unchanged.
+func fileURI(path string) string {
+	if !strings.Contains(path, "://") {
+		if abs, err := filepath.Abs(path); err == nil {
+			return "file://" + filepath.ToSlash(abs)
+		}
+	}
+
+	return path
+}
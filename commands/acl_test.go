@@ -0,0 +1,248 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uhppoted/uhppote-core/types"
+	"github.com/uhppoted/uhppoted-lib/acl"
+)
+
+func TestFetchHTTPTimeoutMidBody(t *testing.T) {
+	release := make(chan struct{})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1024")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Card Number\tFrom\tTo\n"))
+		w.(http.Flusher).Flush()
+
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(release) })
+
+	timeout := 250 * time.Millisecond
+	start := time.Now()
+
+	_, err := fetchHTTP(context.Background(), srv.URL+"/hogwarts.acl", timeout, httpAuth{}, retryPolicy{})
+	elapsed := time.Since(start)
+
+	if err == nil {
+		t.Fatalf("Expected timeout error fetching stalled response, got nil")
+	}
+
+	var neterr net.Error
+	if !errors.As(err, &neterr) || !neterr.Timeout() {
+		t.Errorf("Expected timeout error, got %v", err)
+	}
+
+	if elapsed > timeout+time.Second {
+		t.Errorf("fetchHTTP did not return within the --http-timeout (%v): took %v", timeout, elapsed)
+	}
+}
+
+func TestStoreS3Metadata(t *testing.T) {
+	tests := map[string]int{
+		"PutObject": 1024,
+		"multipart": 5*1024*1024 + 1,
+	}
+
+	credentials := filepath.Join(t.TempDir(), "credentials")
+	if err := ioutil.WriteFile(credentials, []byte("[default]\naws_access_key_id = AKIAEXAMPLE\naws_secret_access_key = secret\n"), 0600); err != nil {
+		t.Fatalf("Error writing AWS credentials file (%v)", err)
+	}
+
+	for name, size := range tests {
+		var mutex sync.Mutex
+		var headers []http.Header
+
+		// ... minimal path-style S3 endpoint for PutObject and the multipart upload requests
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(ioutil.Discard, r.Body)
+
+			query := r.URL.Query()
+			_, uploads := query["uploads"]
+			_, uploadID := query["uploadId"]
+
+			switch {
+			case r.Method == "POST" && uploads:
+				mutex.Lock()
+				headers = append(headers, r.Header.Clone())
+				mutex.Unlock()
+
+				fmt.Fprintf(w, `<InitiateMultipartUploadResult><Bucket>uhppoted</Bucket><Key>reports/hogwarts.tar.gz</Key><UploadId>upload-1</UploadId></InitiateMultipartUploadResult>`)
+
+			case r.Method == "PUT" && uploadID:
+				w.Header().Set("ETag", fmt.Sprintf(`"part-%v"`, query.Get("partNumber")))
+
+			case r.Method == "POST" && uploadID:
+				fmt.Fprintf(w, `<CompleteMultipartUploadResult><Bucket>uhppoted</Bucket><Key>reports/hogwarts.tar.gz</Key><ETag>"complete"</ETag></CompleteMultipartUploadResult>`)
+
+			case r.Method == "PUT":
+				mutex.Lock()
+				headers = append(headers, r.Header.Clone())
+				mutex.Unlock()
+
+				w.Header().Set("ETag", `"object"`)
+
+			default:
+				http.Error(w, "unexpected request", http.StatusBadRequest)
+			}
+		}))
+
+		body := append([]byte{0x1f, 0x8b}, bytes.Repeat([]byte{0}, size-2)...)
+		endpoint := s3Endpoint{url: srv.URL, pathStyle: true}
+		multipart := s3Multipart{partSize: 5, concurrency: 1}
+
+		err := storeS3(context.Background(), "s3://uhppoted/reports/hogwarts.tar.gz", credentials, "default", "us-east-1", "", endpoint, awsRole{}, s3Encryption{}, multipart, nil, "no-cache", bytes.NewReader(body), retryPolicy{})
+
+		srv.Close()
+
+		if err != nil {
+			t.Fatalf("%v: unexpected error uploading to S3 (%v)", name, err)
+		}
+
+		if len(headers) != 1 {
+			t.Fatalf("%v: expected 1 PutObject or CreateMultipartUpload request, got %v", name, len(headers))
+		}
+
+		if v := headers[0].Get("Content-Type"); v != "application/gzip" {
+			t.Errorf("%v: incorrect Content-Type - expected:%v, got:%v", name, "application/gzip", v)
+		}
+
+		if v := headers[0].Get("Cache-Control"); v != "no-cache" {
+			t.Errorf("%v: incorrect Cache-Control - expected:%v, got:%v", name, "no-cache", v)
+		}
+	}
+}
+
+func TestReportJSON(t *testing.T) {
+	from := types.ToDate(2021, time.January, 1)
+	to := types.ToDate(2021, time.December, 31)
+	card := types.Card{CardNumber: 8165538, From: &from, To: &to, Doors: map[uint8]int{1: 1, 2: 0, 3: 0, 4: 0}}
+	timestamp := types.DateTime(time.Date(2021, time.June, 1, 12, 34, 56, 0, time.UTC))
+
+	rpt := Report{
+		DateTime: &timestamp,
+		Diffs: map[uint32]acl.Diff{
+			405419896: {Added: []types.Card{card}},
+			303986753: {},
+		},
+		Changes:  map[uint32]acl.Diff{405419896: {Deleted: []types.Card{card}}},
+		Overflow: map[uint32]*Overflow{405419896: {Cards: 2500, Capacity: 2000}},
+		Review:   map[uint32]bool{405419896: true},
+		Trend:    map[uint32]map[uint32]string{405419896: {8165538: "RECURRING"}},
+		Skipped:  map[uint32]bool{303986753: true},
+	}
+
+	var b bytes.Buffer
+	if err := reportJSON(rpt, &b); err != nil {
+		t.Fatalf("Unexpected error writing JSON report (%v)", err)
+	}
+
+	var report struct {
+		Devices []struct {
+			Device   uint32 `json:"device"`
+			Overflow *struct {
+				Cards    int `json:"cards"`
+				Capacity int `json:"capacity"`
+			} `json:"overflow"`
+			Review     bool              `json:"review"`
+			NotChecked bool              `json:"not-checked"`
+			Trend      map[string]string `json:"trend"`
+		} `json:"devices"`
+		Changes []struct {
+			Device      uint32        `json:"device"`
+			Disappeared []interface{} `json:"disappeared"`
+		} `json:"changes"`
+	}
+
+	if err := json.Unmarshal(b.Bytes(), &report); err != nil {
+		t.Fatalf("Invalid JSON report (%v)\n%s", err, b.Bytes())
+	}
+
+	if len(report.Devices) != 2 {
+		t.Fatalf("Incorrect number of devices - expected:2, got:%v", len(report.Devices))
+	}
+
+	skipped, device := report.Devices[0], report.Devices[1]
+
+	if !skipped.NotChecked || skipped.Overflow != nil || skipped.Review {
+		t.Errorf("Incorrect report for not checked device %v\n%s", skipped.Device, b.Bytes())
+	}
+
+	if device.Overflow == nil || device.Overflow.Cards != 2500 || device.Overflow.Capacity != 2000 {
+		t.Errorf("Incorrect overflow - expected:{2500 2000}, got:%v", device.Overflow)
+	}
+
+	if !device.Review || device.NotChecked {
+		t.Errorf("Incorrect review/not-checked flags - expected:true/false, got:%v/%v", device.Review, device.NotChecked)
+	}
+
+	if device.Trend["8165538"] != "RECURRING" {
+		t.Errorf("Incorrect trend - expected:%v, got:%v", map[string]string{"8165538": "RECURRING"}, device.Trend)
+	}
+
+	if len(report.Changes) != 1 || report.Changes[0].Device != 405419896 || len(report.Changes[0].Disappeared) != 1 {
+		t.Errorf("Incorrect controller changes\n%s", b.Bytes())
+	}
+}
+
+func TestReportOverflowSummary(t *testing.T) {
+	from := types.ToDate(2021, time.January, 1)
+	to := types.ToDate(2021, time.December, 31)
+	card := types.Card{CardNumber: 8165538, From: &from, To: &to, Doors: map[uint8]int{1: 1, 2: 0, 3: 0, 4: 0}}
+
+	rpt := Report{
+		Diffs:    map[uint32]acl.Diff{405419896: {Added: []types.Card{card}}},
+		Overflow: map[uint32]*Overflow{405419896: {Cards: 2500, Capacity: 2000}},
+	}
+
+	var text bytes.Buffer
+	if err := report(rpt, CompareACLCmd.template, &text); err != nil {
+		t.Fatalf("Unexpected error writing text report (%v)", err)
+	}
+
+	var html bytes.Buffer
+	if err := reportHTML(rpt, HTML_TEMPLATE, &html); err != nil {
+		t.Fatalf("Unexpected error writing HTML report (%v)", err)
+	}
+
+	for _, v := range []struct {
+		format string
+		report string
+	}{
+		{"text", text.String()},
+		{"HTML", html.String()},
+	} {
+		if !strings.Contains(v.report, "CAPACITY EXCEEDED") {
+			t.Errorf("%v report missing CAPACITY EXCEEDED\n%v", v.format, v.report)
+		}
+
+		if !strings.Contains(v.report, "Not listed:") {
+			t.Errorf("%v report missing diff summary\n%v", v.format, v.report)
+		}
+
+		if strings.Contains(v.report, "8165538") {
+			t.Errorf("%v report includes the diff for the overflowed device\n%v", v.format, v.report)
+		}
+	}
+}
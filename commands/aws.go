@@ -0,0 +1,332 @@
+package commands
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+const PROFILE_URI = "profile://"
+const CREDENTIALS_REFRESH = 5 * time.Minute
+const DEFAULT_ENDPOINT_REGION = "us-east-1"
+const DEFAULT_ROLE_DURATION = 15 * time.Minute
+const DEFAULT_PART_SIZE = 16
+const DEFAULT_UPLOAD_CONCURRENCY = s3manager.DefaultUploadConcurrency
+
+// IAM role assumed (using STS AssumeRole) with the base credentials e.g. for cross-account access. An empty ARN uses
+// the base credentials directly.
+type awsRole struct {
+	arn        string
+	externalID string
+	duration   time.Duration
+}
+
+// Custom S3 endpoint for S3 compatible stores (e.g. MinIO). An empty URL uses the AWS S3 endpoint.
+type s3Endpoint struct {
+	url       string
+	pathStyle bool
+}
+
+// Sessions are cached so that the credentials providers can cache (and refresh on expiry) temporary
+// credentials for the lifetime of long running commands rather than being recreated for every request.
+var sessions = struct {
+	sync.Mutex
+	cache map[string]*session.Session
+}{
+	cache: map[string]*session.Session{},
+}
+
+// Re-reads the shared credentials file periodically so that temporary credentials that are rotated by an
+// external process are picked up without restarting.
+type sharedCredentialsProvider struct {
+	credentials.Expiry
+	provider credentials.SharedCredentialsProvider
+}
+
+func (p *sharedCredentialsProvider) Retrieve() (credentials.Value, error) {
+	v, err := p.provider.Retrieve()
+	if err != nil {
+		return v, err
+	}
+
+	p.SetExpiration(time.Now().Add(CREDENTIALS_REFRESH), 0)
+
+	return v, nil
+}
+
+// Server-side encryption for uploaded S3 objects: 'AES256' (SSE-S3) or 'aws:kms' (SSE-KMS) with an optional KMS
+// key ID. An empty SSE uploads objects exactly as before.
+type s3Encryption struct {
+	sse      string
+	kmsKeyID string
+}
+
+func (e s3Encryption) validate() error {
+	switch e.sse {
+	case "", s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms:
+	default:
+		return fmt.Errorf("Invalid --sse '%v' (expected %v or %v)", e.sse, s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms)
+	}
+
+	if e.kmsKeyID != "" && e.sse != s3.ServerSideEncryptionAwsKms {
+		return fmt.Errorf("--sse-kms-key-id requires --sse %v", s3.ServerSideEncryptionAwsKms)
+	}
+
+	return nil
+}
+
+// Multipart upload part size (in MiB) and the number of parts uploaded concurrently. Objects smaller than the part
+// size are uploaded with a single PutObject request.
+type s3Multipart struct {
+	partSize    int
+	concurrency int
+}
+
+func (m s3Multipart) validate() error {
+	if int64(m.partSize)*1024*1024 < s3manager.MinUploadPartSize {
+		return fmt.Errorf("Invalid --part-size %v (minimum part size is %vMiB)", m.partSize, s3manager.MinUploadPartSize/1024/1024)
+	}
+
+	if m.concurrency < 1 {
+		return fmt.Errorf("Invalid --upload-concurrency %v (expected 1 or more)", m.concurrency)
+	}
+
+	return nil
+}
+
+// Object tags (--tag key=value) for uploaded S3 objects, in the order specified. The AWS limits are 10 tags per
+// object, 128 character keys and 256 character values.
+type s3Tags []string
+
+func (t *s3Tags) String() string {
+	return strings.Join(*t, ",")
+}
+
+func (t *s3Tags) Set(v string) error {
+	if k := strings.SplitN(v, "=", 2); len(k) != 2 || strings.TrimSpace(k[0]) == "" {
+		return fmt.Errorf("invalid tag '%v' (expected key=value)", v)
+	}
+
+	*t = append(*t, v)
+
+	return nil
+}
+
+func (t s3Tags) validate() error {
+	if len(t) > 10 {
+		return fmt.Errorf("Too many --tag's (%v) - S3 objects are limited to 10 tags", len(t))
+	}
+
+	keys := map[string]bool{}
+	for _, tag := range t {
+		kv := strings.SplitN(tag, "=", 2)
+		key, value := kv[0], kv[1]
+
+		if len([]rune(key)) > 128 {
+			return fmt.Errorf("Invalid --tag '%v' (maximum key length is 128 characters)", tag)
+		}
+
+		if len([]rune(value)) > 256 {
+			return fmt.Errorf("Invalid --tag '%v' (maximum value length is 256 characters)", tag)
+		}
+
+		if strings.HasPrefix(strings.ToLower(key), "aws:") {
+			return fmt.Errorf("Invalid --tag '%v' (the 'aws:' prefix is reserved for AWS tags)", tag)
+		}
+
+		if keys[key] {
+			return fmt.Errorf("Duplicate --tag key '%v'", key)
+		}
+
+		keys[key] = true
+	}
+
+	return nil
+}
+
+// Returns the URL encoded tag set for the PutObject x-amz-tagging header, or nil if there are no tags.
+func (t s3Tags) tagging() *string {
+	if len(t) == 0 {
+		return nil
+	}
+
+	tags := []string{}
+	for _, tag := range t {
+		kv := strings.SplitN(tag, "=", 2)
+		tags = append(tags, url.QueryEscape(kv[0])+"="+url.QueryEscape(kv[1]))
+	}
+
+	return aws.String(strings.Join(tags, "&"))
+}
+
+func isProfileURI(credentials string) bool {
+	return strings.HasPrefix(credentials, PROFILE_URI)
+}
+
+// An empty credentials file uses the default AWS credentials chain i.e. environment variables, the shared credentials
+// file (for the profile) and ECS task or EC2 instance roles.
+//
+// A profile:// credentials URI resolves both the credentials and the default region from the
+// shared AWS config and credentials files (~/.aws/config and ~/.aws/credentials) for the named
+// profile. An explicit region overrides the profile region.
+//
+// An (optional) endpoint replaces the AWS S3 endpoint for S3 compatible stores (e.g. MinIO), optionally
+// with path-style (http://host/bucket/key) addressing.
+//
+// An (optional) role is assumed with the base credentials and the assumed role credentials are cached (and
+// refreshed before they expire) with the session, so that fetches and uploads share the same role session.
+func awsSession(config, profile, region string, endpoint s3Endpoint, role awsRole) (*session.Session, error) {
+	key := fmt.Sprintf("%v|%v|%v|%v|%v|%v|%v|%v|%v", config, profile, region, endpoint.url, endpoint.pathStyle, role.arn, role.externalID, role.duration, getProxy())
+
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	if ss, ok := sessions.cache[key]; ok {
+		return ss, nil
+	}
+
+	ss, err := newSession(config, profile, region, endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if role.arn != "" {
+		if ss, err = assumeRole(ss, role); err != nil {
+			return nil, err
+		}
+	}
+
+	sessions.cache[key] = ss
+
+	return ss, nil
+}
+
+func newSession(config, profile, region string, endpoint s3Endpoint) (*session.Session, error) {
+	if isProfileURI(config) {
+		options := session.Options{
+			Profile:           strings.TrimPrefix(config, PROFILE_URI),
+			SharedConfigState: session.SharedConfigEnable,
+		}
+
+		if client := s3HTTPClient(); client != nil {
+			options.Config.HTTPClient = client
+		}
+
+		if region != "" {
+			options.Config.Region = aws.String(region)
+		}
+
+		if endpoint.url != "" {
+			options.Config.Endpoint = aws.String(endpoint.url)
+			options.Config.S3ForcePathStyle = aws.Bool(endpoint.pathStyle)
+		}
+
+		return session.NewSessionWithOptions(options)
+	}
+
+	// ... no credentials file: use the default AWS credentials chain (environment variables, the shared
+	//     credentials file and ECS task/EC2 instance roles)
+	if config == "" {
+		options := session.Options{}
+
+		if client := s3HTTPClient(); client != nil {
+			options.Config.HTTPClient = client
+		}
+
+		// ... an explicit profile takes precedence over the environment variable credentials, so the 'default'
+		//     profile is left to the SDK default
+		if profile != "" && profile != "default" {
+			options.Profile = profile
+		}
+
+		if region != "" {
+			options.Config.Region = aws.String(region)
+		}
+
+		if endpoint.url != "" {
+			if region == "" {
+				options.Config.Region = aws.String(DEFAULT_ENDPOINT_REGION)
+			}
+
+			options.Config.Endpoint = aws.String(endpoint.url)
+			options.Config.S3ForcePathStyle = aws.Bool(endpoint.pathStyle)
+		}
+
+		return session.NewSessionWithOptions(options)
+	}
+
+	if _, err := os.Stat(config); err != nil {
+		return nil, fmt.Errorf("Invalid AWS credentials file %v (%w)", config, err)
+	}
+
+	provider := sharedCredentialsProvider{
+		provider: credentials.SharedCredentialsProvider{
+			Filename: config,
+			Profile:  profile,
+		},
+	}
+
+	cfg := aws.NewConfig().
+		WithCredentials(credentials.NewCredentials(&provider)).
+		WithRegion(region)
+
+	if client := s3HTTPClient(); client != nil {
+		cfg = cfg.WithHTTPClient(client)
+	}
+
+	if endpoint.url != "" {
+		// ... S3 compatible stores still require a region for request signing
+		if region == "" {
+			cfg = cfg.WithRegion(DEFAULT_ENDPOINT_REGION)
+		}
+
+		cfg = cfg.WithEndpoint(endpoint.url).WithS3ForcePathStyle(endpoint.pathStyle)
+	}
+
+	return session.NewSession(cfg)
+}
+
+// Returns an HTTP client that routes S3 requests through the explicit --proxy, or nil for the AWS SDK default
+// client (which uses the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables).
+func s3HTTPClient() *http.Client {
+	if getProxy() == "" {
+		return nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxyFunc()
+
+	return &http.Client{Transport: transport}
+}
+
+func assumeRole(ss *session.Session, role awsRole) (*session.Session, error) {
+	creds := stscreds.NewCredentials(ss, role.arn, func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = APP
+
+		if role.duration > 0 {
+			p.Duration = role.duration
+		}
+
+		if role.externalID != "" {
+			p.ExternalID = aws.String(role.externalID)
+		}
+	})
+
+	// ... assume the role up front so that STS errors are reported as such rather than as S3 request errors
+	if _, err := creds.Get(); err != nil {
+		return nil, fmt.Errorf("Error assuming role %v (%w)", role.arn, err)
+	}
+
+	return ss.Copy(&aws.Config{Credentials: creds}), nil
+}
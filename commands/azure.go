@@ -0,0 +1,256 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+const AZURE_ACCOUNT = "AZURE_STORAGE_ACCOUNT"
+const AZURE_KEY = "AZURE_STORAGE_KEY"
+const AZURE_SAS = "AZURE_STORAGE_SAS_TOKEN"
+const AZURE_CONNECTION_STRING = "AZURE_STORAGE_CONNECTION_STRING"
+
+var azureHost = regexp.MustCompile(`^([a-z0-9]+)\.blob\.core\.windows\.net$`)
+
+// Credentials for Azure Blob Storage az://container/blob and https://<account>.blob.core.windows.net URLs, either
+// a shared key or a SAS token (or neither, for public blobs and URLs that include a SAS token). Credentials not
+// supplied on the command line are taken from the connection string and then from the AZURE_STORAGE_ACCOUNT,
+// AZURE_STORAGE_KEY, AZURE_STORAGE_SAS_TOKEN and AZURE_STORAGE_CONNECTION_STRING environment variables.
+type azureAuth struct {
+	account    string
+	key        string
+	sas        string
+	connection string
+	endpoint   string
+}
+
+func (a *azureAuth) resolve() error {
+	if a.connection == "" {
+		a.connection = os.Getenv(AZURE_CONNECTION_STRING)
+	}
+
+	if a.connection != "" {
+		for _, field := range strings.Split(a.connection, ";") {
+			kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+
+			switch v := strings.TrimSpace(kv[1]); strings.ToLower(strings.TrimSpace(kv[0])) {
+			case "accountname":
+				a.account = first(a.account, v)
+			case "accountkey":
+				a.key = first(a.key, v)
+			case "sharedaccesssignature":
+				a.sas = first(a.sas, v)
+			case "blobendpoint":
+				a.endpoint = first(a.endpoint, v)
+			}
+		}
+	}
+
+	a.account = first(a.account, os.Getenv(AZURE_ACCOUNT))
+	a.key = first(a.key, os.Getenv(AZURE_KEY))
+	a.sas = strings.TrimPrefix(first(a.sas, os.Getenv(AZURE_SAS)), "?")
+
+	if a.key != "" && a.sas != "" {
+		return fmt.Errorf("--azure-key and --azure-sas are mutually exclusive")
+	}
+
+	if a.endpoint != "" {
+		if _, err := url.Parse(a.endpoint); err != nil {
+			return fmt.Errorf("Invalid Azure BlobEndpoint '%v' (%w)", a.endpoint, err)
+		}
+	}
+
+	return nil
+}
+
+// Returns true for az:// URLs and for https:// URLs for an Azure Blob Storage account (or the connection string
+// BlobEndpoint).
+func (a azureAuth) handles(uri string) bool {
+	if strings.HasPrefix(uri, "az://") {
+		return true
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return false
+	}
+
+	if azureHost.MatchString(strings.ToLower(u.Hostname())) {
+		return true
+	}
+
+	if a.endpoint != "" {
+		if e, err := url.Parse(a.endpoint); err == nil && e.Host != "" && strings.EqualFold(e.Host, u.Host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the blob URL (with the SAS token, if any) and the pipeline credential for the URL.
+func (a azureAuth) blob(uri string) (*url.URL, azblob.Credential, error) {
+	var u *url.URL
+
+	if strings.HasPrefix(uri, "az://") {
+		match := regexp.MustCompile("^az://(.*?)/(.+)").FindStringSubmatch(uri)
+		if len(match) != 3 || match[1] == "" {
+			return nil, nil, fmt.Errorf("Invalid Azure Blob Storage URI (%s)", uri)
+		}
+
+		endpoint := a.endpoint
+		if endpoint == "" {
+			if a.account == "" {
+				return nil, nil, fmt.Errorf("az:// URLs require an Azure storage account (--azure-account or --azure-connection-string)")
+			}
+
+			endpoint = fmt.Sprintf("https://%v.blob.core.windows.net", a.account)
+		}
+
+		v, err := url.Parse(strings.TrimSuffix(endpoint, "/") + "/" + match[1] + "/" + match[2])
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid Azure Blob Storage URI (%s)", uri)
+		}
+
+		u = v
+	} else if v, err := url.Parse(uri); err != nil {
+		return nil, nil, fmt.Errorf("Invalid Azure Blob Storage URI (%s)", uri)
+	} else {
+		u = v
+	}
+
+	if a.sas != "" && u.Query().Get("sig") == "" {
+		if u.RawQuery == "" {
+			u.RawQuery = a.sas
+		} else {
+			u.RawQuery += "&" + a.sas
+		}
+	}
+
+	if a.key == "" || u.Query().Get("sig") != "" {
+		return u, azblob.NewAnonymousCredential(), nil
+	}
+
+	account := a.account
+	if match := azureHost.FindStringSubmatch(strings.ToLower(u.Hostname())); len(match) == 2 && account == "" {
+		account = match[1]
+	}
+
+	credential, err := azblob.NewSharedKeyCredential(account, a.key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid Azure storage account key (%w)", err)
+	}
+
+	return u, credential, nil
+}
+
+// Returns an Azure pipeline that sends requests with the command HTTP client (for the --proxy, --http-timeout and
+// TLS options), with the pipeline retries disabled in favour of the command retry policy.
+func azurePipeline(credential azblob.Credential, timeout time.Duration) pipeline.Pipeline {
+	client := httpClient(timeout)
+	sender := pipeline.FactoryFunc(func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
+		return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+			response, err := client.Do(request.WithContext(ctx))
+			if err != nil {
+				return nil, err
+			}
+
+			return pipeline.NewHTTPResponse(response), nil
+		}
+	})
+
+	return azblob.NewPipeline(credential, azblob.PipelineOptions{
+		Retry:      azblob.RetryOptions{MaxTries: 1},
+		HTTPSender: sender,
+	})
+}
+
+func fetchAzure(ctx context.Context, uri string, auth azureAuth, timeout time.Duration, retry retryPolicy) ([]byte, error) {
+	u, credential, err := auth.blob(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	blob := azblob.NewBlobURL(*u, azurePipeline(credential, timeout))
+
+	var b []byte
+
+	err = retry.do(ctx, fmt.Sprintf("GET %v", uri), func() error {
+		response, err := blob.Download(ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
+		if err != nil {
+			return azureError(uri, err)
+		}
+
+		body := response.Body(azblob.RetryReaderOptions{})
+		defer body.Close()
+
+		b, err = ioutil.ReadAll(body)
+
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func storeAzure(ctx context.Context, uri string, auth azureAuth, r io.Reader, timeout time.Duration, retry retryPolicy) error {
+	u, credential, err := auth.blob(uri)
+	if err != nil {
+		return err
+	}
+
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	blob := azblob.NewBlockBlobURL(*u, azurePipeline(credential, timeout))
+
+	return retry.do(ctx, fmt.Sprintf("PUT %v", uri), func() error {
+		_, err := azblob.UploadBufferToBlockBlob(ctx, body, blob, azblob.UploadToBlockBlobOptions{})
+
+		return azureError(uri, err)
+	})
+}
+
+// Replaces the (very verbose) Azure storage errors with the HTTP status and Azure error code, so that the errors are
+// logged on a single line and retried as for HTTP requests.
+func azureError(uri string, err error) error {
+	var e azblob.StorageError
+	if errors.As(err, &e) && e.Response() != nil {
+		return httpStatusError{
+			URL:        uri,
+			StatusCode: e.Response().StatusCode,
+			Status:     fmt.Sprintf("%v (%v)", e.Response().Status, e.ServiceCode()),
+		}
+	}
+
+	return err
+}
+
+func first(values ...string) string {
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			return strings.TrimSpace(v)
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,71 @@
+package commands
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/uhppoted/uhppote-core/uhppote"
+	"github.com/uhppoted/uhppoted-lib/acl"
+)
+
+// Returns the timestamped URL for a backup ACL file under the --backup URL prefix e.g.
+// s3://uhppoted/backups/backup-2026-10-14T181459.tar.gz.
+func backupURL(prefix string, timestamp time.Time) string {
+	return strings.TrimSuffix(prefix, "/") + "/" + timestamp.Format("backup-2006-01-02T150405.tar.gz")
+}
+
+// Retrieves the current controller ACL and stores it as a signed tar.gz ACL file (in the same format as store-acl)
+// to a timestamped URL under the --backup URL, so that a load can be rolled back by loading the backup file.
+func (cmd *LoadACL) backup(u uhppote.IUHPPOTE, devices []uhppote.Device, log *log.Logger) error {
+	uri := backupURL(cmd.backupTo, time.Now())
+
+	log.Printf("Backing up controller ACL to %v", uri)
+
+	list, errors, _, err := getACL(cmd.ctx, u, devices, cmd.concurrency)
+	if err != nil {
+		return err
+	} else if len(errors) > 0 {
+		return fmt.Errorf("%w %v", ErrUnreachable, errors)
+	}
+
+	var w strings.Builder
+	if err := acl.MakeTSV(list, devices, &w); err != nil {
+		return err
+	}
+
+	tsv := []byte(w.String())
+	files := map[string][]byte{
+		"uhppoted.acl": tsv,
+		TIMESTAMP_FILE: signingTimestamp(time.Now()),
+	}
+
+	signatures, err := sign(signable(files, tsv), cmd.keyfile, cmd.passphrase)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range signatures {
+		files[k] = v
+	}
+
+	var b bytes.Buffer
+	if err := targz(files, &b, gzip.DefaultCompression); err != nil {
+		return err
+	}
+
+	if err := cmd.store(uri, bytes.NewReader(b.Bytes())); err != nil {
+		return err
+	}
+
+	for k, l := range list {
+		log.Printf("%v  Backed up %v records", k, len(l))
+	}
+
+	log.Printf("Stored backup ACL file (%v bytes) to %v", b.Len(), uri)
+
+	return nil
+}
@@ -0,0 +1,187 @@
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+)
+
+type job struct {
+	Name     string `json:"name"`
+	ACL      string `json:"acl"`
+	Checksum string `json:"checksum"`
+	Report   string `json:"report"`
+	Config   string `json:"config"`
+	State    string `json:"state"`
+}
+
+type batchError struct {
+	failed []string
+	err    error
+}
+
+func (e *batchError) Error() string {
+	return fmt.Sprintf("%v of the batch jobs did not complete cleanly: %v", len(e.failed), strings.Join(e.failed, ", "))
+}
+
+func (e *batchError) Unwrap() error {
+	return e.err
+}
+
+func loadBatch(file string) ([]job, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := []job{}
+	if err := json.Unmarshal(b, &jobs); err != nil {
+		return nil, fmt.Errorf("Invalid batch file %v (%w)", file, err)
+	}
+
+	for i := range jobs {
+		if jobs[i].Name == "" {
+			jobs[i].Name = fmt.Sprintf("job %v", i+1)
+		}
+	}
+
+	return jobs, nil
+}
+
+func (cmd *CompareACL) executeBatch(log *log.Logger) error {
+	jobs, err := loadBatch(cmd.batch)
+	if err != nil {
+		return err
+	}
+
+	// ... stdin can only be read once
+	stdin := 0
+	for _, j := range jobs {
+		if j.ACL == "-" || (j.ACL == "" && cmd.acl.contains("-")) {
+			stdin++
+		}
+	}
+
+	if stdin > 1 {
+		return fmt.Errorf("Only one batch job can read the ACL file from stdin ('-')")
+	}
+
+	parallel := cmd.parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	log.Printf("Running %v compare jobs from %v (concurrency: %v)", len(jobs), cmd.batch, parallel)
+
+	results := make([]error, len(jobs))
+	sources := make([]string, len(jobs))
+	semaphore := make(chan struct{}, parallel)
+
+	var wg sync.WaitGroup
+	for i, j := range jobs {
+		ix := i
+		c := *cmd
+		c.batch = ""
+
+		if j.ACL != "" {
+			c.acl = urlList{j.ACL}
+		}
+
+		// ... a job ACL replaces the checksum for the default ACL
+		if j.ACL != "" || j.Checksum != "" {
+			c.checksum = j.Checksum
+		}
+
+		if j.Report != "" {
+			c.rpt = j.Report
+		}
+
+		if j.Config != "" {
+			c.config = j.Config
+		}
+
+		if j.State != "" {
+			c.state = j.State
+		}
+
+		sources[ix] = c.acl.String()
+
+		semaphore <- struct{}{}
+		if err := cmd.ctx.Err(); err != nil {
+			results[ix] = err
+			<-semaphore
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			log.Printf("%v: comparing %v", jobs[ix].Name, sources[ix])
+			results[ix] = c.run(log)
+		}()
+	}
+
+	wg.Wait()
+
+	// ... summarize
+	failed := []string{}
+	var worst error
+	for i, err := range results {
+		switch {
+		case err == nil:
+			log.Printf("%v: OK", jobs[i].Name)
+
+		case errors.Is(err, ErrDrift):
+			log.Printf("%v: DRIFT", jobs[i].Name)
+			failed = append(failed, jobs[i].Name)
+
+		case errors.Is(err, ErrUnreachable):
+			log.Printf("%v: UNREACHABLE (%v)", jobs[i].Name, err)
+			failed = append(failed, jobs[i].Name)
+
+		case errors.Is(err, ErrVerify):
+			source := sources[i]
+			if list := failedSources(err, ErrVerify); len(list) > 0 {
+				source = strings.Join(list, ",")
+			}
+
+			log.Printf("%v: SIGNATURE NOT VERIFIED %v (%v)", jobs[i].Name, source, err)
+			failed = append(failed, jobs[i].Name)
+
+		default:
+			log.Printf("%v: ERROR (%v)", jobs[i].Name, err)
+			failed = append(failed, jobs[i].Name)
+		}
+
+		if severity(err) > severity(worst) {
+			worst = err
+		}
+	}
+
+	log.Printf("BATCH SUMMARY  jobs:%v  ok:%v  failed:%v", len(jobs), len(jobs)-len(failed), len(failed))
+
+	if worst != nil {
+		return &batchError{failed: failed, err: worst}
+	}
+
+	return nil
+}
+
+func severity(err error) int {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, ErrDrift):
+		return 1
+	case errors.Is(err, ErrUnreachable):
+		return 2
+	default:
+		return 3
+	}
+}
@@ -0,0 +1,162 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/uhppoted/uhppote-core/uhppote"
+)
+
+// Converts an ACL with a door permissions bitmask column per controller to the equivalent
+// ACL with a column per door. Bit 0 of the bitmask corresponds to door 1.
+func bitmaskToTSV(tsv []byte, devices []uhppote.Device) ([]byte, error) {
+	r := csv.NewReader(bytes.NewReader(tsv))
+	r.Comma = '\t'
+
+	header, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	cardnumber := -1
+	from := -1
+	to := -1
+	columns := map[int]uhppote.Device{}
+
+loop:
+	for ix, field := range header {
+		key := clean(field)
+
+		switch key {
+		case "cardnumber":
+			cardnumber = ix
+			continue loop
+		case "from":
+			from = ix
+			continue loop
+		case "to":
+			to = ix
+			continue loop
+		}
+
+		for _, d := range devices {
+			if key == clean(d.Name) || key == fmt.Sprintf("%v", d.DeviceID) {
+				columns[ix] = d
+				continue loop
+			}
+		}
+
+		return nil, fmt.Errorf("No configured controller matches '%s'", field)
+	}
+
+	if cardnumber < 0 {
+		return nil, fmt.Errorf("Missing 'Card Number' column")
+	}
+
+	if from < 0 {
+		return nil, fmt.Errorf("Missing 'From' column")
+	}
+
+	if to < 0 {
+		return nil, fmt.Errorf("Missing 'To' column")
+	}
+
+	var b bytes.Buffer
+
+	w := csv.NewWriter(&b)
+	w.Comma = '\t'
+
+	doors := []string{"Card Number", "From", "To"}
+	for ix := range header {
+		if d, ok := columns[ix]; ok {
+			for _, door := range d.Doors {
+				if strings.TrimSpace(door) != "" {
+					doors = append(doors, door)
+				}
+			}
+		}
+	}
+
+	if err := w.Write(doors); err != nil {
+		return nil, err
+	}
+
+	line := 0
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		line += 1
+		row := []string{record[cardnumber], record[from], record[to]}
+		for ix := range header {
+			d, ok := columns[ix]
+			if !ok {
+				continue
+			}
+
+			permissions, err := decodeBitmask(record[ix], d)
+			if err != nil {
+				return nil, fmt.Errorf("Error parsing TSV - line %d: %w", line, err)
+			}
+
+			row = append(row, permissions...)
+		}
+
+		if err := w.Write(row); err != nil {
+			return nil, err
+		}
+	}
+
+	w.Flush()
+
+	return b.Bytes(), w.Error()
+}
+
+func decodeBitmask(field string, device uhppote.Device) ([]string, error) {
+	v := strings.TrimSpace(field)
+	if v == "" {
+		v = "0"
+	}
+
+	mask, err := strconv.ParseUint(v, 0, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid door bitmask '%s' for controller %v", field, device.DeviceID)
+	}
+
+	permissions := []string{}
+	for i, door := range device.Doors {
+		bit := uint64(1) << uint(i)
+
+		if strings.TrimSpace(door) == "" {
+			if mask&bit != 0 {
+				return nil, fmt.Errorf("Door bitmask '%s' sets bit %v but door %v is not configured for controller %v", field, i, i+1, device.DeviceID)
+			}
+			continue
+		}
+
+		if mask&bit != 0 {
+			permissions = append(permissions, "Y")
+		} else {
+			permissions = append(permissions, "N")
+		}
+	}
+
+	if mask>>uint(len(device.Doors)) != 0 {
+		return nil, fmt.Errorf("Door bitmask '%s' overflows the %v doors of controller %v", field, len(device.Doors), device.DeviceID)
+	}
+
+	return permissions, nil
+}
+
+func clean(s string) string {
+	return regexp.MustCompile(`[\s\t]+`).ReplaceAllString(strings.ToLower(s), "")
+}
@@ -0,0 +1,64 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/uhppoted/uhppote-core/uhppote"
+	"github.com/uhppoted/uhppoted-lib/acl"
+)
+
+// The ACL cache is a shared HTTP service (populated by other tools) that returns the most recently
+// retrieved controller ACL as JSON e.g.
+//
+//	{ "timestamp": "2021-05-01T12:34:56Z", "acl": { "405419896": { "65537": { ... } } } }
+type cachedACL struct {
+	Timestamp time.Time `json:"timestamp"`
+	ACL       acl.ACL   `json:"acl"`
+}
+
+func fetchCachedACL(url string, maxStaleness time.Duration, devices []uhppote.Device) (acl.ACL, time.Time, error) {
+	response, err := http.Get(url)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, time.Time{}, fmt.Errorf("%v", response.Status)
+	}
+
+	b, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	cached := cachedACL{}
+	if err := json.Unmarshal(b, &cached); err != nil {
+		return nil, time.Time{}, fmt.Errorf("invalid cached ACL (%w)", err)
+	}
+
+	if cached.Timestamp.IsZero() {
+		return nil, time.Time{}, fmt.Errorf("cached ACL has no timestamp")
+	}
+
+	if age := time.Since(cached.Timestamp); maxStaleness > 0 && age > maxStaleness {
+		return nil, cached.Timestamp, fmt.Errorf("cached ACL is stale (%v old)", age.Round(time.Second))
+	}
+
+	list := acl.ACL{}
+	for _, d := range devices {
+		cards, ok := cached.ACL[d.DeviceID]
+		if !ok {
+			return nil, cached.Timestamp, fmt.Errorf("cached ACL has no entry for controller %v", d.DeviceID)
+		}
+
+		list[d.DeviceID] = cards
+	}
+
+	return list, cached.Timestamp, nil
+}
@@ -0,0 +1,95 @@
+package commands
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bundles that include a 'version' entry with version 2 (or later) are signed over the canonical form of the
+// signed file, i.e. with line endings normalized to LF and trailing whitespace removed from each line, so that
+// logically identical files verify regardless of the platform that created or unpacked them.
+const CANONICAL_VERSION = 2
+
+func canonicalize(b []byte) []byte {
+	b = bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))
+	b = bytes.ReplaceAll(b, []byte("\r"), []byte("\n"))
+
+	return regexp.MustCompile(`(?m)[ \t]+$`).ReplaceAll(b, []byte{})
+}
+
+// Strips a leading UTF-8 byte order mark and normalizes CRLF and CR line endings to LF, e.g. for ACL files exported
+// from Excel on Windows. Applied after the signature has been verified, so it doesn't affect the signed bytes.
+func normalizeText(b []byte) []byte {
+	b = bytes.TrimPrefix(b, []byte("\xef\xbb\xbf"))
+	b = bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))
+
+	return bytes.ReplaceAll(b, []byte("\r"), []byte("\n"))
+}
+
+func isCanonical(files map[string][]byte) bool {
+	if b, ok := files["version"]; ok {
+		if version, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil {
+			return version >= CANONICAL_VERSION
+		}
+	}
+
+	return false
+}
+
+// Returns the bytes over which the signature for a bundle file was created. Bundles without 'version' or 'timestamp'
+// entries are signed over the file exactly as stored. Otherwise the signature is created over a manifest of the
+// (canonical) file, the 'version' entry and the 'timestamp' entry, each prefixed with a '<name> <length>' line, so
+// that bytes can't be moved between the entries without invalidating the signature. Signing the version means it
+// can't be changed (or removed) to select a different verification scheme.
+func signable(files map[string][]byte, b []byte) []byte {
+	if isCanonical(files) {
+		b = canonicalize(b)
+	}
+
+	version, versioned := files["version"]
+	timestamp, timestamped := files[TIMESTAMP_FILE]
+
+	if !versioned && !timestamped {
+		return append([]byte{}, b...)
+	}
+
+	var signed bytes.Buffer
+
+	manifest := func(name string, content []byte) {
+		fmt.Fprintf(&signed, "%v %v\n", name, len(content))
+		signed.Write(content)
+	}
+
+	manifest("file", b)
+
+	if versioned {
+		manifest("version", version)
+	}
+
+	if timestamped {
+		manifest(TIMESTAMP_FILE, timestamp)
+	}
+
+	return signed.Bytes()
+}
+
+// Validates a 'version' or 'timestamp' entry unpacked from a signed bundle.
+func checkBundleEntry(name string, b []byte) error {
+	switch name {
+	case "version":
+		if version, err := strconv.Atoi(strings.TrimSpace(string(b))); err != nil || version < 1 {
+			return fmt.Errorf("Invalid 'version' entry '%v'", strings.TrimSpace(string(b)))
+		}
+
+	case TIMESTAMP_FILE:
+		if _, err := time.Parse(time.RFC3339, strings.TrimSpace(string(b))); err != nil {
+			return fmt.Errorf("Invalid 'timestamp' entry '%v'", strings.TrimSpace(string(b)))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,237 @@
+package commands
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uhppoted/uhppote-core/uhppote"
+)
+
+func TestFetchACLWithBOMAndCRLF(t *testing.T) {
+	fixture, err := ioutil.ReadFile(filepath.Join("testdata", "bom-crlf.tsv"))
+	if err != nil {
+		t.Fatalf("Error reading test fixture (%v)", err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/hogwarts.tsv", "/uhppoted/hogwarts.tsv":
+			w.Header().Set("Content-Length", fmt.Sprintf("%v", len(fixture)))
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%v/%v", len(fixture)-1, len(fixture)))
+			w.Write(fixture)
+
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	defer srv.Close()
+
+	credentials := filepath.Join(t.TempDir(), "credentials")
+	if err := ioutil.WriteFile(credentials, []byte("[default]\naws_access_key_id = AKIAEXAMPLE\naws_secret_access_key = secret\n"), 0600); err != nil {
+		t.Fatalf("Error writing AWS credentials file (%v)", err)
+	}
+
+	devices := []uhppote.Device{
+		*uhppote.NewDevice("Alpha", 12345, nil, 0, []string{"Great Hall", "Kitchen", "Dungeon", "Hogsmeade"}),
+	}
+
+	tests := map[string]string{
+		"HTTP": srv.URL + "/hogwarts.tsv",
+		"S3":   "s3://uhppoted/hogwarts.tsv",
+	}
+
+	for name, uri := range tests {
+		cmd := CompareACLCmd
+		cmd.ctx = context.Background()
+		cmd.noverify = true
+		cmd.retry = retryPolicy{}
+		cmd.credentials = credentials
+		cmd.profile = "default"
+		cmd.region = "us-east-1"
+		cmd.endpoint = s3Endpoint{url: srv.URL, pathStyle: true}
+
+		list, _, err := cmd.fetchACL(uri, devices, log.New(ioutil.Discard, "", 0))
+		if err != nil {
+			t.Fatalf("%v: unexpected error fetching ACL with BOM and CRLF line endings (%v)", name, err)
+		}
+
+		cards := list[12345]
+		if len(cards) != 2 {
+			t.Fatalf("%v: incorrect number of cards - expected:2, got:%v (%v)", name, len(cards), cards)
+		}
+
+		if card, ok := cards[8165538]; !ok {
+			t.Errorf("%v: missing card 8165538", name)
+		} else if card.Doors[1] != 1 || card.Doors[2] != 0 {
+			t.Errorf("%v: incorrect doors for card 8165538 - expected:[Y N], got:%v", name, card.Doors)
+		}
+
+		if card, ok := cards[8165539]; !ok {
+			t.Errorf("%v: missing card 8165539", name)
+		} else if card.Doors[1] != 0 || card.Doors[2] != 29 {
+			t.Errorf("%v: incorrect doors for card 8165539 - expected:[N 29], got:%v", name, card.Doors)
+		}
+	}
+}
+
+func TestSignableIncludesVersion(t *testing.T) {
+	tsv := []byte("Card Number\tFrom\tTo\tGreat Hall  \r\n8165538\t2021-01-01\t2021-12-31\tY\r\n")
+	canonical := "Card Number\tFrom\tTo\tGreat Hall\n8165538\t2021-01-01\t2021-12-31\tY\n"
+	timestamp := []byte("2026-10-15T09:30:00Z\n")
+
+	tests := map[string]struct {
+		files    map[string][]byte
+		expected string
+	}{
+		"unversioned": {
+			files:    map[string][]byte{},
+			expected: string(tsv),
+		},
+		"version 2": {
+			files:    map[string][]byte{"version": []byte("2\n")},
+			expected: "file 63\n" + canonical + "version 2\n2\n",
+		},
+		"version 2 with timestamp": {
+			files:    map[string][]byte{"version": []byte("2\n"), TIMESTAMP_FILE: timestamp},
+			expected: "file 63\n" + canonical + "version 2\n2\n" + "timestamp 21\n2026-10-15T09:30:00Z\n",
+		},
+		"version 3": {
+			files:    map[string][]byte{"version": []byte("3\n")},
+			expected: "file 63\n" + canonical + "version 2\n3\n",
+		},
+		"timestamp only": {
+			files:    map[string][]byte{TIMESTAMP_FILE: timestamp},
+			expected: "file 67\n" + string(tsv) + "timestamp 21\n2026-10-15T09:30:00Z\n",
+		},
+	}
+
+	for name, test := range tests {
+		if signed := signable(test.files, tsv); string(signed) != test.expected {
+			t.Errorf("%v: incorrect signed content\n   expected:%q\n   got:     %q", name, test.expected, signed)
+		}
+	}
+}
+
+func TestSignableWithMovedBytes(t *testing.T) {
+	dir := t.TempDir()
+	keyfile := makeSigningKey(t, dir, "uhppoted")
+
+	acl := []byte("Card Number\tFrom\tTo\tGreat Hall\n8165538\t2021-01-01\t2021-12-31\tY\n8165539\t2021-01-01\t2021-12-31\tY\n")
+	files := map[string][]byte{
+		"version":      []byte("2\n"),
+		TIMESTAMP_FILE: []byte("2026-10-15T09:30:00Z\n"),
+	}
+
+	signature, err := sign(signable(files, acl), keyfile, "")
+	if err != nil {
+		t.Fatalf("Unexpected error signing ACL (%v)", err)
+	}
+
+	if _, err := verify("uhppoted", signable(files, acl), [][]byte{signature["signature"]}, dir); err != nil {
+		t.Fatalf("Unexpected error verifying signed ACL (%v)", err)
+	}
+
+	moved := []byte("8165539\t2021-01-01\t2021-12-31\tY\n")
+	truncated := bytes.TrimSuffix(acl, moved)
+
+	tests := map[string]map[string][]byte{
+		"version": {
+			"version":      append(append([]byte{}, moved...), files["version"]...),
+			TIMESTAMP_FILE: files[TIMESTAMP_FILE],
+		},
+		"timestamp": {
+			"version":      append(append([]byte{}, files["version"]...), moved...),
+			TIMESTAMP_FILE: files[TIMESTAMP_FILE],
+		},
+	}
+
+	for name, tampered := range tests {
+		if _, err := verify("uhppoted", signable(tampered, truncated), [][]byte{signature["signature"]}, dir); err == nil {
+			t.Errorf("%v: expected error verifying ACL with bytes moved into the '%v' entry", name, name)
+		}
+	}
+}
+
+// Creates an ed25519 key pair in the directory, returning the private key file. The public key is <dir>/<uname>.pub.
+func makeSigningKey(t *testing.T, dir, uname string) string {
+	pubkey, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating ed25519 key (%v)", err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("Error marshalling private key (%v)", err)
+	}
+
+	pub, err := x509.MarshalPKIXPublicKey(pubkey)
+	if err != nil {
+		t.Fatalf("Error marshalling public key (%v)", err)
+	}
+
+	keyfile := filepath.Join(dir, uname+".key")
+	if err := ioutil.WriteFile(keyfile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatalf("Error writing private key (%v)", err)
+	}
+
+	pubfile := filepath.Join(dir, uname+".pub")
+	if err := ioutil.WriteFile(pubfile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}), 0644); err != nil {
+		t.Fatalf("Error writing public key (%v)", err)
+	}
+
+	return keyfile
+}
+
+func TestUnpackRejectsDuplicateEntries(t *testing.T) {
+	entries := []struct {
+		name string
+		body string
+	}{
+		{"ACL", "Card Number\tFrom\tTo\tGreat Hall\n8165538\t2021-01-01\t2021-12-31\tY\n"},
+		{"signature", "signature"},
+		{"version", "2\n"},
+		{"version", "2\n"},
+	}
+
+	var tgz bytes.Buffer
+	gz := gzip.NewWriter(&tgz)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		tw.WriteHeader(&tar.Header{Name: e.name, Uname: "uhppoted", Mode: 0644, Size: int64(len(e.body))})
+		tw.Write([]byte(e.body))
+	}
+	tw.Close()
+	gz.Close()
+
+	var z bytes.Buffer
+	zw := zip.NewWriter(&z)
+	for _, e := range entries {
+		w, _ := zw.Create(e.name)
+		w.Write([]byte(e.body))
+	}
+	zw.Close()
+
+	if _, _, err := untar(bytes.NewReader(tgz.Bytes())); err == nil || !strings.Contains(err.Error(), "Multiple version files") {
+		t.Errorf("Expected 'Multiple version files' error unpacking tar.gz, got:%v", err)
+	}
+
+	if _, _, err := unzip(bytes.NewReader(z.Bytes())); err == nil || !strings.Contains(err.Error(), "Multiple version files") {
+		t.Errorf("Expected 'Multiple version files' error unpacking zip, got:%v", err)
+	}
+}
@@ -0,0 +1,237 @@
+package commands
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/uhppoted/uhppote-core/uhppote"
+	"github.com/uhppoted/uhppoted-lib/config"
+)
+
+var CheckCmd = Check{
+	config:      config.DefaultConfig,
+	credentials: DEFAULT_CREDENTIALS,
+	profile:     DEFAULT_PROFILE,
+	region:      DEFAULT_REGION,
+	role:        awsRole{duration: DEFAULT_ROLE_DURATION},
+	httpTimeout: DEFAULT_HTTP_TIMEOUT,
+	retry:       retryPolicy{retries: DEFAULT_RETRIES, delay: DEFAULT_RETRY_DELAY},
+	debug:       false,
+}
+
+type Check struct {
+	acl         string
+	rpt         string
+	config      string
+	credentials string
+	profile     string
+	region      string
+	role        awsRole
+	endpoint    s3Endpoint
+	proxy       string
+	httpTimeout time.Duration
+	httpAuth    httpAuth
+	httpTLS     httpTLS
+	retry       retryPolicy
+	noDevices   bool
+	debug       bool
+	ctx         context.Context
+}
+
+type checked struct {
+	target string
+	info   string
+	err    error
+}
+
+func (cmd *Check) Name() string {
+	return "check"
+}
+
+func (cmd *Check) FlagSet() *flag.FlagSet {
+	flagset := flag.NewFlagSet("check", flag.ExitOnError)
+
+	flagset.StringVar(&cmd.acl, "acl", cmd.acl, "The URL of the ACL file to check (s3://, http(s):// or file://)")
+	flagset.StringVar(&cmd.rpt, "report", cmd.rpt, "The URL of the report file (checks that the s3:// bucket is accessible)")
+	flagset.StringVar(&cmd.credentials, "credentials", cmd.credentials, "AWS credentials file (or profile://<name> to use the credentials and region for the named profile in the shared AWS config)")
+	flagset.StringVar(&cmd.profile, "profile", cmd.profile, "AWS credentials file profile (defaults to 'default')")
+	flagset.StringVar(&cmd.region, "region", cmd.region, "AWS region for S3 (defaults to us-east-1)")
+	flagset.StringVar(&cmd.role.arn, "role-arn", cmd.role.arn, "ARN of an IAM role to assume (using STS AssumeRole) for S3 access e.g. for cross-account access")
+	flagset.StringVar(&cmd.role.externalID, "external-id", cmd.role.externalID, "External ID for assuming the --role-arn role")
+	flagset.DurationVar(&cmd.role.duration, "role-duration", cmd.role.duration, "Session duration for the assumed --role-arn role (credentials are refreshed automatically when they expire)")
+	flagset.StringVar(&cmd.endpoint.url, "endpoint", cmd.endpoint.url, "Custom S3 endpoint URL for S3 compatible stores e.g. http://minio.local:9000 (defaults to AWS S3)")
+	flagset.BoolVar(&cmd.endpoint.pathStyle, "path-style", cmd.endpoint.pathStyle, "Uses path-style (http://host/bucket/key) rather than virtual-hosted style S3 addressing (e.g. for MinIO)")
+	flagset.StringVar(&cmd.proxy, "proxy", cmd.proxy, "HTTP proxy URL for HTTP and S3 requests (overrides the HTTP_PROXY and HTTPS_PROXY environment variables, NO_PROXY still applies)")
+	flagset.DurationVar(&cmd.httpTimeout, "http-timeout", cmd.httpTimeout, "Timeout for HTTP requests (0 for no timeout)")
+	flagset.StringVar(&cmd.httpAuth.user, "http-user", cmd.httpAuth.user, "User name for HTTP basic auth (defaults to the UHPPOTED_HTTP_USER environment variable)")
+	flagset.StringVar(&cmd.httpAuth.password, "http-password", cmd.httpAuth.password, "Password for HTTP basic auth (defaults to the UHPPOTED_HTTP_PASSWORD environment variable)")
+	flagset.StringVar(&cmd.httpAuth.bearer, "http-bearer", cmd.httpAuth.bearer, "Bearer token for HTTP requests (defaults to the UHPPOTED_HTTP_BEARER environment variable)")
+	flagset.StringVar(&cmd.httpTLS.cert, "client-cert", cmd.httpTLS.cert, "PEM client certificate file for mutual TLS with https:// servers")
+	flagset.StringVar(&cmd.httpTLS.key, "client-key", cmd.httpTLS.key, "PEM private key file for the --client-cert client certificate")
+	flagset.StringVar(&cmd.httpTLS.ca, "ca-cert", cmd.httpTLS.ca, "PEM CA certificates file for verifying https:// server certificates (defaults to the system CA certificates)")
+	flagset.IntVar(&cmd.retry.retries, "retries", cmd.retry.retries, "Number of times to retry an S3 or HTTP request after a transient failure (5xx response, connection reset or timeout)")
+	flagset.DurationVar(&cmd.retry.delay, "retry-delay", cmd.retry.delay, "Delay before the first retry of a failed S3 or HTTP request, doubling (with jitter) for each subsequent retry")
+	flagset.BoolVar(&cmd.noDevices, "no-controllers", cmd.noDevices, "Skips the controller checks")
+
+	return flagset
+}
+
+func (cmd *Check) Description() string {
+	return fmt.Sprintf("Checks that the ACL and report URLs and the configured controllers are reachable")
+}
+
+func (cmd *Check) Usage() string {
+	return "check [--acl <URL>] [--report <URL>]"
+}
+
+func (cmd *Check) Help() {
+	fmt.Println()
+	fmt.Printf("  Usage: %s [--debug] [--config <file>] check [--acl <URL>] [--report <URL>] [--credentials <file>] [--profile <file>] [--region <region>] [--role-arn <ARN>] [--external-id <ID>] [--role-duration <duration>] [--endpoint <URL>] [--path-style] [--proxy <URL>] [--http-timeout <duration>] [--http-user <user>] [--http-password <password>] [--http-bearer <token>] [--client-cert <file>] [--client-key <file>] [--ca-cert <file>] [--retries <N>] [--retry-delay <duration>] [--no-controllers]\n", APP)
+	fmt.Println()
+	fmt.Println("    Preflight check for scheduled jobs. Checks that the S3 bucket (and object) of s3:// --acl and --report URLs")
+	fmt.Println("    are accessible with the AWS credentials (HeadBucket and HeadObject), that http(s):// --acl URLs respond to")
+	fmt.Println("    a HEAD request, that file:// --acl files exist and that each controller in the configuration file responds.")
+	fmt.Println("    Reports pass/fail for each target and exits with an error if any check fails.")
+	fmt.Println()
+
+	helpOptions(cmd.FlagSet())
+	fmt.Println()
+}
+
+func (cmd *Check) Execute(args ...interface{}) error {
+	options := args[0].(*Options)
+
+	cmd.config = options.Config
+	cmd.debug = options.Debug
+	cmd.ctx = options.ctx()
+	cmd.retry.log = log.New(os.Stdout, "  ", 0)
+
+	if err := setProxy(cmd.proxy); err != nil {
+		return err
+	}
+
+	if err := setClientTLS(cmd.httpTLS); err != nil {
+		return err
+	}
+
+	conf := config.NewConfig()
+	if err := conf.Load(cmd.config); err != nil {
+		return fmt.Errorf("WARN  Could not load configuration (%v)", err)
+	}
+
+	if cmd.credentials == "" {
+		cmd.credentials = conf.AWS.Credentials
+	}
+
+	if cmd.profile == "" {
+		cmd.profile = conf.AWS.Profile
+	}
+
+	if cmd.region == "" && !isProfileURI(cmd.credentials) {
+		cmd.region = conf.AWS.Region
+	}
+
+	if err := cmd.httpAuth.resolve(); err != nil {
+		return err
+	}
+
+	results := []checked{}
+
+	if uri := strings.TrimSpace(cmd.acl); uri != "" {
+		results = append(results, cmd.checkURL(fileURI(uri)))
+	}
+
+	if uri := strings.TrimSpace(cmd.rpt); strings.HasPrefix(uri, "s3://") {
+		bucket := strings.SplitN(strings.TrimPrefix(uri, "s3://"), "/", 2)[0]
+		results = append(results, cmd.checkURL("s3://"+bucket))
+	}
+
+	if !cmd.noDevices {
+		u, devices := getDevices(conf, cmd.debug)
+		results = append(results, cmd.checkDevices(u, devices)...)
+	}
+
+	if len(results) == 0 {
+		return fmt.Errorf("Nothing to check (no --acl or --report URL and no configured controllers)")
+	}
+
+	width := 0
+	for _, r := range results {
+		if len(r.target) > width {
+			width = len(r.target)
+		}
+	}
+
+	failed := 0
+
+	fmt.Println()
+	for _, r := range results {
+		if r.err != nil {
+			failed++
+			fmt.Printf("  %-*v  FAILED  %v\n", width, r.target, strings.Join(strings.Fields(r.err.Error()), " "))
+		} else if r.info != "" {
+			fmt.Printf("  %-*v  ok      %v\n", width, r.target, r.info)
+		} else {
+			fmt.Printf("  %-*v  ok\n", width, r.target)
+		}
+	}
+	fmt.Println()
+
+	if failed > 0 {
+		return fmt.Errorf("%v of %v checks failed", failed, len(results))
+	}
+
+	return nil
+}
+
+func (cmd *Check) checkURL(uri string) checked {
+	switch {
+	case strings.HasPrefix(uri, "s3://"):
+		err := headS3(cmd.ctx, uri, cmd.credentials, cmd.profile, cmd.region, cmd.endpoint, cmd.role, cmd.retry)
+		return checked{target: uri, err: err}
+
+	case strings.HasPrefix(uri, "http://"), strings.HasPrefix(uri, "https://"):
+		status, err := headHTTP(cmd.ctx, uri, cmd.httpTimeout, cmd.httpAuth, cmd.retry)
+		return checked{target: uri, info: status, err: err}
+
+	case strings.HasPrefix(uri, "file://"):
+		path, err := filePath(uri)
+		if err == nil {
+			_, err = os.Stat(path)
+		}
+
+		return checked{target: uri, err: err}
+
+	default:
+		return checked{target: uri, err: fmt.Errorf("check only supports s3://, http(s):// and file:// URLs")}
+	}
+}
+
+// Contacts each configured controller (a 'get cards' request, which also confirms that the controller will
+// respond to the ACL requests).
+func (cmd *Check) checkDevices(u uhppote.IUHPPOTE, devices []uhppote.Device) []checked {
+	sort.Slice(devices, func(i, j int) bool { return devices[i].DeviceID < devices[j].DeviceID })
+
+	results := []checked{}
+	for _, d := range devices {
+		target := fmt.Sprintf("%v", d.DeviceID)
+		if d.Name != "" {
+			target = fmt.Sprintf("%v (%v)", d.DeviceID, d.Name)
+		}
+
+		start := time.Now()
+		if N, err := u.GetCards(d.DeviceID); err != nil {
+			results = append(results, checked{target: target, err: err})
+		} else {
+			results = append(results, checked{target: target, info: fmt.Sprintf("cards:%v  latency:%v", N, time.Since(start).Round(time.Millisecond))})
+		}
+	}
+
+	return results
+}
@@ -1,15 +1,37 @@
 package commands
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"log"
 )
 
 const APP = "uhppoted-app-s3"
 
 type Options struct {
-	Config string
-	Debug  bool
+	Config  string
+	Debug   bool
+	Context context.Context
+}
+
+// Returns the command context, defaulting to context.Background() if the caller did not provide one.
+func (o *Options) ctx() context.Context {
+	if o.Context == nil {
+		return context.Background()
+	}
+
+	return o.Context
+}
+
+// Logs a cancelled (e.g. Ctrl-C) command as aborted. Any error is returned unchanged.
+func aborted(cmd string, err error, log *log.Logger) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		log.Printf("WARN  %v aborted (%v)", cmd, err)
+	}
+
+	return err
 }
 
 func helpOptions(flagset *flag.FlagSet) {
@@ -2,60 +2,184 @@ package commands
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/url"
 	"os"
+	"path"
 	"strings"
 	"time"
 
+	"github.com/uhppoted/uhppote-core/types"
 	"github.com/uhppoted/uhppote-core/uhppote"
 	"github.com/uhppoted/uhppoted-lib/acl"
 	"github.com/uhppoted/uhppoted-lib/config"
-	"github.com/uhppoted/uhppoted-lib/eventlog"
 )
 
 var CompareACLCmd = CompareACL{
 	config:      config.DefaultConfig,
+	inputFormat: "auto",
+	onDuplicate: "warn",
+	onConflict:  "error",
 	keysdir:     DEFAULT_KEYSDIR,
 	keyfile:     DEFAULT_KEYFILE,
 	credentials: DEFAULT_CREDENTIALS,
 	profile:     DEFAULT_PROFILE,
 	region:      DEFAULT_REGION,
+	role:        awsRole{duration: DEFAULT_ROLE_DURATION},
+	multipart:   s3Multipart{partSize: DEFAULT_PART_SIZE, concurrency: DEFAULT_UPLOAD_CONCURRENCY},
+	httpTimeout: DEFAULT_HTTP_TIMEOUT,
+	retry:       retryPolicy{retries: DEFAULT_RETRIES, delay: DEFAULT_RETRY_DELAY},
 	logFile:     DEFAULT_LOGFILE,
 	logFileSize: DEFAULT_LOGFILESIZE,
+	logFormat:   DEFAULT_LOG_FORMAT,
+	logMaxFiles: DEFAULT_LOG_MAX_FILES,
+	logMaxAge:   DEFAULT_LOG_MAX_AGE,
+	doorsAs:     "columns",
+	format:      "text",
+	reportName:  DEFAULT_REPORT_NAME,
+	parallel:    1,
+	concurrency: 1,
+	failOnDiff:  false,
+	staleness:   15 * time.Minute,
 	noverify:    false,
 	nolog:       false,
 	debug:       false,
+	ldap: ldapSource{
+		cardAttr: "employeeID",
+	},
 	template: `ACL DIFF REPORT {{ .DateTime }}
 {{range $id,$value := .Diffs}}
-  DEVICE {{ $id }}{{if or $value.Updated $value.Added $value.Deleted}}{{else}} OK{{end}}{{if $value.Updated}}
-    Incorrect:  {{range $value.Updated}}{{.}}
+  DEVICE {{with index $.Devices $id}}{{ . }}{{else}}{{ $id }}{{end}}{{with index $.Overflow $id}} CAPACITY EXCEEDED
+    Authoritative ACL has {{ .Cards }} cards but the controller can only store {{ .Capacity }} cards{{end}}{{if index $.Review $id}} NEEDS MANUAL REVIEW
+    Unexpected cards exceed the --max-unexpected limit ({{ len $value.Deleted }} unexpected cards){{end}}{{if index $.Skipped $id}} NOT CHECKED
+    Controller ACL not retrieved before the --controllers-timeout-budget was exhausted{{end}}{{with index $.Errors $id}} UNREACHABLE
+    {{ . }}{{end}}{{if or $value.Updated $value.Added $value.Deleted}}{{else if not (or (index $.Overflow $id) (index $.Review $id) (index $.Skipped $id) (index $.Errors $id))}} OK{{end}}{{if index $.Overflow $id}}{{if or $value.Updated $value.Added $value.Deleted}}
+    Not listed: {{ len $value.Updated }} incorrect, {{ len $value.Added }} missing, {{ len $value.Deleted }} unexpected cards{{end}}{{else}}{{if $value.Updated}}
+    Incorrect:  {{range $value.Updated}}{{.}}{{with index $.Trend $id .CardNumber}}  {{ . }}{{end}}
                 {{end}}{{end}}{{if $value.Added}}
-    Missing:    {{range $value.Added}}{{.}}
+    Missing:    {{range $value.Added}}{{.}}{{with index $.Trend $id .CardNumber}}  {{ . }}{{end}}
                 {{end}}{{end}}{{if $value.Deleted}}
-    Unexpected: {{range $value.Deleted}}{{.}}
-                {{end}}{{end}}{{end}}
-`,
+    Unexpected: {{range $value.Deleted}}{{.}}{{with index $.Trend $id .CardNumber}}  {{ . }}{{end}}
+                {{end}}{{end}}{{end}}{{end}}
+{{if .Changes}}
+CONTROLLER CHANGES SINCE PREVIOUS RUN
+{{range $id,$value := .Changes}}
+  DEVICE {{with index $.Devices $id}}{{ . }}{{else}}{{ $id }}{{end}}{{if $value.Updated}}
+    Changed:     {{range $value.Updated}}{{.}}
+                 {{end}}{{end}}{{if $value.Added}}
+    Appeared:    {{range $value.Added}}{{.}}
+                 {{end}}{{end}}{{if $value.Deleted}}
+    Disappeared: {{range $value.Deleted}}{{.}}
+                 {{end}}{{end}}{{end}}
+{{end}}{{if .Duplicates}}
+DUPLICATE CARD NUMBERS IN THE AUTHORITATIVE ACL
+{{range .Duplicates}}
+  {{ . }}{{end}}
+{{end}}`,
 }
 
 type CompareACL struct {
-	acl         string
+	acl         urlList
 	rpt         string
 	config      string
 	keysdir     string
+	decryptKey  string
+	ca          string
 	keyfile     string
+	passphrase  string
+	cert        string
 	credentials string
+	gcsCreds    string
+	azure       azureAuth
+	sftp        sftpAuth
 	profile     string
 	region      string
+	fallback    string
+	role        awsRole
+	endpoint    s3Endpoint
+	proxy       string
+	httpTimeout time.Duration
+	httpAuth    httpAuth
+	httpTLS     httpTLS
+	retry       retryPolicy
+	encryption  s3Encryption
+	multipart   s3Multipart
+	tags        s3Tags
+	cacheCtrl   string
+	archive     string
+	compression string
 	logFile     string
 	logFileSize int
+	logFormat   string
+	logMaxFiles int
+	logMaxAge   int
 	template    string
+	doorsAs     string
+	inputFormat string
+	delimiter   string
+	format      string
+	tmplFile    string
+	reportName  string
+	firstCard   uint
+	lastCard    uint
+	activeFrom  string
+	activeTo    string
+	window      dateWindow
+	onlyDevice  stringList
+	ignoreDoor  stringList
+	ignored     map[uint32]map[uint8]bool
+	maxCards    uint
+	maxDeleted  uint
+	metrics     string
+	metricsFile string
+	summary     string
+	webhook     webhook
+	smtp        smtpOptions
+	pushgateway string
+	state       string
+	previous    string
+	cache       string
+	staleness   time.Duration
+	budget      time.Duration
+	concurrency int
+	batch       string
+	parallel    int
+	failFast    bool
+	collectAll  bool
+	disabledOk  bool
+	onDuplicate string
+	onConflict  string
+	normalize   bool
+	hexCards    bool
+	failOnDiff  bool
+	skipNoDiff  bool
+	inclusive   bool
 	noverify    bool
+	nodevicesOk bool
+	offlineOk   bool
+	readback    bool
+	includeRaw  bool
+	canonical   bool
+	remediation string
+	nameMap     string
+	dump        string
+	checksum    string
+	maxAge      time.Duration
+	retain      int
 	nolog       bool
 	debug       bool
+	progress    bool
+	ctx         context.Context
+	levels      accessLevels
+	names       deviceNames
+	duplicates  []Duplicate
+	ldap        ldapSource
 }
 
 func (cmd *CompareACL) Name() string {
@@ -65,15 +189,119 @@ func (cmd *CompareACL) Name() string {
 func (cmd *CompareACL) FlagSet() *flag.FlagSet {
 	flagset := flag.NewFlagSet("compare-acl", flag.ExitOnError)
 
-	flagset.StringVar(&cmd.acl, "acl", cmd.acl, "The URL for the authoritative ACL file")
+	flagset.Var(&cmd.acl, "acl", "The URL for the authoritative ACL file (or '-' to read the ACL file from stdin). May be repeated to merge multiple ACL files into the authoritative ACL")
 	flagset.StringVar(&cmd.rpt, "report", cmd.rpt, "The URL for the uploaded report file")
-	flagset.StringVar(&cmd.credentials, "credentials", cmd.credentials, "AWS credentials file")
+	flagset.IntVar(&cmd.retain, "retain", cmd.retain, "Deletes all but the most recent N report files under the s3:// report prefix after a successful upload (0 retains all the report files). Not valid with a custom --report-name")
+	flagset.StringVar(&cmd.archive, "archive", cmd.archive, "Archive format for the uploaded report file ('tar.gz' or 'zip'). Defaults to zip if the URL ends with .zip and tar.gz otherwise")
+	flagset.StringVar(&cmd.compression, "compression", cmd.compression, "Compression level for the uploaded archive (0-9, or 'none' for an uncompressed tar or stored zip). Defaults to the gzip default compression level")
+	flagset.StringVar(&cmd.credentials, "credentials", cmd.credentials, "AWS credentials file (or profile://<name> to use the credentials and region for the named profile in the shared AWS config)")
+	flagset.StringVar(&cmd.gcsCreds, "gcs-credentials", cmd.gcsCreds, "Google Cloud service account JSON credentials file for gs:// URLs (defaults to the application default credentials e.g. GOOGLE_APPLICATION_CREDENTIALS)")
+	flagset.StringVar(&cmd.azure.account, "azure-account", cmd.azure.account, "Azure storage account for az:// URLs (defaults to the AZURE_STORAGE_ACCOUNT environment variable)")
+	flagset.StringVar(&cmd.azure.key, "azure-key", cmd.azure.key, "Azure storage account shared key (defaults to the AZURE_STORAGE_KEY environment variable)")
+	flagset.StringVar(&cmd.azure.sas, "azure-sas", cmd.azure.sas, "Azure SAS token for az:// and blob.core.windows.net URLs (defaults to the AZURE_STORAGE_SAS_TOKEN environment variable)")
+	flagset.StringVar(&cmd.azure.connection, "azure-connection-string", cmd.azure.connection, "Azure storage connection string (defaults to the AZURE_STORAGE_CONNECTION_STRING environment variable)")
+	flagset.StringVar(&cmd.sftp.key, "ssh-key", cmd.sftp.key, "SSH private key file for sftp:// URLs (the passphrase for an encrypted key is taken from the SSH_KEY_PASSPHRASE environment variable)")
+	flagset.StringVar(&cmd.sftp.knownHosts, "known-hosts", cmd.sftp.knownHosts, "SSH known_hosts file used to verify the SFTP server host key (defaults to ~/.ssh/known_hosts)")
 	flagset.StringVar(&cmd.profile, "profile", cmd.profile, "AWS credentials file profile (defaults to 'default')")
 	flagset.StringVar(&cmd.region, "region", cmd.region, "AWS region for S3 (defaults to us-east-1)")
-	flagset.StringVar(&cmd.keysdir, "keys", cmd.keysdir, "Sets the directory to search for RSA signing keys. Key files are expected to be named '<uname>.pub'")
-	flagset.StringVar(&cmd.keyfile, "key", cmd.keyfile, "RSA signing key")
+	flagset.StringVar(&cmd.fallback, "region-fallback", cmd.fallback, "Comma separated list of AWS regions to try in order if the ACL file S3 bucket is not in the --region region (the bucket region is detected automatically if possible)")
+	flagset.StringVar(&cmd.role.arn, "role-arn", cmd.role.arn, "ARN of an IAM role to assume (using STS AssumeRole) for S3 access e.g. for cross-account access")
+	flagset.StringVar(&cmd.role.externalID, "external-id", cmd.role.externalID, "External ID for assuming the --role-arn role")
+	flagset.DurationVar(&cmd.role.duration, "role-duration", cmd.role.duration, "Session duration for the assumed --role-arn role (credentials are refreshed automatically when they expire)")
+	flagset.StringVar(&cmd.endpoint.url, "endpoint", cmd.endpoint.url, "Custom S3 endpoint URL for S3 compatible stores e.g. http://minio.local:9000 (defaults to AWS S3)")
+	flagset.BoolVar(&cmd.endpoint.pathStyle, "path-style", cmd.endpoint.pathStyle, "Uses path-style (http://host/bucket/key) rather than virtual-hosted style S3 addressing (e.g. for MinIO)")
+	flagset.StringVar(&cmd.proxy, "proxy", cmd.proxy, "HTTP proxy URL for HTTP and S3 requests (overrides the HTTP_PROXY and HTTPS_PROXY environment variables, NO_PROXY still applies)")
+	flagset.DurationVar(&cmd.httpTimeout, "http-timeout", cmd.httpTimeout, "Timeout for HTTP requests, including reading the response body (0 for no timeout)")
+	flagset.StringVar(&cmd.httpAuth.user, "http-user", cmd.httpAuth.user, "User name for HTTP basic auth (defaults to the UHPPOTED_HTTP_USER environment variable)")
+	flagset.StringVar(&cmd.httpAuth.password, "http-password", cmd.httpAuth.password, "Password for HTTP basic auth (defaults to the UHPPOTED_HTTP_PASSWORD environment variable)")
+	flagset.StringVar(&cmd.httpAuth.bearer, "http-bearer", cmd.httpAuth.bearer, "Bearer token for HTTP requests (defaults to the UHPPOTED_HTTP_BEARER environment variable)")
+	flagset.StringVar(&cmd.httpTLS.cert, "client-cert", cmd.httpTLS.cert, "PEM client certificate file for mutual TLS with https:// servers")
+	flagset.StringVar(&cmd.httpTLS.key, "client-key", cmd.httpTLS.key, "PEM private key file for the --client-cert client certificate")
+	flagset.StringVar(&cmd.httpTLS.ca, "ca-cert", cmd.httpTLS.ca, "PEM CA certificates file for verifying https:// server certificates (defaults to the system CA certificates)")
+	flagset.IntVar(&cmd.retry.retries, "retries", cmd.retry.retries, "Number of times to retry an S3 or HTTP request after a transient failure (5xx response, connection reset or timeout)")
+	flagset.DurationVar(&cmd.retry.delay, "retry-delay", cmd.retry.delay, "Delay before the first retry of a failed S3 or HTTP request, doubling (with jitter) for each subsequent retry")
+	flagset.StringVar(&cmd.encryption.sse, "sse", cmd.encryption.sse, "Server-side encryption for uploaded S3 objects ('AES256' or 'aws:kms')")
+	flagset.StringVar(&cmd.encryption.kmsKeyID, "sse-kms-key-id", cmd.encryption.kmsKeyID, "KMS key ID for 'aws:kms' server-side encryption (defaults to the AWS managed key)")
+	flagset.IntVar(&cmd.multipart.partSize, "part-size", cmd.multipart.partSize, "Part size (in MiB) for multipart S3 uploads. Smaller files are uploaded with a single PUT request")
+	flagset.IntVar(&cmd.multipart.concurrency, "upload-concurrency", cmd.multipart.concurrency, "Number of parts of a multipart S3 upload to upload concurrently")
+	flagset.Var(&cmd.tags, "tag", "S3 object tag (key=value) for uploaded S3 objects (may be repeated, up to 10 tags)")
+	flagset.StringVar(&cmd.cacheCtrl, "cache-control", cmd.cacheCtrl, "Cache-Control header for uploaded S3 objects e.g. 'no-cache' or 'max-age=300'")
+	flagset.StringVar(&cmd.keysdir, "keys", cmd.keysdir, "Sets the directory to search for RSA or ed25519 signing keys. Key files are expected to be named '<uname>.pub' (and '<uname>/*.pub' for additional e.g. rotated keys)")
+	flagset.StringVar(&cmd.decryptKey, "decrypt-key", cmd.decryptKey, "RSA private key file for decrypting ACL files encrypted with store-acl --encrypt-to (the passphrase for an encrypted key is taken from the UHPPOTED_DECRYPT_KEY_PASSPHRASE environment variable)")
+	flagset.StringVar(&cmd.checksum, "checksum", cmd.checksum, "SHA-256 checksum (hex digest or URL of a .sha256 file) for verifying the downloaded ACL file before it is unpacked")
+	flagset.DurationVar(&cmd.maxAge, "max-age", cmd.maxAge, "Rejects an ACL file with a signed timestamp older than the maximum age e.g. 24h (defaults to 0 i.e. the timestamp is not checked)")
+	flagset.StringVar(&cmd.ca, "ca", cmd.ca, "PEM file with the trusted CA certificates for verifying the ACL signing certificate chain (replaces --keys)")
+	flagset.StringVar(&cmd.keyfile, "key", cmd.keyfile, "RSA or ed25519 signing key (or a comma separated list of keys to attach multiple signatures e.g. during key rotation)")
+	flagset.StringVar(&cmd.passphrase, "key-passphrase", cmd.passphrase, "Passphrase for an encrypted signing key (defaults to the UHPPOTED_KEY_PASSPHRASE environment variable)")
+	flagset.StringVar(&cmd.cert, "cert", cmd.cert, "PEM file with the signing key certificate chain to include in the uploaded file")
+	flagset.StringVar(&cmd.ldap.url, "ldap-url", cmd.ldap.url, "LDAP server URL (e.g. ldaps://ad.example.com) from which to build the authoritative ACL from group memberships (replaces --acl)")
+	flagset.StringVar(&cmd.ldap.baseDN, "ldap-base-dn", cmd.ldap.baseDN, "LDAP base DN for the user search")
+	flagset.StringVar(&cmd.ldap.bindDN, "ldap-bind-dn", cmd.ldap.bindDN, "LDAP bind DN (the password is taken from the UHPPOTED_LDAP_PASSWORD environment variable)")
+	flagset.StringVar(&cmd.ldap.cardAttr, "ldap-card-attribute", cmd.ldap.cardAttr, "LDAP user attribute with the card number (defaults to employeeID)")
+	flagset.StringVar(&cmd.ldap.from, "ldap-valid-from", cmd.ldap.from, "Card start date (YYYY-MM-DD) for cards retrieved from LDAP")
+	flagset.StringVar(&cmd.ldap.to, "ldap-valid-until", cmd.ldap.to, "Card end date (YYYY-MM-DD) for cards retrieved from LDAP")
+	flagset.StringVar(&cmd.inputFormat, "input-format", cmd.inputFormat, "ACL file format ('auto', 'tsv', 'csv' or 'json'). 'auto' detects JSON and CSV ACL files from the .json or .csv extension of the URL or of the ACL file in the archive")
+	flagset.StringVar(&cmd.delimiter, "delimiter", cmd.delimiter, "Field delimiter for TSV and CSV ACL files ('tab', ',', ';' or any single character). Defaults to a tab, or a comma for CSV ACL files")
+	flagset.StringVar(&cmd.doorsAs, "doors-as", cmd.doorsAs, "Door permissions format of the authoritative ACL ('columns' or 'bitmask')")
+	flagset.StringVar(&cmd.tmplFile, "template", cmd.tmplFile, "Go text/template file for the text report (or html/template file for the html report), defaults to the built-in report template")
+	flagset.StringVar(&cmd.reportName, "report-name", cmd.reportName, "Report file name, either a Go time format for the local time or a text/template with {{.Date}}, {{.Time}} (UTC), {{.Device}}, {{.UTC}} and {{.Local}} fields. The report format extension is appended if missing")
+	flagset.StringVar(&cmd.format, "format", cmd.format, "Report format ('text', 'json' or 'html')")
+	flagset.UintVar(&cmd.firstCard, "first-card", cmd.firstCard, "Restricts the comparison to cards with card numbers from this card number (inclusive)")
+	flagset.UintVar(&cmd.lastCard, "last-card", cmd.lastCard, "Restricts the comparison to cards with card numbers up to this card number (inclusive)")
+	flagset.StringVar(&cmd.activeFrom, "active-from", cmd.activeFrom, "Restricts the comparison to cards that are valid on or after this date (YYYY-MM-DD, 'today' or +/-<days>d)")
+	flagset.StringVar(&cmd.activeTo, "active-to", cmd.activeTo, "Restricts the comparison to cards that are valid on or before this date (YYYY-MM-DD, 'today' or +/-<days>d)")
+	flagset.Var(&cmd.onlyDevice, "only-device", "Restricts the comparison to the controller with this ID (repeatable or a comma separated list)")
+	flagset.Var(&cmd.ignoreDoor, "ignore-door", "Excludes a door from the comparison, either for all controllers ('<door>') or for a single controller ('<controller>:<door>'), where the door is a door number or name (repeatable or a comma separated list)")
+	flagset.UintVar(&cmd.maxCards, "max-cards-per-device", cmd.maxCards, "Maximum number of cards that a controller can store (reported as an overflow if exceeded by the authoritative ACL)")
+	flagset.UintVar(&cmd.maxDeleted, "max-unexpected", cmd.maxDeleted, "Maximum number of unexpected cards on a controller before the controller is flagged for manual review and excluded from the remediation script")
+	flagset.StringVar(&cmd.dump, "dump-acl", cmd.dump, "File to which to write the fetched (and verified) authoritative ACL TSV file, or '-' for stdout")
+	flagset.StringVar(&cmd.summary, "summary", cmd.summary, "URL (or local file) to which to write the JSON summary of the report counts")
+	flagset.StringVar(&cmd.webhook.url, "webhook", cmd.webhook.url, "URL to which to POST the report (in the --format format) after it has been uploaded")
+	flagset.StringVar(&cmd.webhook.contentType, "webhook-content-type", cmd.webhook.contentType, "Content-Type for the --webhook request (defaults to application/json for JSON reports and text/plain or text/html otherwise)")
+	flagset.StringVar(&cmd.webhook.auth, "webhook-auth", cmd.webhook.auth, "Authorization header value for the --webhook request e.g. 'Bearer <token>' (defaults to the UHPPOTED_WEBHOOK_AUTH environment variable)")
+	flagset.StringVar(&cmd.smtp.host, "smtp-host", cmd.smtp.host, "SMTP server to which to send the report by email")
+	flagset.IntVar(&cmd.smtp.port, "smtp-port", cmd.smtp.port, "SMTP server port (defaults to 25, or 465 with --smtp-tls)")
+	flagset.StringVar(&cmd.smtp.from, "smtp-from", cmd.smtp.from, "Sender address for the report email")
+	flagset.Var(&cmd.smtp.to, "smtp-to", "Recipient address for the report email (repeatable, or a comma separated list)")
+	flagset.StringVar(&cmd.smtp.user, "smtp-user", cmd.smtp.user, "SMTP user for authenticated SMTP")
+	flagset.StringVar(&cmd.smtp.password, "smtp-password", cmd.smtp.password, "SMTP password (defaults to the UHPPOTED_SMTP_PASSWORD environment variable)")
+	flagset.BoolVar(&cmd.smtp.tls, "smtp-tls", cmd.smtp.tls, "Connects to the SMTP server with TLS (SMTPS) rather than using STARTTLS")
+	flagset.BoolVar(&cmd.smtp.attach, "smtp-attach", cmd.smtp.attach, "Attaches the signed report file to the report email")
+	flagset.BoolVar(&cmd.webhook.errorsOk, "ignore-webhook-errors", cmd.webhook.errorsOk, "Logs a failed --webhook request as a warning rather than failing the command")
+	flagset.StringVar(&cmd.metrics, "openmetrics", cmd.metrics, "File to which to write the compare-acl metrics in OpenMetrics format")
+	flagset.StringVar(&cmd.metricsFile, "metrics-file", cmd.metricsFile, "File to which to write the compare-acl run metrics in Prometheus text format (e.g. for the node_exporter textfile collector)")
+	flagset.StringVar(&cmd.pushgateway, "pushgateway", cmd.pushgateway, "Prometheus pushgateway URL to which to push the compare-acl metrics")
+	flagset.StringVar(&cmd.state, "state", cmd.state, "File in which to persist the controller ACL for detecting controller changes between runs")
+	flagset.StringVar(&cmd.previous, "report-diff-against-previous", cmd.previous, "URL of the previous compare-acl report file (or drift.json file) against which to annotate the drift as NEW or RECURRING")
+	flagset.StringVar(&cmd.remediation, "emit-remediation", cmd.remediation, "File to which to write a (reviewable) script of uhppote-cli commands that would bring the controllers into compliance")
+	flagset.StringVar(&cmd.nameMap, "device-name-map", cmd.nameMap, "File that maps device IDs to friendly names for the report (defaults to the s3.device-name entries in the configuration file)")
+	flagset.StringVar(&cmd.cache, "acl-cache", cmd.cache, "URL of a shared ACL cache service from which to read the current controller ACL")
+	flagset.DurationVar(&cmd.staleness, "max-staleness", cmd.staleness, "Maximum age of a cached controller ACL before falling back to the controllers (defaults to 15m)")
+	flagset.DurationVar(&cmd.budget, "controllers-timeout-budget", cmd.budget, "Maximum total time for retrieving the controller ACLs, after which the remaining controllers are reported as 'not checked'")
+	flagset.StringVar(&cmd.batch, "batch", cmd.batch, "JSON file describing multiple compare jobs to run")
+	flagset.IntVar(&cmd.concurrency, "concurrency", cmd.concurrency, "Maximum number of controllers to retrieve the ACL from concurrently (defaults to 1, 0 for all the controllers at once)")
+	flagset.BoolVar(&cmd.progress, "progress", cmd.progress, "Logs the progress of the controller ACL retrieval (also enabled by --debug), as an updating progress line if stderr is a terminal")
+	flagset.IntVar(&cmd.parallel, "batch-concurrency", cmd.parallel, "Maximum number of batch jobs to run concurrently (defaults to 1)")
+	flagset.BoolVar(&cmd.failFast, "fail-fast", cmd.failFast, "Stops parsing the ACL file at the first invalid record (default)")
+	flagset.BoolVar(&cmd.collectAll, "collect-all", cmd.collectAll, "Reports all the invalid records in the ACL file rather than stopping at the first invalid record")
+	flagset.StringVar(&cmd.onDuplicate, "on-duplicate", cmd.onDuplicate, "Action for duplicate card numbers in the ACL: 'warn' (default), 'error' or 'merge' (merges the dates and door permissions)")
+	flagset.StringVar(&cmd.onConflict, "on-conflict", cmd.onConflict, "Action for cards in more than one --acl file: 'error' (default), 'last-wins' or 'union-doors' (merges the dates and door permissions)")
+	flagset.BoolVar(&cmd.normalize, "normalize-cards", cmd.normalize, "Normalizes the ACL card numbers to the canonical decimal form (no whitespace or leading zeros), ignoring records with invalid card numbers")
+	flagset.BoolVar(&cmd.hexCards, "hex-cards", cmd.hexCards, "Converts 0x prefixed hexadecimal ACL card numbers to decimal (implies --normalize-cards)")
+	flagset.BoolVar(&cmd.disabledOk, "match-disabled", cmd.disabledOk, "Treats a disabled (all doors denied) card as matching a disabled controller card even if the card dates differ")
+	flagset.BoolVar(&cmd.inclusive, "date-inclusive", cmd.inclusive, "Compares card dates as inclusive calendar dates (valid from the start of the start date through to the end of the end date) rather than as exact values")
+	flagset.BoolVar(&cmd.skipNoDiff, "skip-if-unchanged", cmd.skipNoDiff, "Does not create or upload the report if all the controllers match the authoritative ACL")
+	flagset.BoolVar(&cmd.failOnDiff, "fail-on-diff", cmd.failOnDiff, "Exits with the 'drift' exit code if the controllers differ from the authoritative ACL (defaults to false i.e. exits cleanly)")
 	flagset.BoolVar(&cmd.noverify, "no-verify", cmd.noverify, "Disables verification of the downloaded ACL RSA signature")
+	flagset.BoolVar(&cmd.offlineOk, "ignore-unreachable", cmd.offlineOk, "Lists unreachable controllers in the report without failing with the 'unreachable' exit code")
+	flagset.BoolVar(&cmd.nodevicesOk, "no-controllers-ok", cmd.nodevicesOk, "Validates the ACL without failing if none of the controllers are reachable")
+	flagset.BoolVar(&cmd.readback, "verify-upload", cmd.readback, "Re-downloads the uploaded report and verifies that it matches the report that was sent")
+	flagset.BoolVar(&cmd.canonical, "canonicalize", cmd.canonical, "Signs the canonical form (LF line endings, no trailing whitespace) of the report (adds a 'version' entry to the uploaded file)")
+	flagset.BoolVar(&cmd.includeRaw, "report-include-raw", cmd.includeRaw, "Includes the authoritative ACL TSV file in the uploaded report file (as 'authoritative.tsv')")
 	flagset.BoolVar(&cmd.nolog, "no-log", cmd.nolog, "Writes log messages to stdout rather than a rotatable log file")
+	flagset.StringVar(&cmd.logFormat, "log-format", cmd.logFormat, "Log message format ('text' or 'json' i.e. one JSON object per log message)")
+	flagset.IntVar(&cmd.logMaxFiles, "log-max-files", cmd.logMaxFiles, "Maximum number of rotated log files to retain (0 for no limit)")
+	flagset.IntVar(&cmd.logMaxAge, "log-max-age", cmd.logMaxAge, "Maximum age (in days) of rotated log files to retain (0 for no limit)")
 
 	return flagset
 }
@@ -88,11 +316,20 @@ func (cmd *CompareACL) Usage() string {
 
 func (cmd *CompareACL) Help() {
 	fmt.Println()
-	fmt.Printf("  Usage: %s [--debug] [--config <file>] compare--acl --acl <URL> --report <URL> [--credentials <file>] [--profile <file>] [--region <region>] [--keys <dir>] [--key <file>] [--no-verify] [--no-log]\n", APP)
+	fmt.Printf("  Usage: %s [--debug] [--config <file>] compare--acl --acl <URL> [--acl <URL>...] --report <URL> [--credentials <file>] [--gcs-credentials <file>] [--azure-account <account>] [--azure-key <key>] [--azure-sas <token>] [--azure-connection-string <string>] [--ssh-key <file>] [--known-hosts <file>] [--profile <file>] [--region <region>] [--region-fallback <regions>] [--role-arn <ARN>] [--external-id <ID>] [--role-duration <duration>] [--endpoint <URL>] [--path-style] [--proxy <URL>] [--http-timeout <duration>] [--http-user <user>] [--http-password <password>] [--http-bearer <token>] [--client-cert <file>] [--client-key <file>] [--ca-cert <file>] [--retries <N>] [--retry-delay <duration>] [--archive tar.gz|zip] [--compression 0-9|none] [--sse AES256|aws:kms] [--sse-kms-key-id <key>] [--part-size <MiB>] [--upload-concurrency <N>] [--tag <key=value>] [--cache-control <value>] [--keys <dir>] [--decrypt-key <file>] [--ca <file>] [--checksum <hex|URL>] [--max-age <duration>] [--key <file>] [--key-passphrase <passphrase>] [--cert <file>] [--doors-as columns|bitmask] [--input-format auto|tsv|csv|json] [--delimiter <char>] [--format text|json|html] [--template <file>] [--report-name <pattern>] [--first-card <card>] [--last-card <card>] [--active-from <date>] [--active-to <date>] [--only-device <ID>] [--ignore-door [<ID>:]<door>] [--max-cards-per-device <N>] [--max-unexpected <N>] [--retain <N>] [--summary <URL>] [--webhook <URL>] [--webhook-content-type <type>] [--webhook-auth <value>] [--ignore-webhook-errors] [--smtp-host <host>] [--smtp-port <port>] [--smtp-from <address>] [--smtp-to <address>] [--smtp-user <user>] [--smtp-password <password>] [--smtp-tls] [--smtp-attach] [--dump-acl <file>|-] [--openmetrics <file>] [--metrics-file <file>] [--pushgateway <URL>] [--state <file>] [--report-diff-against-previous <URL>] [--emit-remediation <file>] [--device-name-map <file>] [--acl-cache <URL>] [--max-staleness <duration>] [--controllers-timeout-budget <duration>] [--concurrency <N>] [--progress] [--fail-fast|--collect-all] [--normalize-cards] [--hex-cards] [--on-duplicate warn|error|merge] [--on-conflict error|last-wins|union-doors] [--match-disabled] [--date-inclusive] [--fail-on-diff] [--skip-if-unchanged] [--no-verify] [--no-controllers-ok] [--ignore-unreachable] [--verify-upload] [--report-include-raw] [--canonicalize] [--no-log] [--log-format text|json] [--log-max-files <N>] [--log-max-age <days>]\n", APP)
 	fmt.Println()
 	fmt.Println("    Retrieves the ACL from the controllers configured in the configuration file, compares it to the authoritative ACL")
 	fmt.Println("    fetched from the --acl URL and uploads the comparison report to the --report URL.")
 	fmt.Println()
+	fmt.Printf("  Usage: %s [--debug] [--config <file>] compare-acl --ldap-url <URL> --ldap-base-dn <DN> --ldap-valid-from <date> --ldap-valid-until <date> [--ldap-bind-dn <DN>] [--ldap-card-attribute <name>] --report <URL> [options]\n", APP)
+	fmt.Println()
+	fmt.Println("    Builds the authoritative ACL from the LDAP group memberships of the users with a card number, using the access")
+	fmt.Println("    levels defined in the configuration file to map groups to doors.")
+	fmt.Println()
+	fmt.Printf("  Usage: %s [--debug] [--config <file>] compare-acl --batch <file> [--batch-concurrency <N>] [options]\n", APP)
+	fmt.Println()
+	fmt.Println("    Runs each of the compare jobs described in the --batch file, with the other options as defaults for each job.")
+	fmt.Println()
 
 	helpOptions(cmd.FlagSet())
 	fmt.Println()
@@ -103,19 +340,190 @@ func (cmd *CompareACL) Execute(args ...interface{}) error {
 
 	cmd.config = options.Config
 	cmd.debug = options.Debug
+	cmd.ctx = options.ctx()
+
+	if err := setProxy(cmd.proxy); err != nil {
+		return err
+	}
+
+	if err := setClientTLS(cmd.httpTLS); err != nil {
+		return err
+	}
 
 	// ... check parameters
-	if strings.TrimSpace(cmd.acl) == "" {
+	if cmd.failFast && cmd.collectAll {
+		return fmt.Errorf("--fail-fast and --collect-all are mutually exclusive")
+	}
+
+	if err := checkOnDuplicate(cmd.onDuplicate); err != nil {
+		return err
+	}
+
+	if err := checkOnConflict(cmd.onConflict); err != nil {
+		return err
+	}
+
+	if cmd.maxAge > 0 && cmd.noverify {
+		return fmt.Errorf("--max-age requires signature verification and cannot be used with --no-verify")
+	}
+
+	if _, err := aclFormat(cmd.inputFormat, "", nil); err != nil {
+		return err
+	}
+
+	if _, err := aclDelimiter(cmd.delimiter, ""); err != nil {
+		return err
+	}
+
+	if cmd.doorsAs != "columns" && cmd.doorsAs != "bitmask" {
+		return fmt.Errorf("Invalid --doors-as format '%s' (expected 'columns' or 'bitmask')", cmd.doorsAs)
+	}
+
+	if cmd.format != "text" && cmd.format != "json" && cmd.format != "html" {
+		return fmt.Errorf("Invalid --format '%s' (expected 'text', 'json' or 'html')", cmd.format)
+	}
+
+	if err := checkReportName(cmd.reportName); err != nil {
+		return err
+	}
+
+	if cmd.tmplFile != "" {
+		if cmd.format == "json" {
+			return fmt.Errorf("--template is only applicable to the 'text' and 'html' report formats")
+		}
+
+		t, err := loadTemplate(cmd.tmplFile, cmd.format)
+		if err != nil {
+			return err
+		}
+
+		cmd.template = t
+	} else if cmd.format == "html" {
+		cmd.template = HTML_TEMPLATE
+	}
+
+	if cmd.firstCard > math.MaxUint32 || cmd.lastCard > math.MaxUint32 {
+		return fmt.Errorf("Invalid card number range (card numbers must be less than %v)", uint64(math.MaxUint32)+1)
+	}
+
+	if cmd.lastCard != 0 && cmd.firstCard > cmd.lastCard {
+		return fmt.Errorf("Invalid card number range (--first-card %v is greater than --last-card %v)", cmd.firstCard, cmd.lastCard)
+	}
+
+	if from, err := parseActiveDate("--active-from", cmd.activeFrom, time.Now()); err != nil {
+		return err
+	} else {
+		cmd.window.from = from
+	}
+
+	if to, err := parseActiveDate("--active-to", cmd.activeTo, time.Now()); err != nil {
+		return err
+	} else {
+		cmd.window.to = to
+	}
+
+	if cmd.window.from != nil && cmd.window.to != nil && time.Time(*cmd.window.to).Before(time.Time(*cmd.window.from)) {
+		return fmt.Errorf("Invalid date window (--active-from %v is after --active-to %v)", cmd.activeFrom, cmd.activeTo)
+	}
+
+	if err := cmd.encryption.validate(); err != nil {
+		return err
+	}
+
+	if err := cmd.multipart.validate(); err != nil {
+		return err
+	}
+
+	if err := cmd.tags.validate(); err != nil {
+		return err
+	}
+
+	if _, err := archiver(cmd.archive, "", cmd.compression); err != nil {
+		return err
+	}
+
+	if cmd.retain > 0 && !strings.HasPrefix(cmd.rpt, "s3://") && strings.TrimSpace(cmd.batch) == "" {
+		return fmt.Errorf("--retain requires an s3:// --report URL")
+	}
+
+	// ... retention only matches the default report file names
+	if cmd.retain > 0 && cmd.reportName != DEFAULT_REPORT_NAME {
+		return fmt.Errorf("--retain cannot be used with a custom --report-name (only report files named as for '%v' are retained)", DEFAULT_REPORT_NAME)
+	}
+
+	cmd.webhook.resolve()
+
+	if err := cmd.smtp.validate(); err != nil {
+		return err
+	}
+
+	if err := cmd.httpAuth.resolve(); err != nil {
+		return err
+	}
+
+	if err := cmd.azure.resolve(); err != nil {
+		return err
+	}
+
+	logger, err := newLogger(cmd.Name(), cmd.logFile, cmd.logFileSize, cmd.logMaxFiles, cmd.logMaxAge, cmd.nolog, cmd.logFormat, os.Stdout)
+	if err != nil {
+		return err
+	}
+
+	cmd.retry.log = logger
+
+	if strings.TrimSpace(cmd.batch) != "" {
+		return aborted("compare-acl", cmd.executeBatch(logger), logger)
+	}
+
+	return aborted("compare-acl", cmd.run(logger), logger)
+}
+
+func (cmd *CompareACL) run(logger *log.Logger) error {
+	if len(cmd.acl) == 0 && cmd.ldap.url == "" {
 		return fmt.Errorf("compare-acl requires a URL for the authoritative ACL file")
 	}
 
+	stdin := 0
+	for _, v := range cmd.acl {
+		if v == "-" {
+			stdin++
+		}
+	}
+
+	if cmd.ldap.url != "" && stdin > 0 {
+		return fmt.Errorf("--acl - (stdin) and --ldap-url are mutually exclusive")
+	}
+
+	if stdin > 1 {
+		return fmt.Errorf("The ACL file can only be read from stdin ('-') once")
+	}
+
+	if len(cmd.acl) > 1 && cmd.checksum != "" {
+		return fmt.Errorf("--checksum can only be used with a single --acl file")
+	}
+
+	if cmd.ldap.url != "" && (cmd.ldap.baseDN == "" || cmd.ldap.from == "" || cmd.ldap.to == "") {
+		return fmt.Errorf("--ldap-url requires --ldap-base-dn, --ldap-valid-from and --ldap-valid-until")
+	}
+
 	if strings.TrimSpace(cmd.rpt) == "" {
 		return fmt.Errorf("compare-acl requires a URL to upload the compare report")
 	}
 
-	uri, err := url.Parse(cmd.acl)
-	if err != nil {
-		return fmt.Errorf("Invalid ACL file URL '%s' (%w)", cmd.acl, err)
+	sources := []string(cmd.acl)
+	if cmd.ldap.url != "" {
+		sources = []string{cmd.ldap.url}
+	}
+
+	uris := []string{}
+	for _, source := range sources {
+		uri, err := url.Parse(source)
+		if err != nil {
+			return fmt.Errorf("Invalid ACL file URL '%s' (%w)", source, err)
+		}
+
+		uris = append(uris, uri.String())
 	}
 
 	conf := config.NewConfig()
@@ -131,171 +539,827 @@ func (cmd *CompareACL) Execute(args ...interface{}) error {
 		cmd.profile = conf.AWS.Profile
 	}
 
-	if cmd.region == "" {
+	if cmd.region == "" && !isProfileURI(cmd.credentials) {
 		cmd.region = conf.AWS.Region
 	}
 
-	u, devices := getDevices(conf, cmd.debug)
+	levels, err := loadAccessLevels(cmd.config)
+	if err != nil {
+		return fmt.Errorf("Error loading access levels from %v (%w)", cmd.config, err)
+	}
 
-	var logger *log.Logger
-	if !cmd.nolog {
-		events := eventlog.Ticker{Filename: cmd.logFile, MaxSize: cmd.logFileSize}
-		logger = log.New(&events, "", log.Ldate|log.Ltime|log.LUTC)
-	} else {
-		logger = log.New(os.Stdout, "ACL ", log.LstdFlags|log.LUTC|log.Lmsgprefix)
+	cmd.levels = levels
+
+	names, err := loadDeviceNames(cmd.nameMap, cmd.config)
+	if err != nil {
+		return fmt.Errorf("Error loading device names (%w)", err)
 	}
 
-	return cmd.execute(u, uri.String(), devices, logger)
+	cmd.names = names
+
+	u, devices := getDevices(conf, cmd.debug)
+
+	return cmd.execute(u, uris, devices, logger)
 }
 
-func (cmd *CompareACL) execute(u uhppote.IUHPPOTE, uri string, devices []uhppote.Device, log *log.Logger) error {
-	log.Printf("Fetching ACL from %v", uri)
+func (cmd *CompareACL) execute(u uhppote.IUHPPOTE, uris []string, devices []uhppote.Device, log *log.Logger) error {
+	uri := strings.Join(uris, ",")
+	fetch := func() (acl.ACL, []byte, error) {
+		if cmd.ldap.url != "" {
+			return cmd.fetchLDAP(uri, devices, log)
+		}
 
-	f := cmd.fetchHTTP
-	if strings.HasPrefix(uri, "s3://") {
-		f = cmd.fetchS3
-	} else if strings.HasPrefix(uri, "file://") {
-		f = cmd.fetchFile
+		return cmd.fetchSources(uris, devices, log)
 	}
 
-	b, err := f(uri)
+	compared, err := onlyDevices(cmd.onlyDevice, devices)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("Fetched ACL from %v (%d bytes)", uri, len(b))
+	if cmd.ignored, err = ignoredDoors(cmd.ignoreDoor, compared); err != nil {
+		return err
+	}
+
+	start := time.Now()
 
-	x := untar
-	if strings.HasSuffix(uri, ".zip") {
-		x = unzip
+	cmd.duplicates = nil
+	list, raw, err := fetch()
+	if err != nil {
+		return err
 	}
 
-	files, uname, err := x(bytes.NewReader(b))
+	run := runMetrics{
+		records: map[uint32]int{},
+		fetch:   time.Since(start),
+	}
+
+	// ... the ACL is parsed for all the configured controllers but only the --only-device controllers are compared
+	if len(compared) < len(devices) {
+		log.Printf("Comparing controllers %v only", cmd.onlyDevice.String())
+
+		filtered := acl.ACL{}
+		for _, d := range compared {
+			if cards, ok := list[d.DeviceID]; ok {
+				filtered[d.DeviceID] = cards
+			}
+		}
+
+		list = filtered
+		devices = compared
+	}
+
+	overflow := map[uint32]*Overflow{}
+	if cmd.maxCards > 0 {
+		overflow = overflows(list, int(cmd.maxCards))
+		for k, v := range overflow {
+			log.Printf("%v  WARN  authoritative ACL has %v cards, exceeding the controller capacity of %v cards", k, v.Cards, v.Capacity)
+		}
+	}
+
+	if cmd.firstCard != 0 || cmd.lastCard != 0 {
+		log.Printf("Comparing cards in the range [%v,%v]", cmd.firstCard, cmd.lastCard)
+
+		list = filterCardRange(list, uint32(cmd.firstCard), uint32(cmd.lastCard))
+	}
+
+	if cmd.window.from != nil || cmd.window.to != nil {
+		log.Printf("Comparing cards active in the date window %v", cmd.window)
+	}
+
+	diff, current, unreachable, latency, skipped, err := cmd.compare(u, devices, list, log)
 	if err != nil {
 		return err
 	}
 
+	// ... controller cards are either unchanged, updated or unexpected
+	for k, v := range diff {
+		run.records[k] = len(v.Unchanged) + len(v.Updated) + len(v.Deleted)
+	}
+
+	if cmd.nodevicesOk && len(unreachable) >= len(devices) {
+		log.Printf("WARN  No controllers reachable - ACL fetched, verified and parsed but controllers NOT checked")
+		return nil
+	}
+
+	timestamp := types.DateTime(time.Now())
+	rpt := Report{
+		DateTime:   &timestamp,
+		Diffs:      diff,
+		Overflow:   overflow,
+		Names:      cmd.names,
+		Review:     map[uint32]bool{},
+		Duplicates: cmd.duplicates,
+		Devices:    reportDevices(devices, cmd.names),
+		Skipped:    map[uint32]bool{},
+		Errors:     map[uint32]string{},
+	}
+
+	// ... unreachable controllers are listed in the report rather than failing the whole run
+	errors := []error{}
+	for _, d := range devices {
+		if e, ok := unreachable[d.DeviceID]; ok {
+			diff[d.DeviceID] = acl.Diff{}
+			rpt.Errors[d.DeviceID] = e.Error()
+			errors = append(errors, e)
+		}
+	}
+
+	for _, k := range skipped {
+		log.Printf("%v  WARN  not checked - --controllers-timeout-budget (%v) exhausted", k, cmd.budget)
+		diff[k] = acl.Diff{}
+		rpt.Skipped[k] = true
+	}
+
+	if cmd.maxDeleted > 0 {
+		for k, v := range diff {
+			if uint(len(v.Deleted)) > cmd.maxDeleted {
+				log.Printf("%v  WARN  %v unexpected cards exceeds --max-unexpected (%v) - needs manual review", k, len(v.Deleted), cmd.maxDeleted)
+				rpt.Review[k] = true
+			}
+		}
+	}
+
+	if cmd.previous != "" {
+		if previous, err := cmd.fetchDrift(cmd.previous); err != nil {
+			log.Printf("WARN  Error loading previous report from %v (%v)", cmd.previous, err)
+		} else {
+			rpt.Trend = trend(diff, previous)
+			for k, v := range rpt.Trend {
+				recurring := 0
+				for _, label := range v {
+					if label == "RECURRING" {
+						recurring++
+					}
+				}
+
+				log.Printf("%v  TREND  new:%v  recurring:%v", k, len(v)-recurring, recurring)
+			}
+		}
+	}
+
+	if cmd.state != "" {
+		previous, err := loadState(cmd.state)
+		if err != nil {
+			log.Printf("WARN  Error loading previous controller ACL from %v (%v)", cmd.state, err)
+		} else if previous != nil {
+			rpt.Changes = controllerChanges(previous, current)
+			for k, v := range rpt.Changes {
+				log.Printf("%v  CHANGES  changed:%v  appeared:%v  disappeared:%v", k, len(v.Updated), len(v.Added), len(v.Deleted))
+			}
+		}
+
+		// ... retains the previous controller ACL for unreachable controllers
+		for k := range unreachable {
+			if cards, ok := previous[k]; ok {
+				current[k] = cards
+			}
+		}
+
+		if err := saveState(cmd.state, current); err != nil {
+			log.Printf("WARN  Error saving controller ACL to %v (%v)", cmd.state, err)
+		}
+	}
+
+	// ... reachable controllers that all match the authoritative ACL don't need a new report
+	unchanged := len(unreachable) == 0 && len(skipped) == 0
+	for _, v := range diff {
+		if v.HasChanges() {
+			unchanged = false
+		}
+	}
+
+	var archive []byte
+
+	skip := cmd.skipNoDiff && unchanged
+	if skip {
+		log.Printf("No differences between the controllers and the authoritative ACL - skipped report upload (--skip-if-unchanged)")
+	} else {
+		start = time.Now()
+		if archive, err = cmd.upload(rpt, raw, log); err != nil {
+			return err
+		}
+
+		run.upload = time.Since(start)
+	}
+
+	if cmd.retain > 0 && strings.HasPrefix(cmd.rpt, "s3://") && !skip {
+		prefix := s3Prefix(cmd.rpt)
+		if deleted, err := pruneS3(cmd.ctx, prefix, cmd.credentials, cmd.profile, cmd.region, cmd.fallback, cmd.endpoint, cmd.role, cmd.retry, cmd.retain, false, log); err != nil {
+			log.Printf("WARN  Error deleting old report files from %v (%v)", prefix, err)
+		} else {
+			log.Printf("Retained the %v most recent report files in %v (deleted %v)", cmd.retain, prefix, len(deleted))
+		}
+	}
+
+	if cmd.summary != "" {
+		if err := cmd.writeSummary(rpt, uri); err != nil {
+			log.Printf("WARN  Error writing report summary to %v (%v)", cmd.summary, err)
+		} else {
+			log.Printf("Wrote report summary to %v", cmd.summary)
+		}
+	}
+
+	if cmd.remediation != "" {
+		if err := writeRemediation(cmd.remediation, remediation(uri, diff, rpt.Review)); err != nil {
+			log.Printf("WARN  Error writing remediation script to %v (%v)", cmd.remediation, err)
+		} else {
+			log.Printf("Wrote remediation script to %v", cmd.remediation)
+		}
+	}
+
+	if cmd.metrics != "" || cmd.pushgateway != "" {
+		metrics := openmetrics(latency, diff)
+
+		if cmd.metrics != "" {
+			if err := writeMetrics(cmd.metrics, metrics); err != nil {
+				log.Printf("WARN  Error writing metrics to %v (%v)", cmd.metrics, err)
+			} else {
+				log.Printf("Wrote metrics to %v", cmd.metrics)
+			}
+		}
+
+		if cmd.pushgateway != "" {
+			if err := pushMetrics(cmd.pushgateway, APP, metrics); err != nil {
+				log.Printf("WARN  Error pushing metrics to %v (%v)", cmd.pushgateway, err)
+			} else {
+				log.Printf("Pushed metrics to %v", cmd.pushgateway)
+			}
+		}
+	}
+
+	if cmd.webhook.url != "" {
+		if err := cmd.post(rpt); err != nil && cmd.webhook.errorsOk {
+			log.Printf("WARN  Error posting report to webhook %v (%v)", cmd.webhook.url, err)
+		} else if err != nil {
+			log.Printf("ERROR Error posting report to webhook %v (%v)", cmd.webhook.url, err)
+			return fmt.Errorf("Error posting report to webhook (%w)", err)
+		} else {
+			log.Printf("Posted report to webhook %v", cmd.webhook.url)
+		}
+	}
+
+	if cmd.smtp.host != "" {
+		if err := cmd.email(rpt, archive); err != nil {
+			log.Printf("ERROR Error emailing report to %v (%v)", strings.Join(cmd.smtp.to, ","), err)
+			return err
+		}
+
+		log.Printf("Emailed report to %v", strings.Join(cmd.smtp.to, ","))
+	}
+
+	drift := DiffError{}
+	for _, v := range diff {
+		drift.Incorrect += len(v.Updated)
+		drift.Missing += len(v.Added)
+		drift.Unexpected += len(v.Deleted)
+	}
+
+	run.diffs = drift.Incorrect + drift.Missing + drift.Unexpected
+
+	log.Printf("METRICS  %v", run)
+
+	if cmd.metricsFile != "" {
+		if err := writeMetrics(cmd.metricsFile, prometheus(run)); err != nil {
+			log.Printf("WARN  Error writing metrics to %v (%v)", cmd.metricsFile, err)
+		} else {
+			log.Printf("Wrote metrics to %v", cmd.metricsFile)
+		}
+	}
+
+	if len(errors) > 0 && !cmd.offlineOk {
+		return fmt.Errorf("%w %v", ErrUnreachable, errors)
+	}
+
+	if cmd.failOnDiff && (drift.Incorrect > 0 || drift.Missing > 0 || drift.Unexpected > 0) {
+		return &drift
+	}
+
+	return nil
+}
+
+// Fetches, verifies and parses the authoritative ACL file, returning the ACL and the TSV file as fetched.
+func (cmd *CompareACL) fetchACL(uri string, devices []uhppote.Device, log *log.Logger) (acl.ACL, []byte, error) {
+	if uri == "-" {
+		log.Printf("Reading ACL from stdin")
+	} else {
+		log.Printf("Fetching ACL from %v", uri)
+	}
+
+	b, err := cmd.fetch(uri)
+	if err != nil {
+		return nil, nil, &FetchError{URL: uri, Err: err}
+	}
+
+	log.Printf("Fetched ACL from %v (%d bytes)", uri, len(b))
+
+	if cmd.checksum != "" {
+		if err := verifyChecksum(uri, bytes.NewReader(b), cmd.checksum, cmd.fetch); err != nil {
+			return nil, nil, &VerifyError{err}
+		}
+
+		log.Printf("Verified ACL SHA-256 checksum")
+	}
+
+	if b, err = decrypt(uri, b, cmd.decryptKey, log); err != nil {
+		return nil, nil, err
+	}
+
+	files, uname, archive, err := unpack(uri, b)
+	if err != nil {
+		return nil, nil, &ParseError{err}
+	}
+
+	if !archive && !cmd.noverify {
+		return nil, nil, &VerifyError{fmt.Errorf("%v is not a signed tar.gz or zip archive - the signature can only be verified for the archive formats (use --no-verify for unsigned TSV files)", uri)}
+	}
+
 	tsv, ok := files["ACL"]
 	if !ok {
-		return fmt.Errorf("ACL file missing from tar.gz")
+		return nil, nil, &ParseError{fmt.Errorf("ACL file missing from tar.gz")}
 	}
 
 	signature, ok := files["signature"]
 	if !cmd.noverify && !ok {
-		return fmt.Errorf("'signature' file missing from tar.gz")
+		return nil, nil, &VerifyError{fmt.Errorf("'signature' file missing from tar.gz")}
 	}
 
 	log.Printf("Extracted ACL from %v: %v bytes, signature: %v bytes", uri, len(tsv), len(signature))
 
 	if !cmd.noverify {
-		if err := verify(uname, tsv, signature, cmd.keysdir); err != nil {
-			return err
+		if cmd.ca != "" {
+			chain, ok := files["certificate"]
+			if !ok {
+				return nil, nil, &VerifyError{fmt.Errorf("'certificate' file missing from tar.gz")}
+			}
+
+			signer, err := verifyCertificate(signable(files, tsv), signature, chain, cmd.ca)
+			if err != nil {
+				return nil, nil, &VerifyError{err}
+			}
+
+			log.Printf("Verified ACL signature and certificate chain for '%v'", signer)
+		} else if key, err := verify(uname, signable(files, tsv), signatures(files), cmd.keysdir); err != nil {
+			return nil, nil, &VerifyError{err}
+		} else {
+			log.Printf("Verified ACL signature for '%v' with key %v", uname, key)
+		}
+	}
+
+	if err := checkMaxAge(uri, files, cmd.maxAge, log); err != nil {
+		return nil, nil, err
+	}
+
+	raw := tsv
+
+	cmd.dumpACL(raw, log)
+
+	tsv = normalizeText(tsv)
+	format, _ := aclFormat(cmd.inputFormat, uri, files)
+	if delimiter, _ := aclDelimiter(cmd.delimiter, format); format != "json" && delimiter != '\t' {
+		if tsv, err = csvToTSV(tsv, delimiter); err != nil {
+			return nil, nil, &ParseError{err}
+		}
+	}
+
+	if format == "json" {
+		if cmd.doorsAs == "bitmask" {
+			return nil, nil, &ParseError{fmt.Errorf("--doors-as bitmask is not supported for JSON ACL files")}
+		}
+
+		if tsv, err = jsonToTSV(tsv, devices); err != nil {
+			return nil, nil, &ParseError{err}
+		}
+	} else if cmd.doorsAs == "bitmask" {
+		if tsv, err = bitmaskToTSV(tsv, devices); err != nil {
+			return nil, nil, &ParseError{err}
+		}
+	}
+
+	if tsv, err = resolveAccessLevels(tsv, cmd.levels, devices); err != nil {
+		return nil, nil, &ParseError{err}
+	}
+
+	if tsv, err = resolveDisabled(tsv, devices); err != nil {
+		return nil, nil, &ParseError{err}
+	}
+
+	if cmd.normalize || cmd.hexCards {
+		normalized, N, warnings := normalizeCards(tsv, cmd.hexCards)
+		for _, w := range warnings {
+			log.Printf("WARN  %v", w)
+		}
+
+		if N > 0 {
+			log.Printf("Normalized %v card numbers", N)
+		}
+
+		tsv = normalized
+	}
+
+	if tsv, cmd.duplicates, err = resolveDuplicates(tsv, cmd.onDuplicate, devices, log); err != nil {
+		return nil, nil, &ParseError{err}
+	}
+
+	if cmd.collectAll {
+		if errs := validateTSV(tsv, devices); len(errs) > 0 {
+			for _, e := range errs {
+				log.Printf("ERROR %v", e)
+			}
+
+			return nil, nil, &ParseError{parseErrors(errs)}
 		}
 	}
 
 	list, warnings, err := acl.ParseTSV(bytes.NewReader(tsv), devices, false)
 	if err != nil {
-		return err
+		return nil, nil, &ParseError{err}
 	}
 
 	for _, w := range warnings {
-		log.Printf("WARN  %v", w)
+		if len(cmd.duplicates) == 0 || !isDuplicateWarning(w) {
+			log.Printf("WARN  %v", w)
+		}
 	}
 
 	for k, l := range list {
 		log.Printf("%v  Retrieved %v records", k, len(l))
 	}
 
-	current, errors := acl.GetACL(u, devices)
-	if len(errors) > 0 {
-		return fmt.Errorf("%v", errors)
-	}
+	return list, raw, nil
+}
+
+func (cmd *CompareACL) fetchLDAP(uri string, devices []uhppote.Device, log *log.Logger) (acl.ACL, []byte, error) {
+	log.Printf("Retrieving ACL from LDAP %v (%v)", cmd.ldap.url, cmd.ldap.baseDN)
 
-	diff, err := acl.Compare(current, list)
+	list, warnings, err := cmd.ldap.getACL(cmd.levels, devices)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	for k, v := range diff {
-		log.Printf("%v  SUMMARY  same:%v  different:%v  missing:%v  extraneous:%v", k, len(v.Unchanged), len(v.Updated), len(v.Added), len(v.Deleted))
+	for _, w := range warnings {
+		log.Printf("WARN  %v", w)
 	}
 
-	if err := cmd.upload(diff, log); err != nil {
-		return err
+	for k, l := range list {
+		log.Printf("%v  Retrieved %v records", k, len(l))
 	}
 
-	return nil
-}
+	var w strings.Builder
+	if err := acl.MakeTSV(list, devices, &w); err != nil {
+		return nil, nil, err
+	}
+
+	cmd.dumpACL([]byte(w.String()), log)
 
-func (cmd *CompareACL) fetchHTTP(url string) ([]byte, error) {
-	return fetchHTTP(url)
+	return list, []byte(w.String()), nil
 }
 
-func (cmd *CompareACL) fetchS3(url string) ([]byte, error) {
-	return fetchS3(url, cmd.credentials, cmd.profile, cmd.region)
+// Writes the authoritative ACL TSV (after verification and before any processing) to the --dump-acl file (or
+// stdout for '-'). Errors are logged but do not affect the compare.
+func (cmd *CompareACL) dumpACL(tsv []byte, log *log.Logger) {
+	if cmd.dump == "" {
+		return
+	}
+
+	if cmd.dump == "-" {
+		if _, err := os.Stdout.Write(tsv); err != nil {
+			log.Printf("WARN  Error writing ACL to stdout (%v)", err)
+		}
+
+		return
+	}
+
+	if err := writeAtomic(cmd.dump, tsv, 0660); err != nil {
+		log.Printf("WARN  Error writing ACL to %v (%v)", cmd.dump, err)
+	} else {
+		log.Printf("Wrote authoritative ACL to %v", cmd.dump)
+	}
 }
 
-func (cmd *CompareACL) fetchFile(url string) ([]byte, error) {
-	return fetchFile(url)
+// Diffs each controller ACL against the authoritative ACL as soon as it has been retrieved. The controller ACL is
+// only retained if it is required for the --state file.
+func (cmd *CompareACL) compare(u uhppote.IUHPPOTE, devices []uhppote.Device, list acl.ACL, log *log.Logger) (map[uint32]acl.Diff, acl.ACL, map[uint32]error, map[uint32]time.Duration, []uint32, error) {
+	diff := map[uint32]acl.Diff{}
+	current := acl.ACL{}
+	errors := map[uint32]error{}
+	latency := map[uint32]time.Duration{}
+
+	var err error
+
+	f := func(device uint32, cards map[uint32]types.Card, errs []error) {
+		if len(errs) > 0 {
+			for _, e := range errs {
+				log.Printf("%v  WARN  error retrieving controller ACL (%v)", device, e)
+			}
+
+			errors[device] = errs[0]
+			return
+		}
+
+		// ... the --state file retains the unfiltered controller ACL
+		if cmd.state != "" {
+			current[device] = cards
+		}
+
+		if cmd.firstCard != 0 || cmd.lastCard != 0 {
+			cards = filterCardRange(acl.ACL{device: cards}, uint32(cmd.firstCard), uint32(cmd.lastCard))[device]
+		}
+
+		expected := list[device]
+		if cmd.window.from != nil || cmd.window.to != nil {
+			cards, expected = filterActive(cards, expected, cmd.window)
+		}
+
+		controller := cards
+		authoritative := expected
+		ignored := cmd.ignored[device]
+		if len(ignored) > 0 {
+			controller = withoutDoors(cards, ignored)
+			authoritative = withoutDoors(expected, ignored)
+		}
+
+		d, e := acl.Compare(acl.ACL{device: controller}, acl.ACL{device: authoritative})
+		if e != nil {
+			err = e
+			return
+		}
+
+		v := d[device]
+		if cmd.disabledOk {
+			v = matchDisabled(v, controller)
+		}
+
+		if cmd.inclusive {
+			v = matchDates(v, controller)
+		}
+
+		if len(ignored) > 0 {
+			v = restoreDoors(v, cards, expected, ignored)
+		}
+
+		diff[device] = v
+
+		log.Printf("%v  SUMMARY  same:%v  different:%v  missing:%v  extraneous:%v", device, len(v.Unchanged), len(v.Updated), len(v.Added), len(v.Deleted))
+	}
+
+	if cmd.cache != "" {
+		cached, timestamp, e := fetchCachedACL(cmd.cache, cmd.staleness, devices)
+		if e == nil {
+			log.Printf("Using cached controller ACL from %v (retrieved %v)", cmd.cache, timestamp.Format("2006-01-02 15:04:05"))
+			for _, d := range devices {
+				f(d.DeviceID, cached[d.DeviceID], nil)
+			}
+
+			return diff, current, errors, latency, nil, err
+		}
+
+		log.Printf("WARN  Cached controller ACL not usable (%v) - retrieving ACL from controllers", e)
+	}
+
+	var p *progress
+	if cmd.progress || cmd.debug {
+		p = newProgress(len(devices), cmd.nolog, log)
+	}
+
+	skipped, e := streamACL(cmd.ctx, u, devices, cmd.concurrency, cmd.budget, p, func(device uint32, cards map[uint32]types.Card, errs []error, dt time.Duration) {
+		latency[device] = dt
+		f(device, cards, errs)
+	})
+
+	p.finish()
+
+	if e != nil {
+		return nil, nil, nil, nil, nil, e
+	}
+
+	return diff, current, errors, latency, skipped, err
 }
 
-func (cmd *CompareACL) storeHTTP(url string, r io.Reader) error {
-	return storeHTTP(url, r)
+func (cmd *CompareACL) fetchDrift(uri string) (map[uint32]driftSummary, error) {
+	b, err := cmd.fetch(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseDrift(uri, b)
 }
 
-func (cmd *CompareACL) storeS3(uri string, r io.Reader) error {
-	return storeS3(uri, cmd.credentials, cmd.profile, cmd.region, r)
+func (cmd *CompareACL) fetch(uri string) ([]byte, error) {
+	options := FetchOptions{
+		Credentials: cmd.credentials,
+		Profile:     cmd.profile,
+		Region:      cmd.region,
+		Fallback:    cmd.fallback,
+		RoleARN:     cmd.role.arn,
+		ExternalID:  cmd.role.externalID,
+		RoleTTL:     cmd.role.duration,
+		Endpoint:    cmd.endpoint.url,
+		PathStyle:   cmd.endpoint.pathStyle,
+		HTTPTimeout: cmd.httpTimeout,
+		HTTPUser:    cmd.httpAuth.user,
+		HTTPPasswd:  cmd.httpAuth.password,
+		HTTPBearer:  cmd.httpAuth.bearer,
+		GCSKeyFile:  cmd.gcsCreds,
+		AzureAcct:   cmd.azure.account,
+		AzureKey:    cmd.azure.key,
+		AzureSAS:    cmd.azure.sas,
+		AzureHost:   cmd.azure.endpoint,
+		SSHKey:      cmd.sftp.key,
+		KnownHosts:  cmd.sftp.knownHosts,
+		Retries:     cmd.retry.retries,
+		RetryDelay:  cmd.retry.delay,
+		Log:         cmd.retry.log,
+	}
+
+	return fetch(cmd.ctx, uri, options)
 }
 
-func (cmd *CompareACL) storeFile(url string, r io.Reader) error {
-	return storeFile(url, r)
+func (cmd *CompareACL) store(uri string, r io.Reader) error {
+	options := StoreOptions{
+		Credentials: cmd.credentials,
+		Profile:     cmd.profile,
+		Region:      cmd.region,
+		Fallback:    cmd.fallback,
+		RoleARN:     cmd.role.arn,
+		ExternalID:  cmd.role.externalID,
+		RoleTTL:     cmd.role.duration,
+		Endpoint:    cmd.endpoint.url,
+		PathStyle:   cmd.endpoint.pathStyle,
+		SSE:         cmd.encryption.sse,
+		SSEKMSKeyID: cmd.encryption.kmsKeyID,
+		PartSize:    cmd.multipart.partSize,
+		Concurrency: cmd.multipart.concurrency,
+		Tags:        cmd.tags,
+		CacheCtrl:   cmd.cacheCtrl,
+		HTTPTimeout: cmd.httpTimeout,
+		HTTPUser:    cmd.httpAuth.user,
+		HTTPPasswd:  cmd.httpAuth.password,
+		HTTPBearer:  cmd.httpAuth.bearer,
+		GCSKeyFile:  cmd.gcsCreds,
+		AzureAcct:   cmd.azure.account,
+		AzureKey:    cmd.azure.key,
+		AzureSAS:    cmd.azure.sas,
+		AzureHost:   cmd.azure.endpoint,
+		SSHKey:      cmd.sftp.key,
+		KnownHosts:  cmd.sftp.knownHosts,
+		Retries:     cmd.retry.retries,
+		RetryDelay:  cmd.retry.delay,
+		Log:         cmd.retry.log,
+	}
+
+	return store(cmd.ctx, uri, r, options)
 }
 
-func (cmd *CompareACL) upload(diff map[uint32]acl.Diff, log *log.Logger) error {
-	log.Printf("Uploading ACL 'diff' report")
+func (cmd *CompareACL) writeSummary(rpt Report, source string) error {
+	var b bytes.Buffer
+	if err := reportSummary(rpt, source, &b); err != nil {
+		return err
+	}
+
+	return cmd.store(fileURI(cmd.summary), &b)
+}
 
+// Renders the report in the --format format, returning the report and the report file extension.
+func (cmd *CompareACL) render(r Report) ([]byte, string, error) {
 	var w strings.Builder
 
-	if err := report(diff, cmd.template, &w); err != nil {
+	ext := "rpt"
+	switch cmd.format {
+	case "json":
+		ext = "json"
+		if err := reportJSON(r, &w); err != nil {
+			return nil, "", err
+		}
+
+	case "html":
+		ext = "html"
+		if err := reportHTML(r, cmd.template, &w); err != nil {
+			return nil, "", err
+		}
+
+	default:
+		if err := report(r, cmd.template, &w); err != nil {
+			return nil, "", err
+		}
+	}
+
+	return []byte(w.String()), ext, nil
+}
+
+func (cmd *CompareACL) post(r Report) error {
+	rpt, _, err := cmd.render(r)
+	if err != nil {
 		return err
 	}
 
-	filename := time.Now().Format("acl-2006-01-02T150405.rpt")
-	rpt := []byte(w.String())
-	signature, err := sign(rpt, cmd.keyfile)
+	return postWebhook(cmd.ctx, cmd.webhook, rpt, cmd.format, cmd.httpTimeout, cmd.retry)
+}
+
+func (cmd *CompareACL) email(r Report, archive []byte) error {
+	body, _, err := cmd.render(r)
 	if err != nil {
 		return err
 	}
 
+	subject := "ACL diff report"
+	if r.DateTime != nil {
+		subject = fmt.Sprintf("ACL diff report %v", r.DateTime)
+	}
+
+	filename := ""
+	if !cmd.smtp.attach {
+		archive = nil
+	} else if u, err := url.Parse(cmd.rpt); err == nil && path.Base(u.Path) != "." && path.Base(u.Path) != "/" {
+		filename = path.Base(u.Path)
+	} else {
+		filename = "report.tar.gz"
+	}
+
+	return sendReport(cmd.ctx, cmd.smtp, subject, body, cmd.format == "html", filename, archive, cmd.httpTimeout, cmd.retry)
+}
+
+func (cmd *CompareACL) upload(r Report, tsv []byte, log *log.Logger) ([]byte, error) {
+	log.Printf("Uploading ACL 'diff' report")
+
+	rpt, ext, err := cmd.render(r)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if r.DateTime != nil {
+		now = time.Time(*r.DateTime)
+	}
+
+	filename, err := reportFilename(cmd.reportName, now, ext, r.Devices)
+	if err != nil {
+		return nil, err
+	}
+
 	var b bytes.Buffer
 	var files = map[string][]byte{
-		filename:    rpt,
-		"signature": signature,
+		filename: rpt,
 	}
 
-	x := targz
-	if strings.HasSuffix(cmd.rpt, ".zip") {
-		x = zipf
+	if cmd.canonical {
+		files["version"] = []byte(fmt.Sprintf("%v\n", CANONICAL_VERSION))
 	}
 
-	if err := x(files, &b); err != nil {
-		return err
+	signatures, err := sign(signable(files, rpt), cmd.keyfile, cmd.passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range signatures {
+		files[k] = v
 	}
 
-	log.Printf("tar'd report (%v bytes) and signature (%v bytes): %v bytes", len(rpt), len(signature), b.Len())
+	if cmd.cert != "" {
+		chain, err := loadCertificateChain(cmd.cert)
+		if err != nil {
+			return nil, err
+		}
 
-	f := cmd.storeHTTP
-	if strings.HasPrefix(cmd.rpt, "s3://") {
-		f = cmd.storeS3
-	} else if strings.HasPrefix(cmd.rpt, "file://") {
-		f = cmd.storeFile
+		files["certificate"] = chain
 	}
 
-	if err := f(cmd.rpt, bytes.NewReader(b.Bytes())); err != nil {
-		return err
+	if cmd.includeRaw {
+		files[RAW_ACL_FILE] = tsv
+	}
+
+	drift, err := json.MarshalIndent(makeDrift(r.Diffs), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	files[DRIFT_FILE] = drift
+
+	x, err := archiver(cmd.archive, cmd.rpt, cmd.compression)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := x(files, &b); err != nil {
+		return nil, err
+	}
+
+	log.Printf("tar'd report (%v bytes) and signature (%v bytes): %v bytes", len(rpt), len(files["signature"]), b.Len())
+
+	if err := cmd.store(cmd.rpt, bytes.NewReader(b.Bytes())); err != nil {
+		return nil, err
 	}
 
 	log.Printf("Uploaded to %v", cmd.rpt)
 
-	return nil
+	if cmd.readback {
+		if err := verifyUpload(cmd.rpt, b.Bytes(), cmd.fetch); err != nil {
+			log.Printf("ERROR %v", err)
+			return nil, err
+		}
+
+		log.Printf("Verified uploaded report %v", cmd.rpt)
+	}
+
+	return b.Bytes(), nil
 }
@@ -0,0 +1,67 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/uhppoted/uhppoted-lib/acl"
+)
+
+// The controller ACL fixture differs from the authoritative ACL fixture only in the door time profiles
+// for cards 8165538 (29 vs. 30) and 8165540 (29 vs. Y).
+func TestCompareTimeProfileOnlyChange(t *testing.T) {
+	devices := jsonTestDevices[:1]
+
+	authoritative := parseFixture(t, "profiles-acl.tsv")
+	controller := parseFixture(t, "profiles-controller.tsv")
+
+	diff, err := acl.Compare(controller, authoritative)
+	if err != nil {
+		t.Fatalf("Unexpected error comparing ACLs (%v)", err)
+	}
+
+	v := diff[devices[0].DeviceID]
+
+	incorrect := []uint32{}
+	for _, card := range v.Updated {
+		incorrect = append(incorrect, card.CardNumber)
+	}
+
+	sort.Slice(incorrect, func(i, j int) bool { return incorrect[i] < incorrect[j] })
+
+	if len(incorrect) != 2 || incorrect[0] != 8165538 || incorrect[1] != 8165540 {
+		t.Errorf("Incorrect cards - expected:%v, got:%v", []uint32{8165538, 8165540}, incorrect)
+	}
+
+	if len(v.Unchanged) != 1 || v.Unchanged[0].CardNumber != 8165539 {
+		t.Errorf("Unchanged cards - expected:%v, got:%v", []uint32{8165539}, v.Unchanged)
+	}
+
+	if len(v.Added) != 0 || len(v.Deleted) != 0 {
+		t.Errorf("Unexpected missing/extraneous cards - missing:%v, extraneous:%v", v.Added, v.Deleted)
+	}
+
+	for _, card := range v.Updated {
+		if expected := authoritative[devices[0].DeviceID][card.CardNumber]; !sameCard(card, expected) {
+			t.Errorf("Card %v not updated to the authoritative time profile - expected:%v, got:%v", card.CardNumber, expected, card)
+		}
+	}
+}
+
+func parseFixture(t *testing.T, file string) acl.ACL {
+	f, err := os.Open(filepath.Join("testdata", file))
+	if err != nil {
+		t.Fatalf("Error opening test fixture %v (%v)", file, err)
+	}
+
+	defer f.Close()
+
+	list, _, err := acl.ParseTSV(f, jsonTestDevices[:1], true)
+	if err != nil {
+		t.Fatalf("Error parsing test fixture %v (%v)", file, err)
+	}
+
+	return list
+}
@@ -0,0 +1,462 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/uhppoted/uhppote-core/types"
+	"github.com/uhppoted/uhppote-core/uhppote"
+	"github.com/uhppoted/uhppoted-lib/acl"
+	"github.com/uhppoted/uhppoted-lib/config"
+)
+
+var CompareSitesCmd = CompareSites{
+	config:      config.DefaultConfig,
+	keyfile:     DEFAULT_KEYFILE,
+	credentials: DEFAULT_CREDENTIALS,
+	profile:     DEFAULT_PROFILE,
+	region:      DEFAULT_REGION,
+	role:        awsRole{duration: DEFAULT_ROLE_DURATION},
+	multipart:   s3Multipart{partSize: DEFAULT_PART_SIZE, concurrency: DEFAULT_UPLOAD_CONCURRENCY},
+	httpTimeout: DEFAULT_HTTP_TIMEOUT,
+	retry:       retryPolicy{retries: DEFAULT_RETRIES, delay: DEFAULT_RETRY_DELAY},
+	concurrency: 1,
+	logFile:     DEFAULT_LOGFILE,
+	logFileSize: DEFAULT_LOGFILESIZE,
+	logFormat:   DEFAULT_LOG_FORMAT,
+	logMaxFiles: DEFAULT_LOG_MAX_FILES,
+	logMaxAge:   DEFAULT_LOG_MAX_AGE,
+	nolog:       false,
+	debug:       false,
+	template: `SITE DIFF REPORT {{ .DateTime }}
+  SITE A: {{ .SiteA }}
+  SITE B: {{ .SiteB }}
+{{range .Pairs}}
+  CONTROLLER {{ .Name }} ({{ .A }}/{{ .B }}){{if or .Diff.Updated .Diff.Added .Diff.Deleted}}{{else}} OK{{end}}{{if .Diff.Updated}}
+    Different:   {{range .Diff.Updated}}{{.}}
+                 {{end}}{{end}}{{if .Diff.Added}}
+    Only A:      {{range .Diff.Added}}{{.}}
+                 {{end}}{{end}}{{if .Diff.Deleted}}
+    Only B:      {{range .Diff.Deleted}}{{.}}
+                 {{end}}{{end}}{{end}}
+`,
+}
+
+type CompareSites struct {
+	siteA       string
+	siteB       string
+	rpt         string
+	config      string
+	keyfile     string
+	passphrase  string
+	cert        string
+	credentials string
+	gcsCreds    string
+	azure       azureAuth
+	sftp        sftpAuth
+	profile     string
+	region      string
+	role        awsRole
+	endpoint    s3Endpoint
+	proxy       string
+	httpTimeout time.Duration
+	httpAuth    httpAuth
+	httpTLS     httpTLS
+	retry       retryPolicy
+	encryption  s3Encryption
+	multipart   s3Multipart
+	tags        s3Tags
+	cacheCtrl   string
+	archive     string
+	compression string
+	logFile     string
+	logFileSize int
+	logFormat   string
+	logMaxFiles int
+	logMaxAge   int
+	template    string
+	canonical   bool
+	concurrency int
+	nolog       bool
+	debug       bool
+	ctx         context.Context
+}
+
+type sitePair struct {
+	Name string
+	A    uint32
+	B    uint32
+	Diff acl.Diff
+}
+
+func (cmd *CompareSites) Name() string {
+	return "compare-sites"
+}
+
+func (cmd *CompareSites) FlagSet() *flag.FlagSet {
+	flagset := flag.NewFlagSet("compare-sites", flag.ExitOnError)
+
+	flagset.StringVar(&cmd.siteA, "site-a", cmd.siteA, "uhppoted.conf file with the controllers for site A (defaults to --config)")
+	flagset.StringVar(&cmd.siteB, "site-b", cmd.siteB, "uhppoted.conf file with the controllers for site B")
+	flagset.StringVar(&cmd.rpt, "report", cmd.rpt, "The URL for the uploaded report file (the report is written to the console if not specified)")
+	flagset.StringVar(&cmd.archive, "archive", cmd.archive, "Archive format for the uploaded report file ('tar.gz' or 'zip'). Defaults to zip if the URL ends with .zip and tar.gz otherwise")
+	flagset.StringVar(&cmd.compression, "compression", cmd.compression, "Compression level for the uploaded archive (0-9, or 'none' for an uncompressed tar or stored zip). Defaults to the gzip default compression level")
+	flagset.StringVar(&cmd.credentials, "credentials", cmd.credentials, "AWS credentials file (or profile://<name> to use the credentials and region for the named profile in the shared AWS config)")
+	flagset.StringVar(&cmd.gcsCreds, "gcs-credentials", cmd.gcsCreds, "Google Cloud service account JSON credentials file for gs:// URLs (defaults to the application default credentials e.g. GOOGLE_APPLICATION_CREDENTIALS)")
+	flagset.StringVar(&cmd.azure.account, "azure-account", cmd.azure.account, "Azure storage account for az:// URLs (defaults to the AZURE_STORAGE_ACCOUNT environment variable)")
+	flagset.StringVar(&cmd.azure.key, "azure-key", cmd.azure.key, "Azure storage account shared key (defaults to the AZURE_STORAGE_KEY environment variable)")
+	flagset.StringVar(&cmd.azure.sas, "azure-sas", cmd.azure.sas, "Azure SAS token for az:// and blob.core.windows.net URLs (defaults to the AZURE_STORAGE_SAS_TOKEN environment variable)")
+	flagset.StringVar(&cmd.azure.connection, "azure-connection-string", cmd.azure.connection, "Azure storage connection string (defaults to the AZURE_STORAGE_CONNECTION_STRING environment variable)")
+	flagset.StringVar(&cmd.sftp.key, "ssh-key", cmd.sftp.key, "SSH private key file for sftp:// URLs (the passphrase for an encrypted key is taken from the SSH_KEY_PASSPHRASE environment variable)")
+	flagset.StringVar(&cmd.sftp.knownHosts, "known-hosts", cmd.sftp.knownHosts, "SSH known_hosts file used to verify the SFTP server host key (defaults to ~/.ssh/known_hosts)")
+	flagset.StringVar(&cmd.profile, "profile", cmd.profile, "AWS credentials file profile (defaults to 'default')")
+	flagset.StringVar(&cmd.region, "region", cmd.region, "AWS region for S3 (defaults to us-east-1)")
+	flagset.StringVar(&cmd.role.arn, "role-arn", cmd.role.arn, "ARN of an IAM role to assume (using STS AssumeRole) for S3 access e.g. for cross-account access")
+	flagset.StringVar(&cmd.role.externalID, "external-id", cmd.role.externalID, "External ID for assuming the --role-arn role")
+	flagset.DurationVar(&cmd.role.duration, "role-duration", cmd.role.duration, "Session duration for the assumed --role-arn role (credentials are refreshed automatically when they expire)")
+	flagset.StringVar(&cmd.endpoint.url, "endpoint", cmd.endpoint.url, "Custom S3 endpoint URL for S3 compatible stores e.g. http://minio.local:9000 (defaults to AWS S3)")
+	flagset.BoolVar(&cmd.endpoint.pathStyle, "path-style", cmd.endpoint.pathStyle, "Uses path-style (http://host/bucket/key) rather than virtual-hosted style S3 addressing (e.g. for MinIO)")
+	flagset.StringVar(&cmd.proxy, "proxy", cmd.proxy, "HTTP proxy URL for HTTP and S3 requests (overrides the HTTP_PROXY and HTTPS_PROXY environment variables, NO_PROXY still applies)")
+	flagset.DurationVar(&cmd.httpTimeout, "http-timeout", cmd.httpTimeout, "Timeout for HTTP requests, including reading the response body (0 for no timeout)")
+	flagset.StringVar(&cmd.httpAuth.user, "http-user", cmd.httpAuth.user, "User name for HTTP basic auth (defaults to the UHPPOTED_HTTP_USER environment variable)")
+	flagset.StringVar(&cmd.httpAuth.password, "http-password", cmd.httpAuth.password, "Password for HTTP basic auth (defaults to the UHPPOTED_HTTP_PASSWORD environment variable)")
+	flagset.StringVar(&cmd.httpAuth.bearer, "http-bearer", cmd.httpAuth.bearer, "Bearer token for HTTP requests (defaults to the UHPPOTED_HTTP_BEARER environment variable)")
+	flagset.StringVar(&cmd.httpTLS.cert, "client-cert", cmd.httpTLS.cert, "PEM client certificate file for mutual TLS with https:// servers")
+	flagset.StringVar(&cmd.httpTLS.key, "client-key", cmd.httpTLS.key, "PEM private key file for the --client-cert client certificate")
+	flagset.StringVar(&cmd.httpTLS.ca, "ca-cert", cmd.httpTLS.ca, "PEM CA certificates file for verifying https:// server certificates (defaults to the system CA certificates)")
+	flagset.IntVar(&cmd.retry.retries, "retries", cmd.retry.retries, "Number of times to retry an S3 or HTTP request after a transient failure (5xx response, connection reset or timeout)")
+	flagset.DurationVar(&cmd.retry.delay, "retry-delay", cmd.retry.delay, "Delay before the first retry of a failed S3 or HTTP request, doubling (with jitter) for each subsequent retry")
+	flagset.StringVar(&cmd.encryption.sse, "sse", cmd.encryption.sse, "Server-side encryption for uploaded S3 objects ('AES256' or 'aws:kms')")
+	flagset.StringVar(&cmd.encryption.kmsKeyID, "sse-kms-key-id", cmd.encryption.kmsKeyID, "KMS key ID for 'aws:kms' server-side encryption (defaults to the AWS managed key)")
+	flagset.IntVar(&cmd.multipart.partSize, "part-size", cmd.multipart.partSize, "Part size (in MiB) for multipart S3 uploads. Smaller files are uploaded with a single PUT request")
+	flagset.IntVar(&cmd.multipart.concurrency, "upload-concurrency", cmd.multipart.concurrency, "Number of parts of a multipart S3 upload to upload concurrently")
+	flagset.Var(&cmd.tags, "tag", "S3 object tag (key=value) for uploaded S3 objects (may be repeated, up to 10 tags)")
+	flagset.StringVar(&cmd.cacheCtrl, "cache-control", cmd.cacheCtrl, "Cache-Control header for uploaded S3 objects e.g. 'no-cache' or 'max-age=300'")
+	flagset.StringVar(&cmd.keyfile, "key", cmd.keyfile, "RSA or ed25519 signing key (or a comma separated list of keys to attach multiple signatures e.g. during key rotation)")
+	flagset.StringVar(&cmd.passphrase, "key-passphrase", cmd.passphrase, "Passphrase for an encrypted signing key (defaults to the UHPPOTED_KEY_PASSPHRASE environment variable)")
+	flagset.StringVar(&cmd.cert, "cert", cmd.cert, "PEM file with the signing key certificate chain to include in the uploaded file")
+	flagset.BoolVar(&cmd.canonical, "canonicalize", cmd.canonical, "Signs the canonical form (LF line endings, no trailing whitespace) of the report (adds a 'version' entry to the uploaded file)")
+	flagset.IntVar(&cmd.concurrency, "concurrency", cmd.concurrency, "Maximum number of controllers to retrieve the ACL from concurrently (defaults to 1, 0 for all the controllers at once)")
+	flagset.BoolVar(&cmd.nolog, "no-log", cmd.nolog, "Writes log messages to stdout rather than a rotatable log file")
+	flagset.StringVar(&cmd.logFormat, "log-format", cmd.logFormat, "Log message format ('text' or 'json' i.e. one JSON object per log message)")
+	flagset.IntVar(&cmd.logMaxFiles, "log-max-files", cmd.logMaxFiles, "Maximum number of rotated log files to retain (0 for no limit)")
+	flagset.IntVar(&cmd.logMaxAge, "log-max-age", cmd.logMaxAge, "Maximum age (in days) of rotated log files to retain (0 for no limit)")
+
+	return flagset
+}
+
+func (cmd *CompareSites) Description() string {
+	return fmt.Sprintf("Retrieves the ACLs from the controllers at two sites and reports the cards that differ between the sites")
+}
+
+func (cmd *CompareSites) Usage() string {
+	return "compare-sites --site-a <file> --site-b <file>"
+}
+
+func (cmd *CompareSites) Help() {
+	fmt.Println()
+	fmt.Printf("  Usage: %s [--debug] [--config <file>] compare-sites [--site-a <file>] --site-b <file> [--report <URL>] [--credentials <file>] [--gcs-credentials <file>] [--azure-account <account>] [--azure-key <key>] [--azure-sas <token>] [--azure-connection-string <string>] [--ssh-key <file>] [--known-hosts <file>] [--profile <file>] [--region <region>] [--role-arn <ARN>] [--external-id <ID>] [--role-duration <duration>] [--endpoint <URL>] [--path-style] [--proxy <URL>] [--http-timeout <duration>] [--http-user <user>] [--http-password <password>] [--http-bearer <token>] [--client-cert <file>] [--client-key <file>] [--ca-cert <file>] [--retries <N>] [--retry-delay <duration>] [--archive tar.gz|zip] [--compression 0-9|none] [--sse AES256|aws:kms] [--sse-kms-key-id <key>] [--part-size <MiB>] [--upload-concurrency <N>] [--tag <key=value>] [--cache-control <value>] [--key <file>] [--key-passphrase <passphrase>] [--cert <file>] [--canonicalize] [--concurrency <N>] [--no-log] [--log-format text|json] [--log-max-files <N>] [--log-max-age <days>]\n", APP)
+	fmt.Println()
+	fmt.Println("    Retrieves the ACLs from the controllers configured in the site A and site B configuration files and compares")
+	fmt.Println("    them against each other. Controllers are paired by controller name and are expected to have the same door")
+	fmt.Println("    assignments.")
+	fmt.Println()
+
+	helpOptions(cmd.FlagSet())
+	fmt.Println()
+}
+
+func (cmd *CompareSites) Execute(args ...interface{}) error {
+	options := args[0].(*Options)
+
+	cmd.config = options.Config
+	cmd.debug = options.Debug
+	cmd.ctx = options.ctx()
+
+	if err := setProxy(cmd.proxy); err != nil {
+		return err
+	}
+
+	if err := setClientTLS(cmd.httpTLS); err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(cmd.siteA) == "" {
+		cmd.siteA = cmd.config
+	}
+
+	if strings.TrimSpace(cmd.siteB) == "" {
+		return fmt.Errorf("compare-sites requires a configuration file for site B")
+	}
+
+	if err := cmd.encryption.validate(); err != nil {
+		return err
+	}
+
+	if err := cmd.multipart.validate(); err != nil {
+		return err
+	}
+
+	if err := cmd.tags.validate(); err != nil {
+		return err
+	}
+
+	if _, err := archiver(cmd.archive, "", cmd.compression); err != nil {
+		return err
+	}
+
+	confA := config.NewConfig()
+	if err := confA.Load(cmd.siteA); err != nil {
+		return fmt.Errorf("WARN  Could not load site A configuration (%v)", err)
+	}
+
+	confB := config.NewConfig()
+	if err := confB.Load(cmd.siteB); err != nil {
+		return fmt.Errorf("WARN  Could not load site B configuration (%v)", err)
+	}
+
+	if cmd.credentials == "" {
+		cmd.credentials = confA.AWS.Credentials
+	}
+
+	if cmd.profile == "" {
+		cmd.profile = confA.AWS.Profile
+	}
+
+	if cmd.region == "" && !isProfileURI(cmd.credentials) {
+		cmd.region = confA.AWS.Region
+	}
+
+	if err := cmd.httpAuth.resolve(); err != nil {
+		return err
+	}
+
+	if err := cmd.azure.resolve(); err != nil {
+		return err
+	}
+
+	logger, err := newLogger(cmd.Name(), cmd.logFile, cmd.logFileSize, cmd.logMaxFiles, cmd.logMaxAge, cmd.nolog, cmd.logFormat, os.Stdout)
+	if err != nil {
+		return err
+	}
+
+	cmd.retry.log = logger
+
+	ua, devicesA := getDevices(confA, cmd.debug)
+	ub, devicesB := getDevices(confB, cmd.debug)
+
+	return aborted("compare-sites", cmd.execute(ua, devicesA, ub, devicesB, logger), logger)
+}
+
+func (cmd *CompareSites) execute(ua uhppote.IUHPPOTE, devicesA []uhppote.Device, ub uhppote.IUHPPOTE, devicesB []uhppote.Device, log *log.Logger) error {
+	pairs, err := pairDevices(devicesA, devicesB)
+	if err != nil {
+		return err
+	}
+
+	a, errorsA, _, err := getACL(cmd.ctx, ua, devicesA, cmd.concurrency)
+	if err != nil {
+		return err
+	}
+
+	b, errorsB, _, err := getACL(cmd.ctx, ub, devicesB, cmd.concurrency)
+	if err != nil {
+		return err
+	}
+
+	if errors := append(errorsA, errorsB...); len(errors) > 0 {
+		return fmt.Errorf("%w %v", ErrUnreachable, errors)
+	}
+
+	// ... re-key site B by the paired site A controller so that the ACLs can be compared
+	src := acl.ACL{}
+	dst := acl.ACL{}
+	for _, p := range pairs {
+		src[p.A] = b[p.B]
+		dst[p.A] = a[p.A]
+	}
+
+	diff, err := acl.Compare(src, dst)
+	if err != nil {
+		return err
+	}
+
+	drift := false
+	for i, p := range pairs {
+		d := diff[p.A]
+		pairs[i].Diff = d
+
+		log.Printf("%v  SUMMARY  same:%v  different:%v  only-a:%v  only-b:%v", p.Name, len(d.Unchanged), len(d.Updated), len(d.Added), len(d.Deleted))
+
+		if d.HasChanges() {
+			drift = true
+		}
+	}
+
+	var w bytes.Buffer
+	if err := cmd.report(pairs, &w); err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(cmd.rpt) == "" {
+		fmt.Println(w.String())
+	} else if err := cmd.upload(w.Bytes(), log); err != nil {
+		return err
+	}
+
+	if drift {
+		return ErrDrift
+	}
+
+	return nil
+}
+
+// Pairs the site A and site B controllers by controller name.
+func pairDevices(devicesA, devicesB []uhppote.Device) ([]sitePair, error) {
+	names := map[string]uhppote.Device{}
+	for _, d := range devicesB {
+		names[clean(d.Name)] = d
+	}
+
+	pairs := []sitePair{}
+	for _, d := range devicesA {
+		peer, ok := names[clean(d.Name)]
+		if !ok {
+			return nil, fmt.Errorf("No site B controller matches site A controller %v ('%v')", d.DeviceID, d.Name)
+		}
+
+		delete(names, clean(d.Name))
+
+		pairs = append(pairs, sitePair{
+			Name: d.Name,
+			A:    d.DeviceID,
+			B:    peer.DeviceID,
+		})
+	}
+
+	for _, d := range devicesB {
+		if _, ok := names[clean(d.Name)]; ok {
+			return nil, fmt.Errorf("No site A controller matches site B controller %v ('%v')", d.DeviceID, d.Name)
+		}
+	}
+
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Name < pairs[j].Name })
+
+	return pairs, nil
+}
+
+func (cmd *CompareSites) report(pairs []sitePair, w io.Writer) error {
+	t, err := template.New("report").Parse(cmd.template)
+	if err != nil {
+		return err
+	}
+
+	rpt := struct {
+		DateTime types.DateTime
+		SiteA    string
+		SiteB    string
+		Pairs    []sitePair
+	}{
+		DateTime: types.DateTime(time.Now()),
+		SiteA:    cmd.siteA,
+		SiteB:    cmd.siteB,
+		Pairs:    pairs,
+	}
+
+	return t.Execute(w, rpt)
+}
+
+func (cmd *CompareSites) upload(rpt []byte, log *log.Logger) error {
+	log.Printf("Uploading site 'diff' report")
+
+	filename := time.Now().Format("sites-2006-01-02T150405.rpt")
+	var files = map[string][]byte{
+		filename: rpt,
+	}
+
+	if cmd.canonical {
+		files["version"] = []byte(fmt.Sprintf("%v\n", CANONICAL_VERSION))
+	}
+
+	signatures, err := sign(signable(files, rpt), cmd.keyfile, cmd.passphrase)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range signatures {
+		files[k] = v
+	}
+
+	if cmd.cert != "" {
+		chain, err := loadCertificateChain(cmd.cert)
+		if err != nil {
+			return err
+		}
+
+		files["certificate"] = chain
+	}
+
+	var b bytes.Buffer
+	x, err := archiver(cmd.archive, cmd.rpt, cmd.compression)
+	if err != nil {
+		return err
+	}
+
+	if err := x(files, &b); err != nil {
+		return err
+	}
+
+	log.Printf("tar'd report (%v bytes) and signature (%v bytes): %v bytes", len(rpt), len(files["signature"]), b.Len())
+
+	if err := cmd.store(cmd.rpt, bytes.NewReader(b.Bytes())); err != nil {
+		return err
+	}
+
+	log.Printf("Uploaded to %v", cmd.rpt)
+
+	return nil
+}
+
+func (cmd *CompareSites) store(uri string, r io.Reader) error {
+	options := StoreOptions{
+		Credentials: cmd.credentials,
+		Profile:     cmd.profile,
+		Region:      cmd.region,
+		RoleARN:     cmd.role.arn,
+		ExternalID:  cmd.role.externalID,
+		RoleTTL:     cmd.role.duration,
+		Endpoint:    cmd.endpoint.url,
+		PathStyle:   cmd.endpoint.pathStyle,
+		SSE:         cmd.encryption.sse,
+		SSEKMSKeyID: cmd.encryption.kmsKeyID,
+		PartSize:    cmd.multipart.partSize,
+		Concurrency: cmd.multipart.concurrency,
+		Tags:        cmd.tags,
+		CacheCtrl:   cmd.cacheCtrl,
+		HTTPTimeout: cmd.httpTimeout,
+		HTTPUser:    cmd.httpAuth.user,
+		HTTPPasswd:  cmd.httpAuth.password,
+		HTTPBearer:  cmd.httpAuth.bearer,
+		GCSKeyFile:  cmd.gcsCreds,
+		AzureAcct:   cmd.azure.account,
+		AzureKey:    cmd.azure.key,
+		AzureSAS:    cmd.azure.sas,
+		AzureHost:   cmd.azure.endpoint,
+		SSHKey:      cmd.sftp.key,
+		KnownHosts:  cmd.sftp.knownHosts,
+		Retries:     cmd.retry.retries,
+		RetryDelay:  cmd.retry.delay,
+		Log:         cmd.retry.log,
+	}
+
+	return store(cmd.ctx, uri, r, options)
+}
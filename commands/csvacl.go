@@ -0,0 +1,69 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// Returns the field delimiter for the ACL file i.e. the --delimiter if specified, otherwise a comma for CSV ACL
+// files and a tab for TSV ACL files.
+func aclDelimiter(delimiter, format string) (rune, error) {
+	switch delimiter {
+	case "":
+		if format == "csv" {
+			return ',', nil
+		}
+
+		return '\t', nil
+
+	case "tab", "\\t":
+		return '\t', nil
+
+	case "comma":
+		return ',', nil
+
+	case "semicolon":
+		return ';', nil
+	}
+
+	r, size := utf8.DecodeRuneInString(delimiter)
+	if size != len(delimiter) || r == utf8.RuneError || r == '"' || r == '\r' || r == '\n' {
+		return 0, fmt.Errorf("Invalid --delimiter '%v' (expected 'tab', ',', ';' or a single character)", delimiter)
+	}
+
+	return r, nil
+}
+
+// Converts a comma (or other delimiter) separated ACL file to the equivalent TSV ACL so that it is validated and
+// parsed exactly as for a TSV ACL. Quoted fields may contain the delimiter (and quoted tabs are preserved as quoted
+// fields in the TSV).
+func csvToTSV(b []byte, delimiter rune) ([]byte, error) {
+	r := csv.NewReader(bytes.NewReader(b))
+	r.Comma = delimiter
+	r.FieldsPerRecord = -1
+
+	var w bytes.Buffer
+
+	tsv := csv.NewWriter(&w)
+	tsv.Comma = '\t'
+
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Error parsing delimited ACL file (%w)", err)
+		}
+
+		if err := tsv.Write(record); err != nil {
+			return nil, err
+		}
+	}
+
+	tsv.Flush()
+
+	return w.Bytes(), tsv.Error()
+}
@@ -0,0 +1,58 @@
+package commands
+
+import (
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/uhppoted/uhppote-core/types"
+	"github.com/uhppoted/uhppoted-lib/acl"
+)
+
+// Reclassifies as unchanged the 'updated' cards for which the only difference is the representation of the card
+// dates. The authoritative start and end dates are interpreted as inclusive calendar dates i.e. a card is valid
+// from the start of the 'from' day through to the end of the 'to' day, so a controller end date that is a timestamp
+// anywhere in the 'to' day matches the authoritative date. Only the calendar day is compared i.e. a controller end
+// date on the following day is a different date.
+func matchDates(diff acl.Diff, cards map[uint32]types.Card) acl.Diff {
+	updated := []types.Card{}
+
+	for _, card := range diff.Updated {
+		if c, ok := cards[card.CardNumber]; ok && sameDates(card, c) {
+			diff.Unchanged = append(diff.Unchanged, c)
+		} else {
+			updated = append(updated, card)
+		}
+	}
+
+	diff.Updated = updated
+
+	sort.Slice(diff.Unchanged, func(i, j int) bool { return diff.Unchanged[i].CardNumber < diff.Unchanged[j].CardNumber })
+
+	return diff
+}
+
+func sameDates(card, c types.Card) bool {
+	if !reflect.DeepEqual(card.Doors, c.Doors) {
+		return false
+	}
+
+	switch {
+	case card.From == nil || c.From == nil:
+		if card.From != c.From {
+			return false
+		}
+
+	case card.From.String() != c.From.String():
+		return false
+	}
+
+	if card.To == nil || c.To == nil {
+		return card.To == c.To
+	}
+
+	y1, m1, d1 := time.Time(*card.To).Date()
+	y2, m2, d2 := time.Time(*c.To).Date()
+
+	return y1 == y2 && m1 == m2 && d1 == d2
+}
@@ -0,0 +1,42 @@
+package commands
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uhppoted/uhppote-core/types"
+)
+
+func TestSameDates(t *testing.T) {
+	from := types.ToDate(2021, time.January, 1)
+	to := types.ToDate(2021, time.December, 31)
+
+	card := types.Card{
+		CardNumber: 8165538,
+		From:       &from,
+		To:         &to,
+		Doors:      map[uint8]int{1: 1, 2: 0, 3: 0, 4: 0},
+	}
+
+	tests := map[string]struct {
+		to       time.Time
+		expected bool
+	}{
+		"D-1":          {time.Date(2021, time.December, 30, 0, 0, 0, 0, time.Local), false},
+		"D-1 23:59:59": {time.Date(2021, time.December, 30, 23, 59, 59, 0, time.Local), false},
+		"D":            {time.Date(2021, time.December, 31, 0, 0, 0, 0, time.Local), true},
+		"D 23:59:59":   {time.Date(2021, time.December, 31, 23, 59, 59, 0, time.Local), true},
+		"D+1":          {time.Date(2022, time.January, 1, 0, 0, 0, 0, time.Local), false},
+		"D+1 12:00:00": {time.Date(2022, time.January, 1, 12, 0, 0, 0, time.Local), false},
+	}
+
+	for name, test := range tests {
+		controller := card
+		date := types.Date(test.to)
+		controller.To = &date
+
+		if same := sameDates(card, controller); same != test.expected {
+			t.Errorf("%v: incorrect date match - expected:%v, got:%v", name, test.expected, same)
+		}
+	}
+}
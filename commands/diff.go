@@ -0,0 +1,300 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/uhppoted/uhppote-core/types"
+	"github.com/uhppoted/uhppote-core/uhppote"
+	"github.com/uhppoted/uhppoted-lib/acl"
+	"github.com/uhppoted/uhppoted-lib/config"
+)
+
+// The diff command compares two ACL files without involving the controllers i.e. compare-acl with the --a ACL file
+// standing in for the controller ACL. The fetch, verify and parse pipeline and the report rendering and upload are
+// the compare-acl implementation, so the options and report formats are the same.
+var DiffACLCmd = DiffACL{
+	compare: CompareACLCmd,
+}
+
+type DiffACL struct {
+	a       string
+	b       string
+	compare CompareACL
+}
+
+func (cmd *DiffACL) Name() string {
+	return "diff"
+}
+
+func (cmd *DiffACL) FlagSet() *flag.FlagSet {
+	flagset := flag.NewFlagSet("diff", flag.ExitOnError)
+	c := &cmd.compare
+
+	flagset.StringVar(&cmd.a, "a", cmd.a, "The URL of the 'before' ACL file (taking the place of the controller ACL in the report)")
+	flagset.StringVar(&cmd.b, "b", cmd.b, "The URL of the 'after' ACL file (taking the place of the authoritative ACL in the report)")
+	flagset.StringVar(&c.rpt, "report", c.rpt, "The URL for the uploaded report file (the report is written to the console if not specified)")
+	flagset.StringVar(&c.archive, "archive", c.archive, "Archive format for the uploaded report file ('tar.gz' or 'zip'). Defaults to zip if the URL ends with .zip and tar.gz otherwise")
+	flagset.StringVar(&c.compression, "compression", c.compression, "Compression level for the uploaded archive (0-9, or 'none' for an uncompressed tar or stored zip). Defaults to the gzip default compression level")
+	flagset.StringVar(&c.credentials, "credentials", c.credentials, "AWS credentials file (or profile://<name> to use the credentials and region for the named profile in the shared AWS config)")
+	flagset.StringVar(&c.gcsCreds, "gcs-credentials", c.gcsCreds, "Google Cloud service account JSON credentials file for gs:// URLs (defaults to the application default credentials e.g. GOOGLE_APPLICATION_CREDENTIALS)")
+	flagset.StringVar(&c.azure.account, "azure-account", c.azure.account, "Azure storage account for az:// URLs (defaults to the AZURE_STORAGE_ACCOUNT environment variable)")
+	flagset.StringVar(&c.azure.key, "azure-key", c.azure.key, "Azure storage account shared key (defaults to the AZURE_STORAGE_KEY environment variable)")
+	flagset.StringVar(&c.azure.sas, "azure-sas", c.azure.sas, "Azure SAS token for az:// and blob.core.windows.net URLs (defaults to the AZURE_STORAGE_SAS_TOKEN environment variable)")
+	flagset.StringVar(&c.azure.connection, "azure-connection-string", c.azure.connection, "Azure storage connection string (defaults to the AZURE_STORAGE_CONNECTION_STRING environment variable)")
+	flagset.StringVar(&c.sftp.key, "ssh-key", c.sftp.key, "SSH private key file for sftp:// URLs (the passphrase for an encrypted key is taken from the SSH_KEY_PASSPHRASE environment variable)")
+	flagset.StringVar(&c.sftp.knownHosts, "known-hosts", c.sftp.knownHosts, "SSH known_hosts file used to verify the SFTP server host key (defaults to ~/.ssh/known_hosts)")
+	flagset.StringVar(&c.profile, "profile", c.profile, "AWS credentials file profile (defaults to 'default')")
+	flagset.StringVar(&c.region, "region", c.region, "AWS region for S3 (defaults to us-east-1)")
+	flagset.StringVar(&c.role.arn, "role-arn", c.role.arn, "ARN of an IAM role to assume (using STS AssumeRole) for S3 access e.g. for cross-account access")
+	flagset.StringVar(&c.role.externalID, "external-id", c.role.externalID, "External ID for assuming the --role-arn role")
+	flagset.DurationVar(&c.role.duration, "role-duration", c.role.duration, "Session duration for the assumed --role-arn role (credentials are refreshed automatically when they expire)")
+	flagset.StringVar(&c.endpoint.url, "endpoint", c.endpoint.url, "Custom S3 endpoint URL for S3 compatible stores e.g. http://minio.local:9000 (defaults to AWS S3)")
+	flagset.BoolVar(&c.endpoint.pathStyle, "path-style", c.endpoint.pathStyle, "Uses path-style (http://host/bucket/key) rather than virtual-hosted style S3 addressing (e.g. for MinIO)")
+	flagset.StringVar(&c.proxy, "proxy", c.proxy, "HTTP proxy URL for HTTP and S3 requests (overrides the HTTP_PROXY and HTTPS_PROXY environment variables, NO_PROXY still applies)")
+	flagset.DurationVar(&c.httpTimeout, "http-timeout", c.httpTimeout, "Timeout for HTTP requests, including reading the response body (0 for no timeout)")
+	flagset.StringVar(&c.httpAuth.user, "http-user", c.httpAuth.user, "User name for HTTP basic auth (defaults to the UHPPOTED_HTTP_USER environment variable)")
+	flagset.StringVar(&c.httpAuth.password, "http-password", c.httpAuth.password, "Password for HTTP basic auth (defaults to the UHPPOTED_HTTP_PASSWORD environment variable)")
+	flagset.StringVar(&c.httpAuth.bearer, "http-bearer", c.httpAuth.bearer, "Bearer token for HTTP requests (defaults to the UHPPOTED_HTTP_BEARER environment variable)")
+	flagset.StringVar(&c.httpTLS.cert, "client-cert", c.httpTLS.cert, "PEM client certificate file for mutual TLS with https:// servers")
+	flagset.StringVar(&c.httpTLS.key, "client-key", c.httpTLS.key, "PEM private key file for the --client-cert client certificate")
+	flagset.StringVar(&c.httpTLS.ca, "ca-cert", c.httpTLS.ca, "PEM CA certificates file for verifying https:// server certificates (defaults to the system CA certificates)")
+	flagset.IntVar(&c.retry.retries, "retries", c.retry.retries, "Number of times to retry an S3 or HTTP request after a transient failure (5xx response, connection reset or timeout)")
+	flagset.DurationVar(&c.retry.delay, "retry-delay", c.retry.delay, "Delay before the first retry of a failed S3 or HTTP request, doubling (with jitter) for each subsequent retry")
+	flagset.StringVar(&c.encryption.sse, "sse", c.encryption.sse, "Server-side encryption for uploaded S3 objects ('AES256' or 'aws:kms')")
+	flagset.StringVar(&c.encryption.kmsKeyID, "sse-kms-key-id", c.encryption.kmsKeyID, "KMS key ID for 'aws:kms' server-side encryption (defaults to the AWS managed key)")
+	flagset.IntVar(&c.multipart.partSize, "part-size", c.multipart.partSize, "Part size (in MiB) for multipart S3 uploads. Smaller files are uploaded with a single PUT request")
+	flagset.IntVar(&c.multipart.concurrency, "upload-concurrency", c.multipart.concurrency, "Number of parts of a multipart S3 upload to upload concurrently")
+	flagset.Var(&c.tags, "tag", "S3 object tag (key=value) for uploaded S3 objects (may be repeated, up to 10 tags)")
+	flagset.StringVar(&c.cacheCtrl, "cache-control", c.cacheCtrl, "Cache-Control header for uploaded S3 objects e.g. 'no-cache' or 'max-age=300'")
+	flagset.StringVar(&c.keysdir, "keys", c.keysdir, "Sets the directory to search for RSA or ed25519 signing keys. Key files are expected to be named '<uname>.pub' (and '<uname>/*.pub' for additional e.g. rotated keys)")
+	flagset.StringVar(&c.decryptKey, "decrypt-key", c.decryptKey, "RSA private key file for decrypting ACL files encrypted with store-acl --encrypt-to (the passphrase for an encrypted key is taken from the UHPPOTED_DECRYPT_KEY_PASSPHRASE environment variable)")
+	flagset.StringVar(&c.ca, "ca", c.ca, "PEM file with the trusted CA certificates for verifying the ACL signing certificate chains")
+	flagset.StringVar(&c.keyfile, "key", c.keyfile, "RSA or ed25519 signing key for the uploaded report (or a comma separated list of keys to attach multiple signatures e.g. during key rotation)")
+	flagset.StringVar(&c.passphrase, "key-passphrase", c.passphrase, "Passphrase for an encrypted signing key (defaults to the UHPPOTED_KEY_PASSPHRASE environment variable)")
+	flagset.StringVar(&c.cert, "cert", c.cert, "PEM file with the signing key certificate chain to include in the uploaded file")
+	flagset.StringVar(&c.inputFormat, "input-format", c.inputFormat, "ACL file format ('auto', 'tsv', 'csv' or 'json'). 'auto' detects JSON and CSV ACL files from the .json or .csv extension of the URL or of the ACL file in the archive")
+	flagset.StringVar(&c.delimiter, "delimiter", c.delimiter, "Field delimiter for TSV and CSV ACL files ('tab', ',', ';' or any single character). Defaults to a tab, or a comma for CSV ACL files")
+	flagset.StringVar(&c.format, "format", c.format, "Report format ('text', 'json' or 'html')")
+	flagset.StringVar(&c.tmplFile, "template", c.tmplFile, "Go text/template (or html/template for --format html) file for the report (defaults to the built-in template)")
+	flagset.StringVar(&c.reportName, "report-name", c.reportName, "Report file name pattern in the uploaded archive ({timestamp}, {ext} and {device} placeholders)")
+	flagset.StringVar(&c.nameMap, "device-name-map", c.nameMap, "TSV or JSON file mapping controller IDs to friendly names for the report")
+	flagset.StringVar(&c.onDuplicate, "on-duplicate", c.onDuplicate, "Action for duplicate card numbers in the ACL files: 'warn' (default), 'error' or 'merge' (merges the dates and door permissions)")
+	flagset.BoolVar(&c.normalize, "normalize-cards", c.normalize, "Normalizes the ACL card numbers to the canonical decimal form reported by the controllers")
+	flagset.BoolVar(&c.noverify, "no-verify", c.noverify, "Disables verification of the ACL file signatures")
+	flagset.BoolVar(&c.failOnDiff, "fail-on-diff", c.failOnDiff, "Exits with the 'drift' exit code if the ACL files differ (use --fail-on-diff=false to exit cleanly)")
+	flagset.BoolVar(&c.canonical, "canonicalize", c.canonical, "Signs the canonical form (LF line endings, no trailing whitespace) of the report (adds a 'version' entry to the uploaded file)")
+	flagset.BoolVar(&c.nolog, "no-log", c.nolog, "Writes log messages to stdout rather than a rotatable log file")
+	flagset.StringVar(&c.logFormat, "log-format", c.logFormat, "Log message format ('text' or 'json' i.e. one JSON object per log message)")
+	flagset.IntVar(&c.logMaxFiles, "log-max-files", c.logMaxFiles, "Maximum number of rotated log files to retain (0 for no limit)")
+	flagset.IntVar(&c.logMaxAge, "log-max-age", c.logMaxAge, "Maximum age (in days) of rotated log files to retain (0 for no limit)")
+
+	return flagset
+}
+
+func (cmd *DiffACL) Description() string {
+	return fmt.Sprintf("Compares two ACL files and reports the cards that differ, without involving the controllers")
+}
+
+func (cmd *DiffACL) Usage() string {
+	return "diff --a <URL> --b <URL>"
+}
+
+func (cmd *DiffACL) Help() {
+	fmt.Println()
+	fmt.Printf("  Usage: %s [--debug] [--config <file>] diff --a <URL> --b <URL> [--report <URL>] [--credentials <file>] [--gcs-credentials <file>] [--azure-account <account>] [--azure-key <key>] [--azure-sas <token>] [--azure-connection-string <string>] [--ssh-key <file>] [--known-hosts <file>] [--profile <file>] [--region <region>] [--role-arn <ARN>] [--external-id <ID>] [--role-duration <duration>] [--endpoint <URL>] [--path-style] [--proxy <URL>] [--http-timeout <duration>] [--http-user <user>] [--http-password <password>] [--http-bearer <token>] [--client-cert <file>] [--client-key <file>] [--ca-cert <file>] [--retries <N>] [--retry-delay <duration>] [--archive tar.gz|zip] [--compression 0-9|none] [--sse AES256|aws:kms] [--sse-kms-key-id <key>] [--part-size <MiB>] [--upload-concurrency <N>] [--tag <key=value>] [--cache-control <value>] [--keys <dir>] [--decrypt-key <file>] [--ca <file>] [--key <file>] [--key-passphrase <passphrase>] [--cert <file>] [--input-format auto|tsv|csv|json] [--delimiter <char>] [--format text|json|html] [--template <file>] [--report-name <pattern>] [--device-name-map <file>] [--on-duplicate warn|error|merge] [--normalize-cards] [--no-verify] [--fail-on-diff[=false]] [--canonicalize] [--no-log] [--log-format text|json] [--log-max-files <N>] [--log-max-age <days>]\n", APP)
+	fmt.Println()
+	fmt.Println("    Fetches, verifies and parses the --a and --b ACL files and compares them against each other, producing the")
+	fmt.Println("    same report as compare-acl with the --a ACL file in place of the controller ACL i.e. 'missing' cards are")
+	fmt.Println("    only in --b and 'unexpected' cards are only in --a. The controllers in the configuration file define the")
+	fmt.Println("    doors but are not accessed.")
+	fmt.Println()
+
+	helpOptions(cmd.FlagSet())
+	fmt.Println()
+}
+
+func (cmd *DiffACL) Execute(args ...interface{}) error {
+	options := args[0].(*Options)
+	c := &cmd.compare
+
+	c.config = options.Config
+	c.debug = options.Debug
+	c.ctx = options.ctx()
+
+	if err := setProxy(c.proxy); err != nil {
+		return err
+	}
+
+	if err := setClientTLS(c.httpTLS); err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(cmd.a) == "" || strings.TrimSpace(cmd.b) == "" {
+		return fmt.Errorf("diff requires the URLs of the --a and --b ACL files")
+	}
+
+	if err := checkOnDuplicate(c.onDuplicate); err != nil {
+		return err
+	}
+
+	if _, err := aclFormat(c.inputFormat, "", nil); err != nil {
+		return err
+	}
+
+	if _, err := aclDelimiter(c.delimiter, ""); err != nil {
+		return err
+	}
+
+	if c.format != "text" && c.format != "json" && c.format != "html" {
+		return fmt.Errorf("Invalid --format '%s' (expected 'text', 'json' or 'html')", c.format)
+	}
+
+	if err := checkReportName(c.reportName); err != nil {
+		return err
+	}
+
+	if c.tmplFile != "" {
+		if c.format == "json" {
+			return fmt.Errorf("--template is only applicable to the 'text' and 'html' report formats")
+		}
+
+		t, err := loadTemplate(c.tmplFile, c.format)
+		if err != nil {
+			return err
+		}
+
+		c.template = t
+	} else if c.format == "html" {
+		c.template = HTML_TEMPLATE
+	}
+
+	if err := c.encryption.validate(); err != nil {
+		return err
+	}
+
+	if err := c.multipart.validate(); err != nil {
+		return err
+	}
+
+	if err := c.tags.validate(); err != nil {
+		return err
+	}
+
+	if _, err := archiver(c.archive, "", c.compression); err != nil {
+		return err
+	}
+
+	conf := config.NewConfig()
+	if err := conf.Load(c.config); err != nil {
+		return fmt.Errorf("WARN  Could not load configuration (%v)", err)
+	}
+
+	if c.credentials == "" {
+		c.credentials = conf.AWS.Credentials
+	}
+
+	if c.profile == "" {
+		c.profile = conf.AWS.Profile
+	}
+
+	if c.region == "" && !isProfileURI(c.credentials) {
+		c.region = conf.AWS.Region
+	}
+
+	if err := c.httpAuth.resolve(); err != nil {
+		return err
+	}
+
+	if err := c.azure.resolve(); err != nil {
+		return err
+	}
+
+	levels, err := loadAccessLevels(c.config)
+	if err != nil {
+		return fmt.Errorf("Error loading access levels from %v (%w)", c.config, err)
+	}
+
+	c.levels = levels
+
+	names, err := loadDeviceNames(c.nameMap, c.config)
+	if err != nil {
+		return fmt.Errorf("Error loading device names (%w)", err)
+	}
+
+	c.names = names
+
+	logger, err := newLogger(cmd.Name(), c.logFile, c.logFileSize, c.logMaxFiles, c.logMaxAge, c.nolog, c.logFormat, os.Stdout)
+	if err != nil {
+		return err
+	}
+
+	c.retry.log = logger
+
+	_, devices := getDevices(conf, c.debug)
+
+	return aborted("diff", cmd.execute(fileURI(cmd.a), fileURI(cmd.b), devices, logger), logger)
+}
+
+func (cmd *DiffACL) execute(a, b string, devices []uhppote.Device, log *log.Logger) error {
+	c := &cmd.compare
+
+	before, _, err := c.fetchACL(a, devices, log)
+	if err != nil {
+		return err
+	}
+
+	c.duplicates = nil
+	after, raw, err := c.fetchACL(b, devices, log)
+	if err != nil {
+		return err
+	}
+
+	diff, err := acl.Compare(before, after)
+	if err != nil {
+		return err
+	}
+
+	drift := DiffError{}
+	for k, v := range diff {
+		log.Printf("%v  SUMMARY  same:%v  different:%v  only-b:%v  only-a:%v", k, len(v.Unchanged), len(v.Updated), len(v.Added), len(v.Deleted))
+
+		drift.Incorrect += len(v.Updated)
+		drift.Missing += len(v.Added)
+		drift.Unexpected += len(v.Deleted)
+	}
+
+	timestamp := types.DateTime(time.Now())
+	rpt := Report{
+		DateTime:   &timestamp,
+		Diffs:      diff,
+		Overflow:   map[uint32]*Overflow{},
+		Names:      c.names,
+		Review:     map[uint32]bool{},
+		Duplicates: c.duplicates,
+		Devices:    reportDevices(devices, c.names),
+		Skipped:    map[uint32]bool{},
+		Errors:     map[uint32]string{},
+	}
+
+	if strings.TrimSpace(c.rpt) == "" {
+		body, _, err := c.render(rpt)
+		if err != nil {
+			return err
+		}
+
+		os.Stdout.Write(body)
+	} else if _, err := c.upload(rpt, raw, log); err != nil {
+		return err
+	}
+
+	if c.failOnDiff && (drift.Incorrect > 0 || drift.Missing > 0 || drift.Unexpected > 0) {
+		return &drift
+	}
+
+	return nil
+}
@@ -0,0 +1,117 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/csv"
+	"sort"
+	"strings"
+
+	"github.com/uhppoted/uhppote-core/types"
+	"github.com/uhppoted/uhppote-core/uhppote"
+	"github.com/uhppoted/uhppoted-lib/acl"
+)
+
+// Replaces the 'Disabled' column (if any) in the TSV by denying access to all doors for the cards that
+// are marked as disabled i.e. a disabled card remains on the controllers but with no door permissions.
+func resolveDisabled(tsv []byte, devices []uhppote.Device) ([]byte, error) {
+	r := csv.NewReader(bytes.NewReader(tsv))
+	r.Comma = '\t'
+	r.FieldsPerRecord = -1
+
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	} else if len(records) == 0 {
+		return tsv, nil
+	}
+
+	header := records[0]
+	column := -1
+	for ix, field := range header {
+		if clean(field) == "disabled" {
+			column = ix
+			break
+		}
+	}
+
+	if column < 0 {
+		return tsv, nil
+	}
+
+	doors := map[string]bool{}
+	for _, d := range devices {
+		for _, door := range d.Doors {
+			if key := clean(door); key != "" {
+				doors[key] = true
+			}
+		}
+	}
+
+	var b bytes.Buffer
+
+	w := csv.NewWriter(&b)
+	w.Comma = '\t'
+
+	for line, record := range records {
+		// ... invalid records are passed through unchanged for the ACL parser to report
+		if len(record) != len(header) {
+			if err := w.Write(record); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		disabled := line > 0 && strings.EqualFold(strings.TrimSpace(record[column]), "Y")
+		row := []string{}
+		for ix, field := range record {
+			if ix == column {
+				continue
+			}
+
+			if disabled && doors[clean(header[ix])] {
+				field = "N"
+			}
+
+			row = append(row, field)
+		}
+
+		if err := w.Write(row); err != nil {
+			return nil, err
+		}
+	}
+
+	w.Flush()
+
+	return b.Bytes(), w.Error()
+}
+
+// Treats a disabled (all doors denied) authoritative card as matching a disabled controller card even
+// if the card dates differ.
+func matchDisabled(diff acl.Diff, cards map[uint32]types.Card) acl.Diff {
+	updated := []types.Card{}
+
+	for _, card := range diff.Updated {
+		if c, ok := cards[card.CardNumber]; ok && isDisabled(card) && isDisabled(c) {
+			diff.Unchanged = append(diff.Unchanged, c)
+		} else {
+			updated = append(updated, card)
+		}
+	}
+
+	diff.Updated = updated
+
+	sort.Slice(diff.Unchanged, func(i, j int) bool { return diff.Unchanged[i].CardNumber < diff.Unchanged[j].CardNumber })
+
+	return diff
+}
+
+func isDisabled(card types.Card) bool {
+	for _, v := range card.Doors {
+		if v != 0 {
+			return false
+		}
+	}
+
+	return true
+}
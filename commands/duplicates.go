@@ -0,0 +1,241 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/uhppoted/uhppote-core/uhppote"
+)
+
+// Card listed more than once in the authoritative ACL. The lines are the TSV record numbers (excluding the header)
+// and Conflict is set if the records have different dates or door permissions.
+type Duplicate struct {
+	CardNumber uint32
+	Lines      []int
+	Conflict   bool
+	Merged     bool
+}
+
+func (d Duplicate) String() string {
+	lines := []string{}
+	for _, l := range d.Lines {
+		lines = append(lines, fmt.Sprintf("%v", l))
+	}
+
+	s := fmt.Sprintf("%-10v lines %v", d.CardNumber, strings.Join(lines, ","))
+	if d.Conflict {
+		s += "  CONFLICTING"
+	}
+
+	if d.Merged {
+		s += "  MERGED"
+	}
+
+	return s
+}
+
+func checkOnDuplicate(v string) error {
+	switch v {
+	case "warn", "error", "merge":
+		return nil
+
+	default:
+		return fmt.Errorf("Invalid --on-duplicate '%v' (expected 'warn', 'error' or 'merge')", v)
+	}
+}
+
+// Applies the --on-duplicate policy to the duplicate card numbers in the TSV i.e. logs a warning for each duplicate
+// card number and then either continues ('warn'), fails ('error') or merges the duplicate records ('merge').
+func resolveDuplicates(tsv []byte, policy string, devices []uhppote.Device, log *log.Logger) ([]byte, []Duplicate, error) {
+	list := duplicates(tsv)
+	if len(list) == 0 {
+		return tsv, nil, nil
+	}
+
+	cards := []string{}
+	for _, d := range list {
+		log.Printf("WARN  duplicate card number in ACL: %v", d)
+		cards = append(cards, fmt.Sprintf("%v", d.CardNumber))
+	}
+
+	switch policy {
+	case "error":
+		return nil, list, fmt.Errorf("Duplicate card numbers in ACL (%v)", strings.Join(cards, ", "))
+
+	case "merge":
+		merged, err := mergeDuplicates(tsv, list, devices)
+		if err != nil {
+			return nil, list, err
+		}
+
+		for i := range list {
+			list[i].Merged = true
+		}
+
+		log.Printf("Merged the records for %v duplicate card numbers", len(list))
+
+		return merged, list, nil
+
+	default:
+		return tsv, list, nil
+	}
+}
+
+// The ACL parser warns about (and ignores) each duplicate card number - already reported by resolveDuplicates.
+func isDuplicateWarning(err error) bool {
+	return strings.HasPrefix(err.Error(), "Duplicate card number")
+}
+
+// Finds the card numbers that are listed more than once in the TSV. Invalid records are left for the ACL parser
+// to report.
+func duplicates(tsv []byte) []Duplicate {
+	records, column := readTSV(tsv)
+	if column < 0 {
+		return nil
+	}
+
+	lines := map[uint32][]int{}
+	for line, record := range records[1:] {
+		if len(record) != len(records[0]) {
+			continue
+		}
+
+		if cardnumber, err := strconv.ParseUint(strings.TrimSpace(record[column]), 10, 32); err == nil {
+			lines[uint32(cardnumber)] = append(lines[uint32(cardnumber)], line+1)
+		}
+	}
+
+	list := []Duplicate{}
+	for k, v := range lines {
+		if len(v) > 1 {
+			d := Duplicate{CardNumber: k, Lines: v}
+			for _, l := range v[1:] {
+				if !sameRecord(records[v[0]], records[l], column) {
+					d.Conflict = true
+				}
+			}
+
+			list = append(list, d)
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].CardNumber < list[j].CardNumber })
+
+	return list
+}
+
+// Merges the records for duplicate card numbers into a single record (at the position of the first record) with
+// the earliest 'from' date, the latest 'to' date and the union of the door permissions (a time profile grants
+// access to a door that would otherwise be denied, 'Y' takes precedence over a time profile).
+func mergeDuplicates(tsv []byte, duplicates []Duplicate, devices []uhppote.Device) ([]byte, error) {
+	records, column := readTSV(tsv)
+	if column < 0 || len(duplicates) == 0 {
+		return tsv, nil
+	}
+
+	header := records[0]
+	from := -1
+	to := -1
+	doors := map[int]bool{}
+	for ix, field := range header {
+		switch key := clean(field); key {
+		case "from":
+			from = ix
+		case "to":
+			to = ix
+		default:
+			for _, d := range devices {
+				for _, door := range d.Doors {
+					if clean(door) != "" && clean(door) == key {
+						doors[ix] = true
+					}
+				}
+			}
+		}
+	}
+
+	merged := map[int]bool{}
+	for _, d := range duplicates {
+		record := records[d.Lines[0]]
+		for _, l := range d.Lines[1:] {
+			other := records[l]
+			for ix := range record {
+				switch {
+				case ix == from && strings.TrimSpace(other[ix]) < strings.TrimSpace(record[ix]):
+					record[ix] = other[ix]
+				case ix == to && strings.TrimSpace(other[ix]) > strings.TrimSpace(record[ix]):
+					record[ix] = other[ix]
+				case doors[ix]:
+					record[ix] = mergePermission(record[ix], other[ix])
+				}
+			}
+
+			merged[l] = true
+		}
+	}
+
+	var b bytes.Buffer
+
+	w := csv.NewWriter(&b)
+	w.Comma = '\t'
+
+	for line, record := range records {
+		if !merged[line] {
+			if err := w.Write(record); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	w.Flush()
+
+	return b.Bytes(), w.Error()
+}
+
+func mergePermission(p, q string) string {
+	p = strings.TrimSpace(p)
+	q = strings.TrimSpace(q)
+
+	switch {
+	case strings.EqualFold(p, "Y") || strings.EqualFold(q, "Y"):
+		return "Y"
+	case p == "" || strings.EqualFold(p, "N"):
+		return q
+	default:
+		return p
+	}
+}
+
+func sameRecord(p, q []string, column int) bool {
+	for ix := range p {
+		if ix != column && !strings.EqualFold(strings.TrimSpace(p[ix]), strings.TrimSpace(q[ix])) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func readTSV(tsv []byte) ([][]string, int) {
+	r := csv.NewReader(bytes.NewReader(tsv))
+	r.Comma = '\t'
+	r.FieldsPerRecord = -1
+
+	records, err := r.ReadAll()
+	if err != nil || len(records) == 0 {
+		return nil, -1
+	}
+
+	for ix, field := range records[0] {
+		if clean(field) == "cardnumber" {
+			return records, ix
+		}
+	}
+
+	return nil, -1
+}
@@ -0,0 +1,87 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Sentinel errors for the command outcomes. Errors returned by the commands wrap one of these (where applicable) so
+// that code embedding this package can branch on the cause with errors.Is (or errors.As for the error types below).
+var ErrDrift = errors.New("controller ACL does not match authoritative ACL")
+var ErrUnreachable = errors.New("controller unreachable")
+var ErrFetch = errors.New("error fetching ACL")
+var ErrVerify = errors.New("ACL signature verification failed")
+var ErrParse = errors.New("invalid ACL")
+
+// Sentinel errors for SFTP host key verification failures i.e. a host key that does not match the key in the
+// known_hosts file (a possible man-in-the-middle attack) and a host that is not in the known_hosts file.
+var ErrHostKeyMismatch = errors.New("SSH host key mismatch")
+var ErrUnknownHost = errors.New("unknown SSH host")
+
+// DiffError is returned by compare-acl when the controllers differ from the authoritative ACL, with the total number
+// of incorrect, missing and unexpected cards across all the controllers.
+type DiffError struct {
+	Incorrect  int
+	Missing    int
+	Unexpected int
+}
+
+// FetchError is returned when an ACL file (or LDAP directory) could not be retrieved.
+type FetchError struct {
+	URL string
+	Err error
+}
+
+// VerifyError is returned when an ACL file signature (or certificate chain) could not be verified.
+type VerifyError struct {
+	Err error
+}
+
+// ParseError is returned when an ACL file could not be unpacked or contains invalid records.
+type ParseError struct {
+	Err error
+}
+
+func (e *DiffError) Error() string {
+	return fmt.Sprintf("%v (incorrect:%v  missing:%v  unexpected:%v)", ErrDrift, e.Incorrect, e.Missing, e.Unexpected)
+}
+
+func (e *DiffError) Is(target error) bool {
+	return target == ErrDrift
+}
+
+func (e *FetchError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+func (e *FetchError) Is(target error) bool {
+	return target == ErrFetch
+}
+
+func (e *VerifyError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *VerifyError) Unwrap() error {
+	return e.Err
+}
+
+func (e *VerifyError) Is(target error) bool {
+	return target == ErrVerify
+}
+
+func (e *ParseError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ParseError) Is(target error) bool {
+	return target == ErrParse
+}
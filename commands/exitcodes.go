@@ -0,0 +1,103 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type ExitCodes struct {
+	Clean       int
+	Drift       int
+	Unreachable int
+	Fetch       int
+	Verify      int
+	Parse       int
+	Error       int
+}
+
+func NewExitCodes() ExitCodes {
+	return ExitCodes{
+		Clean:       0,
+		Drift:       2,
+		Unreachable: 3,
+		Fetch:       1,
+		Verify:      1,
+		Parse:       1,
+		Error:       1,
+	}
+}
+
+func (e ExitCodes) Code(err error) int {
+	switch {
+	case err == nil:
+		return e.Clean
+
+	case errors.Is(err, ErrUnreachable):
+		return e.Unreachable
+
+	case errors.Is(err, ErrDrift):
+		return e.Drift
+
+	case errors.Is(err, ErrFetch):
+		return e.Fetch
+
+	case errors.Is(err, ErrVerify):
+		return e.Verify
+
+	case errors.Is(err, ErrParse):
+		return e.Parse
+
+	default:
+		return e.Error
+	}
+}
+
+func (e *ExitCodes) String() string {
+	return fmt.Sprintf("clean:%v,drift:%v,unreachable:%v,fetch:%v,verify:%v,parse:%v,error:%v", e.Clean, e.Drift, e.Unreachable, e.Fetch, e.Verify, e.Parse, e.Error)
+}
+
+func (e *ExitCodes) Set(s string) error {
+	codes := *e
+
+	for _, token := range strings.Split(s, ",") {
+		if strings.TrimSpace(token) == "" {
+			continue
+		}
+
+		kv := strings.SplitN(token, ":", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid exit code '%v' (expected <outcome>:<code>)", token)
+		}
+
+		outcome := strings.ToLower(strings.TrimSpace(kv[0]))
+		code, err := strconv.ParseUint(strings.TrimSpace(kv[1]), 10, 8)
+		if err != nil {
+			return fmt.Errorf("invalid exit code '%v' for '%v'", kv[1], outcome)
+		}
+
+		switch outcome {
+		case "clean":
+			codes.Clean = int(code)
+		case "drift":
+			codes.Drift = int(code)
+		case "unreachable":
+			codes.Unreachable = int(code)
+		case "fetch":
+			codes.Fetch = int(code)
+		case "verify":
+			codes.Verify = int(code)
+		case "parse":
+			codes.Parse = int(code)
+		case "error":
+			codes.Error = int(code)
+		default:
+			return fmt.Errorf("invalid outcome '%v' (expected clean, drift, unreachable, fetch, verify, parse or error)", outcome)
+		}
+	}
+
+	*e = codes
+
+	return nil
+}
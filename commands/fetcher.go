@@ -0,0 +1,153 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fetcher retrieves a file (ACL, report, checksum or drift summary) from a source URL. Sources are selected by URL
+// scheme from the registered fetchers, which by default are 's3', 'gs', 'az', 'sftp', 'http', 'https' and 'file'. A
+// wrapper binary can add a custom source by registering a Fetcher for its own URL scheme with RegisterFetcher before
+// executing a command.
+type Fetcher interface {
+	Fetch(ctx context.Context, uri string) ([]byte, error)
+}
+
+// FetcherFunc adapts an ordinary function to the Fetcher interface.
+type FetcherFunc func(ctx context.Context, uri string) ([]byte, error)
+
+// FetcherFactory creates the Fetcher for a command invocation from the command's FetchOptions. Fetchers ignore the
+// options that do not apply to their source.
+type FetcherFactory func(options FetchOptions) Fetcher
+
+// FetchOptions are the download settings of the invoking command.
+type FetchOptions struct {
+	Credentials string        // AWS credentials file (or profile:// URI)
+	Profile     string        // AWS credentials profile
+	Region      string        // AWS region
+	Fallback    string        // comma separated list of fallback AWS regions for S3 buckets
+	RoleARN     string        // IAM role to assume for S3 downloads
+	ExternalID  string        // external ID for the assumed IAM role
+	RoleTTL     time.Duration // assumed IAM role session duration
+	Endpoint    string        // S3 compatible endpoint URL
+	PathStyle   bool          // path-style S3 addressing
+	HTTPTimeout time.Duration // HTTP, Azure and SFTP connection timeout
+	HTTPUser    string        // HTTP basic auth user
+	HTTPPasswd  string        // HTTP basic auth password
+	HTTPBearer  string        // HTTP bearer token
+	GCSKeyFile  string        // GCS service account credentials file
+	AzureAcct   string        // Azure Blob Storage account
+	AzureKey    string        // Azure Blob Storage shared key
+	AzureSAS    string        // Azure Blob Storage SAS token
+	AzureHost   string        // Azure Blob Storage endpoint host
+	SSHKey      string        // SFTP private key file
+	KnownHosts  string        // SFTP known_hosts file
+	Retries     int           // retries for transient failures
+	RetryDelay  time.Duration // initial delay between retries
+	Log         *log.Logger   // logger for retries
+}
+
+func (o FetchOptions) retry() retryPolicy {
+	return retryPolicy{
+		retries: o.Retries,
+		delay:   o.RetryDelay,
+		log:     o.Log,
+	}
+}
+
+func (o FetchOptions) sftp() sftpAuth {
+	return sftpAuth{
+		key:        o.SSHKey,
+		knownHosts: o.KnownHosts,
+	}
+}
+
+func (o FetchOptions) azure() azureAuth {
+	return azureAuth{
+		account:  o.AzureAcct,
+		key:      o.AzureKey,
+		sas:      o.AzureSAS,
+		endpoint: o.AzureHost,
+	}
+}
+
+var fetchers = struct {
+	sync.RWMutex
+	factories map[string]FetcherFactory
+}{
+	factories: map[string]FetcherFactory{
+		"s3": func(options FetchOptions) Fetcher {
+			return FetcherFunc(func(ctx context.Context, uri string) ([]byte, error) {
+				return fetchS3(ctx, uri, options.Credentials, options.Profile, options.Region, options.Fallback, s3Endpoint{options.Endpoint, options.PathStyle}, awsRole{options.RoleARN, options.ExternalID, options.RoleTTL}, options.retry())
+			})
+		},
+		"gs": func(options FetchOptions) Fetcher {
+			return FetcherFunc(func(ctx context.Context, uri string) ([]byte, error) {
+				return fetchGCS(ctx, uri, options.GCSKeyFile, options.retry())
+			})
+		},
+		"az": func(options FetchOptions) Fetcher {
+			return FetcherFunc(func(ctx context.Context, uri string) ([]byte, error) {
+				return fetchAzure(ctx, uri, options.azure(), options.HTTPTimeout, options.retry())
+			})
+		},
+		"sftp": func(options FetchOptions) Fetcher {
+			return FetcherFunc(func(ctx context.Context, uri string) ([]byte, error) {
+				return fetchSFTP(ctx, uri, options.sftp(), options.HTTPTimeout, options.retry())
+			})
+		},
+		"http":  httpFetcher,
+		"https": httpFetcher,
+		"file": func(FetchOptions) Fetcher {
+			return FetcherFunc(func(ctx context.Context, uri string) ([]byte, error) {
+				return fetchFile(uri)
+			})
+		},
+	},
+}
+
+func httpFetcher(options FetchOptions) Fetcher {
+	return FetcherFunc(func(ctx context.Context, uri string) ([]byte, error) {
+		if azure := options.azure(); azure.handles(uri) {
+			return fetchAzure(ctx, uri, azure, options.HTTPTimeout, options.retry())
+		}
+
+		auth := httpAuth{options.HTTPUser, options.HTTPPasswd, options.HTTPBearer}
+
+		return fetchHTTP(ctx, uri, options.HTTPTimeout, auth, options.retry())
+	})
+}
+
+func (f FetcherFunc) Fetch(ctx context.Context, uri string) ([]byte, error) {
+	return f(ctx, uri)
+}
+
+// Registers the Fetcher factory for a URL scheme, replacing any existing fetcher for the scheme.
+func RegisterFetcher(scheme string, f FetcherFactory) {
+	fetchers.Lock()
+	defer fetchers.Unlock()
+
+	fetchers.factories[strings.ToLower(scheme)] = f
+}
+
+func fetch(ctx context.Context, uri string, options FetchOptions) ([]byte, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid URL '%v' (%w)", uri, err)
+	}
+
+	fetchers.RLock()
+	f, ok := fetchers.factories[strings.ToLower(u.Scheme)]
+	fetchers.RUnlock()
+
+	if !ok || f == nil {
+		return nil, fmt.Errorf("No fetcher registered for URL scheme '%v' (%v)", u.Scheme, uri)
+	}
+
+	return f(options).Fetch(ctx, uri)
+}
@@ -0,0 +1,298 @@
+package commands
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uhppoted/uhppote-core/types"
+	"github.com/uhppoted/uhppote-core/uhppote"
+	"github.com/uhppoted/uhppoted-lib/acl"
+)
+
+// Repeatable command line option, with each value optionally a comma separated list.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			*l = append(*l, s)
+		}
+	}
+
+	return nil
+}
+
+// Returns a copy of the ACL containing only the cards with card numbers in the
+// interval [first,last]. A zero 'last' card number is treated as unbounded.
+func filterCardRange(list acl.ACL, first, last uint32) acl.ACL {
+	filtered := acl.ACL{}
+
+	for device, cards := range list {
+		filtered[device] = map[uint32]types.Card{}
+		for k, card := range cards {
+			if k < first || (last != 0 && k > last) {
+				continue
+			}
+
+			filtered[device][k] = card
+		}
+	}
+
+	return filtered
+}
+
+// Date window for --active-from and --active-to (inclusive dates, either of which may be open i.e. nil).
+type dateWindow struct {
+	from *types.Date
+	to   *types.Date
+}
+
+var relativeDate = regexp.MustCompile(`^([+-][0-9]+)d$`)
+
+// Parses an --active-from or --active-to date, which is either a YYYY-MM-DD date, 'today' or a number of days
+// relative to today e.g. +30d.
+func parseActiveDate(option, s string, today time.Time) (*types.Date, error) {
+	s = strings.TrimSpace(s)
+
+	switch {
+	case s == "":
+		return nil, nil
+
+	case strings.EqualFold(s, "today"):
+		d := types.ToDate(today.Year(), today.Month(), today.Day())
+		return &d, nil
+
+	case relativeDate.MatchString(s):
+		days, _ := strconv.Atoi(relativeDate.FindStringSubmatch(s)[1])
+		t := today.AddDate(0, 0, days)
+		d := types.ToDate(t.Year(), t.Month(), t.Day())
+		return &d, nil
+	}
+
+	d, err := types.DateFromString(s)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %v '%v' (expected YYYY-MM-DD, 'today' or +/-<days>d)", option, s)
+	}
+
+	return d, nil
+}
+
+func (w dateWindow) String() string {
+	f := func(d *types.Date) string {
+		if d == nil {
+			return "-"
+		}
+
+		return time.Time(*d).Format("2006-01-02")
+	}
+
+	return fmt.Sprintf("[%v,%v]", f(w.from), f(w.to))
+}
+
+// Returns true if the card is valid on at least one day in the window. A card without a start date is treated as
+// valid from the beginning of time and a card without an end date as valid indefinitely.
+func (w dateWindow) active(card types.Card) bool {
+	date := func(d *types.Date) string {
+		return time.Time(*d).Format("2006-01-02")
+	}
+
+	if w.to != nil && card.From != nil && date(card.From) > date(w.to) {
+		return false
+	}
+
+	if w.from != nil && card.To != nil && date(card.To) < date(w.from) {
+		return false
+	}
+
+	return true
+}
+
+// Returns copies of the controller and authoritative cards without the cards that are not active in the window on
+// either side, so that a card that is active on only one side (e.g. because its dates differ) is still compared and
+// reported as incorrect rather than as missing or unexpected.
+func filterActive(controller, authoritative map[uint32]types.Card, w dateWindow) (map[uint32]types.Card, map[uint32]types.Card) {
+	included := map[uint32]bool{}
+	for _, cards := range []map[uint32]types.Card{controller, authoritative} {
+		for k, card := range cards {
+			if w.active(card) {
+				included[k] = true
+			}
+		}
+	}
+
+	filter := func(cards map[uint32]types.Card) map[uint32]types.Card {
+		filtered := map[uint32]types.Card{}
+		for k, card := range cards {
+			if included[k] {
+				filtered[k] = card
+			}
+		}
+
+		return filtered
+	}
+
+	return filter(controller), filter(authoritative)
+}
+
+func overflows(list acl.ACL, capacity int) map[uint32]*Overflow {
+	overflow := map[uint32]*Overflow{}
+
+	for device, cards := range list {
+		if len(cards) > capacity {
+			overflow[device] = &Overflow{
+				Cards:    len(cards),
+				Capacity: capacity,
+			}
+		}
+	}
+
+	return overflow
+}
+
+// Resolves the --only-device controller IDs against the configured controllers, returning the controllers to compare
+// (all the controllers if no --only-device is given).
+func onlyDevices(ids []string, devices []uhppote.Device) ([]uhppote.Device, error) {
+	if len(ids) == 0 {
+		return devices, nil
+	}
+
+	included := map[uint32]bool{}
+	for _, s := range ids {
+		id, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid --only-device '%v' (expected a controller ID)", s)
+		}
+
+		found := false
+		for _, d := range devices {
+			if d.DeviceID == uint32(id) {
+				found = true
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("Invalid --only-device '%v' (controller not configured)", s)
+		}
+
+		included[uint32(id)] = true
+	}
+
+	filtered := []uhppote.Device{}
+	for _, d := range devices {
+		if included[d.DeviceID] {
+			filtered = append(filtered, d)
+		}
+	}
+
+	return filtered, nil
+}
+
+// Resolves the --ignore-door values against the configured controllers, returning the ignored door numbers for
+// each controller. A value is either a door ('<door>', ignored for every controller) or a controller door
+// ('<controller>:<door>'), where the door is either the door number (1-4) or the door name.
+func ignoredDoors(specs []string, devices []uhppote.Device) (map[uint32]map[uint8]bool, error) {
+	ignored := map[uint32]map[uint8]bool{}
+
+	for _, spec := range specs {
+		device := ""
+		door := spec
+		if ix := strings.Index(spec, ":"); ix >= 0 {
+			device, door = strings.TrimSpace(spec[:ix]), strings.TrimSpace(spec[ix+1:])
+		}
+
+		found := false
+		for _, d := range devices {
+			if device != "" && device != fmt.Sprintf("%v", d.DeviceID) {
+				continue
+			}
+
+			for i, name := range d.Doors {
+				if door == fmt.Sprintf("%v", i+1) || (clean(name) != "" && clean(name) == clean(door)) {
+					if ignored[d.DeviceID] == nil {
+						ignored[d.DeviceID] = map[uint8]bool{}
+					}
+
+					ignored[d.DeviceID][uint8(i+1)] = true
+					found = true
+				}
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("Invalid --ignore-door '%v' (no configured controller door matches)", spec)
+		}
+	}
+
+	return ignored, nil
+}
+
+// Returns a copy of the cards without the permissions for the ignored doors.
+func withoutDoors(cards map[uint32]types.Card, doors map[uint8]bool) map[uint32]types.Card {
+	filtered := map[uint32]types.Card{}
+
+	for k, card := range cards {
+		c := card
+		c.Doors = map[uint8]int{}
+		for door, v := range card.Doors {
+			if !doors[door] {
+				c.Doors[door] = v
+			}
+		}
+
+		filtered[k] = c
+	}
+
+	return filtered
+}
+
+// Replaces the cards in a diff computed without the ignored doors with the original controller and authoritative
+// cards and drops the missing and unexpected cards that only have access to ignored doors.
+func restoreDoors(diff acl.Diff, controller, authoritative map[uint32]types.Card, doors map[uint8]bool) acl.Diff {
+	restore := func(list []types.Card, cards map[uint32]types.Card, drop bool) []types.Card {
+		restored := []types.Card{}
+		for _, card := range list {
+			c, ok := cards[card.CardNumber]
+			if !ok {
+				c = card
+			}
+
+			if !drop || !ignoredOnly(c, doors) {
+				restored = append(restored, c)
+			}
+		}
+
+		sort.Slice(restored, func(i, j int) bool { return restored[i].CardNumber < restored[j].CardNumber })
+
+		return restored
+	}
+
+	return acl.Diff{
+		Unchanged: restore(diff.Unchanged, controller, false),
+		Updated:   restore(diff.Updated, authoritative, false),
+		Added:     restore(diff.Added, authoritative, true),
+		Deleted:   restore(diff.Deleted, controller, true),
+	}
+}
+
+func ignoredOnly(card types.Card, doors map[uint8]bool) bool {
+	access := false
+	for door, v := range card.Doors {
+		if v != 0 {
+			if !doors[door] {
+				return false
+			}
+
+			access = true
+		}
+	}
+
+	return access
+}
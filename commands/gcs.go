@@ -0,0 +1,103 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+)
+
+// Returns a Cloud Storage client for the (optional) service account JSON credentials file. Without a credentials
+// file the client uses the application default credentials i.e. GOOGLE_APPLICATION_CREDENTIALS, the gcloud user
+// credentials or the GCE/GKE metadata server.
+func gcsClient(ctx context.Context, credentials string) (*storage.Client, error) {
+	options := []option.ClientOption{}
+	if credentials != "" {
+		options = append(options, option.WithCredentialsFile(credentials))
+	}
+
+	client, err := storage.NewClient(ctx, options...)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating Cloud Storage client (%w)", err)
+	}
+
+	return client, nil
+}
+
+func gcsObject(uri string) (string, string, error) {
+	match := regexp.MustCompile("^gs://(.*?)/(.*)").FindStringSubmatch(uri)
+	if len(match) != 3 || match[1] == "" || match[2] == "" {
+		return "", "", fmt.Errorf("Invalid GCS URI (%s)", uri)
+	}
+
+	return match[1], match[2], nil
+}
+
+func fetchGCS(ctx context.Context, uri, credentials string, retry retryPolicy) ([]byte, error) {
+	bucket, object, err := gcsObject(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := gcsClient(ctx, credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	defer client.Close()
+
+	var b []byte
+
+	err = retry.do(ctx, fmt.Sprintf("GET %v", uri), func() error {
+		r, err := client.Bucket(bucket).Object(object).NewReader(ctx)
+		if err != nil {
+			return err
+		}
+
+		defer r.Close()
+
+		b, err = ioutil.ReadAll(r)
+
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func storeGCS(ctx context.Context, uri, credentials string, r io.Reader, retry retryPolicy) error {
+	bucket, object, err := gcsObject(uri)
+	if err != nil {
+		return err
+	}
+
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	client, err := gcsClient(ctx, credentials)
+	if err != nil {
+		return err
+	}
+
+	defer client.Close()
+
+	return retry.do(ctx, fmt.Sprintf("PUT %v", uri), func() error {
+		w := client.Bucket(bucket).Object(object).NewWriter(ctx)
+		if _, err := io.Copy(w, bytes.NewReader(body)); err != nil {
+			w.Close()
+			return err
+		}
+
+		return w.Close()
+	})
+}
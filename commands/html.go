@@ -0,0 +1,98 @@
+package commands
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"time"
+
+	"github.com/uhppoted/uhppote-core/types"
+)
+
+// Built-in template for the --format html report. The template data is the same as for the text report and the
+// empty sections are omitted in the same way. As for the text report, the diff for a controller with CAPACITY
+// EXCEEDED is summarised rather than listed. Styles are inline so that the report renders as an email body.
+const HTML_TEMPLATE = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>ACL DIFF REPORT {{ .DateTime }}</title>
+</head>
+<body style="font-family: Helvetica, Arial, sans-serif; font-size: 14px; color: #222222;">
+<h1 style="font-size: 20px;">ACL DIFF REPORT {{ .DateTime }}</h1>
+{{range $id,$value := .Diffs}}
+<h2 style="font-size: 16px; margin-top: 24px;">DEVICE {{with index $.Devices $id}}{{ . }}{{else}}{{ $id }}{{end}}{{if or $value.Updated $value.Added $value.Deleted}}{{else if not (or (index $.Overflow $id) (index $.Review $id) (index $.Skipped $id) (index $.Errors $id))}} <span style="color: #2e7d32;">OK</span>{{end}}</h2>
+{{with index $.Overflow $id}}<p style="color: #c62828;">CAPACITY EXCEEDED: authoritative ACL has {{ .Cards }} cards but the controller can only store {{ .Capacity }} cards</p>
+{{end}}{{if index $.Review $id}}<p style="color: #c62828;">NEEDS MANUAL REVIEW: unexpected cards exceed the --max-unexpected limit ({{ len $value.Deleted }} unexpected cards)</p>
+{{end}}{{if index $.Skipped $id}}<p style="color: #c62828;">NOT CHECKED: controller ACL not retrieved before the --controllers-timeout-budget was exhausted</p>
+{{end}}{{with index $.Errors $id}}<p style="color: #c62828;">UNREACHABLE: {{ . }}</p>
+{{end}}{{if index $.Overflow $id}}{{if or $value.Updated $value.Added $value.Deleted}}<p>Not listed: {{ len $value.Updated }} updated, {{ len $value.Added }} added, {{ len $value.Deleted }} deleted cards</p>
+{{end}}{{else}}{{if $value.Updated}}{{template "cards" (section "Updated" $value.Updated)}}{{end}}{{if $value.Added}}{{template "cards" (section "Added" $value.Added)}}{{end}}{{if $value.Deleted}}{{template "cards" (section "Deleted" $value.Deleted)}}{{end}}{{end}}{{end}}
+{{if .Duplicates}}
+<h2 style="font-size: 16px; margin-top: 24px;">DUPLICATE CARD NUMBERS IN THE ACL</h2>
+<table style="border-collapse: collapse;">
+<tr><th style="text-align: left; padding: 4px 12px; border-bottom: 1px solid #999999;">Card Number</th><th style="text-align: left; padding: 4px 12px; border-bottom: 1px solid #999999;">Lines</th><th style="text-align: left; padding: 4px 12px; border-bottom: 1px solid #999999;"></th></tr>
+{{range .Duplicates}}<tr><td style="padding: 4px 12px;">{{ .CardNumber }}</td><td style="padding: 4px 12px;">{{range $i,$l := .Lines}}{{if $i}},{{end}}{{ $l }}{{end}}</td><td style="padding: 4px 12px;">{{if .Conflict}}CONFLICTING{{end}}{{if .Merged}} MERGED{{end}}</td></tr>
+{{end}}</table>
+{{end}}</body>
+</html>
+
+{{define "cards"}}<h3 style="font-size: 14px; margin-bottom: 4px;">{{ .Title }}</h3>
+<table style="border-collapse: collapse; margin-bottom: 12px;">
+<tr><th style="text-align: left; padding: 4px 12px; border-bottom: 1px solid #999999;">Card Number</th><th style="text-align: left; padding: 4px 12px; border-bottom: 1px solid #999999;">From</th><th style="text-align: left; padding: 4px 12px; border-bottom: 1px solid #999999;">To</th><th style="text-align: center; padding: 4px 12px; border-bottom: 1px solid #999999;">1</th><th style="text-align: center; padding: 4px 12px; border-bottom: 1px solid #999999;">2</th><th style="text-align: center; padding: 4px 12px; border-bottom: 1px solid #999999;">3</th><th style="text-align: center; padding: 4px 12px; border-bottom: 1px solid #999999;">4</th></tr>
+{{range .Cards}}<tr><td style="padding: 4px 12px;">{{ .CardNumber }}</td><td style="padding: 4px 12px;">{{ date .From }}</td><td style="padding: 4px 12px;">{{ date .To }}</td>{{range door .Doors}}<td style="text-align: center; padding: 4px 12px;">{{ . }}</td>{{end}}</tr>
+{{end}}</table>
+{{end}}`
+
+// Template functions for HTML report templates, in addition to the standard template functions.
+var htmlFunctions = template.FuncMap{
+	"section": func(title string, cards []types.Card) interface{} {
+		return struct {
+			Title string
+			Cards []types.Card
+		}{
+			Title: title,
+			Cards: cards,
+		}
+	},
+
+	"date": func(d *types.Date) string {
+		if d == nil {
+			return "-"
+		}
+
+		return fmt.Sprintf("%v", d)
+	},
+
+	"door": func(doors map[uint8]int) []string {
+		permissions := []string{}
+		for _, door := range []uint8{1, 2, 3, 4} {
+			switch p := doors[door]; {
+			case p == 1:
+				permissions = append(permissions, "Y")
+			case p >= 2 && p <= 254:
+				permissions = append(permissions, fmt.Sprintf("%v", p))
+			default:
+				permissions = append(permissions, "N")
+			}
+		}
+
+		return permissions
+	},
+}
+
+// Renders the report with an html/template template, so that the card numbers, device names and error messages are
+// escaped.
+func reportHTML(rpt Report, format string, w io.Writer) error {
+	t, err := template.New("report").Funcs(htmlFunctions).Parse(format)
+	if err != nil {
+		return err
+	}
+
+	if rpt.DateTime == nil {
+		timestamp := types.DateTime(time.Now())
+		rpt.DateTime = &timestamp
+	}
+
+	return t.Execute(w, rpt)
+}
@@ -0,0 +1,168 @@
+package commands
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+const HTTP_USER = "UHPPOTED_HTTP_USER"
+const HTTP_PASSWORD = "UHPPOTED_HTTP_PASSWORD"
+const HTTP_BEARER = "UHPPOTED_HTTP_BEARER"
+
+// Credentials for http:// and https:// ACL and report URLs, either HTTP basic auth or a bearer token. Credentials
+// not supplied on the command line are taken from the UHPPOTED_HTTP_USER, UHPPOTED_HTTP_PASSWORD and
+// UHPPOTED_HTTP_BEARER environment variables.
+type httpAuth struct {
+	user     string
+	password string
+	bearer   string
+}
+
+func (a *httpAuth) resolve() error {
+	if a.user == "" {
+		a.user = os.Getenv(HTTP_USER)
+	}
+
+	if a.password == "" {
+		a.password = os.Getenv(HTTP_PASSWORD)
+	}
+
+	if a.bearer == "" {
+		a.bearer = os.Getenv(HTTP_BEARER)
+	}
+
+	if (a.user != "" || a.password != "") && a.bearer != "" {
+		return fmt.Errorf("HTTP basic auth (--http-user/--http-password) and --http-bearer are mutually exclusive")
+	}
+
+	return nil
+}
+
+func (a httpAuth) apply(rq *http.Request) {
+	if a.bearer != "" {
+		rq.Header.Set("Authorization", "Bearer "+a.bearer)
+	} else if a.user != "" || a.password != "" {
+		rq.SetBasicAuth(a.user, a.password)
+	}
+}
+
+// Explicit --proxy for the HTTP and S3 requests, which overrides the HTTP_PROXY and HTTPS_PROXY environment
+// variables (hosts in NO_PROXY are still accessed directly). An empty proxy uses the environment variables.
+var proxy = struct {
+	sync.RWMutex
+	url string
+}{}
+
+func setProxy(p string) error {
+	if p != "" {
+		if u, err := url.Parse(p); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") {
+			return fmt.Errorf("Invalid --proxy '%v' (expected e.g. http://proxy.local:3128)", p)
+		}
+	}
+
+	proxy.Lock()
+	defer proxy.Unlock()
+
+	proxy.url = p
+
+	return nil
+}
+
+func getProxy() string {
+	proxy.RLock()
+	defer proxy.RUnlock()
+
+	return proxy.url
+}
+
+func proxyFunc() func(*http.Request) (*url.URL, error) {
+	p := getProxy()
+	if p == "" {
+		return http.ProxyFromEnvironment
+	}
+
+	noproxy := os.Getenv("NO_PROXY")
+	if noproxy == "" {
+		noproxy = os.Getenv("no_proxy")
+	}
+
+	f := (&httpproxy.Config{HTTPProxy: p, HTTPSProxy: p, NoProxy: noproxy}).ProxyFunc()
+
+	return func(rq *http.Request) (*url.URL, error) {
+		return f(rq.URL)
+	}
+}
+
+// Client certificate and key (PEM files) for mutual TLS with https:// ACL and report URLs, with optional CA
+// certificates for verifying the server certificate (the system CA certificates are used if not specified).
+type httpTLS struct {
+	cert string
+	key  string
+	ca   string
+}
+
+var clientTLS = struct {
+	sync.RWMutex
+	config *tls.Config
+}{}
+
+func setClientTLS(t httpTLS) error {
+	var config *tls.Config
+
+	if t.cert != "" || t.key != "" || t.ca != "" {
+		config = &tls.Config{}
+	}
+
+	if t.cert != "" || t.key != "" {
+		if t.cert == "" || t.key == "" {
+			return fmt.Errorf("Mutual TLS requires both --client-cert and --client-key")
+		}
+
+		certificate, err := tls.LoadX509KeyPair(t.cert, t.key)
+		if err != nil {
+			return fmt.Errorf("Error loading client certificate %v and key %v (%w)", t.cert, t.key, err)
+		}
+
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	if t.ca != "" {
+		pem, err := ioutil.ReadFile(t.ca)
+		if err != nil {
+			return fmt.Errorf("Error reading CA certificates %v (%w)", t.ca, err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("No valid PEM CA certificates in %v", t.ca)
+		}
+
+		config.RootCAs = pool
+	}
+
+	clientTLS.Lock()
+	defer clientTLS.Unlock()
+
+	clientTLS.config = config
+
+	return nil
+}
+
+func getClientTLS() *tls.Config {
+	clientTLS.RLock()
+	defer clientTLS.RUnlock()
+
+	if clientTLS.config == nil {
+		return nil
+	}
+
+	return clientTLS.config.Clone()
+}
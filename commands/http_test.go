@@ -0,0 +1,106 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// Stub HTTP proxy that answers every proxied request with the ACL and records the requested URLs.
+type stubProxy struct {
+	sync.Mutex
+	*httptest.Server
+	requests []string
+}
+
+func newStubProxy(t *testing.T, body []byte) *stubProxy {
+	p := stubProxy{}
+
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.Lock()
+		p.requests = append(p.requests, fmt.Sprintf("%v %v", r.Method, r.URL))
+		p.Unlock()
+
+		w.Header().Set("Content-Length", fmt.Sprintf("%v", len(body)))
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%v/%v", len(body)-1, len(body)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+	}))
+
+	t.Cleanup(p.Close)
+
+	return &p
+}
+
+func (p *stubProxy) proxied(url string) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	for _, rq := range p.requests {
+		if rq == "GET "+url {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestFetchHTTPWithProxy(t *testing.T) {
+	acl := []byte("Card Number\tFrom\tTo\tGreat Hall\n8165538\t2021-01-01\t2021-12-31\tY\n")
+	proxy := newStubProxy(t, acl)
+
+	if err := setProxy(proxy.URL); err != nil {
+		t.Fatalf("Error setting --proxy (%v)", err)
+	}
+
+	defer setProxy("")
+
+	b, err := fetchHTTP(context.Background(), "http://acl.example.com/hogwarts.acl", 0, httpAuth{}, retryPolicy{})
+	if err != nil {
+		t.Fatalf("Unexpected error fetching ACL through proxy (%v)", err)
+	}
+
+	if string(b) != string(acl) {
+		t.Errorf("Incorrect ACL fetched through proxy\n   expected:%q\n   got:     %q", acl, b)
+	}
+
+	if !proxy.proxied("http://acl.example.com/hogwarts.acl") {
+		t.Errorf("HTTP request not sent through --proxy (proxied requests: %v)", proxy.requests)
+	}
+}
+
+func TestFetchS3WithProxy(t *testing.T) {
+	acl := []byte("Card Number\tFrom\tTo\tGreat Hall\n8165538\t2021-01-01\t2021-12-31\tY\n")
+	proxy := newStubProxy(t, acl)
+
+	credentials := filepath.Join(t.TempDir(), "credentials")
+	if err := ioutil.WriteFile(credentials, []byte("[default]\naws_access_key_id = AKIAEXAMPLE\naws_secret_access_key = secret\n"), 0600); err != nil {
+		t.Fatalf("Error writing AWS credentials file (%v)", err)
+	}
+
+	if err := setProxy(proxy.URL); err != nil {
+		t.Fatalf("Error setting --proxy (%v)", err)
+	}
+
+	defer setProxy("")
+
+	endpoint := s3Endpoint{url: "http://s3.example.com", pathStyle: true}
+
+	b, err := fetchS3(context.Background(), "s3://uhppoted/hogwarts.acl", credentials, "default", "us-east-1", "", endpoint, awsRole{}, retryPolicy{})
+	if err != nil {
+		t.Fatalf("Unexpected error fetching ACL from S3 through proxy (%v)", err)
+	}
+
+	if string(b) != string(acl) {
+		t.Errorf("Incorrect ACL fetched from S3 through proxy\n   expected:%q\n   got:     %q", acl, b)
+	}
+
+	if !proxy.proxied("http://s3.example.com/uhppoted/hogwarts.acl") {
+		t.Errorf("S3 request not sent through --proxy (proxied requests: %v)", proxy.requests)
+	}
+}
@@ -0,0 +1,360 @@
+package commands
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/uhppoted/uhppoted-app-s3/auth"
+	"github.com/uhppoted/uhppoted-lib/config"
+)
+
+var InspectCmd = Inspect{
+	config:      config.DefaultConfig,
+	keysdir:     DEFAULT_KEYSDIR,
+	credentials: DEFAULT_CREDENTIALS,
+	profile:     DEFAULT_PROFILE,
+	region:      DEFAULT_REGION,
+	role:        awsRole{duration: DEFAULT_ROLE_DURATION},
+	httpTimeout: DEFAULT_HTTP_TIMEOUT,
+	retry:       retryPolicy{retries: DEFAULT_RETRIES, delay: DEFAULT_RETRY_DELAY},
+	debug:       false,
+}
+
+type Inspect struct {
+	url         string
+	config      string
+	keysdir     string
+	decryptKey  string
+	ca          string
+	credentials string
+	gcsCreds    string
+	azure       azureAuth
+	sftp        sftpAuth
+	profile     string
+	region      string
+	role        awsRole
+	endpoint    s3Endpoint
+	proxy       string
+	httpTimeout time.Duration
+	httpAuth    httpAuth
+	httpTLS     httpTLS
+	retry       retryPolicy
+	debug       bool
+	ctx         context.Context
+	flagset     *flag.FlagSet
+}
+
+type entry struct {
+	name  string
+	size  int64
+	uname string
+	body  []byte
+}
+
+func (cmd *Inspect) Name() string {
+	return "inspect"
+}
+
+func (cmd *Inspect) FlagSet() *flag.FlagSet {
+	flagset := flag.NewFlagSet("inspect", flag.ExitOnError)
+
+	flagset.StringVar(&cmd.url, "url", cmd.url, "The URL (or local path) of the tar.gz or zip file to inspect")
+	flagset.StringVar(&cmd.credentials, "credentials", cmd.credentials, "AWS credentials file (or profile://<name> to use the credentials and region for the named profile in the shared AWS config)")
+	flagset.StringVar(&cmd.gcsCreds, "gcs-credentials", cmd.gcsCreds, "Google Cloud service account JSON credentials file for gs:// URLs (defaults to the application default credentials e.g. GOOGLE_APPLICATION_CREDENTIALS)")
+	flagset.StringVar(&cmd.azure.account, "azure-account", cmd.azure.account, "Azure storage account for az:// URLs (defaults to the AZURE_STORAGE_ACCOUNT environment variable)")
+	flagset.StringVar(&cmd.azure.key, "azure-key", cmd.azure.key, "Azure storage account shared key (defaults to the AZURE_STORAGE_KEY environment variable)")
+	flagset.StringVar(&cmd.azure.sas, "azure-sas", cmd.azure.sas, "Azure SAS token for az:// and blob.core.windows.net URLs (defaults to the AZURE_STORAGE_SAS_TOKEN environment variable)")
+	flagset.StringVar(&cmd.azure.connection, "azure-connection-string", cmd.azure.connection, "Azure storage connection string (defaults to the AZURE_STORAGE_CONNECTION_STRING environment variable)")
+	flagset.StringVar(&cmd.sftp.key, "ssh-key", cmd.sftp.key, "SSH private key file for sftp:// URLs (the passphrase for an encrypted key is taken from the SSH_KEY_PASSPHRASE environment variable)")
+	flagset.StringVar(&cmd.sftp.knownHosts, "known-hosts", cmd.sftp.knownHosts, "SSH known_hosts file used to verify the SFTP server host key (defaults to ~/.ssh/known_hosts)")
+	flagset.StringVar(&cmd.profile, "profile", cmd.profile, "AWS credentials file profile (defaults to 'default')")
+	flagset.StringVar(&cmd.region, "region", cmd.region, "AWS region for S3 (defaults to us-east-1)")
+	flagset.StringVar(&cmd.role.arn, "role-arn", cmd.role.arn, "ARN of an IAM role to assume (using STS AssumeRole) for S3 access e.g. for cross-account access")
+	flagset.StringVar(&cmd.role.externalID, "external-id", cmd.role.externalID, "External ID for assuming the --role-arn role")
+	flagset.DurationVar(&cmd.role.duration, "role-duration", cmd.role.duration, "Session duration for the assumed --role-arn role (credentials are refreshed automatically when they expire)")
+	flagset.StringVar(&cmd.endpoint.url, "endpoint", cmd.endpoint.url, "Custom S3 endpoint URL for S3 compatible stores e.g. http://minio.local:9000 (defaults to AWS S3)")
+	flagset.BoolVar(&cmd.endpoint.pathStyle, "path-style", cmd.endpoint.pathStyle, "Uses path-style (http://host/bucket/key) rather than virtual-hosted style S3 addressing (e.g. for MinIO)")
+	flagset.StringVar(&cmd.proxy, "proxy", cmd.proxy, "HTTP proxy URL for HTTP and S3 requests (overrides the HTTP_PROXY and HTTPS_PROXY environment variables, NO_PROXY still applies)")
+	flagset.DurationVar(&cmd.httpTimeout, "http-timeout", cmd.httpTimeout, "Timeout for HTTP requests, including reading the response body (0 for no timeout)")
+	flagset.StringVar(&cmd.httpAuth.user, "http-user", cmd.httpAuth.user, "User name for HTTP basic auth (defaults to the UHPPOTED_HTTP_USER environment variable)")
+	flagset.StringVar(&cmd.httpAuth.password, "http-password", cmd.httpAuth.password, "Password for HTTP basic auth (defaults to the UHPPOTED_HTTP_PASSWORD environment variable)")
+	flagset.StringVar(&cmd.httpAuth.bearer, "http-bearer", cmd.httpAuth.bearer, "Bearer token for HTTP requests (defaults to the UHPPOTED_HTTP_BEARER environment variable)")
+	flagset.StringVar(&cmd.httpTLS.cert, "client-cert", cmd.httpTLS.cert, "PEM client certificate file for mutual TLS with https:// servers")
+	flagset.StringVar(&cmd.httpTLS.key, "client-key", cmd.httpTLS.key, "PEM private key file for the --client-cert client certificate")
+	flagset.StringVar(&cmd.httpTLS.ca, "ca-cert", cmd.httpTLS.ca, "PEM CA certificates file for verifying https:// server certificates (defaults to the system CA certificates)")
+	flagset.IntVar(&cmd.retry.retries, "retries", cmd.retry.retries, "Number of times to retry an S3 or HTTP request after a transient failure (5xx response, connection reset or timeout)")
+	flagset.DurationVar(&cmd.retry.delay, "retry-delay", cmd.retry.delay, "Delay before the first retry of a failed S3 or HTTP request, doubling (with jitter) for each subsequent retry")
+	flagset.StringVar(&cmd.keysdir, "keys", cmd.keysdir, "Sets the directory to search for RSA or ed25519 signing keys. Key files are expected to be named '<uname>.pub' (and '<uname>/*.pub' for additional e.g. rotated keys)")
+	flagset.StringVar(&cmd.decryptKey, "decrypt-key", cmd.decryptKey, "RSA private key file for decrypting ACL files encrypted with store-acl --encrypt-to (the passphrase for an encrypted key is taken from the UHPPOTED_DECRYPT_KEY_PASSPHRASE environment variable)")
+	flagset.StringVar(&cmd.ca, "ca", cmd.ca, "PEM file with the trusted CA certificates for verifying the signing certificate chain")
+
+	cmd.flagset = flagset
+
+	return flagset
+}
+
+func (cmd *Inspect) Description() string {
+	return fmt.Sprintf("Lists the contents of a signed ACL or report file and verifies the signature")
+}
+
+func (cmd *Inspect) Usage() string {
+	return "inspect <URL>"
+}
+
+func (cmd *Inspect) Help() {
+	fmt.Println()
+	fmt.Printf("  Usage: %s [--debug] [--config <file>] inspect [--credentials <file>] [--gcs-credentials <file>] [--azure-account <account>] [--azure-key <key>] [--azure-sas <token>] [--azure-connection-string <string>] [--ssh-key <file>] [--known-hosts <file>] [--profile <file>] [--region <region>] [--role-arn <ARN>] [--external-id <ID>] [--role-duration <duration>] [--endpoint <URL>] [--path-style] [--proxy <URL>] [--http-timeout <duration>] [--http-user <user>] [--http-password <password>] [--http-bearer <token>] [--client-cert <file>] [--client-key <file>] [--ca-cert <file>] [--retries <N>] [--retry-delay <duration>] [--keys <dir>] [--decrypt-key <file>] [--ca <file>] <URL>\n", APP)
+	fmt.Println()
+	fmt.Println("    Fetches the tar.gz or zip file from the URL (or local file path) and lists the entries, their sizes and the")
+	fmt.Println("    signer user ID, along with whether or not the signature could be verified.")
+	fmt.Println()
+
+	helpOptions(cmd.FlagSet())
+	fmt.Println()
+}
+
+func (cmd *Inspect) Execute(args ...interface{}) error {
+	options := args[0].(*Options)
+
+	cmd.config = options.Config
+	cmd.debug = options.Debug
+	cmd.ctx = options.ctx()
+	cmd.retry.log = log.New(os.Stdout, "  ", 0)
+
+	if err := setProxy(cmd.proxy); err != nil {
+		return err
+	}
+
+	if err := setClientTLS(cmd.httpTLS); err != nil {
+		return err
+	}
+
+	if err := cmd.httpAuth.resolve(); err != nil {
+		return err
+	}
+
+	if err := cmd.azure.resolve(); err != nil {
+		return err
+	}
+
+	uri := strings.TrimSpace(cmd.url)
+	if uri == "" && cmd.flagset != nil && cmd.flagset.NArg() > 0 {
+		uri = strings.TrimSpace(cmd.flagset.Arg(0))
+	}
+
+	if uri == "" {
+		return fmt.Errorf("inspect requires a URL or file path")
+	}
+
+	uri = fileURI(uri)
+
+	conf := config.NewConfig()
+	if err := conf.Load(cmd.config); err != nil {
+		return fmt.Errorf("WARN  Could not load configuration (%v)", err)
+	}
+
+	if cmd.credentials == "" {
+		cmd.credentials = conf.AWS.Credentials
+	}
+
+	if cmd.profile == "" {
+		cmd.profile = conf.AWS.Profile
+	}
+
+	if cmd.region == "" && !isProfileURI(cmd.credentials) {
+		cmd.region = conf.AWS.Region
+	}
+
+	b, err := cmd.fetch(uri)
+	if err != nil {
+		return &FetchError{URL: uri, Err: err}
+	}
+
+	if b, err = decrypt(uri, b, cmd.decryptKey, cmd.retry.log); err != nil {
+		return err
+	}
+
+	list, err := entries(b, isZip(b))
+	if err != nil {
+		return &ParseError{err}
+	}
+
+	fmt.Println()
+	fmt.Printf("  %v (%v bytes)\n", uri, len(b))
+	fmt.Println()
+	for _, e := range list {
+		fmt.Printf("    %-32v %10v  %v\n", e.name, e.size, e.uname)
+	}
+	fmt.Println()
+
+	signed, signature, chain, files, err := signedEntry(list)
+	if err != nil {
+		fmt.Printf("  signature: NOT VERIFIED (%v)\n\n", err)
+		return nil
+	}
+
+	fmt.Printf("  signed by: %v\n", signed.uname)
+	if timestamp, ok := files[TIMESTAMP_FILE]; ok {
+		fmt.Printf("  signed at: %v\n", strings.TrimSpace(string(timestamp)))
+	}
+
+	if chain != nil && cmd.ca != "" {
+		if signer, err := verifyCertificate(signable(files, signed.body), signature, chain, cmd.ca); err != nil {
+			fmt.Printf("  signature: INVALID (%v)\n\n", err)
+		} else {
+			fmt.Printf("  signature: OK (certificate '%v')\n\n", signer)
+		}
+	} else if key, err := verify(signed.uname, signable(files, signed.body), signatures(files), cmd.keysdir); err != nil {
+		fmt.Printf("  signature: INVALID (%v)\n\n", err)
+	} else {
+		fmt.Printf("  signature: OK (key %v)\n\n", key)
+	}
+
+	return nil
+}
+
+func (cmd *Inspect) fetch(uri string) ([]byte, error) {
+	options := FetchOptions{
+		Credentials: cmd.credentials,
+		Profile:     cmd.profile,
+		Region:      cmd.region,
+		RoleARN:     cmd.role.arn,
+		ExternalID:  cmd.role.externalID,
+		RoleTTL:     cmd.role.duration,
+		Endpoint:    cmd.endpoint.url,
+		PathStyle:   cmd.endpoint.pathStyle,
+		HTTPTimeout: cmd.httpTimeout,
+		HTTPUser:    cmd.httpAuth.user,
+		HTTPPasswd:  cmd.httpAuth.password,
+		HTTPBearer:  cmd.httpAuth.bearer,
+		GCSKeyFile:  cmd.gcsCreds,
+		AzureAcct:   cmd.azure.account,
+		AzureKey:    cmd.azure.key,
+		AzureSAS:    cmd.azure.sas,
+		AzureHost:   cmd.azure.endpoint,
+		SSHKey:      cmd.sftp.key,
+		KnownHosts:  cmd.sftp.knownHosts,
+		Retries:     cmd.retry.retries,
+		RetryDelay:  cmd.retry.delay,
+		Log:         cmd.retry.log,
+	}
+
+	return fetch(cmd.ctx, uri, options)
+}
+
+// Finds the signed file, signature and (optional) certificate chain in the entries of a signed ACL or report file. The
+// returned files include the 'version', 'timestamp' and any additional 'signature.N' entries.
+func signedEntry(list []entry) (*entry, []byte, []byte, map[string][]byte, error) {
+	var signed *entry
+	var signature []byte
+	var chain []byte
+	var files = map[string][]byte{}
+
+	for i, e := range list {
+		switch {
+		case e.name == "signature":
+			signature = e.body
+			files["signature"] = e.body
+		case isSignature(e.name):
+			files[e.name] = e.body
+		case e.name == "certificate":
+			chain = e.body
+		case e.name == "version" || e.name == TIMESTAMP_FILE:
+			if _, ok := files[e.name]; ok {
+				return nil, nil, nil, nil, fmt.Errorf("multiple %v files", e.name)
+			}
+			files[e.name] = e.body
+		case e.name == RAW_ACL_FILE || e.name == DRIFT_FILE:
+			// ... unsigned copy of the authoritative ACL and drift summary included with the report
+		default:
+			if signed != nil {
+				return nil, nil, nil, nil, fmt.Errorf("multiple signed files")
+			}
+			signed = &list[i]
+		}
+	}
+
+	if signed == nil {
+		return nil, nil, nil, nil, fmt.Errorf("no signed file")
+	}
+
+	if signature == nil {
+		return nil, nil, nil, nil, fmt.Errorf("'signature' file missing")
+	}
+
+	return signed, signature, chain, files, nil
+}
+
+func entries(b []byte, iszip bool) ([]entry, error) {
+	list := []entry{}
+
+	if auth.IsEncrypted(b) {
+		return nil, fmt.Errorf("File is encrypted (use --decrypt-key to decrypt it)")
+	}
+
+	if iszip {
+		zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+
+			body, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return nil, err
+			}
+
+			list = append(list, entry{
+				name:  f.Name,
+				size:  int64(f.UncompressedSize64),
+				uname: f.Comment,
+				body:  body,
+			})
+		}
+
+		return list, nil
+	}
+
+	tr, err := tarReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		var buffer bytes.Buffer
+		if _, err := io.Copy(&buffer, tr); err != nil {
+			return nil, err
+		}
+
+		list = append(list, entry{
+			name:  header.Name,
+			size:  header.Size,
+			uname: header.Uname,
+			body:  buffer.Bytes(),
+		})
+	}
+
+	return list, nil
+}
@@ -0,0 +1,194 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/uhppoted/uhppote-core/uhppote"
+)
+
+// Schema for JSON ACL files e.g.:
+//
+//	{ "cards": [
+//	    { "card-number": 8165538, "from": "2021-01-01", "to": "2021-12-31", "doors": { "Great Hall": "Y", "Dungeon": 29 } }
+//	]}
+//
+// Door permissions are 'Y', 'N', true, false or a time profile ID. Doors that are not listed for a card are 'N'.
+// A JSON ACL file may also be just the list of cards.
+type jsonACL struct {
+	Cards []jsonCard `json:"cards"`
+}
+
+type jsonCard struct {
+	CardNumber json.Number                `json:"card-number"`
+	From       string                     `json:"from"`
+	To         string                     `json:"to"`
+	Doors      map[string]json.RawMessage `json:"doors"`
+}
+
+// Resolves the --input-format for the ACL file. 'auto' uses the extension of the ACL file in the tar.gz or zip
+// archive or the extension of the URL (ignoring a .gz suffix) for unpacked files.
+func aclFormat(format, uri string, files map[string][]byte) (string, error) {
+	switch format {
+	case "tsv", "csv", "json":
+		return format, nil
+
+	case "", "auto":
+		if f := string(files["format"]); f == "json" || f == "csv" {
+			return f, nil
+		}
+
+		path := uri
+		if ix := strings.IndexAny(path, "?#"); ix >= 0 {
+			path = path[:ix]
+		}
+
+		if strings.HasSuffix(strings.TrimSuffix(path, ".gz"), ".json") {
+			return "json", nil
+		}
+
+		if strings.HasSuffix(strings.TrimSuffix(path, ".gz"), ".csv") {
+			return "csv", nil
+		}
+
+		return "tsv", nil
+
+	default:
+		return "", fmt.Errorf("Invalid --input-format '%v' (expected 'auto', 'tsv', 'csv' or 'json')", format)
+	}
+}
+
+func isACLFile(name string) bool {
+	ext := filepath.Ext(name)
+
+	return ext == ".acl" || ext == ".json" || ext == ".csv"
+}
+
+// Converts a JSON ACL to the equivalent TSV ACL (with a column per door) so that it is validated and parsed exactly
+// as for a TSV ACL. The door columns are ordered by controller ID and door number, as for the generated TSV files.
+func jsonToTSV(b []byte, devices []uhppote.Device) ([]byte, error) {
+	var cards []jsonCard
+
+	if trimmed := bytes.TrimSpace(b); bytes.HasPrefix(trimmed, []byte("[")) {
+		if err := json.Unmarshal(trimmed, &cards); err != nil {
+			return nil, fmt.Errorf("Error parsing JSON ACL (%w)", err)
+		}
+	} else {
+		var v jsonACL
+		if err := json.Unmarshal(trimmed, &v); err != nil {
+			return nil, fmt.Errorf("Error parsing JSON ACL (%w)", err)
+		}
+
+		cards = v.Cards
+	}
+
+	// ... door columns
+	used := map[string]bool{}
+	for i, card := range cards {
+	loop:
+		for door := range card.Doors {
+			for _, d := range devices {
+				for _, name := range d.Doors {
+					if clean(name) != "" && clean(name) == clean(door) {
+						used[clean(door)] = true
+						continue loop
+					}
+				}
+			}
+
+			return nil, fmt.Errorf("Error parsing JSON ACL - card %d: no configured door matches '%s'", i+1, door)
+		}
+	}
+
+	sorted := make([]uhppote.Device, len(devices))
+	copy(sorted, devices)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].DeviceID < sorted[j].DeviceID })
+
+	header := []string{"Card Number", "From", "To"}
+	doors := []string{}
+	for _, d := range sorted {
+		for _, name := range d.Doors {
+			if key := clean(name); used[key] {
+				header = append(header, name)
+				doors = append(doors, key)
+				used[key] = false
+			}
+		}
+	}
+
+	var w bytes.Buffer
+
+	tsv := csv.NewWriter(&w)
+	tsv.Comma = '\t'
+
+	if err := tsv.Write(header); err != nil {
+		return nil, err
+	}
+
+	for i, card := range cards {
+		if card.CardNumber == "" {
+			return nil, fmt.Errorf("Error parsing JSON ACL - card %d: missing 'card-number'", i+1)
+		}
+
+		row := []string{card.CardNumber.String(), card.From, card.To}
+
+		permissions := map[string]string{}
+		for door, v := range card.Doors {
+			p, err := jsonPermission(v)
+			if err != nil {
+				return nil, fmt.Errorf("Error parsing JSON ACL - card %v: %w for door '%s'", card.CardNumber, err, door)
+			}
+
+			permissions[clean(door)] = p
+		}
+
+		for _, door := range doors {
+			if p, ok := permissions[door]; ok {
+				row = append(row, p)
+			} else {
+				row = append(row, "N")
+			}
+		}
+
+		if err := tsv.Write(row); err != nil {
+			return nil, err
+		}
+	}
+
+	tsv.Flush()
+
+	return w.Bytes(), tsv.Error()
+}
+
+func jsonPermission(v json.RawMessage) (string, error) {
+	var b bool
+	if err := json.Unmarshal(v, &b); err == nil {
+		if b {
+			return "Y", nil
+		}
+
+		return "N", nil
+	}
+
+	var n json.Number
+	if err := json.Unmarshal(v, &n); err == nil {
+		if _, err := strconv.Atoi(n.String()); err != nil {
+			return "", fmt.Errorf("invalid time profile %v", n)
+		}
+
+		return n.String(), nil
+	}
+
+	var s string
+	if err := json.Unmarshal(v, &s); err == nil {
+		return strings.TrimSpace(s), nil
+	}
+
+	return "", fmt.Errorf("expected 'Y', 'N', true, false or a time profile ID")
+}
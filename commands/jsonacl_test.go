@@ -0,0 +1,142 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"testing"
+
+	"github.com/uhppoted/uhppote-core/uhppote"
+	"github.com/uhppoted/uhppoted-lib/acl"
+)
+
+var jsonTestDevices = []uhppote.Device{
+	*uhppote.NewDevice("Alpha", 12345, nil, 0, []string{"Great Hall", "Kitchen", "Dungeon", "Hogsmeade"}),
+	*uhppote.NewDevice("Beta", 54321, nil, 0, []string{"Gryffindor", "Hufflepuff", "Ravenclaw", "Slytherin"}),
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		devices []uhppote.Device
+		tsv     string
+	}{
+		{
+			name:    "dates and doors",
+			devices: jsonTestDevices[:1],
+			tsv: "Card Number\tFrom\tTo\tGreat Hall\tKitchen\tDungeon\tHogsmeade\n" +
+				"8165538\t2021-01-01\t2021-12-31\tY\tN\tN\tY\n" +
+				"8165539\t2021-02-28\t2022-06-30\tN\tN\tN\tN\n",
+		},
+		{
+			name:    "time profiles",
+			devices: jsonTestDevices[:1],
+			tsv: "Card Number\tFrom\tTo\tGreat Hall\tKitchen\tDungeon\tHogsmeade\n" +
+				"8165538\t2021-01-01\t2021-12-31\t29\tY\t100\tN\n",
+		},
+		{
+			name:    "multiple devices",
+			devices: jsonTestDevices,
+			tsv: "Card Number\tFrom\tTo\tGreat Hall\tKitchen\tDungeon\tHogsmeade\tGryffindor\tHufflepuff\tRavenclaw\tSlytherin\n" +
+				"8165538\t2021-01-01\t2021-12-31\tY\tN\tN\tN\tY\tN\tN\tN\n" +
+				"8165539\t2021-01-01\t2021-12-31\tN\tN\tN\tN\tN\tY\t29\tN\n" +
+				"8165540\t2020-07-01\t2023-06-30\tY\tY\tY\tY\tN\tN\tN\tN\n",
+		},
+	}
+
+	for _, test := range tests {
+		expected, _, err := acl.ParseTSV(bytes.NewReader([]byte(test.tsv)), test.devices, true)
+		if err != nil {
+			t.Fatalf("%v: error parsing TSV ACL (%v)", test.name, err)
+		}
+
+		if len(cardNumbers(expected)) == 0 {
+			t.Fatalf("%v: no cards in TSV ACL", test.name)
+		}
+
+		b, err := aclToJSON(expected, test.devices)
+		if err != nil {
+			t.Fatalf("%v: error converting ACL to JSON (%v)", test.name, err)
+		}
+
+		tsv, err := jsonToTSV(b, test.devices)
+		if err != nil {
+			t.Fatalf("%v: error converting JSON ACL to TSV (%v)", test.name, err)
+		}
+
+		list, _, err := acl.ParseTSV(bytes.NewReader(tsv), test.devices, true)
+		if err != nil {
+			t.Fatalf("%v: error parsing converted JSON ACL (%v)", test.name, err)
+		}
+
+		if !sameACL(expected, list) {
+			t.Errorf("%v: JSON round trip ACL does not match TSV ACL\n   expected:%v\n   got:     %v\n   JSON:    %s", test.name, expected, list, b)
+		}
+	}
+}
+
+// Converts an ACL to a JSON ACL file, with the door permissions from each device merged into a single card.
+func aclToJSON(list acl.ACL, devices []uhppote.Device) ([]byte, error) {
+	cards := map[uint32]map[string]interface{}{}
+	cardNumbers := []uint32{}
+
+	for _, d := range devices {
+		for k, card := range list[d.DeviceID] {
+			if _, ok := cards[k]; !ok {
+				cards[k] = map[string]interface{}{
+					"card-number": card.CardNumber,
+					"from":        card.From.String(),
+					"to":          card.To.String(),
+					"doors":       map[string]interface{}{},
+				}
+
+				cardNumbers = append(cardNumbers, k)
+			}
+
+			doors := cards[k]["doors"].(map[string]interface{})
+			for door, p := range card.Doors {
+				switch {
+				case p == 0:
+					doors[d.Doors[door-1]] = "N"
+				case p == 1:
+					doors[d.Doors[door-1]] = true
+				default:
+					doors[d.Doors[door-1]] = p
+				}
+			}
+		}
+	}
+
+	sort.Slice(cardNumbers, func(i, j int) bool { return cardNumbers[i] < cardNumbers[j] })
+
+	v := struct {
+		Cards []map[string]interface{} `json:"cards"`
+	}{}
+
+	for _, k := range cardNumbers {
+		v.Cards = append(v.Cards, cards[k])
+	}
+
+	return json.Marshal(v)
+}
+
+func sameACL(p, q acl.ACL) bool {
+	if len(p) != len(q) {
+		return false
+	}
+
+	for device, cards := range p {
+		other, ok := q[device]
+		if !ok || len(cards) != len(other) {
+			return false
+		}
+
+		for k, card := range cards {
+			if c, ok := other[k]; !ok || !sameCard(card, c) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,153 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+
+	"github.com/uhppoted/uhppote-core/types"
+	"github.com/uhppoted/uhppote-core/uhppote"
+	"github.com/uhppoted/uhppoted-lib/acl"
+)
+
+const LDAP_PASSWORD = "UHPPOTED_LDAP_PASSWORD"
+
+// Builds the authoritative ACL from the LDAP (e.g. Active Directory) group memberships of the users with a card
+// number attribute. Groups are mapped to doors by the access levels defined in the uhppoted.conf file i.e. a user
+// that is a member of the 'Staff' group is granted access to the doors of the 'Staff' access level.
+type ldapSource struct {
+	url      string
+	baseDN   string
+	bindDN   string
+	cardAttr string
+	from     string
+	to       string
+}
+
+func (l *ldapSource) getACL(levels accessLevels, devices []uhppote.Device) (acl.ACL, []error, error) {
+	from, err := types.DateFromString(l.from)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid LDAP card start date '%v' (%w)", l.from, err)
+	}
+
+	to, err := types.DateFromString(l.to)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid LDAP card end date '%v' (%w)", l.to, err)
+	}
+
+	conn, err := ldap.DialURL(l.url)
+	if err != nil {
+		return nil, nil, &FetchError{URL: l.url, Err: err}
+	}
+
+	defer conn.Close()
+
+	if l.bindDN != "" {
+		if err := conn.Bind(l.bindDN, os.Getenv(LDAP_PASSWORD)); err != nil {
+			return nil, nil, &FetchError{URL: l.url, Err: fmt.Errorf("LDAP bind failed for '%v' (%w)", l.bindDN, err)}
+		}
+	}
+
+	rq := ldap.NewSearchRequest(
+		l.baseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		0,
+		0,
+		false,
+		fmt.Sprintf("(&(%v=*)(memberOf=*))", ldap.EscapeFilter(l.cardAttr)),
+		[]string{"dn", l.cardAttr, "memberOf"},
+		nil)
+
+	result, err := conn.SearchWithPaging(rq, 500)
+	if err != nil {
+		return nil, nil, &FetchError{URL: l.url, Err: err}
+	}
+
+	// ... map doors to controller doors
+	type door struct {
+		device uint32
+		door   uint8
+	}
+
+	doors := map[string]door{}
+	for _, d := range devices {
+		for i, name := range d.Doors {
+			if key := clean(name); key != "" {
+				doors[key] = door{d.DeviceID, uint8(i + 1)}
+			}
+		}
+	}
+
+	list := acl.ACL{}
+	for _, d := range devices {
+		list[d.DeviceID] = map[uint32]types.Card{}
+	}
+
+	warnings := []error{}
+	cards := map[uint32]bool{}
+	for _, entry := range result.Entries {
+		v := strings.TrimSpace(entry.GetAttributeValue(l.cardAttr))
+		cardNumber, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			warnings = append(warnings, fmt.Errorf("%v: invalid card number '%v'", entry.DN, v))
+			continue
+		}
+
+		card := uint32(cardNumber)
+		if cards[card] {
+			warnings = append(warnings, &acl.DuplicateCardError{CardNumber: card})
+			continue
+		}
+
+		cards[card] = true
+		granted := map[door]bool{}
+
+		for _, group := range entry.GetAttributeValues("memberOf") {
+			level, ok := levels[clean(groupName(group))]
+			if !ok {
+				continue
+			}
+
+			for _, name := range level {
+				if d, ok := doors[clean(name)]; ok {
+					granted[d] = true
+				}
+			}
+		}
+
+		for _, d := range devices {
+			permissions := map[uint8]int{1: 0, 2: 0, 3: 0, 4: 0}
+			for i := uint8(1); i <= 4; i++ {
+				if granted[door{d.DeviceID, i}] {
+					permissions[i] = 1
+				}
+			}
+
+			list[d.DeviceID][card] = types.Card{
+				CardNumber: card,
+				From:       from,
+				To:         to,
+				Doors:      permissions,
+			}
+		}
+	}
+
+	return list, warnings, nil
+}
+
+// Returns the common name of a group DN e.g. 'Staff' for CN=Staff,OU=Groups,DC=hogwarts,DC=edu
+func groupName(dn string) string {
+	if p, err := ldap.ParseDN(dn); err == nil && len(p.RDNs) > 0 {
+		for _, a := range p.RDNs[0].Attributes {
+			if strings.EqualFold(a.Type, "cn") {
+				return a.Value
+			}
+		}
+	}
+
+	return dn
+}
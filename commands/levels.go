@@ -0,0 +1,185 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/uhppoted/uhppote-core/uhppote"
+	"github.com/uhppoted/uhppoted-lib/encoding/conf"
+)
+
+// Access levels are defined in the uhppoted.conf file as a list of doors for each access level name e.g.
+//
+//	s3.access-level.Staff = Front Door, Side Door, Garage
+//	s3.access-level.Visitor = Front Door
+type accessLevels map[string][]string
+
+func (l *accessLevels) UnmarshalConf(tag string, values map[string]string) (interface{}, error) {
+	levels := accessLevels{}
+	prefix := tag + "."
+
+	for k, v := range values {
+		if strings.HasPrefix(k, prefix) {
+			name := clean(strings.TrimPrefix(k, prefix))
+			doors := []string{}
+			for _, d := range strings.Split(v, ",") {
+				if door := strings.TrimSpace(d); door != "" {
+					doors = append(doors, door)
+				}
+			}
+
+			levels[name] = doors
+		}
+	}
+
+	return &levels, nil
+}
+
+func loadAccessLevels(file string) (accessLevels, error) {
+	if file == "" {
+		return accessLevels{}, nil
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	c := struct {
+		AccessLevels accessLevels `conf:"s3.access-level"`
+	}{}
+
+	if err := conf.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+
+	return c.AccessLevels, nil
+}
+
+// Replaces the 'Access Level' column (if any) in the TSV with the equivalent door columns. A card is
+// granted access to a door if either the access level or an explicit door column grants access.
+func resolveAccessLevels(tsv []byte, levels accessLevels, devices []uhppote.Device) ([]byte, error) {
+	r := csv.NewReader(bytes.NewReader(tsv))
+	r.Comma = '\t'
+	r.FieldsPerRecord = -1
+
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	} else if len(records) == 0 {
+		return tsv, nil
+	}
+
+	header := records[0]
+	column := -1
+	for ix, field := range header {
+		if clean(field) == "accesslevel" {
+			column = ix
+			break
+		}
+	}
+
+	if column < 0 {
+		return tsv, nil
+	}
+
+	// ... map doors to columns
+	configured := map[string]string{}
+	for _, d := range devices {
+		for _, door := range d.Doors {
+			if key := clean(door); key != "" {
+				configured[key] = door
+			}
+		}
+	}
+
+	for name, doors := range levels {
+		for _, door := range doors {
+			if _, ok := configured[clean(door)]; !ok {
+				return nil, fmt.Errorf("Access level '%v': no configured door matches '%v'", name, door)
+			}
+		}
+	}
+
+	columns := map[string]int{}
+	hdr := []string{}
+	for ix, field := range header {
+		if ix != column {
+			columns[clean(field)] = len(hdr)
+			hdr = append(hdr, field)
+		}
+	}
+
+	for _, d := range devices {
+		for _, door := range d.Doors {
+			key := clean(door)
+			if _, ok := columns[key]; key != "" && !ok {
+				columns[key] = len(hdr)
+				hdr = append(hdr, door)
+			}
+		}
+	}
+
+	var b bytes.Buffer
+
+	w := csv.NewWriter(&b)
+	w.Comma = '\t'
+
+	if err := w.Write(hdr); err != nil {
+		return nil, err
+	}
+
+	for line, record := range records[1:] {
+		// ... invalid records are passed through unchanged for the ACL parser to report
+		if len(record) != len(header) {
+			if err := w.Write(record); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		row := make([]string, len(hdr))
+		for ix, field := range record {
+			if ix != column {
+				row[columns[clean(header[ix])]] = field
+			}
+		}
+
+		for _, l := range strings.Split(record[column], ",") {
+			level := clean(l)
+			if level == "" {
+				continue
+			}
+
+			doors, ok := levels[level]
+			if !ok {
+				return nil, fmt.Errorf("Error parsing TSV - line %d: unknown access level '%v'", line+1, strings.TrimSpace(l))
+			}
+
+			for _, door := range doors {
+				ix := columns[clean(door)]
+				if v := strings.TrimSpace(row[ix]); v == "" || v == "N" {
+					row[ix] = "Y"
+				}
+			}
+		}
+
+		for key := range configured {
+			if ix := columns[key]; strings.TrimSpace(row[ix]) == "" {
+				row[ix] = "N"
+			}
+		}
+
+		if err := w.Write(row); err != nil {
+			return nil, err
+		}
+	}
+
+	w.Flush()
+
+	return b.Bytes(), w.Error()
+}
@@ -0,0 +1,165 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/uhppoted/uhppoted-lib/config"
+)
+
+var ListCmd = List{
+	config:      config.DefaultConfig,
+	credentials: DEFAULT_CREDENTIALS,
+	profile:     DEFAULT_PROFILE,
+	region:      DEFAULT_REGION,
+	role:        awsRole{duration: DEFAULT_ROLE_DURATION},
+	retry:       retryPolicy{retries: DEFAULT_RETRIES, delay: DEFAULT_RETRY_DELAY},
+	format:      "text",
+	debug:       false,
+}
+
+type List struct {
+	url         string
+	config      string
+	credentials string
+	profile     string
+	region      string
+	role        awsRole
+	endpoint    s3Endpoint
+	proxy       string
+	retry       retryPolicy
+	format      string
+	debug       bool
+	ctx         context.Context
+	flagset     *flag.FlagSet
+}
+
+func (cmd *List) Name() string {
+	return "list"
+}
+
+func (cmd *List) FlagSet() *flag.FlagSet {
+	flagset := flag.NewFlagSet("list", flag.ExitOnError)
+
+	flagset.StringVar(&cmd.url, "url", cmd.url, "The s3://bucket/prefix URL of the ACL and report files to list")
+	flagset.StringVar(&cmd.credentials, "credentials", cmd.credentials, "AWS credentials file (or profile://<name> to use the credentials and region for the named profile in the shared AWS config)")
+	flagset.StringVar(&cmd.profile, "profile", cmd.profile, "AWS credentials file profile (defaults to 'default')")
+	flagset.StringVar(&cmd.region, "region", cmd.region, "AWS region for S3 (defaults to us-east-1)")
+	flagset.StringVar(&cmd.role.arn, "role-arn", cmd.role.arn, "ARN of an IAM role to assume (using STS AssumeRole) for S3 access e.g. for cross-account access")
+	flagset.StringVar(&cmd.role.externalID, "external-id", cmd.role.externalID, "External ID for assuming the --role-arn role")
+	flagset.DurationVar(&cmd.role.duration, "role-duration", cmd.role.duration, "Session duration for the assumed --role-arn role (credentials are refreshed automatically when they expire)")
+	flagset.StringVar(&cmd.endpoint.url, "endpoint", cmd.endpoint.url, "Custom S3 endpoint URL for S3 compatible stores e.g. http://minio.local:9000 (defaults to AWS S3)")
+	flagset.BoolVar(&cmd.endpoint.pathStyle, "path-style", cmd.endpoint.pathStyle, "Uses path-style (http://host/bucket/key) rather than virtual-hosted style S3 addressing (e.g. for MinIO)")
+	flagset.StringVar(&cmd.proxy, "proxy", cmd.proxy, "HTTP proxy URL for HTTP and S3 requests (overrides the HTTP_PROXY and HTTPS_PROXY environment variables, NO_PROXY still applies)")
+	flagset.IntVar(&cmd.retry.retries, "retries", cmd.retry.retries, "Number of times to retry an S3 request after a transient failure (5xx response, connection reset or timeout)")
+	flagset.DurationVar(&cmd.retry.delay, "retry-delay", cmd.retry.delay, "Delay before the first retry of a failed S3 request, doubling (with jitter) for each subsequent retry")
+	flagset.StringVar(&cmd.format, "format", cmd.format, "Output format ('text' or 'json')")
+
+	cmd.flagset = flagset
+
+	return flagset
+}
+
+func (cmd *List) Description() string {
+	return fmt.Sprintf("Lists the ACL and report files stored under an S3 prefix")
+}
+
+func (cmd *List) Usage() string {
+	return "list <s3://bucket/prefix>"
+}
+
+func (cmd *List) Help() {
+	fmt.Println()
+	fmt.Printf("  Usage: %s [--debug] [--config <file>] list [--credentials <file>] [--profile <file>] [--region <region>] [--role-arn <ARN>] [--external-id <ID>] [--role-duration <duration>] [--endpoint <URL>] [--path-style] [--proxy <URL>] [--retries <N>] [--retry-delay <duration>] [--format text|json] <s3://bucket/prefix>\n", APP)
+	fmt.Println()
+	fmt.Println("    Lists the objects (key, size and last modified time) stored under the S3 bucket and prefix e.g. the uploaded")
+	fmt.Println("    ACL and report files.")
+	fmt.Println()
+
+	helpOptions(cmd.FlagSet())
+	fmt.Println()
+}
+
+func (cmd *List) Execute(args ...interface{}) error {
+	options := args[0].(*Options)
+
+	cmd.config = options.Config
+	cmd.debug = options.Debug
+	cmd.ctx = options.ctx()
+	cmd.retry.log = log.New(os.Stdout, "  ", 0)
+
+	if err := setProxy(cmd.proxy); err != nil {
+		return err
+	}
+
+	if cmd.format != "text" && cmd.format != "json" {
+		return fmt.Errorf("Invalid --format '%s' (expected 'text' or 'json')", cmd.format)
+	}
+
+	uri := strings.TrimSpace(cmd.url)
+	if uri == "" && cmd.flagset != nil && cmd.flagset.NArg() > 0 {
+		uri = strings.TrimSpace(cmd.flagset.Arg(0))
+	}
+
+	if uri == "" {
+		return fmt.Errorf("list requires an s3://bucket/prefix URL")
+	}
+
+	if !strings.HasPrefix(uri, "s3://") {
+		return fmt.Errorf("Invalid list URL '%v' (expected s3://bucket/prefix)", uri)
+	}
+
+	conf := config.NewConfig()
+	if err := conf.Load(cmd.config); err != nil {
+		return fmt.Errorf("WARN  Could not load configuration (%v)", err)
+	}
+
+	if cmd.credentials == "" {
+		cmd.credentials = conf.AWS.Credentials
+	}
+
+	if cmd.profile == "" {
+		cmd.profile = conf.AWS.Profile
+	}
+
+	if cmd.region == "" && !isProfileURI(cmd.credentials) {
+		cmd.region = conf.AWS.Region
+	}
+
+	objects, err := listS3(cmd.ctx, uri, cmd.credentials, cmd.profile, cmd.region, "", cmd.endpoint, cmd.role, cmd.retry)
+	if err != nil {
+		return &FetchError{URL: uri, Err: err}
+	}
+
+	if cmd.format == "json" {
+		b, err := json.MarshalIndent(objects, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s\n", b)
+		return nil
+	}
+
+	width := 32
+	for _, o := range objects {
+		if len(o.Key) > width {
+			width = len(o.Key)
+		}
+	}
+
+	fmt.Println()
+	fmt.Printf("  %v (%v objects)\n", uri, len(objects))
+	fmt.Println()
+	for _, o := range objects {
+		fmt.Printf("    %-*v %10v  %v\n", width, o.Key, o.Size, o.LastModified.UTC().Format("2006-01-02 15:04:05"))
+	}
+	fmt.Println()
+
+	return nil
+}
@@ -1,31 +1,47 @@
 package commands
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/uhppoted/uhppote-core/types"
 	"github.com/uhppoted/uhppote-core/uhppote"
 	"github.com/uhppoted/uhppoted-lib/acl"
 	"github.com/uhppoted/uhppoted-lib/config"
-	"github.com/uhppoted/uhppoted-lib/eventlog"
 )
 
 var LoadACLCmd = LoadACL{
 	config:      config.DefaultConfig,
+	inputFormat: "auto",
+	onDuplicate: "warn",
 	workdir:     DEFAULT_WORKDIR,
 	keysdir:     DEFAULT_KEYSDIR,
 	credentials: DEFAULT_CREDENTIALS,
 	profile:     DEFAULT_PROFILE,
 	region:      DEFAULT_REGION,
+	role:        awsRole{duration: DEFAULT_ROLE_DURATION},
+	httpTimeout: DEFAULT_HTTP_TIMEOUT,
+	retry:       retryPolicy{retries: DEFAULT_RETRIES, delay: DEFAULT_RETRY_DELAY},
+	concurrency: 1,
 	logFile:     DEFAULT_LOGFILE,
 	logFileSize: DEFAULT_LOGFILESIZE,
+	logFormat:   DEFAULT_LOG_FORMAT,
+	logMaxFiles: DEFAULT_LOG_MAX_FILES,
+	logMaxAge:   DEFAULT_LOG_MAX_AGE,
+	format:      "text",
+	reportName:  DEFAULT_REPORT_NAME,
 	dryrun:      false,
 	strict:      false,
 	noreport:    false,
@@ -34,7 +50,7 @@ var LoadACLCmd = LoadACL{
 	debug:       false,
 	template: `ACL DIFF REPORT {{ .DateTime }}
 {{range $id,$value := .Diffs}}
-  DEVICE {{ $id }}{{if $value.Unchanged}}
+  DEVICE {{with index $.Devices $id}}{{ . }}{{else}}{{ $id }}{{end}}{{if $value.Unchanged}}
     Unchanged: {{range $value.Unchanged}}{{.}}
                {{end}}{{end}}{{if $value.Updated}}
     Updated:   {{range $value.Updated}}{{.}}
@@ -43,26 +59,75 @@ var LoadACLCmd = LoadACL{
                {{end}}{{end}}{{if $value.Deleted}}
     Deleted:   {{range $value.Deleted}}{{.}}
                {{end}}{{end}}{{end}}
-`,
+{{if .Duplicates}}
+DUPLICATE CARD NUMBERS IN THE ACL
+{{range .Duplicates}}
+  {{ . }}{{end}}
+{{end}}`,
 }
 
 type LoadACL struct {
 	url         string
 	config      string
 	workdir     string
+	stream      bool
+	inputFormat string
+	delimiter   string
 	keysdir     string
+	decryptKey  string
+	ca          string
 	credentials string
+	gcsCreds    string
+	azure       azureAuth
+	sftp        sftpAuth
 	profile     string
 	region      string
+	fallback    string
+	role        awsRole
+	endpoint    s3Endpoint
+	proxy       string
+	httpTimeout time.Duration
+	httpAuth    httpAuth
+	httpTLS     httpTLS
+	retry       retryPolicy
 	logFile     string
 	logFileSize int
+	logFormat   string
+	logMaxFiles int
+	logMaxAge   int
 	template    string
+	format      string
+	tmplFile    string
+	reportName  string
+	nameMap     string
+	checksum    string
+	maxAge      time.Duration
+	summary     string
+	backupTo    string
+	backupErrOk bool
+	keyfile     string
+	passphrase  string
+	maxDeletes  uint
+	maxChanges  uint
 	dryrun      bool
+	confirm     bool
+	yes         bool
 	strict      bool
+	onDuplicate string
+	normalize   bool
+	hexCards    bool
 	noreport    bool
+	skipNoDiff  bool
+	failFast    bool
+	collectAll  bool
 	noverify    bool
+	concurrency int
 	nolog       bool
 	debug       bool
+	ctx         context.Context
+	levels      accessLevels
+	names       deviceNames
+	duplicates  []Duplicate
 }
 
 func (cmd *LoadACL) Name() string {
@@ -72,17 +137,70 @@ func (cmd *LoadACL) Name() string {
 func (cmd *LoadACL) FlagSet() *flag.FlagSet {
 	flagset := flag.NewFlagSet("load-acl", flag.ExitOnError)
 
-	flagset.StringVar(&cmd.url, "url", cmd.url, "The URL from which to fetch the ACL file")
-	flagset.StringVar(&cmd.credentials, "credentials", cmd.credentials, "AWS credentials file")
+	flagset.StringVar(&cmd.url, "url", cmd.url, "The URL from which to fetch the ACL file (or '-' to read the ACL file from stdin)")
+	flagset.StringVar(&cmd.credentials, "credentials", cmd.credentials, "AWS credentials file (or profile://<name> to use the credentials and region for the named profile in the shared AWS config)")
+	flagset.StringVar(&cmd.gcsCreds, "gcs-credentials", cmd.gcsCreds, "Google Cloud service account JSON credentials file for gs:// URLs (defaults to the application default credentials e.g. GOOGLE_APPLICATION_CREDENTIALS)")
+	flagset.StringVar(&cmd.azure.account, "azure-account", cmd.azure.account, "Azure storage account for az:// URLs (defaults to the AZURE_STORAGE_ACCOUNT environment variable)")
+	flagset.StringVar(&cmd.azure.key, "azure-key", cmd.azure.key, "Azure storage account shared key (defaults to the AZURE_STORAGE_KEY environment variable)")
+	flagset.StringVar(&cmd.azure.sas, "azure-sas", cmd.azure.sas, "Azure SAS token for az:// and blob.core.windows.net URLs (defaults to the AZURE_STORAGE_SAS_TOKEN environment variable)")
+	flagset.StringVar(&cmd.azure.connection, "azure-connection-string", cmd.azure.connection, "Azure storage connection string (defaults to the AZURE_STORAGE_CONNECTION_STRING environment variable)")
+	flagset.StringVar(&cmd.sftp.key, "ssh-key", cmd.sftp.key, "SSH private key file for sftp:// URLs (the passphrase for an encrypted key is taken from the SSH_KEY_PASSPHRASE environment variable)")
+	flagset.StringVar(&cmd.sftp.knownHosts, "known-hosts", cmd.sftp.knownHosts, "SSH known_hosts file used to verify the SFTP server host key (defaults to ~/.ssh/known_hosts)")
 	flagset.StringVar(&cmd.profile, "profile", cmd.profile, "AWS credentials file profile (defaults to 'default')")
 	flagset.StringVar(&cmd.region, "region", cmd.region, "AWS region for S3 (defaults to us-east-1)")
-	flagset.StringVar(&cmd.keysdir, "keys", cmd.keysdir, "Sets the directory to search for RSA signing keys. Key files are expected to be named '<uname>.pub'")
+	flagset.StringVar(&cmd.fallback, "region-fallback", cmd.fallback, "Comma separated list of AWS regions to try in order if the ACL file S3 bucket is not in the --region region (the bucket region is detected automatically if possible)")
+	flagset.StringVar(&cmd.role.arn, "role-arn", cmd.role.arn, "ARN of an IAM role to assume (using STS AssumeRole) for S3 access e.g. for cross-account access")
+	flagset.StringVar(&cmd.role.externalID, "external-id", cmd.role.externalID, "External ID for assuming the --role-arn role")
+	flagset.DurationVar(&cmd.role.duration, "role-duration", cmd.role.duration, "Session duration for the assumed --role-arn role (credentials are refreshed automatically when they expire)")
+	flagset.StringVar(&cmd.endpoint.url, "endpoint", cmd.endpoint.url, "Custom S3 endpoint URL for S3 compatible stores e.g. http://minio.local:9000 (defaults to AWS S3)")
+	flagset.BoolVar(&cmd.endpoint.pathStyle, "path-style", cmd.endpoint.pathStyle, "Uses path-style (http://host/bucket/key) rather than virtual-hosted style S3 addressing (e.g. for MinIO)")
+	flagset.StringVar(&cmd.proxy, "proxy", cmd.proxy, "HTTP proxy URL for HTTP and S3 requests (overrides the HTTP_PROXY and HTTPS_PROXY environment variables, NO_PROXY still applies)")
+	flagset.DurationVar(&cmd.httpTimeout, "http-timeout", cmd.httpTimeout, "Timeout for HTTP requests, including reading the response body (0 for no timeout)")
+	flagset.StringVar(&cmd.httpAuth.user, "http-user", cmd.httpAuth.user, "User name for HTTP basic auth (defaults to the UHPPOTED_HTTP_USER environment variable)")
+	flagset.StringVar(&cmd.httpAuth.password, "http-password", cmd.httpAuth.password, "Password for HTTP basic auth (defaults to the UHPPOTED_HTTP_PASSWORD environment variable)")
+	flagset.StringVar(&cmd.httpAuth.bearer, "http-bearer", cmd.httpAuth.bearer, "Bearer token for HTTP requests (defaults to the UHPPOTED_HTTP_BEARER environment variable)")
+	flagset.StringVar(&cmd.httpTLS.cert, "client-cert", cmd.httpTLS.cert, "PEM client certificate file for mutual TLS with https:// servers")
+	flagset.StringVar(&cmd.httpTLS.key, "client-key", cmd.httpTLS.key, "PEM private key file for the --client-cert client certificate")
+	flagset.StringVar(&cmd.httpTLS.ca, "ca-cert", cmd.httpTLS.ca, "PEM CA certificates file for verifying https:// server certificates (defaults to the system CA certificates)")
+	flagset.IntVar(&cmd.retry.retries, "retries", cmd.retry.retries, "Number of times to retry an S3 or HTTP request after a transient failure (5xx response, connection reset or timeout)")
+	flagset.DurationVar(&cmd.retry.delay, "retry-delay", cmd.retry.delay, "Delay before the first retry of a failed S3 or HTTP request, doubling (with jitter) for each subsequent retry")
+	flagset.StringVar(&cmd.keysdir, "keys", cmd.keysdir, "Sets the directory to search for RSA or ed25519 signing keys. Key files are expected to be named '<uname>.pub' (and '<uname>/*.pub' for additional e.g. rotated keys)")
+	flagset.StringVar(&cmd.decryptKey, "decrypt-key", cmd.decryptKey, "RSA private key file for decrypting ACL files encrypted with store-acl --encrypt-to (the passphrase for an encrypted key is taken from the UHPPOTED_DECRYPT_KEY_PASSPHRASE environment variable)")
+	flagset.StringVar(&cmd.checksum, "checksum", cmd.checksum, "SHA-256 checksum (hex digest or URL of a .sha256 file) for verifying the downloaded ACL file before it is unpacked")
+	flagset.DurationVar(&cmd.maxAge, "max-age", cmd.maxAge, "Rejects an ACL file with a signed timestamp older than the maximum age e.g. 24h (defaults to 0 i.e. the timestamp is not checked)")
+	flagset.StringVar(&cmd.ca, "ca", cmd.ca, "PEM file with the trusted CA certificates for verifying the ACL signing certificate chain (replaces --keys)")
+	flagset.StringVar(&cmd.nameMap, "device-name-map", cmd.nameMap, "File that maps device IDs to friendly names for the report (defaults to the s3.device-name entries in the configuration file)")
+	flagset.StringVar(&cmd.tmplFile, "template", cmd.tmplFile, "Go text/template file for the text report (or html/template file for the html report), defaults to the built-in report template")
+	flagset.StringVar(&cmd.reportName, "report-name", cmd.reportName, "Report file name, either a Go time format for the local time or a text/template with {{.Date}}, {{.Time}} (UTC), {{.Device}}, {{.UTC}} and {{.Local}} fields. The report format extension is appended if missing")
+	flagset.StringVar(&cmd.format, "format", cmd.format, "ACL 'diff' report format ('text', 'json' or 'html')")
+	flagset.StringVar(&cmd.summary, "summary", cmd.summary, "URL (or local file) to which to write the JSON summary of the report counts")
 	flagset.StringVar(&cmd.workdir, "workdir", cmd.workdir, "Sets the working directory for temporary files, etc")
+	flagset.BoolVar(&cmd.stream, "stream", cmd.stream, "Downloads s3:// ACL files to a temporary file in the working directory rather than to memory (for very large ACL files)")
+	flagset.StringVar(&cmd.backupTo, "backup", cmd.backupTo, "URL (s3://, gs://, az://, http(s):// or file://) under which to store a signed backup of the current controller ACL, with a timestamped name, before updating the controllers")
+	flagset.BoolVar(&cmd.backupErrOk, "ignore-backup-errors", cmd.backupErrOk, "Updates the controllers even if the --backup fails")
+	flagset.StringVar(&cmd.keyfile, "key", cmd.keyfile, "RSA or ed25519 signing key file for the --backup ACL file (or a comma separated list of keys)")
+	flagset.StringVar(&cmd.passphrase, "key-passphrase", cmd.passphrase, "Passphrase for an encrypted --key signing key (defaults to the UHPPOTED_KEY_PASSPHRASE environment variable)")
+	flagset.StringVar(&cmd.inputFormat, "input-format", cmd.inputFormat, "ACL file format ('auto', 'tsv', 'csv' or 'json'). 'auto' detects JSON and CSV ACL files from the .json or .csv extension of the URL or of the ACL file in the archive")
+	flagset.StringVar(&cmd.delimiter, "delimiter", cmd.delimiter, "Field delimiter for TSV and CSV ACL files ('tab', ',', ';' or any single character). Defaults to a tab, or a comma for CSV ACL files")
+	flagset.BoolVar(&cmd.failFast, "fail-fast", cmd.failFast, "Stops parsing the ACL file at the first invalid record (default)")
+	flagset.BoolVar(&cmd.collectAll, "collect-all", cmd.collectAll, "Reports all the invalid records in the ACL file rather than stopping at the first invalid record")
 	flagset.BoolVar(&cmd.noverify, "no-verify", cmd.noverify, "Disables verification of the downloaded ACL RSA signature")
-	flagset.BoolVar(&cmd.dryrun, "dry-run", cmd.dryrun, "Simulates a load-acl without making any changes to the access controllers")
+	flagset.UintVar(&cmd.maxDeletes, "max-deletes", cmd.maxDeletes, "Aborts the load if the number of cards to be deleted from any controller exceeds the limit (0 for no limit)")
+	flagset.UintVar(&cmd.maxChanges, "max-changes", cmd.maxChanges, "Aborts the load if the number of cards to be updated, added or deleted on any controller exceeds the limit (0 for no limit)")
+	flagset.BoolVar(&cmd.dryrun, "dry-run", cmd.dryrun, "Simulates a load-acl, reporting the changes that would be made to each access controller without updating the controllers")
+	flagset.BoolVar(&cmd.confirm, "confirm", cmd.confirm, "Prints a summary of the changes and waits for confirmation before updating the controllers (requires a terminal)")
+	flagset.BoolVar(&cmd.yes, "yes", cmd.yes, "Skips the --confirm prompt e.g. for automation")
+	flagset.StringVar(&cmd.onDuplicate, "on-duplicate", cmd.onDuplicate, "Action for duplicate card numbers in the ACL: 'warn' (default), 'error' or 'merge' (merges the dates and door permissions)")
+	flagset.BoolVar(&cmd.normalize, "normalize-cards", cmd.normalize, "Normalizes the ACL card numbers to the canonical decimal form (no whitespace or leading zeros), ignoring records with invalid card numbers")
+	flagset.BoolVar(&cmd.hexCards, "hex-cards", cmd.hexCards, "Converts 0x prefixed hexadecimal ACL card numbers to decimal (implies --normalize-cards)")
 	flagset.BoolVar(&cmd.strict, "strict", cmd.strict, "Fails the load if the ACL contains duplicate card numbers")
 	flagset.BoolVar(&cmd.noreport, "no-report", cmd.noreport, "Disables ACL 'diff' report")
+	flagset.BoolVar(&cmd.skipNoDiff, "skip-if-unchanged", cmd.skipNoDiff, "Does not update controllers that already match the authoritative ACL")
+	flagset.IntVar(&cmd.concurrency, "concurrency", cmd.concurrency, "Maximum number of controllers to retrieve the ACL from concurrently (defaults to 1, 0 for all the controllers at once)")
 	flagset.BoolVar(&cmd.nolog, "no-log", cmd.nolog, "Writes log messages to stdout rather than a rotatable log file")
+	flagset.StringVar(&cmd.logFormat, "log-format", cmd.logFormat, "Log message format ('text' or 'json' i.e. one JSON object per log message)")
+	flagset.IntVar(&cmd.logMaxFiles, "log-max-files", cmd.logMaxFiles, "Maximum number of rotated log files to retain (0 for no limit)")
+	flagset.IntVar(&cmd.logMaxAge, "log-max-age", cmd.logMaxAge, "Maximum age (in days) of rotated log files to retain (0 for no limit)")
 
 	return flagset
 }
@@ -97,7 +215,7 @@ func (cmd *LoadACL) Usage() string {
 
 func (cmd *LoadACL) Help() {
 	fmt.Println()
-	fmt.Printf("  Usage: %s [--debug] [--config <file>] load-acl --url <URL> [--dry-run] [--credentials <file>] [--profile <file>] [--region <region>] [--keys <dir>] [--workdir <dir>] [--strict] [--no-verify] [--no-log] [--no-report]\n", APP)
+	fmt.Printf("  Usage: %s [--debug] [--config <file>] load-acl --url <URL> [--dry-run] [--confirm] [--yes] [--max-deletes <N>] [--max-changes <N>] [--credentials <file>] [--gcs-credentials <file>] [--azure-account <account>] [--azure-key <key>] [--azure-sas <token>] [--azure-connection-string <string>] [--ssh-key <file>] [--known-hosts <file>] [--profile <file>] [--region <region>] [--region-fallback <regions>] [--role-arn <ARN>] [--external-id <ID>] [--role-duration <duration>] [--endpoint <URL>] [--path-style] [--proxy <URL>] [--http-timeout <duration>] [--http-user <user>] [--http-password <password>] [--http-bearer <token>] [--client-cert <file>] [--client-key <file>] [--ca-cert <file>] [--retries <N>] [--retry-delay <duration>] [--keys <dir>] [--decrypt-key <file>] [--ca <file>] [--checksum <hex|URL>] [--max-age <duration>] [--workdir <dir>] [--stream] [--device-name-map <file>] [--format text|json|html] [--template <file>] [--report-name <pattern>] [--summary <URL>] [--backup <URL>] [--ignore-backup-errors] [--key <file>] [--key-passphrase <passphrase>] [--input-format auto|tsv|csv|json] [--delimiter <char>] [--normalize-cards] [--hex-cards] [--on-duplicate warn|error|merge] [--strict] [--fail-fast|--collect-all] [--no-verify] [--concurrency <N>] [--no-log] [--log-format text|json] [--log-max-files <N>] [--log-max-age <days>] [--no-report] [--skip-if-unchanged]\n", APP)
 	fmt.Println()
 	fmt.Println("    Fetches the ACL file stored at the pre-signed S3 URL and loads it to the controllers configured in")
 	fmt.Println("    the configuration file. Duplicate card numbers are ignored (or deleted if they exist) with a warning")
@@ -113,8 +231,72 @@ func (cmd *LoadACL) Execute(args ...interface{}) error {
 
 	cmd.config = options.Config
 	cmd.debug = options.Debug
+	cmd.ctx = options.ctx()
+
+	if err := setProxy(cmd.proxy); err != nil {
+		return err
+	}
+
+	if err := setClientTLS(cmd.httpTLS); err != nil {
+		return err
+	}
 
 	// ... check parameters
+	if cmd.failFast && cmd.collectAll {
+		return fmt.Errorf("--fail-fast and --collect-all are mutually exclusive")
+	}
+
+	if cmd.confirm && !cmd.yes {
+		if strings.TrimSpace(cmd.url) == "-" {
+			return fmt.Errorf("--confirm cannot read the confirmation from stdin when the ACL file is read from stdin (use --yes to skip the prompt)")
+		} else if !isTerminal(os.Stdin) {
+			return fmt.Errorf("--confirm requires a terminal but stdin is not a TTY (use --yes to skip the prompt)")
+		}
+	}
+
+	if cmd.maxAge > 0 && cmd.noverify {
+		return fmt.Errorf("--max-age requires signature verification and cannot be used with --no-verify")
+	}
+
+	if strings.TrimSpace(cmd.backupTo) != "" && strings.TrimSpace(cmd.keyfile) == "" {
+		return fmt.Errorf("--backup requires a --key to sign the backup ACL file")
+	}
+
+	if err := checkOnDuplicate(cmd.onDuplicate); err != nil {
+		return err
+	}
+
+	if _, err := aclFormat(cmd.inputFormat, "", nil); err != nil {
+		return err
+	}
+
+	if _, err := aclDelimiter(cmd.delimiter, ""); err != nil {
+		return err
+	}
+
+	if cmd.format != "text" && cmd.format != "json" && cmd.format != "html" {
+		return fmt.Errorf("Invalid --format '%s' (expected 'text', 'json' or 'html')", cmd.format)
+	}
+
+	if err := checkReportName(cmd.reportName); err != nil {
+		return err
+	}
+
+	if cmd.tmplFile != "" {
+		if cmd.format == "json" {
+			return fmt.Errorf("--template is only applicable to the 'text' and 'html' report formats")
+		}
+
+		t, err := loadTemplate(cmd.tmplFile, cmd.format)
+		if err != nil {
+			return err
+		}
+
+		cmd.template = t
+	} else if cmd.format == "html" {
+		cmd.template = HTML_TEMPLATE
+	}
+
 	if strings.TrimSpace(cmd.url) == "" {
 		return fmt.Errorf("load-acl requires a URL for the authoritative ACL file in the command options")
 	}
@@ -137,91 +319,234 @@ func (cmd *LoadACL) Execute(args ...interface{}) error {
 		cmd.profile = conf.AWS.Profile
 	}
 
-	if cmd.region == "" {
+	if cmd.region == "" && !isProfileURI(cmd.credentials) {
 		cmd.region = conf.AWS.Region
 	}
 
-	u, devices := getDevices(conf, cmd.debug)
+	levels, err := loadAccessLevels(cmd.config)
+	if err != nil {
+		return fmt.Errorf("Error loading access levels from %v (%w)", cmd.config, err)
+	}
 
-	var logger *log.Logger
-	if !cmd.nolog {
-		events := eventlog.Ticker{Filename: cmd.logFile, MaxSize: cmd.logFileSize}
-		logger = log.New(&events, "", log.Ldate|log.Ltime|log.LUTC)
-	} else {
-		logger = log.New(os.Stdout, "ACL ", log.LstdFlags|log.LUTC|log.Lmsgprefix)
+	cmd.levels = levels
+
+	names, err := loadDeviceNames(cmd.nameMap, cmd.config)
+	if err != nil {
+		return fmt.Errorf("Error loading device names (%w)", err)
 	}
 
-	return cmd.execute(u, uri.String(), devices, logger)
-}
+	cmd.names = names
 
-func (cmd *LoadACL) execute(u uhppote.IUHPPOTE, uri string, devices []uhppote.Device, log *log.Logger) error {
-	log.Printf("Fetching ACL from %v", uri)
+	u, devices := getDevices(conf, cmd.debug)
 
-	f := cmd.fetchHTTP
-	if strings.HasPrefix(uri, "s3://") {
-		f = cmd.fetchS3
-	} else if strings.HasPrefix(uri, "file://") {
-		f = cmd.fetchFile
+	if err := cmd.httpAuth.resolve(); err != nil {
+		return err
 	}
 
-	b, err := f(uri)
+	if err := cmd.azure.resolve(); err != nil {
+		return err
+	}
+
+	logger, err := newLogger(cmd.Name(), cmd.logFile, cmd.logFileSize, cmd.logMaxFiles, cmd.logMaxAge, cmd.nolog, cmd.logFormat, os.Stdout)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("Fetched ACL from %v (%d bytes)", uri, len(b))
+	cmd.retry.log = logger
+
+	return aborted("load-acl", cmd.execute(u, uri.String(), devices, logger), logger)
+}
 
-	x := untar
-	if strings.HasSuffix(uri, ".zip") {
-		x = unzip
+func (cmd *LoadACL) execute(u uhppote.IUHPPOTE, uri string, devices []uhppote.Device, log *log.Logger) error {
+	if uri == "-" {
+		log.Printf("Reading ACL from stdin")
+	} else {
+		log.Printf("Fetching ACL from %v", uri)
 	}
 
-	files, uname, err := x(bytes.NewReader(b))
+	files, uname, archive, err := cmd.download(uri, log)
 	if err != nil {
 		return err
 	}
 
+	if !archive && !cmd.noverify {
+		return &VerifyError{fmt.Errorf("%v is not a signed tar.gz or zip archive - the signature can only be verified for the archive formats (use --no-verify for unsigned TSV files)", uri)}
+	}
+
 	tsv, ok := files["ACL"]
 	if !ok {
-		return fmt.Errorf("ACL file missing from tar.gz")
+		return &ParseError{fmt.Errorf("ACL file missing from tar.gz")}
 	}
 
 	signature, ok := files["signature"]
 	if !cmd.noverify && !ok {
-		return fmt.Errorf("'signature' file missing from tar.gz")
+		return &VerifyError{fmt.Errorf("'signature' file missing from tar.gz")}
 	}
 
 	log.Printf("Extracted ACL from %v: %v bytes, signature: %v bytes", uri, len(tsv), len(signature))
 
 	if !cmd.noverify {
-		if err := verify(uname, tsv, signature, cmd.keysdir); err != nil {
-			return err
+		if cmd.ca != "" {
+			chain, ok := files["certificate"]
+			if !ok {
+				return &VerifyError{fmt.Errorf("'certificate' file missing from tar.gz")}
+			}
+
+			signer, err := verifyCertificate(signable(files, tsv), signature, chain, cmd.ca)
+			if err != nil {
+				return &VerifyError{err}
+			}
+
+			log.Printf("Verified ACL signature and certificate chain for '%v'", signer)
+		} else if key, err := verify(uname, signable(files, tsv), signatures(files), cmd.keysdir); err != nil {
+			return &VerifyError{err}
+		} else {
+			log.Printf("Verified ACL signature for '%v' with key %v", uname, key)
+		}
+	}
+
+	if err := checkMaxAge(uri, files, cmd.maxAge, log); err != nil {
+		return err
+	}
+
+	tsv = normalizeText(tsv)
+	format, _ := aclFormat(cmd.inputFormat, uri, files)
+	if delimiter, _ := aclDelimiter(cmd.delimiter, format); format != "json" && delimiter != '\t' {
+		if tsv, err = csvToTSV(tsv, delimiter); err != nil {
+			return &ParseError{err}
+		}
+	}
+
+	if format == "json" {
+		if tsv, err = jsonToTSV(tsv, devices); err != nil {
+			return &ParseError{err}
+		}
+	}
+
+	if tsv, err = resolveAccessLevels(tsv, cmd.levels, devices); err != nil {
+		return &ParseError{err}
+	}
+
+	if tsv, err = resolveDisabled(tsv, devices); err != nil {
+		return &ParseError{err}
+	}
+
+	if cmd.normalize || cmd.hexCards {
+		normalized, N, warnings := normalizeCards(tsv, cmd.hexCards)
+		for _, w := range warnings {
+			log.Printf("WARN  %v", w)
+		}
+
+		if N > 0 {
+			log.Printf("Normalized %v card numbers", N)
+		}
+
+		tsv = normalized
+	}
+
+	if tsv, cmd.duplicates, err = resolveDuplicates(tsv, cmd.onDuplicate, devices, log); err != nil {
+		return &ParseError{err}
+	}
+
+	if cmd.collectAll {
+		if errs := validateTSV(tsv, devices); len(errs) > 0 {
+			for _, e := range errs {
+				log.Printf("ERROR %v", e)
+			}
+
+			return &ParseError{parseErrors(errs)}
 		}
 	}
 
 	list, warnings, err := acl.ParseTSV(bytes.NewReader(tsv), devices, cmd.strict)
 	if err != nil {
-		return err
+		return &ParseError{err}
 	}
 
 	for _, w := range warnings {
-		log.Printf("WARN  %v", w)
+		if len(cmd.duplicates) == 0 || !isDuplicateWarning(w) {
+			log.Printf("WARN  %v", w)
+		}
 	}
 
 	for k, l := range list {
 		log.Printf("%v  Retrieved %v records", k, len(l))
 	}
 
-	if !cmd.noreport {
-		current, errors := acl.GetACL(u, devices)
-		if len(errors) > 0 {
-			return fmt.Errorf("%v", errors)
+	// ... a dry run always generates the report as the audit record of the simulated load
+	if !cmd.noreport || cmd.dryrun || cmd.maxDeletes > 0 || cmd.maxChanges > 0 || cmd.skipNoDiff || cmd.confirm {
+		current, errors, _, err := getACL(cmd.ctx, u, devices, cmd.concurrency)
+		if err != nil {
+			return err
+		} else if len(errors) > 0 {
+			return fmt.Errorf("%w %v", ErrUnreachable, errors)
 		}
 
-		cmd.report(current, list, log)
+		diff, err := acl.Compare(current, list)
+		if err != nil {
+			return err
+		}
+
+		if !cmd.noreport || cmd.dryrun {
+			if err := cmd.report(uri, diff, devices, log); err != nil {
+				log.Printf("ERROR Error generating 'diff' report (%v)", err)
+				return err
+			}
+		}
+
+		if err := cmd.guard(diff, log); err != nil && !cmd.dryrun {
+			return err
+		}
+
+		if cmd.dryrun {
+			preview(diff, "DRY RUN", "would", log)
+			return nil
+		}
+
+		if cmd.skipNoDiff {
+			for k, v := range diff {
+				if !v.HasChanges() {
+					log.Printf("%v  controller ACL matches the authoritative ACL - not updated (--skip-if-unchanged)", k)
+					delete(list, k)
+				}
+			}
+
+			if len(list) == 0 {
+				log.Printf("All controllers match the authoritative ACL - skipped updating the controllers (--skip-if-unchanged)")
+				return nil
+			}
+		}
+
+		if cmd.confirm && cmd.yes {
+			log.Printf("Skipped confirmation prompt (--yes)")
+		} else if cmd.confirm {
+			if ok, err := confirm(diff, list, os.Stdin, os.Stdout); err != nil {
+				return err
+			} else if !ok {
+				log.Printf("Load cancelled at the confirmation prompt - controllers not updated")
+				return nil
+			}
+
+			log.Printf("Load confirmed at the confirmation prompt")
+		}
+	}
+
+	// ... don't start updating the controllers if the command has been cancelled
+	if err := cmd.ctx.Err(); err != nil {
+		return err
 	}
 
-	rpt, errors := acl.PutACL(u, list, cmd.dryrun)
+	if strings.TrimSpace(cmd.backupTo) != "" {
+		if err := cmd.backup(u, devices, log); err != nil {
+			if !cmd.backupErrOk {
+				return fmt.Errorf("Backup failed, controllers not updated (%w)", err)
+			}
+
+			log.Printf("WARN  Backup failed (%v) - updating controllers without a backup (--ignore-backup-errors)", err)
+		}
+	}
+
+	rpt, errors := acl.PutACL(u, list, false)
 	for k, v := range rpt {
 		log.Printf("%v  SUMMARY  unchanged:%v  updated:%v  added:%v  deleted:%v  failed:%v  errors:%v",
 			k,
@@ -240,38 +565,322 @@ func (cmd *LoadACL) execute(u uhppote.IUHPPOTE, uri string, devices []uhppote.De
 	return nil
 }
 
-func (cmd *LoadACL) fetchHTTP(url string) ([]byte, error) {
-	return fetchHTTP(url)
+// Fetches, checks the (optional) checksum and unpacks the ACL file. With --stream, s3:// ACL files are downloaded
+// to a temporary file in the working directory and unpacked from the file rather than from memory.
+func (cmd *LoadACL) download(uri string, log *log.Logger) (map[string][]byte, string, bool, error) {
+	if cmd.stream && strings.HasPrefix(uri, "s3://") {
+		f, N, err := fetchS3ToFile(cmd.ctx, uri, cmd.credentials, cmd.profile, cmd.region, cmd.fallback, cmd.endpoint, cmd.role, cmd.retry, cmd.workdir)
+		if err != nil {
+			return nil, "", false, &FetchError{URL: uri, Err: err}
+		}
+
+		defer func() {
+			f.Close()
+			if err := os.Remove(f.Name()); err != nil {
+				log.Printf("WARN  Error deleting temporary file %v (%v)", f.Name(), err)
+			}
+		}()
+
+		log.Printf("Fetched ACL from %v (%d bytes) to %v", uri, N, f.Name())
+
+		if cmd.checksum != "" {
+			if err := verifyChecksum(uri, f, cmd.checksum, cmd.fetch); err != nil {
+				return nil, "", false, &VerifyError{err}
+			}
+
+			log.Printf("Verified ACL SHA-256 checksum")
+
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return nil, "", false, err
+			}
+		}
+
+		// ... encrypted ACL files are decrypted and unpacked in memory
+		if cmd.decryptKey == "" {
+			files, uname, archive, err := unpackFile(uri, f, N)
+			if err != nil {
+				return nil, "", false, &ParseError{err}
+			}
+
+			return files, uname, archive, nil
+		}
+
+		b, err := ioutil.ReadAll(f)
+		if err != nil {
+			return nil, "", false, err
+		}
+
+		return cmd.unpack(uri, b, log)
+	}
+
+	b, err := cmd.fetch(uri)
+	if err != nil {
+		return nil, "", false, &FetchError{URL: uri, Err: err}
+	}
+
+	log.Printf("Fetched ACL from %v (%d bytes)", uri, len(b))
+
+	if cmd.checksum != "" {
+		if err := verifyChecksum(uri, bytes.NewReader(b), cmd.checksum, cmd.fetch); err != nil {
+			return nil, "", false, &VerifyError{err}
+		}
+
+		log.Printf("Verified ACL SHA-256 checksum")
+	}
+
+	return cmd.unpack(uri, b, log)
 }
 
-func (cmd *LoadACL) fetchS3(url string) ([]byte, error) {
-	return fetchS3(url, cmd.credentials, cmd.profile, cmd.region)
+func (cmd *LoadACL) unpack(uri string, b []byte, log *log.Logger) (map[string][]byte, string, bool, error) {
+	b, err := decrypt(uri, b, cmd.decryptKey, log)
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	files, uname, archive, err := unpack(uri, b)
+	if err != nil {
+		return nil, "", false, &ParseError{err}
+	}
+
+	return files, uname, archive, nil
+}
+
+func (cmd *LoadACL) fetch(uri string) ([]byte, error) {
+	if uri == "-" {
+		return fetchStdin(uri)
+	}
+
+	options := FetchOptions{
+		Credentials: cmd.credentials,
+		Profile:     cmd.profile,
+		Region:      cmd.region,
+		Fallback:    cmd.fallback,
+		RoleARN:     cmd.role.arn,
+		ExternalID:  cmd.role.externalID,
+		RoleTTL:     cmd.role.duration,
+		Endpoint:    cmd.endpoint.url,
+		PathStyle:   cmd.endpoint.pathStyle,
+		HTTPTimeout: cmd.httpTimeout,
+		HTTPUser:    cmd.httpAuth.user,
+		HTTPPasswd:  cmd.httpAuth.password,
+		HTTPBearer:  cmd.httpAuth.bearer,
+		GCSKeyFile:  cmd.gcsCreds,
+		AzureAcct:   cmd.azure.account,
+		AzureKey:    cmd.azure.key,
+		AzureSAS:    cmd.azure.sas,
+		AzureHost:   cmd.azure.endpoint,
+		SSHKey:      cmd.sftp.key,
+		KnownHosts:  cmd.sftp.knownHosts,
+		Retries:     cmd.retry.retries,
+		RetryDelay:  cmd.retry.delay,
+		Log:         cmd.retry.log,
+	}
+
+	return fetch(cmd.ctx, uri, options)
+}
+
+// Checks the number of cards to be deleted and changed on each controller against the --max-deletes and
+// --max-changes limits, so that e.g. a truncated ACL file cannot wipe the cards from the controllers.
+func (cmd *LoadACL) guard(diff map[uint32]acl.Diff, log *log.Logger) error {
+	return guard("Load", diff, cmd.maxDeletes, cmd.maxChanges, log)
+}
+
+// Checks the per-controller deletes and changes against the (optional) limits. A zero limit is not checked.
+func guard(operation string, diff map[uint32]acl.Diff, maxDeletes, maxChanges uint, log *log.Logger) error {
+	devices := []uint32{}
+	for k := range diff {
+		devices = append(devices, k)
+	}
+
+	sort.Slice(devices, func(i, j int) bool { return devices[i] < devices[j] })
+
+	exceeded := []string{}
+	for _, k := range devices {
+		v := diff[k]
+		deletes := uint(len(v.Deleted))
+		changes := uint(len(v.Updated) + len(v.Added) + len(v.Deleted))
+
+		if maxDeletes > 0 && deletes > maxDeletes {
+			log.Printf("%v  ERROR %v cards to be deleted exceeds --max-deletes (%v)", k, deletes, maxDeletes)
+			exceeded = append(exceeded, fmt.Sprintf("%v: %v deletes", k, deletes))
+		} else if maxChanges > 0 && changes > maxChanges {
+			log.Printf("%v  ERROR %v cards to be changed exceeds --max-changes (%v)", k, changes, maxChanges)
+			exceeded = append(exceeded, fmt.Sprintf("%v: %v changes", k, changes))
+		}
+	}
+
+	if len(exceeded) > 0 {
+		return fmt.Errorf("%v aborted - ACL changes exceed the safety limits (%v)", operation, strings.Join(exceeded, ", "))
+	}
+
+	return nil
 }
 
-func (cmd *LoadACL) fetchFile(url string) ([]byte, error) {
-	return fetchFile(url)
+func (cmd *LoadACL) store(uri string, r io.Reader) error {
+	options := StoreOptions{
+		Credentials: cmd.credentials,
+		Profile:     cmd.profile,
+		Region:      cmd.region,
+		Fallback:    cmd.fallback,
+		RoleARN:     cmd.role.arn,
+		ExternalID:  cmd.role.externalID,
+		RoleTTL:     cmd.role.duration,
+		Endpoint:    cmd.endpoint.url,
+		PathStyle:   cmd.endpoint.pathStyle,
+		HTTPTimeout: cmd.httpTimeout,
+		HTTPUser:    cmd.httpAuth.user,
+		HTTPPasswd:  cmd.httpAuth.password,
+		HTTPBearer:  cmd.httpAuth.bearer,
+		GCSKeyFile:  cmd.gcsCreds,
+		AzureAcct:   cmd.azure.account,
+		AzureKey:    cmd.azure.key,
+		AzureSAS:    cmd.azure.sas,
+		AzureHost:   cmd.azure.endpoint,
+		SSHKey:      cmd.sftp.key,
+		KnownHosts:  cmd.sftp.knownHosts,
+		Retries:     cmd.retry.retries,
+		RetryDelay:  cmd.retry.delay,
+		Log:         cmd.retry.log,
+	}
+
+	return store(cmd.ctx, uri, r, options)
 }
 
-func (cmd *LoadACL) report(current, list acl.ACL, log *log.Logger) error {
+func (cmd *LoadACL) report(uri string, diff map[uint32]acl.Diff, devices []uhppote.Device, log *log.Logger) error {
 	log.Printf("Generating ACL 'diff' report")
 
-	diff, err := acl.Compare(current, list)
-	if err != nil {
+	timestamp := types.DateTime(time.Now())
+	rpt := Report{
+		DateTime:   &timestamp,
+		Diffs:      diff,
+		Names:      cmd.names,
+		Duplicates: cmd.duplicates,
+		Devices:    reportDevices(devices, cmd.names),
+	}
+
+	write := func(w io.Writer) error {
+		switch cmd.format {
+		case "json":
+			return reportJSON(rpt, w)
+		case "html":
+			return reportHTML(rpt, cmd.template, w)
+		default:
+			return report(rpt, cmd.template, w)
+		}
+	}
+
+	if err := write(os.Stdout); err != nil {
 		return err
 	}
 
-	report(diff, cmd.template, os.Stdout)
+	if cmd.summary != "" {
+		var b bytes.Buffer
+		if err := reportSummary(rpt, uri, &b); err != nil {
+			log.Printf("WARN  Error creating report summary (%v)", err)
+		} else if err := cmd.store(fileURI(cmd.summary), &b); err != nil {
+			log.Printf("WARN  Error writing report summary to %v (%v)", cmd.summary, err)
+		} else {
+			log.Printf("Wrote report summary to %v", cmd.summary)
+		}
+	}
 
-	filename := time.Now().Format("acl-2006-01-02T150405.rpt")
-	file := filepath.Join(cmd.workdir, filename)
-	f, err := os.Create(file)
+	ext := "rpt"
+	if cmd.format == "json" || cmd.format == "html" {
+		ext = cmd.format
+	}
+
+	filename, err := reportFilename(cmd.reportName, time.Time(timestamp), ext, rpt.Devices)
 	if err != nil {
 		return err
 	}
 
-	defer f.Close()
+	var b bytes.Buffer
+	if err := write(&b); err != nil {
+		return err
+	}
+
+	file := filepath.Join(cmd.workdir, filename)
+
+	log.Printf("Writing 'diff' report to %v", file)
+
+	return writeAtomic(file, b.Bytes(), 0660)
+}
+
+// Prints the per-controller changes and a summary of the deleted cards and waits for a y(es) response. Only the
+// controllers in the (possibly --skip-if-unchanged filtered) ACL are included.
+func confirm(diff map[uint32]acl.Diff, list acl.ACL, r io.Reader, w io.Writer) (bool, error) {
+	devices := []uint32{}
+	for k := range list {
+		devices = append(devices, k)
+	}
+
+	sort.Slice(devices, func(i, j int) bool { return devices[i] < devices[j] })
+
+	deleted := 0
+	affected := 0
+
+	fmt.Fprintln(w)
+	for _, k := range devices {
+		v := diff[k]
 
-	log.Printf("Writing 'diff' report to %v", f.Name())
+		fmt.Fprintf(w, "  %v  unchanged:%v  updated:%v  added:%v  deleted:%v\n", k, len(v.Unchanged), len(v.Updated), len(v.Added), len(v.Deleted))
 
-	return report(diff, cmd.template, f)
+		if len(v.Deleted) > 0 {
+			deleted += len(v.Deleted)
+			affected++
+		}
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "%v cards will be deleted across %v devices - proceed? [y/N] ", deleted, affected)
+
+	response, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+
+	switch strings.ToLower(strings.TrimSpace(response)) {
+	case "y", "yes":
+		return true, nil
+
+	default:
+		return false, nil
+	}
+}
+
+// Logs the changes that a load-acl or rollback would make to each controller, tagged with e.g. DRY RUN.
+func preview(diff map[uint32]acl.Diff, tag, verb string, log *log.Logger) {
+	devices := []uint32{}
+	for k := range diff {
+		devices = append(devices, k)
+	}
+
+	sort.Slice(devices, func(i, j int) bool { return devices[i] < devices[j] })
+
+	cards := func(list []types.Card) []uint32 {
+		l := []uint32{}
+		for _, c := range list {
+			l = append(l, c.CardNumber)
+		}
+
+		return l
+	}
+
+	for _, k := range devices {
+		v := diff[k]
+
+		log.Printf("%v  %v  unchanged:%v  updated:%v  added:%v  deleted:%v", k, tag, len(v.Unchanged), len(v.Updated), len(v.Added), len(v.Deleted))
+
+		if len(v.Updated) > 0 {
+			log.Printf("%v  %v  %v update %v", k, tag, verb, cards(v.Updated))
+		}
+
+		if len(v.Added) > 0 {
+			log.Printf("%v  %v  %v add %v", k, tag, verb, cards(v.Added))
+		}
+
+		if len(v.Deleted) > 0 {
+			log.Printf("%v  %v  %v delete %v", k, tag, verb, cards(v.Deleted))
+		}
+	}
 }
@@ -0,0 +1,184 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uhppoted/uhppoted-lib/eventlog"
+)
+
+const DEFAULT_LOG_FORMAT = "text"
+const DEFAULT_LOG_MAX_FILES = 10
+const DEFAULT_LOG_MAX_AGE = 30
+
+const logTimestamp = "2006-01-02T15-04-05.000"
+
+var levels = regexp.MustCompile(`(?:^|\s)(WARN|ERROR)\s`)
+
+// Returns a logger that writes to the rotatable log file (or to the console writer for --no-log) in either the
+// default 'text' format or as one JSON object per line for log pipelines that ingest JSON. Rotated log files are
+// retained up to the (optional) maximum number of files and maximum age (in days).
+func newLogger(command, file string, size, maxFiles, maxAge int, nolog bool, format string, console io.Writer) (*log.Logger, error) {
+	w := console
+	if !nolog {
+		w = &rotatingLog{
+			ticker:   &eventlog.Ticker{Filename: file, MaxSize: size},
+			maxFiles: maxFiles,
+			maxAge:   maxAge,
+		}
+	}
+
+	switch format {
+	case "text":
+		if !nolog {
+			return log.New(w, "", log.Ldate|log.Ltime|log.LUTC), nil
+		}
+
+		return log.New(w, "ACL ", log.LstdFlags|log.LUTC|log.Lmsgprefix), nil
+
+	case "json":
+		return log.New(&jsonLog{w: w, command: command}, "", 0), nil
+
+	default:
+		return nil, fmt.Errorf("Invalid --log-format '%v' (expected 'text' or 'json')", format)
+	}
+}
+
+type jsonLog struct {
+	sync.Mutex
+	w       io.Writer
+	command string
+}
+
+func (l *jsonLog) Write(p []byte) (int, error) {
+	message := strings.TrimRight(string(p), "\n")
+
+	level := "info"
+	if match := levels.FindStringSubmatch(message); match != nil {
+		level = strings.ToLower(match[1])
+	}
+
+	b, err := json.Marshal(struct {
+		Timestamp string `json:"timestamp"`
+		Level     string `json:"level"`
+		Command   string `json:"command"`
+		Message   string `json:"message"`
+	}{
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+		Level:     level,
+		Command:   l.command,
+		Message:   message,
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	if _, err := l.w.Write(append(b, '\n')); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// The eventlog.Ticker truncates the log file when it rotates, so the log file is first renamed to
+// <name>-<timestamp>.<ext> (as for the Ticker backup files) and the rotated files beyond the maximum number of
+// files or older than the maximum age are deleted.
+type rotatingLog struct {
+	sync.Mutex
+	ticker   *eventlog.Ticker
+	maxFiles int
+	maxAge   int
+	size     int64
+	opened   bool
+}
+
+func (l *rotatingLog) Write(p []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	filename := l.ticker.Filename
+	max := int64(l.ticker.MaxSize) * 1024 * 1024
+	if l.ticker.MaxSize <= 0 {
+		max = 100 * 1024 * 1024
+	}
+
+	if !l.opened {
+		if info, err := os.Stat(filename); err == nil {
+			l.size = info.Size()
+		}
+
+		l.opened = true
+	}
+
+	if l.size > 0 && l.size+int64(len(p)) >= max {
+		ext := filepath.Ext(filename)
+		rotated := fmt.Sprintf("%v-%v%v", strings.TrimSuffix(filename, ext), time.Now().UTC().Format(logTimestamp), ext)
+
+		if err := os.Rename(filename, rotated); err != nil {
+			log.Printf("WARN  Error archiving log file %v (%v)", filename, err)
+		} else if err := l.ticker.Rotate(); err != nil {
+			return 0, err
+		} else {
+			l.cleanup()
+		}
+
+		l.size = 0
+	}
+
+	n, err := l.ticker.Write(p)
+	l.size += int64(n)
+
+	return n, err
+}
+
+func (l *rotatingLog) cleanup() {
+	filename := l.ticker.Filename
+	ext := filepath.Ext(filename)
+	prefix := strings.TrimSuffix(filepath.Base(filename), ext) + "-"
+
+	files, err := ioutil.ReadDir(filepath.Dir(filename))
+	if err != nil {
+		log.Printf("WARN  Error reading log file directory (%v)", err)
+		return
+	}
+
+	type rotated struct {
+		name      string
+		timestamp time.Time
+	}
+
+	list := []rotated{}
+	for _, f := range files {
+		name := f.Name()
+		if !f.IsDir() && strings.HasPrefix(name, prefix) && strings.HasSuffix(name, ext) {
+			if t, err := time.Parse(logTimestamp, strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext)); err == nil {
+				list = append(list, rotated{name, t})
+			}
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].timestamp.After(list[j].timestamp) })
+
+	cutoff := time.Now().Add(-time.Duration(l.maxAge) * 24 * time.Hour)
+	for i, f := range list {
+		if (l.maxFiles > 0 && i >= l.maxFiles) || (l.maxAge > 0 && f.timestamp.Before(cutoff)) {
+			if err := os.Remove(filepath.Join(filepath.Dir(filename), f.name)); err != nil {
+				log.Printf("WARN  Error deleting rotated log file %v (%v)", f.name, err)
+			}
+		}
+	}
+}
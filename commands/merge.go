@@ -0,0 +1,325 @@
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/uhppoted/uhppote-core/types"
+	"github.com/uhppoted/uhppote-core/uhppote"
+	"github.com/uhppoted/uhppoted-lib/acl"
+)
+
+// Maximum number of authoritative ACL sources fetched and verified concurrently.
+const MAX_SOURCE_FETCHES = 4
+
+// List of authoritative ACL URLs (--acl may be repeated). Unlike stringList the values are not split on commas,
+// because a comma is a valid character in an S3 key or HTTP URL.
+type urlList []string
+
+func (l *urlList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *urlList) Set(v string) error {
+	if v = strings.TrimSpace(v); v != "" {
+		*l = append(*l, v)
+	}
+
+	return nil
+}
+
+func (l urlList) contains(v string) bool {
+	for _, u := range l {
+		if u == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+func checkOnConflict(v string) error {
+	switch v {
+	case "error", "last-wins", "union-doors":
+		return nil
+
+	default:
+		return fmt.Errorf("Invalid --on-conflict '%v' (expected 'error', 'last-wins' or 'union-doors')", v)
+	}
+}
+
+// Fetches, verifies and parses each of the authoritative ACL sources (concurrently, up to MAX_SOURCE_FETCHES at a
+// time) and merges them into a single ACL using the --on-conflict policy for cards that are in more than one source.
+// A source that cannot be fetched, verified or parsed does not stop the other sources from being checked and the
+// returned error identifies every failing source. The returned TSV is the merged ACL.
+func (cmd *CompareACL) fetchSources(uris []string, devices []uhppote.Device, log *log.Logger) (acl.ACL, []byte, error) {
+	if len(uris) == 1 {
+		return cmd.fetchACL(uris[0], devices, log)
+	}
+
+	sources := make([]acl.ACL, len(uris))
+	duplicates := make([][]Duplicate, len(uris))
+	errs := make([]error, len(uris))
+	semaphore := make(chan struct{}, MAX_SOURCE_FETCHES)
+
+	var wg sync.WaitGroup
+	for i, uri := range uris {
+		ix := i
+		u := uri
+		c := *cmd
+
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			list, _, err := c.fetchACL(u, devices, log)
+			if err != nil {
+				log.Printf("WARN  ACL source %v: %v", u, err)
+				errs[ix] = err
+				return
+			}
+
+			log.Printf("ACL source %v: %v records", u, len(cardNumbers(list)))
+
+			sources[ix] = list
+			duplicates[ix] = c.duplicates
+		}()
+	}
+
+	wg.Wait()
+
+	if err := aggregate(uris, errs); err != nil {
+		return nil, nil, err
+	}
+
+	merged, conflicts, err := mergeACL(sources, uris, cmd.onConflict)
+	if err != nil {
+		return nil, nil, &ParseError{err}
+	}
+
+	for _, c := range conflicts {
+		log.Printf("WARN  card %v is in more than one ACL source (%v)", c, cmd.onConflict)
+	}
+
+	log.Printf("Merged %v ACL sources: %v records, %v conflicts", len(uris), len(cardNumbers(merged)), len(conflicts))
+
+	var b bytes.Buffer
+	if err := acl.MakeTSV(merged, devices, &b); err != nil {
+		return nil, nil, err
+	}
+
+	cmd.duplicates = []Duplicate{}
+	for _, d := range duplicates {
+		cmd.duplicates = append(cmd.duplicates, d...)
+	}
+
+	return merged, b.Bytes(), nil
+}
+
+// Combines the per-source errors into a single error that names each failing source. The error is a VerifyError if
+// any source failed verification, otherwise a ParseError if any source was invalid, otherwise a FetchError.
+func aggregate(uris []string, errs []error) error {
+	failed := sourceErrors{}
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, sourceError{url: uris[i], err: err})
+		}
+	}
+
+	switch {
+	case len(failed) == 0:
+		return nil
+
+	case failed.is(ErrVerify):
+		return &VerifyError{failed}
+
+	case failed.is(ErrParse):
+		return &ParseError{failed}
+
+	default:
+		return &FetchError{URL: strings.Join(failed.urls(), ","), Err: failed}
+	}
+}
+
+type sourceError struct {
+	url string
+	err error
+}
+
+// List of the errors for the ACL sources that could not be fetched, verified or parsed, in --acl order.
+type sourceErrors []sourceError
+
+func (e sourceErrors) Error() string {
+	list := []string{}
+	for _, v := range e {
+		list = append(list, fmt.Sprintf("%v (%v)", v.url, v.err))
+	}
+
+	return fmt.Sprintf("%v of the ACL sources failed: %v", len(e), strings.Join(list, "; "))
+}
+
+func (e sourceErrors) is(target error) bool {
+	for _, v := range e {
+		if errors.Is(v.err, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (e sourceErrors) urls() []string {
+	list := []string{}
+	for _, v := range e {
+		list = append(list, v.url)
+	}
+
+	return list
+}
+
+// Returns the URLs of the ACL sources that failed with the target error, or nil if the error is not a multi-source
+// error.
+func failedSources(err error, target error) []string {
+	var e sourceErrors
+	if !errors.As(err, &e) {
+		return nil
+	}
+
+	list := []string{}
+	for _, v := range e {
+		if errors.Is(v.err, target) {
+			list = append(list, v.url)
+		}
+	}
+
+	return list
+}
+
+// Merges the ACLs in order. A card that is in more than one ACL with different dates or door permissions is a
+// conflict and is either an error ('error'), replaced by the card from the later ACL ('last-wins') or merged with the
+// earliest start date, latest end date and the union of the door permissions ('union-doors'). Returns the merged ACL
+// and the conflicting card numbers.
+func mergeACL(sources []acl.ACL, uris []string, policy string) (acl.ACL, []uint32, error) {
+	merged := acl.ACL{}
+	origin := map[uint32]int{}
+	conflicts := map[uint32]bool{}
+
+	for ix, list := range sources {
+		for device, cards := range list {
+			if _, ok := merged[device]; !ok {
+				merged[device] = map[uint32]types.Card{}
+			}
+
+			for k, card := range cards {
+				existing, ok := merged[device][k]
+				if !ok {
+					merged[device][k] = card
+					continue
+				}
+
+				if sameCard(existing, card) {
+					continue
+				}
+
+				if policy == "error" {
+					return nil, nil, fmt.Errorf("Card %v in %v conflicts with the card in %v (--on-conflict error)", k, uris[ix], uris[origin[k]])
+				}
+
+				conflicts[k] = true
+
+				if policy == "union-doors" {
+					merged[device][k] = unionCard(existing, card)
+				} else {
+					merged[device][k] = card
+				}
+			}
+		}
+
+		for k := range cardNumbers(list) {
+			if _, ok := origin[k]; !ok {
+				origin[k] = ix
+			}
+		}
+	}
+
+	list := []uint32{}
+	for k := range conflicts {
+		list = append(list, k)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+
+	return merged, list, nil
+}
+
+func cardNumbers(list acl.ACL) map[uint32]bool {
+	cards := map[uint32]bool{}
+	for _, v := range list {
+		for k := range v {
+			cards[k] = true
+		}
+	}
+
+	return cards
+}
+
+func sameCard(p, q types.Card) bool {
+	if !sameDate(p.From, q.From) || !sameDate(p.To, q.To) || len(p.Doors) != len(q.Doors) {
+		return false
+	}
+
+	for door, v := range p.Doors {
+		if q.Doors[door] != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+func sameDate(p, q *types.Date) bool {
+	if p == nil || q == nil {
+		return p == q
+	}
+
+	return p.String() == q.String()
+}
+
+func unionCard(p, q types.Card) types.Card {
+	card := types.Card{
+		CardNumber: p.CardNumber,
+		From:       p.From,
+		To:         p.To,
+		Doors:      map[uint8]int{},
+	}
+
+	if q.From != nil && (card.From == nil || q.From.Before(*card.From)) {
+		card.From = q.From
+	}
+
+	if q.To != nil && (card.To == nil || q.To.After(*card.To)) {
+		card.To = q.To
+	}
+
+	for door, v := range p.Doors {
+		card.Doors[door] = v
+	}
+
+	for door, v := range q.Doors {
+		switch u := card.Doors[door]; {
+		case u == 1 || v == 1:
+			card.Doors[door] = 1
+		case u == 0:
+			card.Doors[door] = v
+		}
+	}
+
+	return card
+}
@@ -0,0 +1,92 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFetchSources(t *testing.T) {
+	files := map[string]string{
+		"/gryffindor.tsv": "Card Number\tFrom\tTo\tGreat Hall\tKitchen\tDungeon\tHogsmeade\n8165538\t2021-01-01\t2021-12-31\tY\tN\tN\tN\n",
+		"/hufflepuff.tsv": "Card Number\tFrom\tTo\tGreat Hall\tKitchen\tDungeon\tHogsmeade\n8165539\t2021-01-01\t2021-12-31\tN\tY\tN\tN\n",
+		"/ravenclaw.tsv":  "Card Number\tFrom\tTo\tGreat Hall\tKitchen\tDungeon\tHogsmeade\n8165540\t2021-01-01\t2021-12-31\tN\tN\tY\tN\n",
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f, ok := files[r.URL.Path]; ok {
+			fmt.Fprint(w, f)
+		} else {
+			http.NotFound(w, r)
+		}
+	}))
+
+	defer srv.Close()
+
+	cmd := CompareACLCmd
+	cmd.ctx = context.Background()
+	cmd.noverify = true
+	cmd.retry = retryPolicy{}
+
+	uris := []string{srv.URL + "/gryffindor.tsv", srv.URL + "/hufflepuff.tsv", srv.URL + "/ravenclaw.tsv"}
+
+	list, _, err := cmd.fetchSources(uris, jsonTestDevices[:1], log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("Unexpected error fetching ACL sources (%v)", err)
+	}
+
+	if cards := cardNumbers(list); len(cards) != 3 {
+		t.Errorf("Incorrect number of merged cards - expected:3, got:%v", len(cards))
+	}
+}
+
+func TestFetchSourcesWithErrors(t *testing.T) {
+	files := map[string]string{
+		"/gryffindor.tsv": "Card Number\tFrom\tTo\tGreat Hall\tKitchen\tDungeon\tHogsmeade\n8165538\t2021-01-01\t2021-12-31\tY\tN\tN\tN\n",
+		"/ravenclaw.tsv":  "Card Number\tFrom\tTo\tGreat Hall\tKitchen\tDungeon\tHogsmeade\n8165540\t2021-01-01\t2021-12-31\tN\tN\tY\tN\n",
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f, ok := files[r.URL.Path]; ok {
+			fmt.Fprint(w, f)
+		} else {
+			http.NotFound(w, r)
+		}
+	}))
+
+	defer srv.Close()
+
+	// ... unsigned TSV files fail verification, the missing file fails to fetch
+	cmd := CompareACLCmd
+	cmd.ctx = context.Background()
+	cmd.noverify = false
+	cmd.retry = retryPolicy{}
+
+	uris := []string{srv.URL + "/gryffindor.tsv", srv.URL + "/hufflepuff.tsv", srv.URL + "/ravenclaw.tsv"}
+
+	_, _, err := cmd.fetchSources(uris, jsonTestDevices[:1], log.New(ioutil.Discard, "", 0))
+	if err == nil {
+		t.Fatalf("Expected error fetching ACL sources, got nil")
+	}
+
+	if !errors.Is(err, ErrVerify) {
+		t.Errorf("Expected VerifyError, got %v", err)
+	}
+
+	for _, uri := range uris {
+		if !strings.Contains(err.Error(), uri) {
+			t.Errorf("Error does not identify failing ACL source %v (%v)", uri, err)
+		}
+	}
+
+	expected := []string{srv.URL + "/gryffindor.tsv", srv.URL + "/ravenclaw.tsv"}
+	if failed := failedSources(err, ErrVerify); strings.Join(failed, ",") != strings.Join(expected, ",") {
+		t.Errorf("Incorrect unverified ACL sources - expected:%v, got:%v", expected, failed)
+	}
+}
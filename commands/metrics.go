@@ -0,0 +1,185 @@
+package commands
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/uhppoted/uhppoted-lib/acl"
+)
+
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+func openmetrics(latency map[uint32]time.Duration, diff map[uint32]acl.Diff) []byte {
+	var b bytes.Buffer
+
+	// ... controller latency histogram
+	counts := make([]int, len(latencyBuckets))
+	sum := 0.0
+	for _, dt := range latency {
+		t := dt.Seconds()
+		sum += t
+		for i, le := range latencyBuckets {
+			if t <= le {
+				counts[i]++
+			}
+		}
+	}
+
+	fmt.Fprintln(&b, "# TYPE uhppoted_acl_controller_latency_seconds histogram")
+	fmt.Fprintln(&b, "# UNIT uhppoted_acl_controller_latency_seconds seconds")
+	fmt.Fprintln(&b, "# HELP uhppoted_acl_controller_latency_seconds Time taken to retrieve the ACL from a controller")
+	for i, le := range latencyBuckets {
+		fmt.Fprintf(&b, "uhppoted_acl_controller_latency_seconds_bucket{le=\"%v\"} %v\n", le, counts[i])
+	}
+	fmt.Fprintf(&b, "uhppoted_acl_controller_latency_seconds_bucket{le=\"+Inf\"} %v\n", len(latency))
+	fmt.Fprintf(&b, "uhppoted_acl_controller_latency_seconds_count %v\n", len(latency))
+	fmt.Fprintf(&b, "uhppoted_acl_controller_latency_seconds_sum %.6f\n", sum)
+
+	// ... diffs by type
+	devices := []uint32{}
+	for k := range diff {
+		devices = append(devices, k)
+	}
+
+	sort.Slice(devices, func(i, j int) bool { return devices[i] < devices[j] })
+
+	fmt.Fprintln(&b, "# TYPE uhppoted_acl_diffs counter")
+	fmt.Fprintln(&b, "# HELP uhppoted_acl_diffs Number of cards by comparison result")
+	for _, k := range devices {
+		v := diff[k]
+		fmt.Fprintf(&b, "uhppoted_acl_diffs_total{device=\"%v\",type=\"unchanged\"} %v\n", k, len(v.Unchanged))
+		fmt.Fprintf(&b, "uhppoted_acl_diffs_total{device=\"%v\",type=\"updated\"} %v\n", k, len(v.Updated))
+		fmt.Fprintf(&b, "uhppoted_acl_diffs_total{device=\"%v\",type=\"added\"} %v\n", k, len(v.Added))
+		fmt.Fprintf(&b, "uhppoted_acl_diffs_total{device=\"%v\",type=\"deleted\"} %v\n", k, len(v.Deleted))
+	}
+
+	fmt.Fprintln(&b, "# EOF")
+
+	return b.Bytes()
+}
+
+// compare-acl run metrics for the Prometheus node_exporter textfile collector.
+type runMetrics struct {
+	records map[uint32]int
+	diffs   int
+	fetch   time.Duration
+	upload  time.Duration
+}
+
+// Formats the run metrics as a single logfmt line e.g. records=405419896:12,303986753:9 diffs=3 fetch=0.125 upload=0.051
+func (m runMetrics) String() string {
+	devices := []uint32{}
+	for k := range m.records {
+		devices = append(devices, k)
+	}
+
+	sort.Slice(devices, func(i, j int) bool { return devices[i] < devices[j] })
+
+	records := []string{}
+	for _, k := range devices {
+		records = append(records, fmt.Sprintf("%v:%v", k, m.records[k]))
+	}
+
+	return fmt.Sprintf("records=%v diffs=%v fetch=%.3f upload=%.3f", strings.Join(records, ","), m.diffs, m.fetch.Seconds(), m.upload.Seconds())
+}
+
+func prometheus(m runMetrics) []byte {
+	var b bytes.Buffer
+
+	devices := []uint32{}
+	for k := range m.records {
+		devices = append(devices, k)
+	}
+
+	sort.Slice(devices, func(i, j int) bool { return devices[i] < devices[j] })
+
+	fmt.Fprintln(&b, "# HELP uhppoted_acl_records Number of cards retrieved from the controller")
+	fmt.Fprintln(&b, "# TYPE uhppoted_acl_records gauge")
+	for _, k := range devices {
+		fmt.Fprintf(&b, "uhppoted_acl_records{device=\"%v\"} %v\n", k, m.records[k])
+	}
+
+	fmt.Fprintln(&b, "# HELP uhppoted_acl_diffs Number of incorrect, missing and unexpected cards across all controllers")
+	fmt.Fprintln(&b, "# TYPE uhppoted_acl_diffs gauge")
+	fmt.Fprintf(&b, "uhppoted_acl_diffs %v\n", m.diffs)
+
+	fmt.Fprintln(&b, "# HELP uhppoted_acl_fetch_duration_seconds Time taken to fetch, verify and parse the authoritative ACL")
+	fmt.Fprintln(&b, "# TYPE uhppoted_acl_fetch_duration_seconds gauge")
+	fmt.Fprintf(&b, "uhppoted_acl_fetch_duration_seconds %.6f\n", m.fetch.Seconds())
+
+	fmt.Fprintln(&b, "# HELP uhppoted_acl_upload_duration_seconds Time taken to upload the report")
+	fmt.Fprintln(&b, "# TYPE uhppoted_acl_upload_duration_seconds gauge")
+	fmt.Fprintf(&b, "uhppoted_acl_upload_duration_seconds %.6f\n", m.upload.Seconds())
+
+	fmt.Fprintln(&b, "# HELP uhppoted_acl_last_run_timestamp_seconds Time at which compare-acl last completed")
+	fmt.Fprintln(&b, "# TYPE uhppoted_acl_last_run_timestamp_seconds gauge")
+	fmt.Fprintf(&b, "uhppoted_acl_last_run_timestamp_seconds %v\n", time.Now().Unix())
+
+	return b.Bytes()
+}
+
+func writeMetrics(file string, metrics []byte) error {
+	return writeAtomic(file, metrics, 0660)
+}
+
+// Writes the file to a temporary file in the same directory and renames it, so that a reader (e.g. a collector)
+// never sees a partially written file. The temporary file is removed if the write fails.
+func writeAtomic(file string, b []byte, mode os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(f.Name(), mode); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), file)
+}
+
+func pushMetrics(gateway string, job string, metrics []byte) error {
+	uri := fmt.Sprintf("%v/metrics/job/%v", strings.TrimSuffix(gateway, "/"), job)
+
+	rq, err := http.NewRequest("PUT", uri, bytes.NewReader(metrics))
+	if err != nil {
+		return err
+	}
+
+	rq.Header.Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+
+	response, err := http.DefaultClient.Do(rq)
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("push to %v failed (%v)", gateway, response.Status)
+	}
+
+	return nil
+}
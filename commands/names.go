@@ -0,0 +1,125 @@
+package commands
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/uhppoted/uhppote-core/uhppote"
+	"github.com/uhppoted/uhppoted-lib/encoding/conf"
+)
+
+// Friendly device names are defined either in a --device-name-map file e.g.
+//
+//	405419896 = Main Entrance
+//	303986753 = Loading Dock
+//
+// or in the uhppoted.conf file e.g.
+//
+//	s3.device-name.405419896 = Main Entrance
+type deviceNames map[uint32]string
+
+func (n *deviceNames) UnmarshalConf(tag string, values map[string]string) (interface{}, error) {
+	names := deviceNames{}
+	prefix := tag + "."
+
+	for k, v := range values {
+		if strings.HasPrefix(k, prefix) {
+			id, err := strconv.ParseUint(strings.TrimPrefix(k, prefix), 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid device ID in '%v' (%w)", k, err)
+			}
+
+			names[uint32(id)] = strings.TrimSpace(v)
+		}
+	}
+
+	return &names, nil
+}
+
+// Controller details for the report, from the controller configuration.
+type ReportDevice struct {
+	Name         string
+	SerialNumber uint32
+}
+
+func (d ReportDevice) String() string {
+	if d.Name != "" {
+		return fmt.Sprintf("%v (%v)", d.Name, d.SerialNumber)
+	}
+
+	return fmt.Sprintf("%v", d.SerialNumber)
+}
+
+// Returns the report details for the configured controllers. A friendly device name (if defined) replaces the
+// controller name from the configuration.
+func reportDevices(devices []uhppote.Device, names deviceNames) map[uint32]ReportDevice {
+	m := map[uint32]ReportDevice{}
+	for _, d := range devices {
+		name := strings.TrimSpace(d.Name)
+		if v, ok := names[d.DeviceID]; ok && v != "" {
+			name = v
+		}
+
+		m[d.DeviceID] = ReportDevice{
+			Name:         name,
+			SerialNumber: d.DeviceID,
+		}
+	}
+
+	return m
+}
+
+func loadDeviceNames(file string, confFile string) (deviceNames, error) {
+	if file == "" {
+		if confFile == "" {
+			return deviceNames{}, nil
+		}
+
+		b, err := ioutil.ReadFile(confFile)
+		if err != nil {
+			return nil, err
+		}
+
+		c := struct {
+			Names deviceNames `conf:"s3.device-name"`
+		}{}
+
+		if err := conf.Unmarshal(b, &c); err != nil {
+			return nil, err
+		}
+
+		return c.Names, nil
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	names := deviceNames{}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		tokens := strings.SplitN(text, "=", 2)
+		if len(tokens) != 2 {
+			return nil, fmt.Errorf("%v: invalid device name at line %v ('%v')", file, line, text)
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSpace(tokens[0]), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%v: invalid device ID at line %v ('%v')", file, line, strings.TrimSpace(tokens[0]))
+		}
+
+		names[uint32(id)] = strings.TrimSpace(tokens[1])
+	}
+
+	return names, s.Err()
+}
@@ -0,0 +1,96 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Rewrites the card numbers in the TSV in the canonical decimal form reported by the controllers i.e. without
+// whitespace or leading zeros and (optionally) converting 0x prefixed hexadecimal card numbers to decimal.
+// Records with invalid card numbers are removed and returned as warnings. Returns the TSV, the number of card
+// numbers that were changed and the warnings.
+func normalizeCards(tsv []byte, hex bool) ([]byte, int, []error) {
+	r := csv.NewReader(bytes.NewReader(tsv))
+	r.Comma = '\t'
+	r.FieldsPerRecord = -1
+
+	records, err := r.ReadAll()
+	if err != nil || len(records) == 0 {
+		// ... left for the ACL parser to report
+		return tsv, 0, nil
+	}
+
+	header := records[0]
+	column := -1
+	for ix, field := range header {
+		if clean(field) == "cardnumber" {
+			column = ix
+			break
+		}
+	}
+
+	if column < 0 {
+		return tsv, 0, nil
+	}
+
+	var b bytes.Buffer
+
+	w := csv.NewWriter(&b)
+	w.Comma = '\t'
+	w.Write(header)
+
+	changed := 0
+	warnings := []error{}
+	for line, record := range records[1:] {
+		if len(record) <= column {
+			w.Write(record)
+			continue
+		}
+
+		field := record[column]
+		cardnumber, err := normalizeCard(field, hex)
+		if err != nil {
+			warnings = append(warnings, fmt.Errorf("line %d: invalid card number '%v' - record ignored", line+1, field))
+			continue
+		}
+
+		if cardnumber != field {
+			changed++
+		}
+
+		row := append([]string{}, record...)
+		row[column] = cardnumber
+
+		w.Write(row)
+	}
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return tsv, 0, []error{err}
+	}
+
+	return b.Bytes(), changed, warnings
+}
+
+func normalizeCard(field string, hex bool) (string, error) {
+	s := strings.TrimSpace(field)
+
+	if hex && (strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X")) {
+		v, err := strconv.ParseUint(s[2:], 16, 32)
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("%v", v), nil
+	}
+
+	v, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%v", v), nil
+}
@@ -0,0 +1,146 @@
+package commands
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/uhppoted/uhppoted-lib/config"
+)
+
+// Maximum expiry for an AWS Signature Version 4 presigned URL
+const MAX_PRESIGN_EXPIRES = 7 * 24 * time.Hour
+
+var PresignCmd = Presign{
+	config:      config.DefaultConfig,
+	credentials: DEFAULT_CREDENTIALS,
+	profile:     DEFAULT_PROFILE,
+	region:      DEFAULT_REGION,
+	role:        awsRole{duration: DEFAULT_ROLE_DURATION},
+	method:      "GET",
+	expires:     1 * time.Hour,
+	debug:       false,
+}
+
+type Presign struct {
+	url         string
+	config      string
+	credentials string
+	profile     string
+	region      string
+	role        awsRole
+	endpoint    s3Endpoint
+	method      string
+	expires     time.Duration
+	debug       bool
+	ctx         context.Context
+	flagset     *flag.FlagSet
+}
+
+func (cmd *Presign) Name() string {
+	return "presign"
+}
+
+func (cmd *Presign) FlagSet() *flag.FlagSet {
+	flagset := flag.NewFlagSet("presign", flag.ExitOnError)
+
+	flagset.StringVar(&cmd.url, "url", cmd.url, "The s3://bucket/key URL of the object for which to generate a presigned URL")
+	flagset.StringVar(&cmd.method, "method", cmd.method, "HTTP method for the presigned URL ('GET' to download the object or 'PUT' to upload it)")
+	flagset.DurationVar(&cmd.expires, "expires", cmd.expires, "Duration for which the presigned URL is valid (defaults to 1h, maximum 168h i.e. 7 days)")
+	flagset.StringVar(&cmd.credentials, "credentials", cmd.credentials, "AWS credentials file (or profile://<name> to use the credentials and region for the named profile in the shared AWS config)")
+	flagset.StringVar(&cmd.profile, "profile", cmd.profile, "AWS credentials file profile (defaults to 'default')")
+	flagset.StringVar(&cmd.region, "region", cmd.region, "AWS region for S3 (defaults to us-east-1)")
+	flagset.StringVar(&cmd.role.arn, "role-arn", cmd.role.arn, "ARN of an IAM role to assume (using STS AssumeRole) for S3 access e.g. for cross-account access")
+	flagset.StringVar(&cmd.role.externalID, "external-id", cmd.role.externalID, "External ID for assuming the --role-arn role")
+	flagset.DurationVar(&cmd.role.duration, "role-duration", cmd.role.duration, "Session duration for the assumed --role-arn role (the presigned URL is only valid while the session credentials are valid)")
+	flagset.StringVar(&cmd.endpoint.url, "endpoint", cmd.endpoint.url, "Custom S3 endpoint URL for S3 compatible stores e.g. http://minio.local:9000 (defaults to AWS S3)")
+	flagset.BoolVar(&cmd.endpoint.pathStyle, "path-style", cmd.endpoint.pathStyle, "Uses path-style (http://host/bucket/key) rather than virtual-hosted style S3 addressing (e.g. for MinIO)")
+
+	cmd.flagset = flagset
+
+	return flagset
+}
+
+func (cmd *Presign) Description() string {
+	return fmt.Sprintf("Generates a presigned URL for downloading or uploading an S3 object")
+}
+
+func (cmd *Presign) Usage() string {
+	return "presign <s3://bucket/key>"
+}
+
+func (cmd *Presign) Help() {
+	fmt.Println()
+	fmt.Printf("  Usage: %s [--debug] [--config <file>] presign [--method GET|PUT] [--expires <duration>] [--credentials <file>] [--profile <file>] [--region <region>] [--role-arn <ARN>] [--external-id <ID>] [--role-duration <duration>] [--endpoint <URL>] [--path-style] <s3://bucket/key>\n", APP)
+	fmt.Println()
+	fmt.Println("    Prints a presigned https:// URL for the S3 object that can be used without AWS credentials until it expires")
+	fmt.Println("    e.g. to give an auditor temporary access to a report file (GET) or to allow an external system to upload an")
+	fmt.Println("    ACL file to a known key (PUT).")
+	fmt.Println()
+
+	helpOptions(cmd.FlagSet())
+	fmt.Println()
+}
+
+func (cmd *Presign) Execute(args ...interface{}) error {
+	options := args[0].(*Options)
+
+	cmd.config = options.Config
+	cmd.debug = options.Debug
+	cmd.ctx = options.ctx()
+
+	method := strings.ToUpper(strings.TrimSpace(cmd.method))
+	if method != "GET" && method != "PUT" {
+		return fmt.Errorf("Invalid --method '%v' (expected 'GET' or 'PUT')", cmd.method)
+	}
+
+	if cmd.expires <= 0 || cmd.expires > MAX_PRESIGN_EXPIRES {
+		return fmt.Errorf("Invalid --expires '%v' (must be greater than 0 and no more than %v)", cmd.expires, MAX_PRESIGN_EXPIRES)
+	}
+
+	uri := strings.TrimSpace(cmd.url)
+	if uri == "" && cmd.flagset != nil && cmd.flagset.NArg() > 0 {
+		uri = strings.TrimSpace(cmd.flagset.Arg(0))
+	}
+
+	if uri == "" {
+		return fmt.Errorf("presign requires an s3://bucket/key URL")
+	}
+
+	if !strings.HasPrefix(uri, "s3://") {
+		return fmt.Errorf("Invalid presign URL '%v' (expected s3://bucket/key)", uri)
+	}
+
+	conf := config.NewConfig()
+	if err := conf.Load(cmd.config); err != nil {
+		return fmt.Errorf("WARN  Could not load configuration (%v)", err)
+	}
+
+	if cmd.credentials == "" {
+		cmd.credentials = conf.AWS.Credentials
+	}
+
+	if cmd.profile == "" {
+		cmd.profile = conf.AWS.Profile
+	}
+
+	if cmd.region == "" && !isProfileURI(cmd.credentials) {
+		cmd.region = conf.AWS.Region
+	}
+
+	if cmd.role.arn != "" && cmd.expires > cmd.role.duration {
+		fmt.Fprintf(os.Stderr, "WARN  the presigned URL is only valid until the --role-duration (%v) session credentials expire\n", cmd.role.duration)
+	}
+
+	presigned, err := presignS3(cmd.ctx, uri, method, cmd.expires, cmd.credentials, cmd.profile, cmd.region, cmd.endpoint, cmd.role)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(presigned)
+
+	return nil
+}
@@ -0,0 +1,123 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Progress logging for the controller ACL retrieval (--progress or --debug), which logs a line as each controller
+// ACL retrieval starts and completes. If stderr is a terminal (and the log messages are not being written to the
+// terminal i.e. without --no-log) the progress is also shown as a single updating 'done/total' line on stderr.
+type progress struct {
+	sync.Mutex
+	total   int
+	started int
+	done    int
+	errors  int
+	start   time.Time
+	log     *log.Logger
+	tty     io.Writer
+	ticker  *time.Ticker
+	stopped chan struct{}
+}
+
+func newProgress(total int, nolog bool, log *log.Logger) *progress {
+	p := progress{
+		total: total,
+		start: time.Now(),
+		log:   log,
+	}
+
+	if info, err := os.Stderr.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 && !nolog {
+		p.tty = os.Stderr
+		p.ticker = time.NewTicker(time.Second)
+		p.stopped = make(chan struct{})
+
+		go func() {
+			for {
+				select {
+				case <-p.ticker.C:
+					p.Lock()
+					p.redraw()
+					p.Unlock()
+
+				case <-p.stopped:
+					return
+				}
+			}
+		}()
+	}
+
+	p.log.Printf("Retrieving ACL from %v controllers", total)
+
+	return &p
+}
+
+func (p *progress) starting(device uint32) {
+	if p == nil {
+		return
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	p.started++
+	p.log.Printf("%v  retrieving controller ACL (%v of %v)", device, p.started, p.total)
+	p.redraw()
+}
+
+func (p *progress) completed(device uint32, cards int, errs []error, dt time.Duration) {
+	if p == nil {
+		return
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	p.done++
+	if len(errs) > 0 {
+		p.errors++
+		p.log.Printf("%v  retrieving controller ACL failed in %v (%v of %v done, elapsed %v)", device, dt.Round(time.Millisecond), p.done, p.total, p.elapsed())
+	} else {
+		p.log.Printf("%v  retrieved %v cards in %v (%v of %v done, elapsed %v)", device, cards, dt.Round(time.Millisecond), p.done, p.total, p.elapsed())
+	}
+
+	p.redraw()
+}
+
+func (p *progress) finish() {
+	if p == nil {
+		return
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	if p.ticker != nil {
+		p.ticker.Stop()
+		close(p.stopped)
+		p.ticker = nil
+	}
+
+	p.redraw()
+	if p.tty != nil {
+		fmt.Fprintln(p.tty)
+		p.tty = nil
+	}
+
+	p.log.Printf("Retrieved ACL from %v of %v controllers in %v (%v failed, %v not checked)", p.done-p.errors, p.total, p.elapsed(), p.errors, p.total-p.done)
+}
+
+func (p *progress) redraw() {
+	if p.tty != nil {
+		fmt.Fprintf(p.tty, "\r  controllers: %v/%v  errors: %v  elapsed: %-10v", p.done, p.total, p.errors, p.elapsed().Round(time.Second))
+	}
+}
+
+func (p *progress) elapsed() time.Duration {
+	return time.Since(p.start).Round(time.Millisecond)
+}
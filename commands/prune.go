@@ -0,0 +1,149 @@
+package commands
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/uhppoted/uhppoted-lib/config"
+)
+
+var PruneCmd = Prune{
+	config:      config.DefaultConfig,
+	credentials: DEFAULT_CREDENTIALS,
+	profile:     DEFAULT_PROFILE,
+	region:      DEFAULT_REGION,
+	role:        awsRole{duration: DEFAULT_ROLE_DURATION},
+	retry:       retryPolicy{retries: DEFAULT_RETRIES, delay: DEFAULT_RETRY_DELAY},
+	debug:       false,
+}
+
+type Prune struct {
+	url         string
+	config      string
+	credentials string
+	profile     string
+	region      string
+	role        awsRole
+	endpoint    s3Endpoint
+	proxy       string
+	retry       retryPolicy
+	retain      int
+	dryrun      bool
+	debug       bool
+	ctx         context.Context
+	flagset     *flag.FlagSet
+}
+
+func (cmd *Prune) Name() string {
+	return "prune"
+}
+
+func (cmd *Prune) FlagSet() *flag.FlagSet {
+	flagset := flag.NewFlagSet("prune", flag.ExitOnError)
+
+	flagset.StringVar(&cmd.url, "url", cmd.url, "The s3://bucket/prefix URL of the uploaded report files to prune")
+	flagset.StringVar(&cmd.credentials, "credentials", cmd.credentials, "AWS credentials file (or profile://<name> to use the credentials and region for the named profile in the shared AWS config)")
+	flagset.StringVar(&cmd.profile, "profile", cmd.profile, "AWS credentials file profile (defaults to 'default')")
+	flagset.StringVar(&cmd.region, "region", cmd.region, "AWS region for S3 (defaults to us-east-1)")
+	flagset.StringVar(&cmd.role.arn, "role-arn", cmd.role.arn, "ARN of an IAM role to assume (using STS AssumeRole) for S3 access e.g. for cross-account access")
+	flagset.StringVar(&cmd.role.externalID, "external-id", cmd.role.externalID, "External ID for assuming the --role-arn role")
+	flagset.DurationVar(&cmd.role.duration, "role-duration", cmd.role.duration, "Session duration for the assumed --role-arn role (credentials are refreshed automatically when they expire)")
+	flagset.StringVar(&cmd.endpoint.url, "endpoint", cmd.endpoint.url, "Custom S3 endpoint URL for S3 compatible stores e.g. http://minio.local:9000 (defaults to AWS S3)")
+	flagset.BoolVar(&cmd.endpoint.pathStyle, "path-style", cmd.endpoint.pathStyle, "Uses path-style (http://host/bucket/key) rather than virtual-hosted style S3 addressing (e.g. for MinIO)")
+	flagset.StringVar(&cmd.proxy, "proxy", cmd.proxy, "HTTP proxy URL for HTTP and S3 requests (overrides the HTTP_PROXY and HTTPS_PROXY environment variables, NO_PROXY still applies)")
+	flagset.IntVar(&cmd.retry.retries, "retries", cmd.retry.retries, "Number of times to retry an S3 request after a transient failure (5xx response, connection reset or timeout)")
+	flagset.DurationVar(&cmd.retry.delay, "retry-delay", cmd.retry.delay, "Delay before the first retry of a failed S3 request, doubling (with jitter) for each subsequent retry")
+	flagset.IntVar(&cmd.retain, "retain", cmd.retain, "Number of the most recent report files to retain")
+	flagset.BoolVar(&cmd.dryrun, "dry-run", cmd.dryrun, "Lists the report files that would be deleted without deleting them")
+
+	cmd.flagset = flagset
+
+	return flagset
+}
+
+func (cmd *Prune) Description() string {
+	return fmt.Sprintf("Deletes all but the most recent report files stored under an S3 prefix")
+}
+
+func (cmd *Prune) Usage() string {
+	return "prune --retain <N> <s3://bucket/prefix>"
+}
+
+func (cmd *Prune) Help() {
+	fmt.Println()
+	fmt.Printf("  Usage: %s [--debug] [--config <file>] prune --retain <N> [--dry-run] [--credentials <file>] [--profile <file>] [--region <region>] [--role-arn <ARN>] [--external-id <ID>] [--role-duration <duration>] [--endpoint <URL>] [--path-style] [--proxy <URL>] [--retries <N>] [--retry-delay <duration>] <s3://bucket/prefix>\n", APP)
+	fmt.Println()
+	fmt.Println("    Deletes all but the most recent --retain report files stored directly under the S3 bucket and prefix. Only")
+	fmt.Println("    report files named acl-YYYY-MM-DDThhmmss.rpt (or .json, .html, .tar.gz or .zip) are deleted - other objects under")
+	fmt.Println("    the prefix are never deleted.")
+	fmt.Println()
+
+	helpOptions(cmd.FlagSet())
+	fmt.Println()
+}
+
+func (cmd *Prune) Execute(args ...interface{}) error {
+	options := args[0].(*Options)
+
+	cmd.config = options.Config
+	cmd.debug = options.Debug
+	cmd.ctx = options.ctx()
+
+	if err := setProxy(cmd.proxy); err != nil {
+		return err
+	}
+
+	if cmd.retain < 1 {
+		return fmt.Errorf("prune requires --retain <N> (1 or more)")
+	}
+
+	uri := strings.TrimSpace(cmd.url)
+	if uri == "" && cmd.flagset != nil && cmd.flagset.NArg() > 0 {
+		uri = strings.TrimSpace(cmd.flagset.Arg(0))
+	}
+
+	if uri == "" {
+		return fmt.Errorf("prune requires an s3://bucket/prefix URL")
+	}
+
+	if !strings.HasPrefix(uri, "s3://") {
+		return fmt.Errorf("Invalid prune URL '%v' (expected s3://bucket/prefix)", uri)
+	}
+
+	conf := config.NewConfig()
+	if err := conf.Load(cmd.config); err != nil {
+		return fmt.Errorf("WARN  Could not load configuration (%v)", err)
+	}
+
+	if cmd.credentials == "" {
+		cmd.credentials = conf.AWS.Credentials
+	}
+
+	if cmd.profile == "" {
+		cmd.profile = conf.AWS.Profile
+	}
+
+	if cmd.region == "" && !isProfileURI(cmd.credentials) {
+		cmd.region = conf.AWS.Region
+	}
+
+	logger := log.New(os.Stdout, "  ", 0)
+	cmd.retry.log = logger
+
+	deleted, err := pruneS3(cmd.ctx, uri, cmd.credentials, cmd.profile, cmd.region, "", cmd.endpoint, cmd.role, cmd.retry, cmd.retain, cmd.dryrun, logger)
+	if err != nil {
+		return err
+	}
+
+	if cmd.dryrun {
+		fmt.Printf("\n  %v: %v report files would be deleted\n\n", uri, len(deleted))
+	} else {
+		fmt.Printf("\n  %v: deleted %v report files\n\n", uri, len(deleted))
+	}
+
+	return nil
+}
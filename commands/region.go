@@ -0,0 +1,95 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// Runs the S3 request with the session for the region. If the request fails because the bucket is in a different
+// region, the request is retried with the bucket region (from the x-amz-bucket-region header of a HeadBucket request)
+// and then with each of the (comma separated) fallback regions in order. The region is logged if the request succeeds
+// with a region other than the configured region. Not applicable to custom S3 endpoints.
+func withS3Region(ctx context.Context, bucket, config, profile, region, fallback string, endpoint s3Endpoint, role awsRole, retry retryPolicy, f func(ss *session.Session) error) error {
+	ss, err := awsSession(config, profile, region, endpoint, role)
+	if err != nil {
+		return err
+	}
+
+	err = f(ss)
+	if err == nil || !wrongRegion(err) || endpoint.url != "" || ctx.Err() != nil {
+		return err
+	}
+
+	regions := []string{}
+	if hint, e := s3manager.GetBucketRegion(ctx, ss, bucket, region); e == nil && hint != "" {
+		regions = append(regions, hint)
+	}
+
+	for _, r := range strings.Split(fallback, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			regions = append(regions, r)
+		}
+	}
+
+	tried := []string{aws.StringValue(ss.Config.Region)}
+	skip := map[string]bool{aws.StringValue(ss.Config.Region): true}
+
+	for _, r := range regions {
+		if skip[r] {
+			continue
+		}
+
+		tried = append(tried, r)
+		skip[r] = true
+
+		if retry.log != nil {
+			retry.log.Printf("WARN  S3 bucket %v is not in region %v (%v) - retrying with region %v", bucket, aws.StringValue(ss.Config.Region), err, r)
+		}
+
+		rs, e := awsSession(config, profile, r, endpoint, role)
+		if e != nil {
+			return e
+		}
+
+		if err = f(rs); err == nil {
+			if retry.log != nil {
+				retry.log.Printf("S3 bucket %v is in region %v", bucket, r)
+			}
+
+			return nil
+		} else if !wrongRegion(err) {
+			return err
+		}
+	}
+
+	if len(tried) > 1 {
+		return fmt.Errorf("%w (tried regions %v)", err, strings.Join(tried, ","))
+	}
+
+	return err
+}
+
+// Returns true for the S3 errors returned for a request to the wrong region for the bucket i.e. a 301 redirect
+// (BucketRegionError), a request signed for the wrong region (AuthorizationHeaderMalformed) or AccessDenied (which
+// is returned for some wrong region requests).
+func wrongRegion(err error) bool {
+	// ... AWS SDK errors do not implement Unwrap
+	if ae, ok := err.(awserr.Error); ok {
+		switch ae.Code() {
+		case "BucketRegionError", "PermanentRedirect", "AuthorizationHeaderMalformed", "AccessDenied":
+			return true
+		}
+
+		if ae.OrigErr() != nil {
+			return wrongRegion(ae.OrigErr())
+		}
+	}
+
+	return false
+}
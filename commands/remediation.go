@@ -0,0 +1,90 @@
+package commands
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/uhppoted/uhppote-core/types"
+	"github.com/uhppoted/uhppoted-lib/acl"
+)
+
+// Generates a shell script of uhppote-cli commands that would bring the controllers into compliance with the
+// authoritative ACL. The script is intended to be reviewed before being run and is deliberately not executable.
+func remediation(uri string, diff map[uint32]acl.Diff, exclude map[uint32]bool) []byte {
+	var b strings.Builder
+
+	fmt.Fprintln(&b, "#!/bin/sh")
+	fmt.Fprintln(&b)
+	fmt.Fprintf(&b, "# ACL remediation generated by %v compare-acl %v\n", APP, time.Now().Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(&b, "# Authoritative ACL: %v\n", uri)
+	fmt.Fprintln(&b, "#")
+	fmt.Fprintln(&b, "# REVIEW CAREFULLY BEFORE RUNNING")
+	fmt.Fprintln(&b)
+	fmt.Fprintln(&b, "set -e")
+
+	devices := []uint32{}
+	for k := range diff {
+		devices = append(devices, k)
+	}
+
+	sort.Slice(devices, func(i, j int) bool { return devices[i] < devices[j] })
+
+	for _, device := range devices {
+		d := diff[device]
+		if !d.HasChanges() {
+			continue
+		}
+
+		if exclude[device] {
+			fmt.Fprintln(&b)
+			fmt.Fprintf(&b, "# %v  excluded - needs manual review (unexpected:%v)\n", device, len(d.Deleted))
+			continue
+		}
+
+		fmt.Fprintln(&b)
+		fmt.Fprintf(&b, "# %v  incorrect:%v  missing:%v  unexpected:%v\n", device, len(d.Updated), len(d.Added), len(d.Deleted))
+
+		for _, list := range [][]types.Card{d.Updated, d.Added} {
+			for _, card := range list {
+				if card.From == nil || card.To == nil {
+					fmt.Fprintf(&b, "# card %v skipped (missing start or end date)\n", card.CardNumber)
+					continue
+				}
+
+				if doors(card) == "" {
+					fmt.Fprintf(&b, "# card %v skipped (no door permissions)\n", card.CardNumber)
+					continue
+				}
+
+				fmt.Fprintf(&b, "uhppote-cli put-card %v %v %v %v %v\n", device, card.CardNumber, card.From, card.To, doors(card))
+			}
+		}
+
+		for _, card := range d.Deleted {
+			fmt.Fprintf(&b, "uhppote-cli delete-card %v %v\n", device, card.CardNumber)
+		}
+	}
+
+	return []byte(b.String())
+}
+
+func writeRemediation(file string, script []byte) error {
+	return writeAtomic(file, script, 0660)
+}
+
+// Formats the card door permissions as a uhppote-cli door list e.g. 1,2:29,4 (door 2 with time profile 29).
+func doors(card types.Card) string {
+	list := []string{}
+	for door := uint8(1); door <= 4; door++ {
+		switch p := card.Doors[door]; {
+		case p == 1:
+			list = append(list, fmt.Sprintf("%v", door))
+		case p >= 2 && p <= 254:
+			list = append(list, fmt.Sprintf("%v:%v", door, p))
+		}
+	}
+
+	return strings.Join(list, ",")
+}
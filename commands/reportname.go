@@ -0,0 +1,104 @@
+package commands
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Default --report-name i.e. a Go time format for the local time e.g. acl-2026-10-14T181459.rpt
+const DEFAULT_REPORT_NAME = "acl-2006-01-02T150405"
+
+var unsafeChars = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// Template fields for a --report-name template e.g. report_{{.Date}}_UTC. Date and Time are UTC.
+type reportFields struct {
+	Date   string
+	Time   string
+	Device string
+	UTC    time.Time
+	Local  time.Time
+}
+
+func checkReportName(pattern string) error {
+	_, err := reportFilename(pattern, time.Now(), "rpt", nil)
+
+	return err
+}
+
+// Returns the report file name for the --report-name pattern, which is either a Go time format (for the local time)
+// or a text/template with the reportFields fields. The report format extension is appended unless the name already
+// has the extension.
+func reportFilename(pattern string, now time.Time, ext string, devices map[uint32]ReportDevice) (string, error) {
+	name := ""
+
+	if !strings.Contains(pattern, "{{") {
+		name = now.Format(pattern)
+	} else {
+		t, err := template.New("report-name").Option("missingkey=error").Parse(pattern)
+		if err != nil {
+			return "", fmt.Errorf("Invalid --report-name '%v' (%v)", pattern, err)
+		}
+
+		utc := now.UTC()
+		fields := reportFields{
+			Date:   utc.Format("20060102"),
+			Time:   utc.Format("150405"),
+			Device: deviceField(devices),
+			UTC:    utc,
+			Local:  now.Local(),
+		}
+
+		var b strings.Builder
+		if err := t.Execute(&b, fields); err != nil {
+			return "", fmt.Errorf("Invalid --report-name '%v' (%v)", pattern, err)
+		}
+
+		name = b.String()
+	}
+
+	name = strings.TrimSpace(name)
+	if !strings.HasSuffix(name, "."+ext) {
+		name += "." + ext
+	}
+
+	switch {
+	case strings.ContainsAny(name, `/\`):
+		return "", fmt.Errorf("Invalid --report-name '%v' (report file name '%v' includes a path separator)", pattern, name)
+
+	case strings.TrimSuffix(name, "."+ext) == "" || strings.HasPrefix(name, ".."):
+		return "", fmt.Errorf("Invalid --report-name '%v' (invalid report file name '%v')", pattern, name)
+
+	case name == RAW_ACL_FILE || name == DRIFT_FILE:
+		return "", fmt.Errorf("Invalid --report-name '%v' ('%v' is reserved)", pattern, name)
+	}
+
+	return name, nil
+}
+
+// Returns the controller name (or serial number) for a single controller, or the names joined with '-' for multiple
+// controllers, with anything other than letters, digits, '.', '_' and '-' replaced by '_' so that the name is a valid
+// file name.
+func deviceField(devices map[uint32]ReportDevice) string {
+	ids := []uint32{}
+	for k := range devices {
+		ids = append(ids, k)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	names := []string{}
+	for _, k := range ids {
+		name := strings.TrimSpace(devices[k].Name)
+		if name == "" {
+			name = fmt.Sprintf("%v", k)
+		}
+
+		names = append(names, unsafeChars.ReplaceAllString(name, "_"))
+	}
+
+	return strings.Join(names, "-")
+}
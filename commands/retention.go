@@ -0,0 +1,107 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Only report files named as for the report in the uploaded archive (e.g. acl-2026-10-14T181459.tar.gz) are
+// candidates for deletion, so that unrelated objects under the same prefix are never deleted.
+var retained = regexp.MustCompile(`^acl-[0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9]{6}\.(rpt|json|html|tar\.gz|zip)$`)
+
+// Deletes all but the most recent 'retain' report files directly under the s3://bucket/prefix/ URL, returning the
+// keys of the deleted (or for a dry run, the to-be-deleted) report files.
+func pruneS3(ctx context.Context, prefix, config, profile, region, fallback string, endpoint s3Endpoint, role awsRole, retry retryPolicy, retain int, dryrun bool, log *log.Logger) ([]string, error) {
+	if retain < 1 {
+		return nil, fmt.Errorf("Invalid --retain %v (expected 1 or more)", retain)
+	}
+
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+
+	match := regexp.MustCompile("^s3://(.*?)/(.*)$").FindStringSubmatch(prefix)
+	if len(match) != 3 || match[1] == "" {
+		return nil, fmt.Errorf("Invalid S3 URI (%s)", prefix)
+	}
+
+	bucket := match[1]
+	base := match[2]
+
+	objects, err := listS3(ctx, prefix, config, profile, region, fallback, endpoint, role, retry)
+	if err != nil {
+		return nil, err
+	}
+
+	reports := []string{}
+	for _, o := range objects {
+		name := strings.TrimPrefix(o.Key, base)
+		if !strings.Contains(name, "/") && retained.MatchString(name) {
+			reports = append(reports, o.Key)
+		}
+	}
+
+	// ... the report file names sort by timestamp
+	sort.Slice(reports, func(i, j int) bool { return reports[i] > reports[j] })
+
+	if len(reports) <= retain {
+		return []string{}, nil
+	}
+
+	deletes := reports[retain:]
+	if dryrun {
+		for _, key := range deletes {
+			log.Printf("DRY RUN  would delete s3://%v/%v", bucket, key)
+		}
+
+		return deletes, nil
+	}
+
+	// ... a wrong region retry resumes from the first object that was not deleted
+	deleted := []string{}
+	err = withS3Region(ctx, bucket, config, profile, region, fallback, endpoint, role, retry, func(ss *session.Session) error {
+		for _, key := range deletes[len(deleted):] {
+			object := s3.DeleteObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    aws.String(key),
+			}
+
+			err := retry.do(ctx, fmt.Sprintf("DELETE s3://%v/%v", bucket, key), func() error {
+				_, err := s3.New(ss).DeleteObjectWithContext(ctx, &object)
+				return err
+			})
+
+			if err != nil {
+				return err
+			}
+
+			log.Printf("Deleted s3://%v/%v", bucket, key)
+			deleted = append(deleted, key)
+		}
+
+		return nil
+	})
+
+	if err != nil && len(deleted) < len(deletes) {
+		return deleted, fmt.Errorf("Error deleting s3://%v/%v (%w)", bucket, deletes[len(deleted)], err)
+	} else if err != nil {
+		return deleted, err
+	}
+
+	return deleted, nil
+}
+
+// Returns the s3://bucket/prefix/ 'directory' of an s3:// object URL.
+func s3Prefix(uri string) string {
+	if i := strings.LastIndex(uri, "/"); i >= len("s3://") {
+		return uri[:i+1]
+	}
+
+	return uri + "/"
+}
@@ -0,0 +1,116 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"google.golang.org/api/googleapi"
+)
+
+const DEFAULT_RETRIES = 3
+const DEFAULT_RETRY_DELAY = 1 * time.Second
+
+// Retry policy for S3 and HTTP requests. Transient failures (5xx responses, connection resets and timeouts)
+// are retried up to 'retries' times with an exponential backoff (with jitter) starting at 'delay'. Each retry
+// is logged to the (optional) logger.
+type retryPolicy struct {
+	retries int
+	delay   time.Duration
+	log     *log.Logger
+}
+
+type httpStatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e httpStatusError) Error() string {
+	return fmt.Sprintf("%v: %v", e.URL, e.Status)
+}
+
+func (p retryPolicy) do(ctx context.Context, op string, f func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt > p.retries || ctx.Err() != nil || !transient(err) {
+			return err
+		}
+
+		wait := p.backoff(attempt)
+		if p.log != nil {
+			p.log.Printf("WARN  %v failed (%v) - retrying in %v (%v of %v)", op, err, wait, attempt, p.retries)
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// Returns a random delay between 1/2 and 1 times the exponential backoff delay for the attempt.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	d := p.delay
+	for i := 1; i < attempt && d < time.Hour; i++ {
+		d *= 2
+	}
+
+	if d <= 1 {
+		return d
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Returns true for 5xx responses, connection resets, timeouts and Cloud Storage 429 (rate limited) responses. Client
+// errors (4xx), cancellation and all other errors (including signature verification errors) are not retried.
+func transient(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var status httpStatusError
+	if errors.As(err, &status) {
+		return status.StatusCode >= 500
+	}
+
+	if errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+
+	var neterr net.Error
+	if errors.As(err, &neterr) && neterr.Timeout() {
+		return true
+	}
+
+	var gcserr *googleapi.Error
+	if errors.As(err, &gcserr) {
+		return gcserr.Code >= 500 || gcserr.Code == 429
+	}
+
+	// ... AWS SDK errors do not implement Unwrap
+	if rf, ok := err.(awserr.RequestFailure); ok && rf.StatusCode() != 0 {
+		return rf.StatusCode() >= 500
+	}
+
+	if ae, ok := err.(awserr.Error); ok {
+		switch ae.Code() {
+		case "SlowDown", "RequestTimeout", "InternalError", "ServiceUnavailable":
+			return true
+		}
+
+		if ae.OrigErr() != nil {
+			return transient(ae.OrigErr())
+		}
+	}
+
+	return false
+}
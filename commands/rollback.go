@@ -0,0 +1,345 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/uhppoted/uhppote-core/uhppote"
+	"github.com/uhppoted/uhppoted-lib/acl"
+	"github.com/uhppoted/uhppoted-lib/config"
+)
+
+var RollbackCmd = Rollback{
+	config:      config.DefaultConfig,
+	keysdir:     DEFAULT_KEYSDIR,
+	credentials: DEFAULT_CREDENTIALS,
+	profile:     DEFAULT_PROFILE,
+	region:      DEFAULT_REGION,
+	role:        awsRole{duration: DEFAULT_ROLE_DURATION},
+	httpTimeout: DEFAULT_HTTP_TIMEOUT,
+	retry:       retryPolicy{retries: DEFAULT_RETRIES, delay: DEFAULT_RETRY_DELAY},
+	concurrency: 1,
+	logFile:     DEFAULT_LOGFILE,
+	logFileSize: DEFAULT_LOGFILESIZE,
+	logFormat:   DEFAULT_LOG_FORMAT,
+	logMaxFiles: DEFAULT_LOG_MAX_FILES,
+	logMaxAge:   DEFAULT_LOG_MAX_AGE,
+	dryrun:      false,
+	nolog:       false,
+	debug:       false,
+}
+
+type Rollback struct {
+	url         string
+	config      string
+	keysdir     string
+	decryptKey  string
+	ca          string
+	credentials string
+	gcsCreds    string
+	azure       azureAuth
+	sftp        sftpAuth
+	profile     string
+	region      string
+	role        awsRole
+	endpoint    s3Endpoint
+	proxy       string
+	httpTimeout time.Duration
+	httpAuth    httpAuth
+	httpTLS     httpTLS
+	retry       retryPolicy
+	logFile     string
+	logFileSize int
+	logFormat   string
+	logMaxFiles int
+	logMaxAge   int
+	maxDeletes  uint
+	dryrun      bool
+	concurrency int
+	nolog       bool
+	debug       bool
+	ctx         context.Context
+	flagset     *flag.FlagSet
+}
+
+func (cmd *Rollback) Name() string {
+	return "rollback"
+}
+
+func (cmd *Rollback) FlagSet() *flag.FlagSet {
+	flagset := flag.NewFlagSet("rollback", flag.ExitOnError)
+
+	flagset.StringVar(&cmd.url, "url", cmd.url, "The URL (s3://, gs://, az://, http(s):// or file://) of the signed ACL file to restore e.g. a load-acl --backup or store-acl file")
+	flagset.StringVar(&cmd.credentials, "credentials", cmd.credentials, "AWS credentials file (or profile://<name> to use the credentials and region for the named profile in the shared AWS config)")
+	flagset.StringVar(&cmd.gcsCreds, "gcs-credentials", cmd.gcsCreds, "Google Cloud service account JSON credentials file for gs:// URLs (defaults to the application default credentials e.g. GOOGLE_APPLICATION_CREDENTIALS)")
+	flagset.StringVar(&cmd.azure.account, "azure-account", cmd.azure.account, "Azure storage account for az:// URLs (defaults to the AZURE_STORAGE_ACCOUNT environment variable)")
+	flagset.StringVar(&cmd.azure.key, "azure-key", cmd.azure.key, "Azure storage account shared key (defaults to the AZURE_STORAGE_KEY environment variable)")
+	flagset.StringVar(&cmd.azure.sas, "azure-sas", cmd.azure.sas, "Azure SAS token for az:// and blob.core.windows.net URLs (defaults to the AZURE_STORAGE_SAS_TOKEN environment variable)")
+	flagset.StringVar(&cmd.azure.connection, "azure-connection-string", cmd.azure.connection, "Azure storage connection string (defaults to the AZURE_STORAGE_CONNECTION_STRING environment variable)")
+	flagset.StringVar(&cmd.sftp.key, "ssh-key", cmd.sftp.key, "SSH private key file for sftp:// URLs (the passphrase for an encrypted key is taken from the SSH_KEY_PASSPHRASE environment variable)")
+	flagset.StringVar(&cmd.sftp.knownHosts, "known-hosts", cmd.sftp.knownHosts, "SSH known_hosts file used to verify the SFTP server host key (defaults to ~/.ssh/known_hosts)")
+	flagset.StringVar(&cmd.profile, "profile", cmd.profile, "AWS credentials file profile (defaults to 'default')")
+	flagset.StringVar(&cmd.region, "region", cmd.region, "AWS region for S3 (defaults to us-east-1)")
+	flagset.StringVar(&cmd.role.arn, "role-arn", cmd.role.arn, "ARN of an IAM role to assume (using STS AssumeRole) for S3 access e.g. for cross-account access")
+	flagset.StringVar(&cmd.role.externalID, "external-id", cmd.role.externalID, "External ID for assuming the --role-arn role")
+	flagset.DurationVar(&cmd.role.duration, "role-duration", cmd.role.duration, "Session duration for the assumed --role-arn role (credentials are refreshed automatically when they expire)")
+	flagset.StringVar(&cmd.endpoint.url, "endpoint", cmd.endpoint.url, "Custom S3 endpoint URL for S3 compatible stores e.g. http://minio.local:9000 (defaults to AWS S3)")
+	flagset.BoolVar(&cmd.endpoint.pathStyle, "path-style", cmd.endpoint.pathStyle, "Uses path-style (http://host/bucket/key) rather than virtual-hosted style S3 addressing (e.g. for MinIO)")
+	flagset.StringVar(&cmd.proxy, "proxy", cmd.proxy, "HTTP proxy URL for HTTP and S3 requests (overrides the HTTP_PROXY and HTTPS_PROXY environment variables, NO_PROXY still applies)")
+	flagset.DurationVar(&cmd.httpTimeout, "http-timeout", cmd.httpTimeout, "Timeout for HTTP requests, including reading the response body (0 for no timeout)")
+	flagset.StringVar(&cmd.httpAuth.user, "http-user", cmd.httpAuth.user, "User name for HTTP basic auth (defaults to the UHPPOTED_HTTP_USER environment variable)")
+	flagset.StringVar(&cmd.httpAuth.password, "http-password", cmd.httpAuth.password, "Password for HTTP basic auth (defaults to the UHPPOTED_HTTP_PASSWORD environment variable)")
+	flagset.StringVar(&cmd.httpAuth.bearer, "http-bearer", cmd.httpAuth.bearer, "Bearer token for HTTP requests (defaults to the UHPPOTED_HTTP_BEARER environment variable)")
+	flagset.StringVar(&cmd.httpTLS.cert, "client-cert", cmd.httpTLS.cert, "PEM client certificate file for mutual TLS with https:// servers")
+	flagset.StringVar(&cmd.httpTLS.key, "client-key", cmd.httpTLS.key, "PEM private key file for the --client-cert client certificate")
+	flagset.StringVar(&cmd.httpTLS.ca, "ca-cert", cmd.httpTLS.ca, "PEM CA certificates file for verifying https:// server certificates (defaults to the system CA certificates)")
+	flagset.IntVar(&cmd.retry.retries, "retries", cmd.retry.retries, "Number of times to retry an S3 or HTTP request after a transient failure (5xx response, connection reset or timeout)")
+	flagset.DurationVar(&cmd.retry.delay, "retry-delay", cmd.retry.delay, "Delay before the first retry of a failed S3 or HTTP request, doubling (with jitter) for each subsequent retry")
+	flagset.StringVar(&cmd.keysdir, "keys", cmd.keysdir, "Sets the directory to search for RSA or ed25519 signing keys. Key files are expected to be named '<uname>.pub' (and '<uname>/*.pub' for additional e.g. rotated keys)")
+	flagset.StringVar(&cmd.decryptKey, "decrypt-key", cmd.decryptKey, "RSA private key file for decrypting ACL files encrypted with store-acl --encrypt-to (the passphrase for an encrypted key is taken from the UHPPOTED_DECRYPT_KEY_PASSPHRASE environment variable)")
+	flagset.StringVar(&cmd.ca, "ca", cmd.ca, "PEM file with the trusted CA certificates for verifying the signing certificate chain")
+	flagset.UintVar(&cmd.maxDeletes, "max-deletes", cmd.maxDeletes, "Aborts the rollback without updating any controller if the number of cards to be deleted from a controller exceeds the limit (0 for no limit)")
+	flagset.BoolVar(&cmd.dryrun, "dry-run", cmd.dryrun, "Logs the changes that the rollback would make to each controller without updating the controllers")
+	flagset.IntVar(&cmd.concurrency, "concurrency", cmd.concurrency, "Maximum number of controllers to retrieve the ACL from concurrently (defaults to 1, 0 for all the controllers at once)")
+	flagset.BoolVar(&cmd.nolog, "no-log", cmd.nolog, "Writes log messages to stdout rather than a rotatable log file")
+	flagset.StringVar(&cmd.logFormat, "log-format", cmd.logFormat, "Log message format ('text' or 'json' i.e. one JSON object per log message)")
+	flagset.IntVar(&cmd.logMaxFiles, "log-max-files", cmd.logMaxFiles, "Maximum number of rotated log files to retain (0 for no limit)")
+	flagset.IntVar(&cmd.logMaxAge, "log-max-age", cmd.logMaxAge, "Maximum age (in days) of rotated log files to retain (0 for no limit)")
+
+	cmd.flagset = flagset
+
+	return flagset
+}
+
+func (cmd *Rollback) Description() string {
+	return fmt.Sprintf("Restores a previously stored ACL file to the configured UHPPOTE controllers")
+}
+
+func (cmd *Rollback) Usage() string {
+	return "rollback [--dry-run] <URL>"
+}
+
+func (cmd *Rollback) Help() {
+	fmt.Println()
+	fmt.Printf("  Usage: %s [--debug] [--config <file>] rollback [--dry-run] [--max-deletes <N>] [--credentials <file>] [--gcs-credentials <file>] [--azure-account <account>] [--azure-key <key>] [--azure-sas <token>] [--azure-connection-string <string>] [--ssh-key <file>] [--known-hosts <file>] [--profile <file>] [--region <region>] [--role-arn <ARN>] [--external-id <ID>] [--role-duration <duration>] [--endpoint <URL>] [--path-style] [--proxy <URL>] [--http-timeout <duration>] [--http-user <user>] [--http-password <password>] [--http-bearer <token>] [--client-cert <file>] [--client-key <file>] [--ca-cert <file>] [--retries <N>] [--retry-delay <duration>] [--keys <dir>] [--decrypt-key <file>] [--ca <file>] [--concurrency <N>] [--no-log] [--log-format text|json] [--log-max-files <N>] [--log-max-age <days>] <URL>\n", APP)
+	fmt.Println()
+	fmt.Println("    Fetches a signed ACL file (e.g. a load-acl --backup file) and restores it to the controllers configured in")
+	fmt.Println("    the configuration file. The changes to each controller are logged before the controllers are updated and the")
+	fmt.Println("    ACL file signature is always verified.")
+	fmt.Println()
+
+	helpOptions(cmd.FlagSet())
+	fmt.Println()
+}
+
+func (cmd *Rollback) Execute(args ...interface{}) error {
+	options := args[0].(*Options)
+
+	cmd.config = options.Config
+	cmd.debug = options.Debug
+	cmd.ctx = options.ctx()
+
+	if err := setProxy(cmd.proxy); err != nil {
+		return err
+	}
+
+	if err := setClientTLS(cmd.httpTLS); err != nil {
+		return err
+	}
+
+	if err := cmd.httpAuth.resolve(); err != nil {
+		return err
+	}
+
+	if err := cmd.azure.resolve(); err != nil {
+		return err
+	}
+
+	uri := strings.TrimSpace(cmd.url)
+	if uri == "" && cmd.flagset != nil && cmd.flagset.NArg() > 0 {
+		uri = strings.TrimSpace(cmd.flagset.Arg(0))
+	}
+
+	if uri == "" {
+		return fmt.Errorf("rollback requires the URL of the ACL file to restore")
+	} else if uri == "-" {
+		return fmt.Errorf("rollback does not support reading the ACL file from stdin")
+	}
+
+	uri = fileURI(uri)
+
+	conf := config.NewConfig()
+	if err := conf.Load(cmd.config); err != nil {
+		return fmt.Errorf("WARN  Could not load configuration (%v)", err)
+	}
+
+	if cmd.credentials == "" {
+		cmd.credentials = conf.AWS.Credentials
+	}
+
+	if cmd.profile == "" {
+		cmd.profile = conf.AWS.Profile
+	}
+
+	if cmd.region == "" && !isProfileURI(cmd.credentials) {
+		cmd.region = conf.AWS.Region
+	}
+
+	u, devices := getDevices(conf, cmd.debug)
+
+	logger, err := newLogger(cmd.Name(), cmd.logFile, cmd.logFileSize, cmd.logMaxFiles, cmd.logMaxAge, cmd.nolog, cmd.logFormat, os.Stdout)
+	if err != nil {
+		return err
+	}
+
+	cmd.retry.log = logger
+
+	return aborted("rollback", cmd.execute(u, uri, devices, logger), logger)
+}
+
+func (cmd *Rollback) execute(u uhppote.IUHPPOTE, uri string, devices []uhppote.Device, log *log.Logger) error {
+	log.Printf("Fetching rollback ACL from %v", uri)
+
+	b, err := cmd.fetch(uri)
+	if err != nil {
+		return &FetchError{URL: uri, Err: err}
+	}
+
+	log.Printf("Fetched rollback ACL from %v (%d bytes)", uri, len(b))
+
+	if b, err = decrypt(uri, b, cmd.decryptKey, log); err != nil {
+		return err
+	}
+
+	files, uname, archive, err := unpack(uri, b)
+	if err != nil {
+		return &ParseError{err}
+	} else if !archive {
+		return &VerifyError{fmt.Errorf("%v is not a signed tar.gz or zip archive", uri)}
+	}
+
+	tsv, ok := files["ACL"]
+	if !ok {
+		return &ParseError{fmt.Errorf("ACL file missing from tar.gz")}
+	}
+
+	signature, ok := files["signature"]
+	if !ok {
+		return &VerifyError{fmt.Errorf("'signature' file missing from tar.gz")}
+	}
+
+	if cmd.ca != "" {
+		chain, ok := files["certificate"]
+		if !ok {
+			return &VerifyError{fmt.Errorf("'certificate' file missing from tar.gz")}
+		}
+
+		signer, err := verifyCertificate(signable(files, tsv), signature, chain, cmd.ca)
+		if err != nil {
+			return &VerifyError{err}
+		}
+
+		log.Printf("Verified ACL signature and certificate chain for '%v'", signer)
+	} else if key, err := verify(uname, signable(files, tsv), signatures(files), cmd.keysdir); err != nil {
+		return &VerifyError{err}
+	} else {
+		log.Printf("Verified ACL signature for '%v' with key %v", uname, key)
+	}
+
+	tsv = normalizeText(tsv)
+
+	list, warnings, err := acl.ParseTSV(bytes.NewReader(tsv), devices, false)
+	if err != nil {
+		return &ParseError{err}
+	}
+
+	for _, w := range warnings {
+		log.Printf("WARN  %v", w)
+	}
+
+	current, errors, _, err := getACL(cmd.ctx, u, devices, cmd.concurrency)
+	if err != nil {
+		return err
+	} else if len(errors) > 0 {
+		return fmt.Errorf("%w %v", ErrUnreachable, errors)
+	}
+
+	diff, err := acl.Compare(current, list)
+	if err != nil {
+		return err
+	}
+
+	if cmd.dryrun {
+		preview(diff, "DRY RUN", "would", log)
+	} else {
+		preview(diff, "ROLLBACK", "will", log)
+	}
+
+	if err := guard("Rollback", diff, cmd.maxDeletes, 0, log); err != nil && !cmd.dryrun {
+		return err
+	}
+
+	if cmd.dryrun {
+		return nil
+	}
+
+	// ... don't start updating the controllers if the command has been cancelled
+	if err := cmd.ctx.Err(); err != nil {
+		return err
+	}
+
+	rpt, errs := acl.PutACL(u, list, false)
+	for k, v := range rpt {
+		log.Printf("%v  ROLLBACK  unchanged:%v  updated:%v  added:%v  deleted:%v  failed:%v  errors:%v",
+			k,
+			len(v.Unchanged),
+			len(v.Updated),
+			len(v.Added),
+			len(v.Deleted),
+			len(v.Failed),
+			len(v.Errors))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", errs)
+	}
+
+	log.Printf("Restored ACL from %v", uri)
+
+	return nil
+}
+
+func (cmd *Rollback) fetch(uri string) ([]byte, error) {
+	options := FetchOptions{
+		Credentials: cmd.credentials,
+		Profile:     cmd.profile,
+		Region:      cmd.region,
+		RoleARN:     cmd.role.arn,
+		ExternalID:  cmd.role.externalID,
+		RoleTTL:     cmd.role.duration,
+		Endpoint:    cmd.endpoint.url,
+		PathStyle:   cmd.endpoint.pathStyle,
+		HTTPTimeout: cmd.httpTimeout,
+		HTTPUser:    cmd.httpAuth.user,
+		HTTPPasswd:  cmd.httpAuth.password,
+		HTTPBearer:  cmd.httpAuth.bearer,
+		GCSKeyFile:  cmd.gcsCreds,
+		AzureAcct:   cmd.azure.account,
+		AzureKey:    cmd.azure.key,
+		AzureSAS:    cmd.azure.sas,
+		AzureHost:   cmd.azure.endpoint,
+		SSHKey:      cmd.sftp.key,
+		KnownHosts:  cmd.sftp.knownHosts,
+		Retries:     cmd.retry.retries,
+		RetryDelay:  cmd.retry.delay,
+		Log:         cmd.retry.log,
+	}
+
+	return fetch(cmd.ctx, uri, options)
+}
@@ -0,0 +1,251 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const SSH_KEY_PASSPHRASE = "SSH_KEY_PASSPHRASE"
+
+// Credentials for sftp://user@host/path URLs i.e. the (optional) SSH private key file and the known_hosts file used
+// to verify the server host key (defaults to ~/.ssh/known_hosts). A password in the URL is used if there is no key
+// (or the server rejects the key) and the passphrase for an encrypted key is taken from the SSH_KEY_PASSPHRASE
+// environment variable.
+type sftpAuth struct {
+	key        string
+	knownHosts string
+}
+
+func (a sftpAuth) knownHostsFile() (string, error) {
+	if a.knownHosts != "" {
+		return a.knownHosts, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("Unable to locate SSH known_hosts file (%w)", err)
+	}
+
+	return filepath.Join(home, ".ssh", "known_hosts"), nil
+}
+
+func (a sftpAuth) methods(u *url.URL) ([]ssh.AuthMethod, error) {
+	methods := []ssh.AuthMethod{}
+
+	if a.key != "" {
+		bytes, err := ioutil.ReadFile(a.key)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading SSH key %v (%w)", a.key, err)
+		}
+
+		signer, err := ssh.ParsePrivateKey(bytes)
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) {
+			passphrase := os.Getenv(SSH_KEY_PASSPHRASE)
+			if passphrase == "" {
+				return nil, fmt.Errorf("SSH key %v is encrypted (passphrase not set in %v)", a.key, SSH_KEY_PASSPHRASE)
+			}
+
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(bytes, []byte(passphrase))
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid SSH key %v (%w)", a.key, err)
+		}
+
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+
+	if password, ok := u.User.Password(); ok {
+		methods = append(methods, ssh.Password(password))
+	}
+
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("sftp:// URLs require an SSH key (--ssh-key) or a password in the URL")
+	}
+
+	return methods, nil
+}
+
+// Opens an SFTP session to the URL host, verifying the server host key against the known_hosts file. Host key
+// mismatches and unknown hosts are returned as ErrHostKeyMismatch and ErrUnknownHost (and are not retried), while
+// everything else is returned as a connection error.
+func (a sftpAuth) connect(ctx context.Context, u *url.URL, timeout time.Duration) (*sftp.Client, error) {
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "22")
+	}
+
+	user := u.User.Username()
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+
+	methods, err := a.methods(u)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := a.knownHostsFile()
+	if err != nil {
+		return nil, err
+	}
+
+	callback, err := knownhosts.New(file)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading SSH known_hosts file %v (%w)", file, err)
+	}
+
+	var hostkey error
+
+	config := ssh.ClientConfig{
+		User:    user,
+		Auth:    methods,
+		Timeout: timeout,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			var keyerr *knownhosts.KeyError
+
+			err := callback(hostname, remote, key)
+			if errors.As(err, &keyerr) && len(keyerr.Want) > 0 {
+				hostkey = fmt.Errorf("%w for %v (%v key %v does not match the key in %v)", ErrHostKeyMismatch, hostname, key.Type(), ssh.FingerprintSHA256(key), file)
+			} else if errors.As(err, &keyerr) {
+				hostkey = fmt.Errorf("%w %v (no %v host key in %v)", ErrUnknownHost, hostname, key.Type(), file)
+			} else {
+				hostkey = err
+			}
+
+			return hostkey
+		},
+	}
+
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, fmt.Errorf("SFTP connection to %v failed (%w)", host, err)
+	}
+
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, host, &config)
+	if err != nil {
+		conn.Close()
+		if hostkey != nil {
+			return nil, hostkey
+		}
+
+		return nil, fmt.Errorf("SFTP connection to %v failed (%w)", host, err)
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	client, err := sftp.NewClient(ssh.NewClient(c, chans, reqs))
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("SFTP connection to %v failed (%w)", host, err)
+	}
+
+	return client, nil
+}
+
+// Returns the remote file path for an sftp:// URL. Paths are absolute unless the path starts with /~/, which is
+// relative to the login directory (as for the sftp command line client).
+func sftpPath(uri string) (*url.URL, string, error) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "sftp" || u.Hostname() == "" {
+		return nil, "", fmt.Errorf("Invalid SFTP URI (%s)", uri)
+	}
+
+	path := u.Path
+	if strings.HasPrefix(path, "/~/") {
+		path = strings.TrimPrefix(path, "/~/")
+	}
+
+	if path == "" || strings.HasSuffix(path, "/") {
+		return nil, "", fmt.Errorf("Invalid SFTP URI (%s)", uri)
+	}
+
+	return u, path, nil
+}
+
+func fetchSFTP(ctx context.Context, uri string, auth sftpAuth, timeout time.Duration, retry retryPolicy) ([]byte, error) {
+	u, path, err := sftpPath(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	var b []byte
+
+	err = retry.do(ctx, fmt.Sprintf("GET %v", uri), func() error {
+		client, err := auth.connect(ctx, u, timeout)
+		if err != nil {
+			return err
+		}
+
+		defer client.Close()
+
+		f, err := client.Open(path)
+		if err != nil {
+			return fmt.Errorf("Error opening %v (%w)", uri, err)
+		}
+
+		defer f.Close()
+
+		b, err = ioutil.ReadAll(f)
+
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func storeSFTP(ctx context.Context, uri string, auth sftpAuth, r io.Reader, timeout time.Duration, retry retryPolicy) error {
+	u, path, err := sftpPath(uri)
+	if err != nil {
+		return err
+	}
+
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	return retry.do(ctx, fmt.Sprintf("PUT %v", uri), func() error {
+		client, err := auth.connect(ctx, u, timeout)
+		if err != nil {
+			return err
+		}
+
+		defer client.Close()
+
+		f, err := client.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		if err != nil {
+			return fmt.Errorf("Error creating %v (%w)", uri, err)
+		}
+
+		if _, err := f.Write(body); err != nil {
+			f.Close()
+			return fmt.Errorf("Error writing %v (%w)", uri, err)
+		}
+
+		return f.Close()
+	})
+}
@@ -0,0 +1,226 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const SMTP_PASSWORD = "UHPPOTED_SMTP_PASSWORD"
+
+// SMTP delivery of the compare-acl report. Without --smtp-tls the connection is upgraded with STARTTLS if the server
+// supports it. The password is taken from the UHPPOTED_SMTP_PASSWORD environment variable if not supplied on the
+// command line.
+type smtpOptions struct {
+	host     string
+	port     int
+	from     string
+	to       stringList
+	user     string
+	password string
+	tls      bool
+	attach   bool
+}
+
+func (o *smtpOptions) validate() error {
+	if o.host == "" {
+		if len(o.to) > 0 || o.from != "" {
+			return fmt.Errorf("--smtp-to and --smtp-from require --smtp-host")
+		}
+
+		return nil
+	}
+
+	if len(o.to) == 0 {
+		return fmt.Errorf("--smtp-host requires at least one --smtp-to recipient")
+	}
+
+	if o.from == "" {
+		return fmt.Errorf("--smtp-host requires an --smtp-from address")
+	}
+
+	if o.password == "" {
+		o.password = os.Getenv(SMTP_PASSWORD)
+	}
+
+	if o.port == 0 {
+		o.port = 25
+		if o.tls {
+			o.port = 465
+		}
+	}
+
+	return nil
+}
+
+func (o smtpOptions) address() string {
+	return net.JoinHostPort(o.host, strconv.Itoa(o.port))
+}
+
+// Emails the report (as the message body, in HTML for HTML reports) to the --smtp-to recipients, with the (optional)
+// signed report file as an attachment.
+func sendReport(ctx context.Context, o smtpOptions, subject string, body []byte, html bool, filename string, archive []byte, timeout time.Duration, retry retryPolicy) error {
+	message, err := makeMessage(o, subject, body, html, filename, archive)
+	if err != nil {
+		return err
+	}
+
+	return retry.do(ctx, fmt.Sprintf("SMTP %v", o.address()), func() error {
+		return sendMail(ctx, o, message, timeout)
+	})
+}
+
+func sendMail(ctx context.Context, o smtpOptions, message []byte, timeout time.Duration) error {
+	config := getClientTLS()
+	if config == nil {
+		config = &tls.Config{}
+	}
+
+	config.ServerName = o.host
+
+	dialer := net.Dialer{Timeout: DEFAULT_DIAL_TIMEOUT}
+	conn, err := dialer.DialContext(ctx, "tcp", o.address())
+	if err != nil {
+		return fmt.Errorf("SMTP connection to %v failed (%w)", o.address(), err)
+	}
+
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	if o.tls {
+		conn = tls.Client(conn, config)
+	}
+
+	c, err := smtp.NewClient(conn, o.host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("SMTP connection to %v failed (%w)", o.address(), err)
+	}
+
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok && !o.tls {
+		if err := c.StartTLS(config); err != nil {
+			return fmt.Errorf("SMTP STARTTLS with %v failed (%w)", o.address(), err)
+		}
+	}
+
+	if o.user != "" {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return fmt.Errorf("SMTP authentication failed for %v (server does not support authentication)", o.user)
+		}
+
+		if err := c.Auth(smtp.PlainAuth("", o.user, o.password, o.host)); err != nil {
+			return fmt.Errorf("SMTP authentication failed for %v (%w)", o.user, err)
+		}
+	}
+
+	if err := c.Mail(o.from); err != nil {
+		return fmt.Errorf("SMTP server rejected sender %v (%w)", o.from, err)
+	}
+
+	for _, to := range o.to {
+		if err := c.Rcpt(to); err != nil {
+			return fmt.Errorf("SMTP server rejected recipient %v (%w)", to, err)
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(message); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+func makeMessage(o smtpOptions, subject string, body []byte, html bool, filename string, archive []byte) ([]byte, error) {
+	var b bytes.Buffer
+
+	contentType := "text/plain; charset=utf-8"
+	if html {
+		contentType = "text/html; charset=utf-8"
+	}
+
+	fmt.Fprintf(&b, "From: %v\r\n", o.from)
+	fmt.Fprintf(&b, "To: %v\r\n", strings.Join(o.to, ", "))
+	fmt.Fprintf(&b, "Subject: %v\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\n")
+
+	if archive == nil {
+		fmt.Fprintf(&b, "Content-Type: %v\r\n", contentType)
+		fmt.Fprintf(&b, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+		w := quotedprintable.NewWriter(&b)
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		} else if err := w.Close(); err != nil {
+			return nil, err
+		}
+
+		return b.Bytes(), nil
+	}
+
+	m := multipart.NewWriter(&b)
+
+	fmt.Fprintf(&b, "Content-Type: multipart/mixed; boundary=%v\r\n\r\n", m.Boundary())
+
+	part, err := m.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	w := quotedprintable.NewWriter(part)
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	} else if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	attachment, err := m.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"application/octet-stream"},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": filename})},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(archive)
+	for len(encoded) > 76 {
+		fmt.Fprintf(attachment, "%v\r\n", encoded[:76])
+		encoded = encoded[76:]
+	}
+
+	fmt.Fprintf(attachment, "%v\r\n", encoded)
+
+	if err := m.Close(); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
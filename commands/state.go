@@ -0,0 +1,82 @@
+package commands
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/uhppoted/uhppote-core/types"
+	"github.com/uhppoted/uhppoted-lib/acl"
+)
+
+func loadState(file string) (acl.ACL, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	state := acl.ACL{}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+func saveState(file string, current acl.ACL) error {
+	b, err := json.MarshalIndent(current, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeAtomic(file, b, 0660)
+}
+
+// Cards are compared on their printable representation because the dates restored from the
+// state file don't necessarily have the same time.Location as the dates retrieved from a
+// controller.
+func controllerChanges(previous, current acl.ACL) map[uint32]acl.Diff {
+	changes := map[uint32]acl.Diff{}
+
+	for device, cards := range current {
+		before, ok := previous[device]
+		if !ok {
+			continue
+		}
+
+		diff := acl.Diff{
+			Updated: []types.Card{},
+			Added:   []types.Card{},
+			Deleted: []types.Card{},
+		}
+
+		for k, card := range cards {
+			if c, ok := before[k]; !ok {
+				diff.Added = append(diff.Added, card)
+			} else if c.String() != card.String() {
+				diff.Updated = append(diff.Updated, card)
+			}
+		}
+
+		for k, card := range before {
+			if _, ok := cards[k]; !ok {
+				diff.Deleted = append(diff.Deleted, card)
+			}
+		}
+
+		for _, list := range [][]types.Card{diff.Added, diff.Updated, diff.Deleted} {
+			sort.Slice(list, func(i, j int) bool { return list[i].CardNumber < list[j].CardNumber })
+		}
+
+		if diff.HasChanges() {
+			changes[device] = diff
+		}
+	}
+
+	return changes
+}
@@ -2,6 +2,7 @@ package commands
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"io"
@@ -9,11 +10,12 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/uhppoted/uhppote-core/uhppote"
+	"github.com/uhppoted/uhppoted-app-s3/auth"
 	"github.com/uhppoted/uhppoted-lib/acl"
 	"github.com/uhppoted/uhppoted-lib/config"
-	"github.com/uhppoted/uhppoted-lib/eventlog"
 )
 
 var StoreACLCmd = StoreACL{
@@ -22,24 +24,61 @@ var StoreACLCmd = StoreACL{
 	credentials: DEFAULT_CREDENTIALS,
 	profile:     DEFAULT_PROFILE,
 	region:      DEFAULT_REGION,
+	role:        awsRole{duration: DEFAULT_ROLE_DURATION},
+	multipart:   s3Multipart{partSize: DEFAULT_PART_SIZE, concurrency: DEFAULT_UPLOAD_CONCURRENCY},
+	httpTimeout: DEFAULT_HTTP_TIMEOUT,
+	retry:       retryPolicy{retries: DEFAULT_RETRIES, delay: DEFAULT_RETRY_DELAY},
+	concurrency: 1,
 	logFile:     DEFAULT_LOGFILE,
 	logFileSize: DEFAULT_LOGFILESIZE,
+	logFormat:   DEFAULT_LOG_FORMAT,
+	logMaxFiles: DEFAULT_LOG_MAX_FILES,
+	logMaxAge:   DEFAULT_LOG_MAX_AGE,
+	dryrun:      false,
 	nolog:       false,
 	debug:       false,
 }
 
 type StoreACL struct {
 	url         string
+	output      string
 	config      string
 	keyfile     string
+	encryptTo   string
+	passphrase  string
+	cert        string
 	credentials string
+	gcsCreds    string
+	azure       azureAuth
+	sftp        sftpAuth
 	profile     string
 	region      string
+	role        awsRole
+	endpoint    s3Endpoint
+	proxy       string
+	httpTimeout time.Duration
+	httpAuth    httpAuth
+	httpTLS     httpTLS
+	retry       retryPolicy
+	encryption  s3Encryption
+	multipart   s3Multipart
+	tags        s3Tags
+	cacheCtrl   string
+	archive     string
+	compression string
 	logFile     string
 	logFileSize int
+	logFormat   string
+	logMaxFiles int
+	logMaxAge   int
 	nosign      bool
+	dryrun      bool
+	readback    bool
+	canonical   bool
+	concurrency int
 	nolog       bool
 	debug       bool
+	ctx         context.Context
 }
 
 func (cmd *StoreACL) Name() string {
@@ -50,12 +89,53 @@ func (cmd *StoreACL) FlagSet() *flag.FlagSet {
 	flagset := flag.NewFlagSet("store-acl", flag.ExitOnError)
 
 	flagset.StringVar(&cmd.url, "url", cmd.url, "URL for a 'PUT' request to upload the retrieved ACL file")
-	flagset.StringVar(&cmd.credentials, "credentials", cmd.credentials, "AWS credentials file")
+	flagset.StringVar(&cmd.output, "output", cmd.output, "Writes the signed ACL file to stdout ('-') rather than uploading it to the --url (log messages are written to stderr with --no-log)")
+	flagset.StringVar(&cmd.archive, "archive", cmd.archive, "Archive format for the uploaded ACL file ('tar.gz' or 'zip'). Defaults to zip if the URL ends with .zip and tar.gz otherwise")
+	flagset.StringVar(&cmd.compression, "compression", cmd.compression, "Compression level for the uploaded archive (0-9, or 'none' for an uncompressed tar or stored zip). Defaults to the gzip default compression level")
+	flagset.StringVar(&cmd.credentials, "credentials", cmd.credentials, "AWS credentials file (or profile://<name> to use the credentials and region for the named profile in the shared AWS config)")
+	flagset.StringVar(&cmd.gcsCreds, "gcs-credentials", cmd.gcsCreds, "Google Cloud service account JSON credentials file for gs:// URLs (defaults to the application default credentials e.g. GOOGLE_APPLICATION_CREDENTIALS)")
+	flagset.StringVar(&cmd.azure.account, "azure-account", cmd.azure.account, "Azure storage account for az:// URLs (defaults to the AZURE_STORAGE_ACCOUNT environment variable)")
+	flagset.StringVar(&cmd.azure.key, "azure-key", cmd.azure.key, "Azure storage account shared key (defaults to the AZURE_STORAGE_KEY environment variable)")
+	flagset.StringVar(&cmd.azure.sas, "azure-sas", cmd.azure.sas, "Azure SAS token for az:// and blob.core.windows.net URLs (defaults to the AZURE_STORAGE_SAS_TOKEN environment variable)")
+	flagset.StringVar(&cmd.azure.connection, "azure-connection-string", cmd.azure.connection, "Azure storage connection string (defaults to the AZURE_STORAGE_CONNECTION_STRING environment variable)")
+	flagset.StringVar(&cmd.sftp.key, "ssh-key", cmd.sftp.key, "SSH private key file for sftp:// URLs (the passphrase for an encrypted key is taken from the SSH_KEY_PASSPHRASE environment variable)")
+	flagset.StringVar(&cmd.sftp.knownHosts, "known-hosts", cmd.sftp.knownHosts, "SSH known_hosts file used to verify the SFTP server host key (defaults to ~/.ssh/known_hosts)")
 	flagset.StringVar(&cmd.profile, "profile", cmd.profile, "AWS credentials file profile (defaults to 'default')")
 	flagset.StringVar(&cmd.region, "region", cmd.region, "AWS region for S3 (defaults to us-east-1)")
-	flagset.StringVar(&cmd.keyfile, "key", cmd.keyfile, "RSA signing key")
+	flagset.StringVar(&cmd.role.arn, "role-arn", cmd.role.arn, "ARN of an IAM role to assume (using STS AssumeRole) for S3 access e.g. for cross-account access")
+	flagset.StringVar(&cmd.role.externalID, "external-id", cmd.role.externalID, "External ID for assuming the --role-arn role")
+	flagset.DurationVar(&cmd.role.duration, "role-duration", cmd.role.duration, "Session duration for the assumed --role-arn role (credentials are refreshed automatically when they expire)")
+	flagset.StringVar(&cmd.endpoint.url, "endpoint", cmd.endpoint.url, "Custom S3 endpoint URL for S3 compatible stores e.g. http://minio.local:9000 (defaults to AWS S3)")
+	flagset.BoolVar(&cmd.endpoint.pathStyle, "path-style", cmd.endpoint.pathStyle, "Uses path-style (http://host/bucket/key) rather than virtual-hosted style S3 addressing (e.g. for MinIO)")
+	flagset.StringVar(&cmd.proxy, "proxy", cmd.proxy, "HTTP proxy URL for HTTP and S3 requests (overrides the HTTP_PROXY and HTTPS_PROXY environment variables, NO_PROXY still applies)")
+	flagset.DurationVar(&cmd.httpTimeout, "http-timeout", cmd.httpTimeout, "Timeout for HTTP requests, including reading the response body (0 for no timeout)")
+	flagset.StringVar(&cmd.httpAuth.user, "http-user", cmd.httpAuth.user, "User name for HTTP basic auth (defaults to the UHPPOTED_HTTP_USER environment variable)")
+	flagset.StringVar(&cmd.httpAuth.password, "http-password", cmd.httpAuth.password, "Password for HTTP basic auth (defaults to the UHPPOTED_HTTP_PASSWORD environment variable)")
+	flagset.StringVar(&cmd.httpAuth.bearer, "http-bearer", cmd.httpAuth.bearer, "Bearer token for HTTP requests (defaults to the UHPPOTED_HTTP_BEARER environment variable)")
+	flagset.StringVar(&cmd.httpTLS.cert, "client-cert", cmd.httpTLS.cert, "PEM client certificate file for mutual TLS with https:// servers")
+	flagset.StringVar(&cmd.httpTLS.key, "client-key", cmd.httpTLS.key, "PEM private key file for the --client-cert client certificate")
+	flagset.StringVar(&cmd.httpTLS.ca, "ca-cert", cmd.httpTLS.ca, "PEM CA certificates file for verifying https:// server certificates (defaults to the system CA certificates)")
+	flagset.IntVar(&cmd.retry.retries, "retries", cmd.retry.retries, "Number of times to retry an S3 or HTTP request after a transient failure (5xx response, connection reset or timeout)")
+	flagset.DurationVar(&cmd.retry.delay, "retry-delay", cmd.retry.delay, "Delay before the first retry of a failed S3 or HTTP request, doubling (with jitter) for each subsequent retry")
+	flagset.StringVar(&cmd.encryption.sse, "sse", cmd.encryption.sse, "Server-side encryption for uploaded S3 objects ('AES256' or 'aws:kms')")
+	flagset.StringVar(&cmd.encryption.kmsKeyID, "sse-kms-key-id", cmd.encryption.kmsKeyID, "KMS key ID for 'aws:kms' server-side encryption (defaults to the AWS managed key)")
+	flagset.IntVar(&cmd.multipart.partSize, "part-size", cmd.multipart.partSize, "Part size (in MiB) for multipart S3 uploads. Smaller files are uploaded with a single PUT request")
+	flagset.IntVar(&cmd.multipart.concurrency, "upload-concurrency", cmd.multipart.concurrency, "Number of parts of a multipart S3 upload to upload concurrently")
+	flagset.Var(&cmd.tags, "tag", "S3 object tag (key=value) for uploaded S3 objects (may be repeated, up to 10 tags)")
+	flagset.StringVar(&cmd.cacheCtrl, "cache-control", cmd.cacheCtrl, "Cache-Control header for uploaded S3 objects e.g. 'no-cache' or 'max-age=300'")
+	flagset.StringVar(&cmd.keyfile, "key", cmd.keyfile, "RSA or ed25519 signing key (or a comma separated list of keys to attach multiple signatures e.g. during key rotation)")
+	flagset.StringVar(&cmd.passphrase, "key-passphrase", cmd.passphrase, "Passphrase for an encrypted signing key (defaults to the UHPPOTED_KEY_PASSPHRASE environment variable)")
+	flagset.StringVar(&cmd.encryptTo, "encrypt-to", cmd.encryptTo, "RSA public key file of the recipient for encrypting the signed ACL file (decrypted with --decrypt-key by load-acl, compare-acl, rollback and inspect)")
+	flagset.StringVar(&cmd.cert, "cert", cmd.cert, "PEM file with the signing key certificate chain to include in the uploaded file")
 	flagset.BoolVar(&cmd.nosign, "no-sign", cmd.nosign, "Does not sign the generated report")
+	flagset.BoolVar(&cmd.dryrun, "dry-run", cmd.dryrun, "Retrieves the ACL from the controllers and creates the ACL file without uploading it")
+	flagset.BoolVar(&cmd.readback, "verify-upload", cmd.readback, "Re-downloads the uploaded ACL file and verifies that it matches the file that was sent")
+	flagset.BoolVar(&cmd.canonical, "canonicalize", cmd.canonical, "Signs the canonical form (LF line endings, no trailing whitespace) of the ACL file (adds a 'version' entry to the uploaded file)")
+	flagset.IntVar(&cmd.concurrency, "concurrency", cmd.concurrency, "Maximum number of controllers to retrieve the ACL from concurrently (defaults to 1, 0 for all the controllers at once)")
 	flagset.BoolVar(&cmd.nolog, "no-log", cmd.nolog, "Writes log messages to stdout rather than a rotatable log file")
+	flagset.StringVar(&cmd.logFormat, "log-format", cmd.logFormat, "Log message format ('text' or 'json' i.e. one JSON object per log message)")
+	flagset.IntVar(&cmd.logMaxFiles, "log-max-files", cmd.logMaxFiles, "Maximum number of rotated log files to retain (0 for no limit)")
+	flagset.IntVar(&cmd.logMaxAge, "log-max-age", cmd.logMaxAge, "Maximum age (in days) of rotated log files to retain (0 for no limit)")
 
 	return flagset
 }
@@ -70,9 +150,10 @@ func (cmd *StoreACL) Usage() string {
 
 func (cmd *StoreACL) Help() {
 	fmt.Println()
-	fmt.Printf("  Usage: %s [--debug] [--config <file>] store-acl --url <URL> [--credentials <file>] [--profile <file>] [--region <region>] [--key <file>] [--no-log] [--no-sign]\n", APP)
+	fmt.Printf("  Usage: %s [--debug] [--config <file>] store-acl --url <URL>|--output - [--credentials <file>] [--gcs-credentials <file>] [--azure-account <account>] [--azure-key <key>] [--azure-sas <token>] [--azure-connection-string <string>] [--ssh-key <file>] [--known-hosts <file>] [--profile <file>] [--region <region>] [--role-arn <ARN>] [--external-id <ID>] [--role-duration <duration>] [--endpoint <URL>] [--path-style] [--proxy <URL>] [--http-timeout <duration>] [--http-user <user>] [--http-password <password>] [--http-bearer <token>] [--client-cert <file>] [--client-key <file>] [--ca-cert <file>] [--retries <N>] [--retry-delay <duration>] [--archive tar.gz|zip] [--compression 0-9|none] [--sse AES256|aws:kms] [--sse-kms-key-id <key>] [--part-size <MiB>] [--upload-concurrency <N>] [--tag <key=value>] [--cache-control <value>] [--key <file>] [--key-passphrase <passphrase>] [--encrypt-to <file>] [--cert <file>] [--verify-upload] [--canonicalize] [--concurrency <N>] [--no-log] [--log-format text|json] [--log-max-files <N>] [--log-max-age <days>] [--no-sign] [--dry-run]\n", APP)
 	fmt.Println()
 	fmt.Println("    Retrieves the ACL from the controllers configured in the configuration file and stores it to the provided URL")
+	fmt.Println("    (or writes it to stdout with --output -)")
 	fmt.Println()
 
 	helpOptions(cmd.FlagSet())
@@ -80,8 +161,21 @@ func (cmd *StoreACL) Help() {
 }
 
 func (cmd *StoreACL) Execute(args ...interface{}) error {
-	//	ctx := args[0].(context.Context)
-	if strings.TrimSpace(cmd.url) == "" {
+	cmd.ctx = args[0].(*Options).ctx()
+
+	if err := setProxy(cmd.proxy); err != nil {
+		return err
+	}
+
+	if err := setClientTLS(cmd.httpTLS); err != nil {
+		return err
+	}
+
+	if cmd.output != "" && cmd.output != "-" {
+		return fmt.Errorf("Invalid --output '%v' (expected '-' for stdout)", cmd.output)
+	}
+
+	if strings.TrimSpace(cmd.url) == "" && cmd.output != "-" {
 		return fmt.Errorf("store-acl requires a pre-signed S3 URL in the command options")
 	}
 
@@ -90,6 +184,22 @@ func (cmd *StoreACL) Execute(args ...interface{}) error {
 		return fmt.Errorf("Invalid upload URL '%s' (%w)", cmd.url, err)
 	}
 
+	if err := cmd.encryption.validate(); err != nil {
+		return err
+	}
+
+	if err := cmd.multipart.validate(); err != nil {
+		return err
+	}
+
+	if err := cmd.tags.validate(); err != nil {
+		return err
+	}
+
+	if _, err := archiver(cmd.archive, "", cmd.compression); err != nil {
+		return err
+	}
+
 	conf := config.NewConfig()
 	if err := conf.Load(cmd.config); err != nil {
 		return fmt.Errorf("WARN  Could not load configuration (%v)", err)
@@ -103,29 +213,48 @@ func (cmd *StoreACL) Execute(args ...interface{}) error {
 		cmd.profile = conf.AWS.Profile
 	}
 
-	if cmd.region == "" {
+	if cmd.region == "" && !isProfileURI(cmd.credentials) {
 		cmd.region = conf.AWS.Region
 	}
 
 	u, devices := getDevices(conf, cmd.debug)
 
-	var logger *log.Logger
-	if !cmd.nolog {
-		events := eventlog.Ticker{Filename: cmd.logFile, MaxSize: cmd.logFileSize}
-		logger = log.New(&events, "", log.Ldate|log.Ltime|log.LUTC)
-	} else {
-		logger = log.New(os.Stdout, "ACL ", log.LstdFlags|log.LUTC|log.Lmsgprefix)
+	if err := cmd.httpAuth.resolve(); err != nil {
+		return err
+	}
+
+	if err := cmd.azure.resolve(); err != nil {
+		return err
 	}
 
-	return cmd.execute(u, uri.String(), devices, logger)
+	// ... keeps stdout clean for the ACL file
+	var console io.Writer = os.Stdout
+	if cmd.output == "-" {
+		console = os.Stderr
+	}
+
+	logger, err := newLogger(cmd.Name(), cmd.logFile, cmd.logFileSize, cmd.logMaxFiles, cmd.logMaxAge, cmd.nolog, cmd.logFormat, console)
+	if err != nil {
+		return err
+	}
+
+	cmd.retry.log = logger
+
+	return aborted("store-acl", cmd.execute(u, uri.String(), devices, logger), logger)
 }
 
 func (cmd *StoreACL) execute(u uhppote.IUHPPOTE, uri string, devices []uhppote.Device, log *log.Logger) error {
-	log.Printf("Storing ACL to %v", uri)
+	if cmd.output == "-" {
+		log.Printf("Writing ACL to stdout")
+	} else {
+		log.Printf("Storing ACL to %v", uri)
+	}
 
-	list, errors := acl.GetACL(u, devices)
-	if len(errors) > 0 {
-		return fmt.Errorf("%v", errors)
+	list, errors, _, err := getACL(cmd.ctx, u, devices, cmd.concurrency)
+	if err != nil {
+		return err
+	} else if len(errors) > 0 {
+		return fmt.Errorf("%w %v", ErrUnreachable, errors)
 	}
 
 	for k, l := range list {
@@ -142,17 +271,34 @@ func (cmd *StoreACL) execute(u uhppote.IUHPPOTE, uri string, devices []uhppote.D
 	files["uhppoted.acl"] = tsv
 
 	if !cmd.nosign {
-		signature, err := sign(tsv, cmd.keyfile)
+		if cmd.canonical {
+			files["version"] = []byte(fmt.Sprintf("%v\n", CANONICAL_VERSION))
+		}
+
+		files[TIMESTAMP_FILE] = signingTimestamp(time.Now())
+
+		signatures, err := sign(signable(files, tsv), cmd.keyfile, cmd.passphrase)
 		if err != nil {
 			return err
 		}
-		files["signature"] = signature
+		for k, v := range signatures {
+			files[k] = v
+		}
+
+		if cmd.cert != "" {
+			chain, err := loadCertificateChain(cmd.cert)
+			if err != nil {
+				return err
+			}
+
+			files["certificate"] = chain
+		}
 	}
 
 	var b bytes.Buffer
-	x := targz
-	if strings.HasSuffix(uri, ".zip") {
-		x = zipf
+	x, err := archiver(cmd.archive, uri, cmd.compression)
+	if err != nil {
+		return err
 	}
 
 	if err := x(files, &b); err != nil {
@@ -161,30 +307,110 @@ func (cmd *StoreACL) execute(u uhppote.IUHPPOTE, uri string, devices []uhppote.D
 
 	log.Printf("tar'd ACL (%v bytes) and signature (%v bytes): %v bytes", len(files["uhppoted.acl"]), len(files["signature"]), b.Len())
 
-	f := cmd.storeHTTP
-	if strings.HasPrefix(uri, "s3://") {
-		f = cmd.storeS3
-	} else if strings.HasPrefix(uri, "file://") {
-		f = cmd.storeFile
+	if cmd.encryptTo != "" {
+		encrypted, err := auth.Encrypt(b.Bytes(), cmd.encryptTo)
+		if err != nil {
+			return err
+		}
+
+		b.Reset()
+		b.Write(encrypted)
+
+		log.Printf("Encrypted ACL file for %v (%v bytes)", cmd.encryptTo, b.Len())
 	}
 
-	if err := f(uri, bytes.NewReader(b.Bytes())); err != nil {
+	if cmd.output == "-" {
+		if _, err := os.Stdout.Write(b.Bytes()); err != nil {
+			return err
+		}
+
+		log.Printf("Wrote ACL file (%v bytes) to stdout", b.Len())
+		return nil
+	}
+
+	if cmd.dryrun {
+		log.Printf("DRY RUN  ACL file (%v bytes) not uploaded to %v", b.Len(), uri)
+		return nil
+	}
+
+	if err := cmd.store(uri, bytes.NewReader(b.Bytes())); err != nil {
 		return err
 	}
 
 	log.Printf("Stored ACL to %v", uri)
 
+	if cmd.readback {
+		if err := verifyUpload(uri, b.Bytes(), cmd.fetch); err != nil {
+			log.Printf("ERROR %v", err)
+			return err
+		}
+
+		log.Printf("Verified uploaded ACL %v", uri)
+	}
+
 	return nil
 }
 
-func (cmd *StoreACL) storeHTTP(url string, r io.Reader) error {
-	return storeHTTP(url, r)
-}
+func (cmd *StoreACL) fetch(uri string) ([]byte, error) {
+	options := FetchOptions{
+		Credentials: cmd.credentials,
+		Profile:     cmd.profile,
+		Region:      cmd.region,
+		RoleARN:     cmd.role.arn,
+		ExternalID:  cmd.role.externalID,
+		RoleTTL:     cmd.role.duration,
+		Endpoint:    cmd.endpoint.url,
+		PathStyle:   cmd.endpoint.pathStyle,
+		HTTPTimeout: cmd.httpTimeout,
+		HTTPUser:    cmd.httpAuth.user,
+		HTTPPasswd:  cmd.httpAuth.password,
+		HTTPBearer:  cmd.httpAuth.bearer,
+		GCSKeyFile:  cmd.gcsCreds,
+		AzureAcct:   cmd.azure.account,
+		AzureKey:    cmd.azure.key,
+		AzureSAS:    cmd.azure.sas,
+		AzureHost:   cmd.azure.endpoint,
+		SSHKey:      cmd.sftp.key,
+		KnownHosts:  cmd.sftp.knownHosts,
+		Retries:     cmd.retry.retries,
+		RetryDelay:  cmd.retry.delay,
+		Log:         cmd.retry.log,
+	}
 
-func (cmd *StoreACL) storeS3(uri string, r io.Reader) error {
-	return storeS3(uri, cmd.credentials, cmd.profile, cmd.region, r)
+	return fetch(cmd.ctx, uri, options)
 }
 
-func (cmd *StoreACL) storeFile(url string, r io.Reader) error {
-	return storeFile(url, r)
+func (cmd *StoreACL) store(uri string, r io.Reader) error {
+	options := StoreOptions{
+		Credentials: cmd.credentials,
+		Profile:     cmd.profile,
+		Region:      cmd.region,
+		RoleARN:     cmd.role.arn,
+		ExternalID:  cmd.role.externalID,
+		RoleTTL:     cmd.role.duration,
+		Endpoint:    cmd.endpoint.url,
+		PathStyle:   cmd.endpoint.pathStyle,
+		SSE:         cmd.encryption.sse,
+		SSEKMSKeyID: cmd.encryption.kmsKeyID,
+		PartSize:    cmd.multipart.partSize,
+		Concurrency: cmd.multipart.concurrency,
+		Tags:        cmd.tags,
+		CacheCtrl:   cmd.cacheCtrl,
+		HTTPTimeout: cmd.httpTimeout,
+		HTTPUser:    cmd.httpAuth.user,
+		HTTPPasswd:  cmd.httpAuth.password,
+		HTTPBearer:  cmd.httpAuth.bearer,
+		GCSKeyFile:  cmd.gcsCreds,
+		AzureAcct:   cmd.azure.account,
+		AzureKey:    cmd.azure.key,
+		AzureSAS:    cmd.azure.sas,
+		AzureHost:   cmd.azure.endpoint,
+		SSHKey:      cmd.sftp.key,
+		KnownHosts:  cmd.sftp.knownHosts,
+		Retries:     cmd.retry.retries,
+		RetryDelay:  cmd.retry.delay,
+		Log:         cmd.retry.log,
+	}
+
+	return store(cmd.ctx, uri, r, options)
 }
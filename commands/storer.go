@@ -0,0 +1,160 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storer uploads a file (report or ACL) to a destination URL. Destinations are selected by URL scheme from the
+// registered storers, which by default are 's3', 'gs', 'az', 'sftp', 'http', 'https' and 'file'. A wrapper binary can add a custom
+// destination (e.g. a message bus) by registering a Storer for its own URL scheme with RegisterStorer before
+// executing a command.
+type Storer interface {
+	Store(ctx context.Context, uri string, r io.Reader) error
+}
+
+// StorerFunc adapts an ordinary function to the Storer interface.
+type StorerFunc func(ctx context.Context, uri string, r io.Reader) error
+
+// StorerFactory creates the Storer for a command invocation from the command's StoreOptions. Storers ignore the
+// options that do not apply to their destination.
+type StorerFactory func(options StoreOptions) Storer
+
+// StoreOptions are the upload settings of the invoking command.
+type StoreOptions struct {
+	Credentials string        // AWS credentials file (or profile:// URI)
+	Profile     string        // AWS credentials profile
+	Region      string        // AWS region
+	Fallback    string        // comma separated list of fallback AWS regions for S3 buckets
+	RoleARN     string        // IAM role to assume for S3 uploads
+	ExternalID  string        // external ID for the assumed IAM role
+	RoleTTL     time.Duration // assumed IAM role session duration
+	Endpoint    string        // S3 compatible endpoint URL
+	PathStyle   bool          // path-style S3 addressing
+	SSE         string        // S3 server-side encryption (AES256 or aws:kms)
+	SSEKMSKeyID string        // KMS key ID for aws:kms server-side encryption
+	PartSize    int           // S3 multipart upload part size (MiB)
+	Concurrency int           // S3 multipart upload concurrency
+	Tags        []string      // S3 object tags (key=value)
+	CacheCtrl   string        // Cache-Control header for the uploaded object
+	HTTPTimeout time.Duration // HTTP, Azure and SFTP connection timeout
+	HTTPUser    string        // HTTP basic auth user
+	HTTPPasswd  string        // HTTP basic auth password
+	HTTPBearer  string        // HTTP bearer token
+	GCSKeyFile  string        // GCS service account credentials file
+	AzureAcct   string        // Azure Blob Storage account
+	AzureKey    string        // Azure Blob Storage shared key
+	AzureSAS    string        // Azure Blob Storage SAS token
+	AzureHost   string        // Azure Blob Storage endpoint host
+	SSHKey      string        // SFTP private key file
+	KnownHosts  string        // SFTP known_hosts file
+	Retries     int           // retries for transient failures
+	RetryDelay  time.Duration // initial delay between retries
+	Log         *log.Logger   // logger for retries
+}
+
+func (o StoreOptions) retry() retryPolicy {
+	return retryPolicy{
+		retries: o.Retries,
+		delay:   o.RetryDelay,
+		log:     o.Log,
+	}
+}
+
+func (o StoreOptions) sftp() sftpAuth {
+	return sftpAuth{
+		key:        o.SSHKey,
+		knownHosts: o.KnownHosts,
+	}
+}
+
+func (o StoreOptions) azure() azureAuth {
+	return azureAuth{
+		account:  o.AzureAcct,
+		key:      o.AzureKey,
+		sas:      o.AzureSAS,
+		endpoint: o.AzureHost,
+	}
+}
+
+var storers = struct {
+	sync.RWMutex
+	factories map[string]StorerFactory
+}{
+	factories: map[string]StorerFactory{
+		"s3": func(options StoreOptions) Storer {
+			return StorerFunc(func(ctx context.Context, uri string, r io.Reader) error {
+				return storeS3(ctx, uri, options.Credentials, options.Profile, options.Region, options.Fallback, s3Endpoint{options.Endpoint, options.PathStyle}, awsRole{options.RoleARN, options.ExternalID, options.RoleTTL}, s3Encryption{options.SSE, options.SSEKMSKeyID}, s3Multipart{options.PartSize, options.Concurrency}, options.Tags, options.CacheCtrl, r, options.retry())
+			})
+		},
+		"gs": func(options StoreOptions) Storer {
+			return StorerFunc(func(ctx context.Context, uri string, r io.Reader) error {
+				return storeGCS(ctx, uri, options.GCSKeyFile, r, options.retry())
+			})
+		},
+		"az": func(options StoreOptions) Storer {
+			return StorerFunc(func(ctx context.Context, uri string, r io.Reader) error {
+				return storeAzure(ctx, uri, options.azure(), r, options.HTTPTimeout, options.retry())
+			})
+		},
+		"sftp": func(options StoreOptions) Storer {
+			return StorerFunc(func(ctx context.Context, uri string, r io.Reader) error {
+				return storeSFTP(ctx, uri, options.sftp(), r, options.HTTPTimeout, options.retry())
+			})
+		},
+		"http":  httpStorer,
+		"https": httpStorer,
+		"file": func(StoreOptions) Storer {
+			return StorerFunc(func(ctx context.Context, uri string, r io.Reader) error {
+				return storeFile(uri, r)
+			})
+		},
+	},
+}
+
+func httpStorer(options StoreOptions) Storer {
+	return StorerFunc(func(ctx context.Context, uri string, r io.Reader) error {
+		if azure := options.azure(); azure.handles(uri) {
+			return storeAzure(ctx, uri, azure, r, options.HTTPTimeout, options.retry())
+		}
+
+		auth := httpAuth{options.HTTPUser, options.HTTPPasswd, options.HTTPBearer}
+
+		return storeHTTP(ctx, uri, r, options.HTTPTimeout, auth, options.retry())
+	})
+}
+
+func (f StorerFunc) Store(ctx context.Context, uri string, r io.Reader) error {
+	return f(ctx, uri, r)
+}
+
+// Registers the Storer factory for a URL scheme, replacing any existing storer for the scheme.
+func RegisterStorer(scheme string, f StorerFactory) {
+	storers.Lock()
+	defer storers.Unlock()
+
+	storers.factories[strings.ToLower(scheme)] = f
+}
+
+func store(ctx context.Context, uri string, r io.Reader, options StoreOptions) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return fmt.Errorf("Invalid URL '%v' (%w)", uri, err)
+	}
+
+	storers.RLock()
+	f, ok := storers.factories[strings.ToLower(u.Scheme)]
+	storers.RUnlock()
+
+	if !ok || f == nil {
+		return fmt.Errorf("No storer registered for URL scheme '%v' (%v)", u.Scheme, uri)
+	}
+
+	return f(options).Store(ctx, uri, r)
+}
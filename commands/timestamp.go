@@ -0,0 +1,51 @@
+package commands
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Signed ACL files created by store-acl and load-acl --backup include a 'timestamp' entry with the UTC time at which
+// the ACL file was signed. The timestamp is included in the signed manifest (see signable) so that it can't be replaced
+// without invalidating the signature.
+const TIMESTAMP_FILE = "timestamp"
+
+// Allowance for the clock difference between the signing and verifying hosts.
+const MAX_CLOCK_SKEW = 5 * time.Minute
+
+func signingTimestamp(t time.Time) []byte {
+	return []byte(fmt.Sprintf("%v\n", t.UTC().Format(time.RFC3339)))
+}
+
+// Rejects a signed ACL file with a signing timestamp older than --max-age (e.g. an old ACL file replayed by a
+// compromised mirror), or without a signing timestamp. Not checked if --max-age is not set.
+func checkMaxAge(uri string, files map[string][]byte, maxAge time.Duration, log *log.Logger) error {
+	if maxAge <= 0 {
+		return nil
+	}
+
+	b, ok := files[TIMESTAMP_FILE]
+	if !ok {
+		return &VerifyError{fmt.Errorf("%v does not include a signed timestamp (required for --max-age)", uri)}
+	}
+
+	signed, err := time.Parse(time.RFC3339, strings.TrimSpace(string(b)))
+	if err != nil {
+		return &VerifyError{fmt.Errorf("%v has an invalid signed timestamp '%v'", uri, strings.TrimSpace(string(b)))}
+	}
+
+	age := time.Since(signed)
+	if age > maxAge {
+		return &VerifyError{fmt.Errorf("%v was signed at %v, which is older than the --max-age %v", uri, signed.Format(time.RFC3339), maxAge)}
+	}
+
+	if age < -MAX_CLOCK_SKEW {
+		return &VerifyError{fmt.Errorf("%v has a signed timestamp %v in the future", uri, signed.Format(time.RFC3339))}
+	}
+
+	log.Printf("Verified ACL signing timestamp %v (age %v)", signed.Format(time.RFC3339), age.Round(time.Second))
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/uhppoted/uhppoted-lib/acl"
+)
+
+// Name of the (unsigned) JSON summary of the drift included in the uploaded compare-acl report file.
+const DRIFT_FILE = "drift.json"
+
+type driftSummary struct {
+	Incorrect  []uint32 `json:"incorrect,omitempty"`
+	Missing    []uint32 `json:"missing,omitempty"`
+	Unexpected []uint32 `json:"unexpected,omitempty"`
+}
+
+func makeDrift(diff map[uint32]acl.Diff) map[uint32]driftSummary {
+	drift := map[uint32]driftSummary{}
+
+	for k, v := range diff {
+		if !v.HasChanges() {
+			continue
+		}
+
+		d := driftSummary{}
+		for _, card := range v.Updated {
+			d.Incorrect = append(d.Incorrect, card.CardNumber)
+		}
+
+		for _, card := range v.Added {
+			d.Missing = append(d.Missing, card.CardNumber)
+		}
+
+		for _, card := range v.Deleted {
+			d.Unexpected = append(d.Unexpected, card.CardNumber)
+		}
+
+		drift[k] = d
+	}
+
+	return drift
+}
+
+// Extracts the drift summary from a previous report file. The file can be either a report file uploaded by
+// compare-acl (tar.gz or zip) or just the JSON drift summary.
+func parseDrift(uri string, b []byte) (map[uint32]driftSummary, error) {
+	if !strings.HasSuffix(uri, ".json") {
+		list, err := entries(b, isZip(b))
+		if err != nil {
+			return nil, err
+		}
+
+		b = nil
+		for _, e := range list {
+			if e.name == DRIFT_FILE {
+				b = e.body
+			}
+		}
+
+		if b == nil {
+			return nil, fmt.Errorf("'%v' file missing from previous report", DRIFT_FILE)
+		}
+	}
+
+	drift := map[uint32]driftSummary{}
+	if err := json.Unmarshal(b, &drift); err != nil {
+		return nil, err
+	}
+
+	return drift, nil
+}
+
+// Annotates each card in the diff as NEW or RECURRING, depending on whether the card had the same drift
+// (incorrect, missing or unexpected) on the same controller in the previous report.
+func trend(diff map[uint32]acl.Diff, previous map[uint32]driftSummary) map[uint32]map[uint32]string {
+	annotations := map[uint32]map[uint32]string{}
+
+	contains := func(list []uint32, card uint32) bool {
+		for _, v := range list {
+			if v == card {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	for k, v := range diff {
+		p := previous[k]
+		m := map[uint32]string{}
+
+		for _, card := range v.Updated {
+			m[card.CardNumber] = label(contains(p.Incorrect, card.CardNumber))
+		}
+
+		for _, card := range v.Added {
+			m[card.CardNumber] = label(contains(p.Missing, card.CardNumber))
+		}
+
+		for _, card := range v.Deleted {
+			m[card.CardNumber] = label(contains(p.Unexpected, card.CardNumber))
+		}
+
+		annotations[k] = m
+	}
+
+	return annotations
+}
+
+func label(recurring bool) string {
+	if recurring {
+		return "RECURRING"
+	}
+
+	return "NEW"
+}
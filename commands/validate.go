@@ -0,0 +1,71 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/uhppoted/uhppote-core/uhppote"
+	"github.com/uhppoted/uhppoted-lib/acl"
+)
+
+type parseErrors []error
+
+func (e parseErrors) Error() string {
+	list := []string{}
+	for _, err := range e {
+		list = append(list, fmt.Sprintf("%v", err))
+	}
+
+	return fmt.Sprintf("%v invalid ACL records\n%v", len(e), strings.Join(list, "\n"))
+}
+
+// Parses each record of the TSV individually so that all the invalid records are reported rather
+// than just the first invalid record.
+func validateTSV(tsv []byte, devices []uhppote.Device) []error {
+	r := csv.NewReader(bytes.NewReader(tsv))
+	r.Comma = '\t'
+	r.FieldsPerRecord = -1
+
+	header, err := r.Read()
+	if err != nil {
+		return []error{err}
+	}
+
+	list := []error{}
+	for line := 1; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			list = append(list, fmt.Errorf("Error parsing TSV - line %d: %w", line, err))
+			continue
+		}
+
+		if len(record) != len(header) {
+			list = append(list, fmt.Errorf("Error parsing TSV - line %d: expected %v fields, got %v", line, len(header), len(record)))
+			continue
+		}
+
+		var b bytes.Buffer
+		w := csv.NewWriter(&b)
+		w.Comma = '\t'
+		w.Write(header)
+		w.Write(record)
+		w.Flush()
+
+		if _, _, err := acl.ParseTSV(bytes.NewReader(b.Bytes()), devices, false); err != nil {
+			if cause := errors.Unwrap(err); cause != nil {
+				list = append(list, fmt.Errorf("Error parsing TSV - line %d: %w", line, cause))
+			} else {
+				// ... header errors apply to every record
+				return []error{err}
+			}
+		}
+	}
+
+	return list
+}
@@ -0,0 +1,72 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+const WEBHOOK_AUTH = "UHPPOTED_WEBHOOK_AUTH"
+
+// Webhook to which compare-acl POSTs the report. The content type defaults to the report format and the (optional)
+// Authorization header value is taken from the UHPPOTED_WEBHOOK_AUTH environment variable if not supplied on the
+// command line.
+type webhook struct {
+	url         string
+	contentType string
+	auth        string
+	errorsOk    bool
+}
+
+func (h *webhook) resolve() {
+	if h.auth == "" {
+		h.auth = os.Getenv(WEBHOOK_AUTH)
+	}
+}
+
+// Returns the Content-Type for the report format, unless overridden by --webhook-content-type.
+func (h webhook) mediaType(format string) string {
+	switch {
+	case h.contentType != "":
+		return h.contentType
+	case format == "json":
+		return "application/json"
+	case format == "html":
+		return "text/html; charset=utf-8"
+	default:
+		return "text/plain; charset=utf-8"
+	}
+}
+
+// POSTs the report to the webhook URL. Any response other than 2xx is an error (5xx responses are retried).
+func postWebhook(ctx context.Context, h webhook, body []byte, format string, timeout time.Duration, retry retryPolicy) error {
+	client := httpClient(timeout)
+
+	return retry.do(ctx, fmt.Sprintf("POST %v", h.url), func() error {
+		rq, err := http.NewRequestWithContext(ctx, "POST", h.url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+
+		rq.Header.Set("Content-Type", h.mediaType(format))
+		if h.auth != "" {
+			rq.Header.Set("Authorization", h.auth)
+		}
+
+		response, err := client.Do(rq)
+		if err != nil {
+			return err
+		}
+
+		defer response.Body.Close()
+
+		if response.StatusCode < 200 || response.StatusCode > 299 {
+			return httpStatusError{URL: h.url, StatusCode: response.StatusCode, Status: response.Status}
+		}
+
+		return nil
+	})
+}
@@ -3,8 +3,16 @@ module github.com/uhppoted/uhppoted-app-s3
 go 1.16
 
 require (
+	cloud.google.com/go/storage v1.15.0
+	github.com/Azure/azure-pipeline-go v0.2.3
+	github.com/Azure/azure-storage-blob-go v0.13.0
 	github.com/aws/aws-sdk-go v1.38.28
+	github.com/go-ldap/ldap/v3 v3.4.1
+	github.com/pkg/sftp v1.13.0
 	github.com/uhppoted/uhppote-core v0.7.1
-	github.com/uhppoted/uhppoted-lib v0.7.1 // indirect
+	github.com/uhppoted/uhppoted-lib v0.7.1
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
+	golang.org/x/net v0.0.0-20210316092652-d523dce5a7f4
 	golang.org/x/sys v0.0.0-20210426230700-d19ff857e887
+	google.golang.org/api v0.45.0
 )